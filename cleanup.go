@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+// serverCleanupCommand handles `rep server-cleanup`, installing or printing
+// the cron job removing the temp files that runs which crashed left on the
+// server.
+func serverCleanupCommand(args []string) {
+	flags := flag.NewFlagSet("server-cleanup", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	install := flags.Bool("install", false, "install the cron job in the crontab of the server user")
+	printLine := flags.Bool("print", false, "print the crontab line of the cron job")
+	ttl := flags.Duration("ttl", replicator.DefaultServerCleanupTTL, "age of the temp files to remove")
+	flags.Parse(args)
+	if *install == *printLine {
+		fmt.Fprintln(os.Stderr, "usage: rep server-cleanup --install|--print [-f config.yml] [--ttl 24h]")
+		os.Exit(2)
+	}
+
+	if *printLine {
+		// The line is printed without a config too, for /tmp.
+		var dir string
+		config, err := replicator.ReadConfig(*configFile)
+		switch {
+		case err == nil:
+			dir = config.Server.TempDir
+		case !os.IsNotExist(err):
+			panic(err)
+		}
+		fmt.Println(replicator.ServerCleanupCronLine(dir, *ttl))
+		return
+	}
+
+	rep, mon := newReplicator(*configFile, os.Stdout, &outputOptions{})
+	defer mon.close()
+	if err := rep.InstallServerCleanup(context.Background(), *ttl); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a command of rep, for the usage and the shell completion.
+type command struct {
+	name    string
+	summary string
+	// subcommands are the words following the command, such as daemon
+	// install.
+	subcommands []string
+	flags       []string
+}
+
+var outputFlags = []string{"--screen-reader", "--tui", "--verbose", "--quiet", "--log-format"}
+
+// fileFlags take a file, completed as such.
+var fileFlags = []string{"-f", "--file"}
+
+// commands are the commands of rep, sync first as it also runs without a
+// command. Their flags must be kept in line with their flag sets.
+var commands = []command{
+	{name: "sync", summary: "replicate the databases, the default", flags: withOutputFlags("-f", "--force-disconnect", "--with-globals", "--show-remote-logs", "--downgrade", "--keep-dump", "--skip-space-check", "--bwlimit", "--analyze", "--reuse-dump", "--resume", "--incremental", "--incremental-reset", "--output", "--yes", "-y")},
+	{name: "dump", summary: "dump the server database to stdout, a file, an artifact or the artifact store", flags: withOutputFlags("-f", "--stdout", "--file", "--artifact", "--store", "--channel", "--show-remote-logs")},
+	{name: "restore", summary: "replace the local database with a dump from stdin or a file", flags: withOutputFlags("-f", "--stdin", "--file", "--force-disconnect", "--analyze", "--yes", "-y")},
+	{name: "pull", summary: "replicate an artifact of the server or of the artifact store", flags: withOutputFlags("-f", "--latest", "--from-store", "--snapshot", "--force-disconnect", "--with-globals", "--show-remote-logs", "--skip-space-check", "--bwlimit", "--analyze", "--keep-dump", "--yes", "-y")},
+	{name: "sync-tables", summary: "replace the rows of some tables of the local database", flags: withOutputFlags("-f", "--yes", "-y")},
+	{name: "list", summary: "list the databases of the server with their size", flags: []string{"-f"}},
+	{name: "verify", summary: "compare the tables of the local database with the server", flags: withOutputFlags("-f")},
+	{name: "init", summary: "write a config file by asking for it", flags: []string{"-f", "--force"}},
+	{name: "status", summary: "show the progress of the running replications"},
+	{name: "attach", summary: "stream the output of a running replication"},
+	{name: "pause", summary: "pause the transfer of a running replication"},
+	{name: "resume", summary: "resume a paused transfer"},
+	{name: "manifest", summary: "show the manifest of a run", subcommands: []string{"show"}},
+	{name: "send", summary: "send the cached dump to a teammate", flags: []string{"-f", "--to", "--force-disconnect"}},
+	{name: "secret", summary: "store a secret in the keychain", subcommands: []string{"set"}},
+	{name: "config", summary: "show the config as parsed", subcommands: []string{"show"}, flags: []string{"-f"}},
+	{name: "snapshots", summary: "remove the old dumps of the artifact store", subcommands: []string{"gc"}, flags: []string{"-f", "--dry-run"}},
+	{name: "publish", summary: "publish a stored dump to a channel", flags: []string{"-f", "--channel", "--from"}},
+	{name: "setup-remote", summary: "create a role only able to dump the server database", flags: []string{"-f", "--admin-user", "--role"}},
+	{name: "server-cleanup", summary: "install a cron job removing the temp files left on the server", flags: []string{"-f", "--install", "--print", "--ttl"}},
+	{name: "daemon", summary: "run or schedule the replication", subcommands: []string{"run", "install", "status", "uninstall"}, flags: []string{"-f", "--name", "--every", "--cron", "--metrics-addr", "--force-disconnect"}},
+	{name: "selftest", summary: "check the installation with Docker containers", flags: []string{"--keep"}},
+	{name: "help", summary: "list the commands and the flags of sync"},
+	{name: "completion", summary: "print the completion script of bash, zsh or fish", subcommands: []string{"bash", "zsh", "fish"}},
+}
+
+func withOutputFlags(flags ...string) []string {
+	return append(flags, outputFlags...)
+}
+
+// completionCommand handles `rep completion bash|zsh|fish`, printing the
+// completion script of the shell.
+func completionCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: rep completion bash|zsh|fish")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout)
+	case "zsh":
+		writeZshCompletion(os.Stdout)
+	case "fish":
+		writeFishCompletion(os.Stdout)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: rep completion bash|zsh|fish")
+		os.Exit(2)
+	}
+}
+
+func commandNames() []string {
+	var names []string
+	for _, command := range commands {
+		names = append(names, command.name)
+	}
+	return names
+}
+
+func (c command) words() []string {
+	return append(append([]string{}, c.subcommands...), c.flags...)
+}
+
+// writeBashCompletion writes the script for ~/.bashrc, as
+// source <(rep completion bash).
+func writeBashCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# bash completion of rep, source <(rep completion bash)\n")
+	fmt.Fprintf(w, "_rep() {\n")
+	fmt.Fprintf(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(w, "\tcase \"$prev\" in\n")
+	fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(fileFlags, "|"))
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(append(commandNames(), commands[0].flags...), " "))
+	fmt.Fprintf(w, "\t\treturn\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "\tcase \"${COMP_WORDS[1]}\" in\n")
+	for _, command := range commands[1:] {
+		fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", command.name, strings.Join(command.words(), " "))
+	}
+	fmt.Fprintf(w, "\t*) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(commands[0].flags, " "))
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -F _rep rep\n")
+}
+
+// writeZshCompletion writes the script for ~/.zshrc, as
+// source <(rep completion zsh), or for a file _rep of the fpath.
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, "#compdef rep\n")
+	fmt.Fprintf(w, "# zsh completion of rep, source <(rep completion zsh)\n")
+	fmt.Fprintf(w, "_rep() {\n")
+	fmt.Fprintf(w, "\tcase $words[CURRENT-1] in\n")
+	fmt.Fprintf(w, "\t%s) _files; return ;;\n", strings.Join(fileFlags, "|"))
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "\tif (( CURRENT == 2 )); then\n")
+	fmt.Fprintf(w, "\t\tlocal -a commands\n")
+	fmt.Fprintf(w, "\t\tcommands=(\n")
+	for _, command := range commands {
+		fmt.Fprintf(w, "\t\t\t%s\n", zshQuote(command.name+":"+command.summary))
+	}
+	fmt.Fprintf(w, "\t\t)\n")
+	fmt.Fprintf(w, "\t\t_describe command commands\n")
+	fmt.Fprintf(w, "\t\tcompadd -- %s\n", strings.Join(commands[0].flags, " "))
+	fmt.Fprintf(w, "\t\treturn\n")
+	fmt.Fprintf(w, "\tfi\n")
+	fmt.Fprintf(w, "\tcase $words[2] in\n")
+	for _, command := range commands[1:] {
+		if words := command.words(); len(words) > 0 {
+			fmt.Fprintf(w, "\t%s) compadd -- %s ;;\n", command.name, strings.Join(words, " "))
+		}
+	}
+	fmt.Fprintf(w, "\tsync|-*) compadd -- %s ;;\n", strings.Join(commands[0].flags, " "))
+	fmt.Fprintf(w, "\tesac\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "compdef _rep rep\n")
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// writeFishCompletion writes the script for
+// ~/.config/fish/completions/rep.fish.
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# fish completion of rep, rep completion fish > ~/.config/fish/completions/rep.fish\n")
+	fmt.Fprintf(w, "complete -c rep -f\n")
+	for _, command := range commands {
+		fmt.Fprintf(w, "complete -c rep -n __fish_use_subcommand -a %s -d %s\n", command.name, zshQuote(command.summary))
+	}
+	for i, command := range commands {
+		condition := "'__fish_seen_subcommand_from " + command.name + "'"
+		if i == 0 {
+			// The flags of sync also apply without a command.
+			condition = "'__fish_use_subcommand; or __fish_seen_subcommand_from sync'"
+		}
+		if len(command.subcommands) > 0 {
+			fmt.Fprintf(w, "complete -c rep -n %s -a %q\n", condition, strings.Join(command.subcommands, " "))
+		}
+		for _, flag := range command.flags {
+			option := "-s " + strings.TrimPrefix(flag, "-")
+			if strings.HasPrefix(flag, "--") {
+				option = "-l " + strings.TrimPrefix(flag, "--")
+			}
+			for _, fileFlag := range fileFlags {
+				if flag == fileFlag {
+					option += " -r -F"
+				}
+			}
+			fmt.Fprintf(w, "complete -c rep -n %s %s\n", condition, option)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/phuocph/rep/pkg/replicator"
+	"gopkg.in/yaml.v2"
+)
+
+// configCommand handles `rep config show`, printing the config as parsed,
+// with its variables expanded and its secrets redacted, to check what a
+// YAML mistake changed.
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Fprintln(os.Stderr, "usage: rep config show [-f config.yml]")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("config show", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	flags.Parse(args[1:])
+
+	config, err := replicator.ReadConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	raw, err := yaml.Marshal(replicator.RedactedConfig(config))
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(raw)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusLines is how many of the latest log lines `rep status` shows.
+const statusLines = 10
+
+// backlogLines is how many of the latest log lines the monitor keeps for
+// `rep attach`.
+const backlogLines = 1000
+
+// watcherBuffer is how many writes of the output wait for an attached
+// terminal before it is dropped.
+const watcherBuffer = 1024
+
+// controller is the part of a running replication that other terminals can
+// act on.
+type controller interface {
+	Pause()
+	Resume()
+}
+
+// monitor serves the output of a running replication on a local control
+// socket, so `rep status` and `rep attach` can follow it from another
+// terminal, and `rep pause` and `rep resume` can control it.
+type monitor struct {
+	mu         sync.Mutex
+	controller controller
+	path       string
+	configFile string
+	started    time.Time
+	lines      *lineRing
+	partial    string
+	// watchers are the attached terminals, each fed by its own goroutine
+	// so a slow one doesn't hold up the run.
+	watchers map[net.Conn]chan []byte
+	listener net.Listener
+	// closers are run by close first.
+	closers []func()
+}
+
+func runDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+	return filepath.Join(home, ".rep", "run")
+}
+
+func startMonitor(configFile string) *monitor {
+	dir := runDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%d.sock", os.Getpid()))
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		panic(err)
+	}
+	os.Chmod(path, 0600)
+
+	m := &monitor{
+		path:       path,
+		configFile: configFile,
+		started:    time.Now(),
+		lines:      newLineRing(backlogLines),
+		watchers:   map[net.Conn]chan []byte{},
+		listener:   listener,
+	}
+	go m.serve()
+
+	return m
+}
+
+func (m *monitor) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *monitor) handle(conn net.Conn) {
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	request = strings.TrimSpace(request)
+	if request == "pause" || request == "resume" {
+		fmt.Fprintln(conn, m.control(request))
+		conn.Close()
+		return
+	}
+
+	m.mu.Lock()
+	header := fmt.Sprintf("-> Run %d started %s ago, config file: %s", os.Getpid(), time.Since(m.started).Round(time.Second), m.configFile)
+	var lines []string
+	var out chan []byte
+	if request == "attach" {
+		lines = m.lines.last(backlogLines)
+		out = make(chan []byte, watcherBuffer)
+		m.watchers[conn] = out
+	} else {
+		lines = m.lines.last(statusLines)
+	}
+	m.mu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintln(conn, header)
+	for _, line := range lines {
+		fmt.Fprintln(conn, line)
+	}
+	if out != nil {
+		m.feed(conn, out)
+	}
+	conn.Close()
+}
+
+// control pauses or resumes the run, returning the reply of the request.
+func (m *monitor) control(request string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.controller == nil:
+		return "-> The run can't be controlled yet"
+	case request == "pause":
+		m.controller.Pause()
+		return fmt.Sprintf("-> Run %d paused, the transfer stops until `rep resume`", os.Getpid())
+	}
+	m.controller.Resume()
+	return fmt.Sprintf("-> Run %d resumed", os.Getpid())
+}
+
+// feed writes the output of the run to an attached terminal until out is
+// closed, or a write fails, which detaches it.
+func (m *monitor) feed(conn net.Conn, out chan []byte) {
+	for p := range out {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(p); err != nil {
+			m.mu.Lock()
+			if m.watchers[conn] == out {
+				delete(m.watchers, conn)
+				close(out)
+			}
+			m.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Write records the output of the run and forwards it to attached
+// terminals. It never fails nor waits for them, so it can be combined with
+// os.Stdout: a terminal too slow to keep up is detached.
+func (m *monitor) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := m.partial + string(p)
+	lines := strings.Split(data, "\n")
+	m.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		m.lines.add(line)
+	}
+
+	for conn, out := range m.watchers {
+		select {
+		case out <- append([]byte(nil), p...):
+		default:
+			delete(m.watchers, conn)
+			close(out)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (m *monitor) setController(c controller) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.controller = c
+}
+
+// onClose registers fn to be run by close, such as stopping the TUI
+// before the error of the run is printed.
+func (m *monitor) onClose(fn func()) {
+	m.closers = append(m.closers, fn)
+}
+
+func (m *monitor) close() {
+	for _, fn := range m.closers {
+		fn()
+	}
+	m.listener.Close()
+	os.Remove(m.path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The feeds write what is left and close the connections.
+	for conn, out := range m.watchers {
+		delete(m.watchers, conn)
+		close(out)
+	}
+}
+
+// lineRing keeps the last lines written to it, up to its size.
+type lineRing struct {
+	lines []string
+	// next is where the next line goes, replacing the oldest once full.
+	next int
+	full bool
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{lines: make([]string, size)}
+}
+
+func (r *lineRing) add(line string) {
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns up to the n latest lines, oldest first.
+func (r *lineRing) last(n int) []string {
+	var lines []string
+	if r.full {
+		lines = append(lines, r.lines[r.next:]...)
+	}
+	lines = append(lines, r.lines[:r.next]...)
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+type runSocket struct {
+	PID  int
+	Path string
+}
+
+func listRunSockets() []runSocket {
+	files, err := ioutil.ReadDir(runDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		panic(err)
+	}
+
+	var sockets []runSocket
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".sock") {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSuffix(name, ".sock"))
+		if err != nil {
+			continue
+		}
+		sockets = append(sockets, runSocket{PID: pid, Path: filepath.Join(runDir(), name)})
+	}
+
+	return sockets
+}
+
+func requestRun(socket runSocket, request string, w io.Writer) error {
+	conn, err := net.Dial("unix", socket.Path)
+	if err != nil {
+		// The run is gone without cleaning up its socket.
+		os.Remove(socket.Path)
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, conn)
+	return err
+}
+
+func statusCommand() {
+	found := false
+	for _, socket := range listRunSockets() {
+		if err := requestRun(socket, "status", os.Stdout); err != nil {
+			continue
+		}
+		found = true
+		fmt.Println()
+	}
+
+	if !found {
+		fmt.Println("-> No running replication")
+	}
+}
+
+// pickRun returns the run selected by the optional run id in args, or the
+// only running one.
+func pickRun(command string, args []string) (runSocket, bool) {
+	sockets := listRunSockets()
+	if len(args) > 0 {
+		pid, err := strconv.Atoi(args[0])
+		if err != nil {
+			panic(fmt.Errorf("invalid run id %q", args[0]))
+		}
+		sockets = []runSocket{{PID: pid, Path: filepath.Join(runDir(), fmt.Sprintf("%d.sock", pid))}}
+	}
+
+	switch len(sockets) {
+	case 0:
+		fmt.Println("-> No running replication")
+		return runSocket{}, false
+	case 1:
+		return sockets[0], true
+	default:
+		fmt.Printf("-> Several replications are running, pick one with `rep %s <run id>`:\n", command)
+		for _, socket := range sockets {
+			fmt.Printf("   %d\n", socket.PID)
+		}
+		return runSocket{}, false
+	}
+}
+
+func attachCommand(args []string) {
+	socket, ok := pickRun("attach", args)
+	if !ok {
+		return
+	}
+
+	if err := requestRun(socket, "attach", os.Stdout); err != nil {
+		panic(err)
+	}
+	fmt.Println("-> Run ended")
+}
+
+// controlCommand sends request, pause or resume, to a running replication.
+func controlCommand(request string, args []string) {
+	socket, ok := pickRun(request, args)
+	if !ok {
+		return
+	}
+
+	if err := requestRun(socket, request, os.Stdout); err != nil {
+		panic(err)
+	}
+}
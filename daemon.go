@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const daemonUsage = "usage: rep daemon run|install|status|uninstall [-f config.yml] [--name rep-config] [--every 24h | --cron '0 3 * * *'] [--metrics-addr :9187] [--force-disconnect]"
+
+// daemonCommand handles `rep daemon run|install|status|uninstall`. run
+// replicates a config on schedule in the foreground, every --every or on a
+// --cron expression, serving its metrics with --metrics-addr. install
+// registers it to run every --every with the scheduler of the OS instead: a
+// systemd user timer on Linux, a launchd agent on macOS, or a task of the
+// Task Scheduler on Windows, not a Windows service. The scheduled runs
+// survive reboots and log to ~/.rep/logs/<name>.log.
+func daemonCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, daemonUsage)
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("daemon "+args[0], flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	name := flags.String("name", "", "name of the scheduled job, rep-<config file name> by default")
+	every := flags.Duration("every", 24*time.Hour, "how often the replication runs")
+	cron := flags.String("cron", "", "cron expression of the runs, such as '0 3 * * *', instead of --every, with run only")
+	metricsAddr := flags.String("metrics-addr", "", "serve the Prometheus metrics of the runs on this address at /metrics, with run only")
+	forceDisconnect := flags.Bool("force-disconnect", false, forceDisconnectUsage)
+	flags.Parse(args[1:])
+	if flags.NArg() != 0 || *every < time.Minute || (*cron != "" || *metricsAddr != "") && args[0] != "run" {
+		fmt.Fprintln(os.Stderr, daemonUsage)
+		os.Exit(2)
+	}
+	var schedule daemonSchedule = everySchedule(*every)
+	if *cron != "" {
+		var err error
+		if schedule, err = parseCron(*cron); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	job, err := newDaemonJob(*configFile, *name, *every, *forceDisconnect)
+	if err != nil {
+		panic(err)
+	}
+	switch args[0] {
+	case "run":
+		err = job.run(schedule, *metricsAddr)
+	case "install":
+		err = job.install()
+	case "status":
+		err = job.status()
+	case "uninstall":
+		err = job.uninstall()
+	default:
+		fmt.Fprintln(os.Stderr, daemonUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+var daemonNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// daemonJob is the scheduled replication of a config.
+type daemonJob struct {
+	name   string
+	config string
+	every  time.Duration
+	// args is the command line of the run, the rep executable first.
+	args []string
+	log  string
+}
+
+func newDaemonJob(configFile, name string, every time.Duration, forceDisconnect bool) (*daemonJob, error) {
+	config, err := filepath.Abs(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		base := filepath.Base(config)
+		name = "rep-" + strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	// The name names the unit files and the log.
+	name = daemonNameUnsafe.ReplaceAllString(name, "-")
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &daemonJob{
+		name:   name,
+		config: config,
+		every:  every,
+		args:   []string{executable, "-f", config, "--yes"},
+		log:    filepath.Join(home, ".rep", "logs", name+".log"),
+	}
+	if forceDisconnect {
+		job.args = append(job.args, "--force-disconnect")
+	}
+	return job, nil
+}
+
+func (j *daemonJob) install() error {
+	if _, err := os.Stat(j.config); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.log), 0700); err != nil {
+		return err
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		if err := j.installSystemd(); err != nil {
+			return err
+		}
+		fmt.Println("The timer only runs while you are logged in, unless `loginctl enable-linger` lets your user units run without a session.")
+	case "darwin":
+		if err := j.installLaunchd(); err != nil {
+			return err
+		}
+	case "windows":
+		if err := j.installTask(); err != nil {
+			return err
+		}
+		fmt.Println("The task of the Task Scheduler only runs while you are logged in, unlike a Windows service.")
+	default:
+		return fmt.Errorf("rep daemon doesn't support %s, schedule %s yourself", runtime.GOOS, strings.Join(j.args, " "))
+	}
+	fmt.Printf("%s runs every %s and logs to %s\n", j.name, j.every, j.log)
+	return nil
+}
+
+func (j *daemonJob) status() error {
+	state, err := j.readState()
+	if err != nil {
+		return err
+	}
+	if state.Schedule != "" {
+		// The job is run by `rep daemon run` rather than the OS.
+		j.printState(state)
+		return nil
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("systemctl", "--user", "list-timers", "--all", j.name+".timer")
+	case "darwin":
+		cmd = exec.Command("launchctl", "list", j.launchdLabel())
+	case "windows":
+		cmd = exec.Command("schtasks", "/Query", "/TN", j.name, "/V", "/FO", "LIST")
+	default:
+		return fmt.Errorf("rep daemon doesn't support %s", runtime.GOOS)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s isn't installed: %v", j.name, err)
+	}
+
+	raw, err := ioutil.ReadFile(j.log)
+	if os.IsNotExist(err) {
+		fmt.Printf("\n%s hasn't run yet\n", j.name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(raw), "\n"), "\n")
+	if len(lines) > 20 {
+		lines = lines[len(lines)-20:]
+	}
+	fmt.Printf("\nLast lines of %s:\n%s\n", j.log, strings.Join(lines, "\n"))
+	return nil
+}
+
+func (j *daemonJob) uninstall() error {
+	switch runtime.GOOS {
+	case "linux":
+		if err := runDaemonCommand("systemctl", "--user", "disable", "--now", j.name+".timer"); err != nil {
+			return err
+		}
+		dir, err := systemdUserDir()
+		if err != nil {
+			return err
+		}
+		for _, unit := range []string{".timer", ".service"} {
+			if err := os.Remove(filepath.Join(dir, j.name+unit)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := runDaemonCommand("systemctl", "--user", "daemon-reload"); err != nil {
+			return err
+		}
+	case "darwin":
+		plist, err := j.launchdPlist()
+		if err != nil {
+			return err
+		}
+		if err := runDaemonCommand("launchctl", "unload", "-w", plist); err != nil {
+			return err
+		}
+		if err := os.Remove(plist); err != nil {
+			return err
+		}
+	case "windows":
+		if err := runDaemonCommand("schtasks", "/Delete", "/TN", j.name, "/F"); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("rep daemon doesn't support %s", runtime.GOOS)
+	}
+	fmt.Printf("%s uninstalled, its log %s is left\n", j.name, j.log)
+	return nil
+}
+
+func systemdUserDir() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "systemd", "user"), nil
+}
+
+// installSystemd writes a oneshot service running the replication and the
+// timer starting it every j.every, counted from the end of the previous run
+// so a slow run never overlaps the next.
+func (j *daemonJob) installSystemd() error {
+	dir, err := systemdUserDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	var quoted []string
+	for _, arg := range j.args {
+		quoted = append(quoted, systemdQuote(arg))
+	}
+	service := fmt.Sprintf(`[Unit]
+Description=rep replication of %s
+
+[Service]
+Type=oneshot
+WorkingDirectory=%s
+ExecStart=%s
+StandardOutput=append:%s
+StandardError=append:%s
+`, j.config, filepath.Dir(j.config), strings.Join(quoted, " "), j.log, j.log)
+	timer := fmt.Sprintf(`[Unit]
+Description=Schedule of the rep replication of %s
+
+[Timer]
+OnActiveSec=%d
+OnUnitInactiveSec=%d
+
+[Install]
+WantedBy=timers.target
+`, j.config, int(j.every.Seconds()), int(j.every.Seconds()))
+
+	if err := ioutil.WriteFile(filepath.Join(dir, j.name+".service"), []byte(service), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, j.name+".timer"), []byte(timer), 0600); err != nil {
+		return err
+	}
+	if err := runDaemonCommand("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	return runDaemonCommand("systemctl", "--user", "enable", "--now", j.name+".timer")
+}
+
+// systemdQuote quotes an argument of ExecStart with spaces or quotes.
+func systemdQuote(arg string) string {
+	if !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+func (j *daemonJob) launchdLabel() string {
+	return "com.github.phuocph." + j.name
+}
+
+func (j *daemonJob) launchdPlist() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", j.launchdLabel()+".plist"), nil
+}
+
+// installLaunchd writes and loads a launchd agent starting the replication
+// every j.every. launchd doesn't start a job still running.
+func (j *daemonJob) installLaunchd() error {
+	plist, err := j.launchdPlist()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(plist), 0755); err != nil {
+		return err
+	}
+
+	var arguments strings.Builder
+	for _, arg := range j.args {
+		fmt.Fprintf(&arguments, "\t\t<string>%s</string>\n", xmlEscape(arg))
+	}
+	agent := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>StartInterval</key>
+	<integer>%d</integer>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`,
+		xmlEscape(j.launchdLabel()),
+		arguments.String(),
+		xmlEscape(filepath.Dir(j.config)),
+		int(j.every.Seconds()),
+		xmlEscape(j.log),
+		xmlEscape(j.log),
+	)
+	if err := ioutil.WriteFile(plist, []byte(agent), 0644); err != nil {
+		return err
+	}
+	// A previous agent is replaced.
+	exec.Command("launchctl", "unload", plist).Run()
+	return runDaemonCommand("launchctl", "load", "-w", plist)
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// installTask creates a task of the Task Scheduler, run as the current user,
+// starting the replication every j.every. The Task Scheduler doesn't start a
+// task still running.
+func (j *daemonJob) installTask() error {
+	schedule := []string{"/SC", "MINUTE", "/MO", fmt.Sprint(int(j.every.Minutes()))}
+	switch {
+	case j.every%(24*time.Hour) == 0:
+		schedule = []string{"/SC", "DAILY", "/MO", fmt.Sprint(int(j.every.Hours() / 24))}
+	case j.every%time.Hour == 0:
+		schedule = []string{"/SC", "HOURLY", "/MO", fmt.Sprint(int(j.every.Hours()))}
+	case j.every >= 24*time.Hour:
+		return fmt.Errorf("the Task Scheduler can't run every %s, use whole days", j.every)
+	}
+
+	var quoted []string
+	for _, arg := range j.args {
+		quoted = append(quoted, `"`+arg+`"`)
+	}
+	run := fmt.Sprintf(`cmd /c "cd /d "%s" && %s >> "%s" 2>&1"`, filepath.Dir(j.config), strings.Join(quoted, " "), j.log)
+	args := append([]string{"/Create", "/F", "/TN", j.name, "/TR", run}, schedule...)
+	return runDaemonCommand("schtasks", args...)
+}
+
+// runDaemonCommand runs a command of the scheduler of the OS, its output
+// explaining a failure.
+func runDaemonCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+// daemonSchedule gives the start of the next run.
+type daemonSchedule interface {
+	next(last, now time.Time) time.Time
+	String() string
+}
+
+// everySchedule starts a run every interval from the start of the previous
+// one, right away if it is overdue.
+type everySchedule time.Duration
+
+func (s everySchedule) next(last, now time.Time) time.Time {
+	next := last.Add(time.Duration(s))
+	if next.Before(now) {
+		return now
+	}
+	return next
+}
+
+func (s everySchedule) String() string {
+	return "every " + time.Duration(s).String()
+}
+
+// cronSchedule is a cron expression of 5 fields: minute, hour, day of the
+// month, month and day of the week, in local time. A field is *, a number,
+// a range a-b, a list of them separated by commas, each with an optional
+// step /n.
+type cronSchedule struct {
+	expr   string
+	fields [5]map[int]bool
+	// anyMonthDay and anyWeekDay record whether the day of the month and of
+	// the week are *, as cron runs on either one when both are restricted.
+	anyMonthDay, anyWeekDay bool
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, expected 5 fields", expr)
+	}
+	s := &cronSchedule{expr: expr, anyMonthDay: parts[2] == "*", anyWeekDay: parts[4] == "*"}
+	for i, part := range parts {
+		values := map[int]bool{}
+		for _, item := range strings.Split(part, ",") {
+			low, high := cronRanges[i][0], cronRanges[i][1]
+			step := 1
+			j := strings.Index(item, "/")
+			stepped := j >= 0
+			if stepped {
+				var err error
+				if step, err = strconv.Atoi(item[j+1:]); err != nil || step <= 0 {
+					return nil, fmt.Errorf("invalid step in cron field %q", part)
+				}
+				item = item[:j]
+			}
+			if item != "*" {
+				bounds := strings.SplitN(item, "-", 2)
+				var err error
+				if low, err = strconv.Atoi(bounds[0]); err != nil {
+					return nil, fmt.Errorf("invalid cron field %q", part)
+				}
+				// A step from a single value runs to the end of the range,
+				// as in 5/15.
+				if !stepped {
+					high = low
+				}
+				if len(bounds) == 2 {
+					if high, err = strconv.Atoi(bounds[1]); err != nil {
+						return nil, fmt.Errorf("invalid cron field %q", part)
+					}
+				}
+			}
+			if low < cronRanges[i][0] || high > cronRanges[i][1] || low > high {
+				return nil, fmt.Errorf("cron field %q out of range %d-%d", part, cronRanges[i][0], cronRanges[i][1])
+			}
+			for v := low; v <= high; v += step {
+				values[v] = true
+			}
+		}
+		s.fields[i] = values
+	}
+	// Sunday is 0 or 7.
+	if s.fields[4][7] {
+		s.fields[4][0] = true
+	}
+	return s, nil
+}
+
+func (s *cronSchedule) next(last, now time.Time) time.Time {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	// Every minute of up to 4 years, for the 29th of February.
+	for limit := t.AddDate(4, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if s.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.fields[0][t.Minute()] || !s.fields[1][t.Hour()] || !s.fields[3][int(t.Month())] {
+		return false
+	}
+	monthDay, weekDay := s.fields[2][t.Day()], s.fields[4][int(t.Weekday())]
+	switch {
+	case s.anyMonthDay && s.anyWeekDay:
+		return true
+	case s.anyMonthDay:
+		return weekDay
+	case s.anyWeekDay:
+		return monthDay
+	default:
+		return monthDay || weekDay
+	}
+}
+
+func (s *cronSchedule) String() string {
+	return "on cron " + s.expr
+}
+
+// daemonState is the state of a job run by `rep daemon run`, persisted so
+// `rep daemon status` can show it and a restarted daemon knows when the
+// last run started.
+type daemonState struct {
+	PID        int       `json:"pid,omitempty"`
+	Schedule   string    `json:"schedule"`
+	Running    bool      `json:"running"`
+	LastStart  time.Time `json:"last_start,omitempty"`
+	LastEnd    time.Time `json:"last_end,omitempty"`
+	LastStatus string    `json:"last_status,omitempty"`
+	// LastSuccess is the end of the last run that succeeded.
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	NextRun     time.Time `json:"next_run,omitempty"`
+	Runs        int       `json:"runs"`
+	Failures    int       `json:"failures"`
+}
+
+func daemonStateDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+	return filepath.Join(home, ".rep", "daemon")
+}
+
+func (j *daemonJob) statePath() string {
+	return filepath.Join(daemonStateDir(), j.name+".json")
+}
+
+func (j *daemonJob) readState() (daemonState, error) {
+	var state daemonState
+	raw, err := ioutil.ReadFile(j.statePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(raw, &state)
+}
+
+// writeState replaces the state file through a temp file, so a reader never
+// sees it half written.
+func (j *daemonJob) writeState(state daemonState) error {
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.statePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.statePath())
+}
+
+// lock makes sure a single daemon runs the job, the lock file holding its
+// pid. A lock left by a daemon that died is taken over.
+func (j *daemonJob) lock() (func(), error) {
+	unlock, pid, err := replicator.AcquireLock(filepath.Join(daemonStateDir(), j.name+".lock"))
+	if err != nil {
+		return nil, err
+	}
+	if pid != 0 {
+		return nil, fmt.Errorf("%s is already run by the daemon %d", j.name, pid)
+	}
+	return unlock, nil
+}
+
+// printState prints the state of the job run by `rep daemon run`.
+func (j *daemonJob) printState(state daemonState) {
+	if state.PID != 0 && replicator.ProcessAlive(state.PID) {
+		fmt.Printf("%s runs %s in the daemon %d\n", j.name, state.Schedule, state.PID)
+	} else {
+		fmt.Printf("%s ran %s, its daemon is stopped\n", j.name, state.Schedule)
+	}
+	switch {
+	case state.Running:
+		fmt.Printf("Running since %s\n", state.LastStart.Format(time.RFC3339))
+	case !state.NextRun.IsZero():
+		fmt.Printf("Next run at %s\n", state.NextRun.Format(time.RFC3339))
+	}
+	if !state.LastEnd.IsZero() {
+		fmt.Printf("Last run at %s %s after %s\n", state.LastStart.Format(time.RFC3339), state.LastStatus, state.LastEnd.Sub(state.LastStart).Round(time.Second))
+	}
+	fmt.Printf("%d runs, %d failed\n", state.Runs, state.Failures)
+}
+
+// run runs the replication on schedule in the foreground, each run in its
+// own rep process so a failure doesn't stop the daemon, until interrupted.
+// The runs never overlap: the starts missed while a run was running make a
+// single run. With metricsAddr, the metrics of the runs are served there.
+func (j *daemonJob) run(schedule daemonSchedule, metricsAddr string) error {
+	if _, err := os.Stat(j.config); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(daemonStateDir(), 0700); err != nil {
+		return err
+	}
+	unlock, err := j.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := j.readState()
+	if err != nil {
+		return err
+	}
+	state.PID = os.Getpid()
+	state.Schedule = schedule.String()
+	state.Running = false
+
+	if metricsAddr != "" {
+		listener, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", j.serveMetrics)
+		go http.Serve(listener, mux)
+		fmt.Printf("-> Metrics served on http://%s/metrics\n", listener.Addr())
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	fmt.Printf("-> %s runs %s, state in %s\n", j.name, schedule, j.statePath())
+	for {
+		state.NextRun = schedule.next(state.LastStart, time.Now())
+		if state.NextRun.IsZero() {
+			return fmt.Errorf("%s never runs", schedule)
+		}
+		if err := j.writeState(state); err != nil {
+			return err
+		}
+		fmt.Printf("-> Next run at %s\n", state.NextRun.Format(time.RFC3339))
+		select {
+		case <-stop:
+			fmt.Println("-> Daemon stopped")
+			return nil
+		case <-time.After(time.Until(state.NextRun)):
+		}
+
+		state.Running = true
+		state.LastStart = time.Now()
+		state.NextRun = time.Time{}
+		if err := j.writeState(state); err != nil {
+			return err
+		}
+		fmt.Printf("-> Run %d started at %s\n", state.Runs+1, state.LastStart.Format(time.RFC3339))
+		stopped, err := j.runOnce(stop)
+		state.Running = false
+		state.LastEnd = time.Now()
+		state.Runs++
+		state.LastStatus = "succeeded"
+		if err != nil {
+			state.Failures++
+			state.LastStatus = "failed: " + err.Error()
+		} else {
+			state.LastSuccess = state.LastEnd
+		}
+		fmt.Printf("-> Run %d %s after %s\n", state.Runs, state.LastStatus, state.LastEnd.Sub(state.LastStart).Round(time.Second))
+		if err := j.writeState(state); err != nil {
+			return err
+		}
+		if stopped {
+			fmt.Println("-> Daemon stopped")
+			return nil
+		}
+	}
+}
+
+// runOnce runs the replication, interrupting it if the daemon is stopped,
+// which it reports. `rep server-cleanup` removes what an interrupted run
+// leaves on the server.
+func (j *daemonJob) runOnce(stop <-chan os.Signal) (bool, error) {
+	cmd := exec.Command(j.args[0], j.args[1:]...)
+	cmd.Dir = filepath.Dir(j.config)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-stop:
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			cmd.Process.Kill()
+		}
+		return true, <-done
+	}
+}
+
+// serveMetrics serves the metrics of the runs from the state file, in the
+// text format of Prometheus, for an alert on refreshes failing or late.
+func (j *daemonJob) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	state, err := j.readState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+	}
+	timestamp := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.Unix())
+	}
+	running, success, duration := 0.0, 0.0, 0.0
+	if state.Running {
+		running = 1
+	} else if !state.LastEnd.IsZero() {
+		duration = state.LastEnd.Sub(state.LastStart).Seconds()
+	}
+	if strings.HasPrefix(state.LastStatus, "succeeded") {
+		success = 1
+	}
+	metric("rep_daemon_runs_total", "counter", "The runs of the daemon.", float64(state.Runs))
+	metric("rep_daemon_failures_total", "counter", "The failed runs of the daemon.", float64(state.Failures))
+	metric("rep_daemon_running", "gauge", "Whether a run is running.", running)
+	metric("rep_last_run_success", "gauge", "Whether the last run succeeded.", success)
+	metric("rep_last_run_timestamp_seconds", "gauge", "When the last run finished.", timestamp(state.LastEnd))
+	metric("rep_last_run_duration_seconds", "gauge", "How long the last run took.", duration)
+	metric("rep_last_success_timestamp_seconds", "gauge", "When the last successful run finished.", timestamp(state.LastSuccess))
+	metric("rep_next_run_timestamp_seconds", "gauge", "When the next run starts.", timestamp(state.NextRun))
+}
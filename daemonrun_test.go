@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr  string
+		field int
+		want  []int
+	}{
+		{"*/15 * * * *", 0, []int{0, 15, 30, 45}},
+		{"5/15 * * * *", 0, []int{5, 20, 35, 50}},
+		{"10-20/5 * * * *", 0, []int{10, 15, 20}},
+		{"1,2,40-42 * * * *", 0, []int{1, 2, 40, 41, 42}},
+		{"0 22/1 * * *", 1, []int{22, 23}},
+		{"0 0 * * 1-5", 4, []int{1, 2, 3, 4, 5}},
+		{"0 0 * * 7", 4, []int{0, 7}},
+		{"0 0 28-31/2 * *", 2, []int{28, 30}},
+	}
+	for _, test := range tests {
+		s, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expr, err)
+			continue
+		}
+		var got []int
+		for v := range s.fields[test.field] {
+			got = append(got, v)
+		}
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCron(%q) field %d = %v, want %v", test.expr, test.field, got, test.want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"30-10 * * * *",
+		"55/15 * 32 * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	s, err := parseCron("5/15 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 10, 21, 30, 0, time.UTC)
+	want := time.Date(2024, 3, 1, 10, 35, 0, 0, time.UTC)
+	if got := s.next(time.Time{}, now); !got.Equal(want) {
+		t.Errorf("next(%v) = %v, want %v", now, got, want)
+	}
+}
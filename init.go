@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phuocph/rep/pkg/replicator"
+	"gopkg.in/yaml.v2"
+)
+
+// initConnectTimeout bounds the connections tested by `rep init`, the
+// config it writes having no timeouts.
+const initConnectTimeout = 30 * time.Second
+
+// initCommand handles `rep init`, asking for the server, its database and
+// the local database, testing each as it is answered, and writing the config
+// file once they all work.
+func initCommand(args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file to write")
+	force := flags.Bool("force", false, "overwrite the config file if it exists")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: rep init [-f config.yml] [--force]")
+		os.Exit(2)
+	}
+	if !isTerminal(os.Stdin) {
+		fmt.Fprintln(os.Stderr, "rep init asks its questions on a terminal, write the config from config.sample.yml instead")
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*configFile); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists, --force overwrites it\n", *configFile)
+		os.Exit(2)
+	}
+
+	config := &replicator.Config{}
+	config.Timeouts.Connect = initConnectTimeout
+	config.Server = replicator.Server{Port: 22, User: currentUser(), PrivateKeyFile: defaultPrivateKey()}
+	config.Server.DB = replicator.DB{Engine: "postgres", Host: "localhost"}
+
+	fmt.Println("-> The server")
+	askUntil(func() error {
+		config.Server.Host = ask("SSH host", config.Server.Host)
+		config.Server.Port = replicator.SSHPort(askPort("SSH port", int(config.Server.Port)))
+		config.Server.User = ask("SSH user", config.Server.User)
+		config.Server.PrivateKeyFile = ask("SSH private key file", config.Server.PrivateKeyFile)
+		return checkInit(config, func(ctx context.Context, rep *replicator.Replicator) error {
+			return rep.Connect(ctx)
+		})
+	})
+
+	fmt.Println("-> The database to replicate, as seen from the server")
+	askUntil(func() error {
+		db := &config.Server.DB
+		db.Engine = ask("Engine, postgres, mysql, mariadb or mongodb", db.Engine)
+		db.Host = ask("Host", db.Host)
+		db.Port = askPort("Port", defaultPort(db.Engine, db.Port))
+		db.Database = ask("Database", db.Database)
+		db.Username = ask("User", db.Username)
+		db.Password = askPassword()
+		return checkInit(config, func(ctx context.Context, rep *replicator.Replicator) error {
+			return rep.CheckServer(ctx)
+		})
+	})
+
+	fmt.Println("-> The local database, replaced by each run")
+	config.LocalDB = replicator.DB{Host: "localhost", Port: config.Server.DB.Port, Database: config.Server.DB.Database, Username: config.Server.DB.Username}
+	askUntil(func() error {
+		db := &config.LocalDB
+		db.Host = ask("Host", db.Host)
+		db.Port = askPort("Port", db.Port)
+		db.Database = ask("Database", db.Database)
+		db.Username = ask("User", db.Username)
+		db.Password = askPassword()
+		return checkInit(config, func(ctx context.Context, rep *replicator.Replicator) error {
+			return rep.Check(ctx)
+		})
+	})
+
+	if err := ioutil.WriteFile(*configFile, []byte(initConfig(config)), 0600); err != nil {
+		panic(err)
+	}
+	fmt.Printf("-> %s written, `rep -f %s` replicates the database, config.sample.yml lists the other options\n", *configFile, *configFile)
+}
+
+// askUntil asks the questions of fn again, the previous answers as their
+// defaults, until the test of the answers passes.
+func askUntil(fn func() error) {
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		fmt.Printf("   Failed: %v\n", err)
+		if !confirm("Change the answers and try again?") {
+			os.Exit(1)
+		}
+	}
+}
+
+// checkInit tests config with check, then cleans up.
+func checkInit(config *replicator.Config, check func(ctx context.Context, rep *replicator.Replicator) error) error {
+	copied := *config
+	rep := replicator.New(&copied)
+	rep.Output = os.Stdout
+	ctx := context.Background()
+	err := check(ctx, rep)
+	rep.Cleanup(ctx)
+	return err
+}
+
+// ask reads the answer to question, def if empty.
+func ask(question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := readLine()
+	if err != nil {
+		panic(err)
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def
+	}
+	return answer
+}
+
+func askPort(question string, def int) int {
+	for {
+		answer := ask(question, strconv.Itoa(def))
+		port, err := strconv.Atoi(answer)
+		if err == nil && port > 0 && port < 65536 {
+			return port
+		}
+		fmt.Printf("   %q isn't a port\n", answer)
+	}
+}
+
+func askPassword() string {
+	password, err := readSecret("Password, empty for none: ")
+	if err != nil {
+		panic(err)
+	}
+	return password
+}
+
+func confirm(question string) bool {
+	answer := strings.ToLower(ask(question+" [Y/n]", ""))
+	return answer == "" || answer == "y" || answer == "yes"
+}
+
+// readLine reads a line from stdin a byte at a time, so readSecret reads
+// the next one.
+func readLine() (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 && b[0] != '\n' {
+			line = append(line, b[0])
+		}
+		if n == 1 && b[0] == '\n' || err != nil && len(line) > 0 {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func defaultPort(engine string, port int) int {
+	if port != 0 {
+		return port
+	}
+	if port := replicator.DefaultPort(engine); port != 0 {
+		return port
+	}
+	return 5432
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// defaultPrivateKey returns the first usual SSH private key that exists.
+func defaultPrivateKey() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		file := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return ""
+}
+
+// initConfig returns the config file of the answers, laid out like
+// config.sample.yml.
+func initConfig(config *replicator.Config) string {
+	server, local := config.Server, config.LocalDB
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by rep init, see config.sample.yml for the other options.\n\n")
+	fmt.Fprintf(&b, "server:\n")
+	fmt.Fprintf(&b, "  host: %s\n", yamlString(server.Host))
+	fmt.Fprintf(&b, "  port: %d\n", server.Port)
+	fmt.Fprintf(&b, "  user: %s\n", yamlString(server.User))
+	fmt.Fprintf(&b, "  private_key_file: %s\n", yamlString(server.PrivateKeyFile))
+	fmt.Fprintf(&b, "  db:\n")
+	fmt.Fprintf(&b, "    engine: %s\n", yamlString(server.DB.Engine))
+	writeInitDB(&b, "    ", server.DB)
+	fmt.Fprintf(&b, "\nlocal_db:\n")
+	writeInitDB(&b, "  ", local)
+	return b.String()
+}
+
+func writeInitDB(b *strings.Builder, indent string, db replicator.DB) {
+	fmt.Fprintf(b, "%shost: %s\n", indent, yamlString(db.Host))
+	fmt.Fprintf(b, "%sport: %d\n", indent, db.Port)
+	fmt.Fprintf(b, "%sdatabase: %s\n", indent, yamlString(db.Database))
+	fmt.Fprintf(b, "%susername: %s\n", indent, yamlString(db.Username))
+	fmt.Fprintf(b, "%spassword: %s\n", indent, yamlString(db.Password))
+}
+
+// yamlString quotes s as a YAML scalar where needed, escaping the ${ that
+// would refer to an environment variable.
+func yamlString(s string) string {
+	raw, err := yaml.Marshal(strings.Replace(s, "${", "$${", -1))
+	if err != nil {
+		panic(err)
+	}
+	return strings.TrimSuffix(string(raw), "\n")
+}
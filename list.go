@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+// listCommand handles `rep list`, listing the databases of the server with
+// their size and last activity, to pick the database of the config and
+// check the config reaches the server before a full run. The progress goes
+// to stderr, the list to stdout.
+func listCommand(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: rep list [-f config.yml]")
+		os.Exit(2)
+	}
+
+	rep, mon := newReplicator(*configFile, os.Stderr, &outputOptions{})
+	defer mon.close()
+	databases, err := rep.ListDatabases(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
+	found := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tSIZE\tLAST ACTIVITY")
+	for _, database := range databases {
+		name := database.Name
+		if database.Configured {
+			name += " *"
+			found = true
+		}
+		size := "-"
+		if database.Bytes >= 0 {
+			size = replicator.FormatSize(database.Bytes)
+		}
+		activity := database.LastActivity
+		if activity == "" {
+			activity = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, size, activity)
+	}
+	w.Flush()
+	if found {
+		fmt.Printf("\n* the database of %s\n", *configFile)
+	} else {
+		fmt.Printf("\nThe database of %s isn't on the server\n", *configFile)
+	}
+}
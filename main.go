@@ -1,267 +1,357 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net"
-	"os/exec"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
-	"golang.org/x/crypto/ssh"
-	"gopkg.in/yaml.v2"
+	"github.com/phuocph/rep/pkg/replicator"
 )
 
-type db struct {
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	Database string `yaml:"database"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-}
-
-type server struct {
-	Host           string `yaml:"host"`
-	Port           string `yaml:"port"`
-	User           string `yaml:"user"`
-	PrivateKeyFile string `yaml:"private_key_file"`
-	DB             db     `yaml:"db"`
-}
-
-type Config struct {
-	Server  server `yaml:"server"`
-	LocalDB db     `yaml:"local_db"`
-}
-
-func readConfig(configFile string) *Config {
-	raw, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		panic(err)
+func main() {
+	defer exitQuietly()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			statusCommand()
+			return
+		case "attach":
+			attachCommand(os.Args[2:])
+			return
+		case "pause", "resume":
+			controlCommand(os.Args[1], os.Args[2:])
+			return
+		case "manifest":
+			manifestCommand(os.Args[2:])
+			return
+		case "dump":
+			dumpCommand(os.Args[2:])
+			return
+		case "restore":
+			restoreCommand(os.Args[2:])
+			return
+		case "pull":
+			pullCommand(os.Args[2:])
+			return
+		case "send":
+			sendCommand(os.Args[2:])
+			return
+		case "secret":
+			secretCommand(os.Args[2:])
+			return
+		case "config":
+			configCommand(os.Args[2:])
+			return
+		case "snapshots":
+			snapshotsCommand(os.Args[2:])
+			return
+		case "publish":
+			publishCommand(os.Args[2:])
+			return
+		case "init":
+			initCommand(os.Args[2:])
+			return
+		case "setup-remote":
+			setupRemoteCommand(os.Args[2:])
+			return
+		case "server-cleanup":
+			serverCleanupCommand(os.Args[2:])
+			return
+		case "daemon":
+			daemonCommand(os.Args[2:])
+			return
+		case "selftest":
+			selftestCommand(os.Args[2:])
+			return
+		case "list":
+			listCommand(os.Args[2:])
+			return
+		case "verify":
+			verifyCommand(os.Args[2:])
+			return
+		case "sync-tables":
+			syncTablesCommand(os.Args[2:])
+			return
+		case "completion":
+			completionCommand(os.Args[2:])
+			return
+		}
 	}
 
-	config := &Config{}
-	err = yaml.Unmarshal(raw, &config)
-	if err != nil {
-		panic(err)
+	// `rep sync` names the replication of the databases, which also runs
+	// without a command, and `rep help` prints its usage.
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "sync" {
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "help" {
+		args = []string{"-h"}
 	}
-
-	return config
-}
-
-func Dial(config server) *ssh.Client {
-	key, err := ioutil.ReadFile(config.PrivateKeyFile)
-	if err != nil {
-		panic(err)
+	flag.Usage = usage
+	var configFiles configFiles
+	flag.Var(&configFiles, "f", "config file, repeated to replicate several databases")
+	var opts syncOptions
+	flag.BoolVar(&opts.forceDisconnect, "force-disconnect", false, forceDisconnectUsage)
+	flag.BoolVar(&opts.withGlobals, "with-globals", false, withGlobalsUsage)
+	output := addOutputFlags(flag.CommandLine)
+	flag.BoolVar(&opts.showRemoteLogs, "show-remote-logs", false, showRemoteLogsUsage)
+	flag.BoolVar(&opts.downgrade, "downgrade", false, "rewrite the dump for a local server older than the server database")
+	flag.Var(&opts.keepDump, "keep-dump", keepDumpUsage)
+	flag.BoolVar(&opts.skipSpaceCheck, "skip-space-check", false, skipSpaceCheckUsage)
+	flag.Var(&opts.bwlimit, "bwlimit", bwlimitUsage)
+	flag.BoolVar(&opts.analyze, "analyze", true, analyzeUsage)
+	flag.DurationVar(&opts.reuseDump, "reuse-dump", 0, "restore the cached dump instead of dumping if it is more recent than this, e.g. 6h")
+	flag.BoolVar(&opts.resume, "resume", false, resumeUsage)
+	flag.BoolVar(&opts.incremental, "incremental", false, "apply the changes of the server database since the last run with logical replication, instead of replacing the local database")
+	flag.BoolVar(&opts.resetIncremental, "incremental-reset", false, "drop the subscription of --incremental and copy the server database again, after a change of its schema")
+	flag.StringVar(&output.result, "output", "text", resultUsage)
+	flag.BoolVar(&opts.yes, "yes", false, yesUsage)
+	flag.BoolVar(&opts.yes, "y", false, yesUsage)
+	flag.CommandLine.Parse(args)
+	if flag.NArg() != 0 {
+		usage()
+		os.Exit(2)
 	}
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		panic(err)
+	if output.result != "text" && output.result != "json" {
+		fmt.Fprintf(os.Stderr, "unknown --output %q, expected text or json\n", output.result)
+		os.Exit(2)
 	}
-
-	sshClientConfig := &ssh.ClientConfig{
-		User: config.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil }),
+	checkConfirmable(opts.yes)
+	if len(configFiles) == 0 {
+		configFiles = append(configFiles, "config.yml")
 	}
 
-	address := fmt.Sprintf("%s:%s", config.Host, config.Port)
-	client, err := ssh.Dial("tcp", address, sshClientConfig)
-	if err != nil {
-		panic(err)
+	// The databases of the same server are replicated over one connection.
+	var reps []*replicator.Replicator
+	defer func() {
+		closed := map[replicator.RemoteExecutor]bool{}
+		for _, rep := range reps {
+			if rep.SharedRemote && !closed[rep.Remote] {
+				rep.Remote.Close()
+				closed[rep.Remote] = true
+			}
+		}
+	}()
+	for _, configFile := range configFiles {
+		reps = append(reps, runConfig(configFile, reps, &opts, output))
 	}
+	output.printResult(nil)
+}
 
-	return client
+// syncOptions are the flags of sync, set on the Replicator of each config
+// file.
+type syncOptions struct {
+	forceDisconnect  bool
+	withGlobals      bool
+	showRemoteLogs   bool
+	downgrade        bool
+	skipSpaceCheck   bool
+	analyze          bool
+	resume           bool
+	incremental      bool
+	resetIncremental bool
+	yes              bool
+	reuseDump        time.Duration
+	keepDump         keepDumpFlag
+	bwlimit          sizeFlag
 }
 
-func buildDumpCommand(dbConfig db, fileName string) string {
-	// options := "--no-privileges --no-owner --blobs --format=custom --verbose"
-	options := "-Fc -x"
-	cmd := fmt.Sprintf(
-		"PGPASSWORD=%s pg_dump -h %s -p %d -U %s -d %s %s -f %s",
-		dbConfig.Password,
-		dbConfig.Host,
-		dbConfig.Port,
-		dbConfig.Username,
-		dbConfig.Database,
-		options,
-		fileName,
-	)
+// apply sets the options on rep.
+func (o *syncOptions) apply(rep *replicator.Replicator) {
+	rep.ForceDisconnect = o.forceDisconnect
+	rep.WithGlobals = o.withGlobals
+	rep.ShowRemoteLogs = o.showRemoteLogs
+	rep.Downgrade = o.downgrade
+	rep.SkipSpaceCheck = o.skipSpaceCheck
+	rep.SkipAnalyze = !o.analyze
+	rep.ResumeFailed = o.resume
+	rep.ConfirmReplace = !o.yes
+	rep.ReuseDump = o.reuseDump
+	rep.KeepDump = string(o.keepDump)
+	rep.BandwidthLimit = int64(o.bwlimit)
+	rep.ResetIncremental = o.resetIncremental
+}
+
+// configFiles is the -f flag, which can be repeated.
+type configFiles []string
+
+func (f *configFiles) String() string {
+	return strings.Join(*f, ",")
+}
 
-	return cmd
+func (f *configFiles) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
-func buildRestoreCommand(dbConfig db, database, fileName string) string {
-	// options := "--no-privileges --no-owner --blobs --format=custom --verbose"
-	options := "-x -O -c --if-exists "
-	cmd := fmt.Sprintf(
-		"PGPASSWORD=%s pg_restore -h %s -p %d -U %s -d %s %s %s",
-		dbConfig.Password,
-		dbConfig.Host,
-		dbConfig.Port,
-		dbConfig.Username,
-		database,
-		options,
-		fileName,
-	)
+// keepDumpFlag is the --keep-dump flag, keeping the dump in
+// replicator.DefaultKeepDumpDir, or in the directory of --keep-dump=dir.
+type keepDumpFlag string
 
-	return cmd
+func (f *keepDumpFlag) String() string {
+	return string(*f)
 }
 
-func runRemoteCmd(client *ssh.Client, cmd string) {
-	session, err := client.NewSession()
-	if err != nil {
-		panic(err)
+func (f *keepDumpFlag) Set(value string) error {
+	if value == "true" {
+		value = replicator.DefaultKeepDumpDir
 	}
-	defer session.Close()
-
-	var stderr bytes.Buffer
-	session.Stderr = &stderr
-	if err := session.Run(cmd); err != nil {
-		fmt.Println(stderr.String())
-		panic(err)
+	if value == "false" {
+		value = ""
 	}
+	*f = keepDumpFlag(value)
+	return nil
 }
 
-func runLocalCmd(runCmd string) {
-	cmd := exec.Command("bash", "-c", runCmd)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		fmt.Println(stderr.String())
-		panic(err)
-	}
+func (f *keepDumpFlag) IsBoolFlag() bool {
+	return true
 }
 
-func copyDumpFile(serverConfig server, dumpFileName string) string {
-	copiedFile := dumpFileName
-	scpCmd := fmt.Sprintf(
-		"scp %s@%s:%s %s",
-		serverConfig.User,
-		serverConfig.Host,
-		dumpFileName,
-		copiedFile,
-	)
-	runLocalCmd(scpCmd)
+// sizeFlag is a size flag such as --bwlimit 10M, in bytes.
+type sizeFlag int64
 
-	return copiedFile
+func (f *sizeFlag) String() string {
+	if *f == 0 {
+		return ""
+	}
+	return replicator.FormatSize(int64(*f))
 }
 
-func checkingConfig(config *Config) {
-	localDBExistsCmd := fmt.Sprintf(
-		"PGPASSWORD=%s psql -h %s -p %d -U %s -d %s -c \"SELECT 1\"",
-		config.LocalDB.Password,
-		config.LocalDB.Host,
-		config.LocalDB.Port,
-		config.LocalDB.Username,
-		config.LocalDB.Database,
-	)
-	runLocalCmd(localDBExistsCmd)
+func (f *sizeFlag) Set(value string) error {
+	size, err := replicator.ParseSize(value)
+	*f = sizeFlag(size)
+	return err
 }
 
-func runPSQLCmd(dbConfig db, accessForRunningDB, cmd string) {
-	psqlCmd := fmt.Sprintf(
-		"PGPASSWORD=%s psql -h %s -p %d -U %s -d %s",
-		dbConfig.Password,
-		dbConfig.Host,
-		dbConfig.Port,
-		dbConfig.Username,
-		accessForRunningDB,
-	)
-
-	runCmd := fmt.Sprintf("%s -c \"%s\"", psqlCmd, cmd)
-	runLocalCmd(runCmd)
+// usage prints the commands of rep and the flags of sync.
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: rep [sync] [-f config.yml]... [flags]")
+	fmt.Fprintln(os.Stderr, "       rep <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", command.name, command.summary)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "\nFlags of sync:")
+	flag.PrintDefaults()
 }
 
-func printStep(step int, s string, args ...interface{}) int {
-	step++
-	s = fmt.Sprintf(s, args...)
-	fmt.Printf("%d. %s\n", step, s)
-	return step
+// runConfig replicates the database of configFile, sharing the connection
+// of one of previous if it replicated from the same server.
+func runConfig(configFile string, previous []*replicator.Replicator, opts *syncOptions, output *outputOptions) *replicator.Replicator {
+	rep, mon := newReplicator(configFile, output.out(), output)
+	defer mon.close()
+	for _, other := range previous {
+		if rep.ShareRemote(other) {
+			break
+		}
+	}
+	opts.apply(rep)
+	run := rep.Run
+	if opts.incremental || opts.resetIncremental {
+		run = rep.RunIncremental
+	}
+	err := run(context.Background())
+	output.results = append(output.results, rep.Result())
+	if err != nil {
+		output.fail(output.out(), err)
+	}
+	return rep
 }
 
-func main() {
-	var configFile string
-	flag.StringVar(&configFile, "f", "config.yml", "env mode")
-	flag.Parse()
-	fmt.Println("-> Config file: ", configFile)
-
-	config := readConfig(configFile)
-	step := 0
-	step = printStep(step, "Checking config...")
-	checkingConfig(config)
-
-	step = printStep(step, "SSH to %s", config.Server.Host)
-	client := Dial(config.Server)
-	defer client.Close()
-
-	suffix := fmt.Sprintf("%d", int(time.Now().UnixNano()))
-	dumpFile := fmt.Sprintf("/tmp/%s_%s.dump", config.Server.DB.Database, suffix)
-
-	dumpCmd := buildDumpCommand(config.Server.DB, dumpFile)
-	step = printStep(step, "Dumping database %s in %s", config.Server.DB.Database, config.Server.Host)
-	runRemoteCmd(client, dumpCmd)
-	defer func() {
-		step = printStep(step, "Remove temp dump file %s in %s", dumpFile, config.Server.Host)
-		runRemoteCmd(client, fmt.Sprintf("rm -f %s", dumpFile))
-	}()
-
-	step = printStep(step, "Copy dump file %s to local", dumpFile)
-	copiedDumpFile := copyDumpFile(config.Server, dumpFile)
-	defer func() {
-		step = printStep(step, "Remove local temp copied file %s", copiedDumpFile)
-		runLocalCmd(fmt.Sprintf("rm -f %s", copiedDumpFile))
-	}()
+// heartbeatInterval is how often a run whose output isn't a terminal, such as
+// a CI log, shows it is alive.
+const heartbeatInterval = 30 * time.Second
+
+const (
+	forceDisconnectUsage = "terminate the sessions connected to the local database before replacing it"
+	withGlobalsUsage     = "create the roles of the server missing locally before restoring"
+	screenReaderUsage    = "print timestamped status lines only, for screen readers"
+	verboseUsage         = "also print the commands and stream the log of the dump on the server"
+	quietUsage           = "print nothing but the error of a failed run"
+	logFormatUsage       = "text, or json for one JSON event per line"
+	tuiUsage             = "show the steps, a progress bar and the last lines of the output, redrawn in place on the terminal"
+	bwlimitUsage         = "limit the transfer of the dump to this many bytes per second, e.g. 10M"
+	yesUsage             = "replace the local database without asking, for scripts"
+	resultUsage          = "text, or json to print the result of the runs as a JSON document, the output going to stderr"
+	showRemoteLogsUsage  = "stream the log of the dump on the server"
+	skipSpaceCheckUsage  = "don't check the free space for the dump and the restore before dumping"
+	analyzeUsage         = "analyze the restored database before replacing the local one, --analyze=false to skip"
+	keepDumpUsage        = "keep the local dump in ~/.rep/dumps, or in the directory of --keep-dump=dir"
+	resumeUsage          = "continue the last failed run from the dump it kept instead of dumping again"
+)
 
-	intermediateDB := fmt.Sprintf("tmp_%s", suffix)
-	step = printStep(step, "Create local intermediate database %s", intermediateDB)
-	runPSQLCmd(
-		config.LocalDB,
-		config.LocalDB.Database,
-		fmt.Sprintf("CREATE DATABASE %s", intermediateDB),
-	)
-	defer func() {
-		step = printStep(step, "Drop local intermediate database %s", intermediateDB)
-		runPSQLCmd(
-			config.LocalDB,
-			config.LocalDB.Database,
-			fmt.Sprintf("DROP DATABASE IF EXISTS %s", intermediateDB),
-		)
-	}()
+// newReplicator reads the config and starts the monitor of the run, the
+// output going to out as chosen by the output flags. With --screen-reader,
+// the progress is reported by the heartbeat lines even on a terminal, and
+// with --tui by the TUI redrawn in place.
+func newReplicator(configFile string, out io.Writer, opts *outputOptions) (*replicator.Replicator, *monitor) {
+	opts.check()
+	var display *tuiDisplay
+	if opts.tui {
+		if !isTerminal(out) {
+			fmt.Fprintln(os.Stderr, "--tui needs a terminal")
+			os.Exit(2)
+		}
+		display = newTUIDisplay(out)
+	}
+	mon := startMonitor(configFile)
+	writer := opts.writer(out)
+	output := io.MultiWriter(writer, mon)
+	if display != nil {
+		output = io.MultiWriter(display, mon)
+		mon.onClose(display.close)
+	}
+	fmt.Fprintln(output, "-> Config file: ", configFile)
 
-	restoredDB := fmt.Sprintf("restored_%s", suffix)
-	step = printStep(step, "Create local restored database %s", restoredDB)
-	runPSQLCmd(
-		config.LocalDB,
-		intermediateDB,
-		fmt.Sprintf("CREATE DATABASE %s", restoredDB),
-	)
-	defer func() {
-		step = printStep(step, "Drop local restored database if exists %s", restoredDB)
-		runPSQLCmd(
-			config.LocalDB,
-			config.LocalDB.Database,
-			fmt.Sprintf("DROP DATABASE IF EXISTS %s", restoredDB),
-		)
-	}()
+	config, err := replicator.ReadConfig(configFile)
+	if err != nil {
+		mon.close()
+		opts.fail(out, err)
+	}
 
-	step = printStep(step, "Restoring %s to databae %s", copiedDumpFile, restoredDB)
-	restoreCmd := buildRestoreCommand(config.LocalDB, restoredDB, copiedDumpFile)
-	runLocalCmd(restoreCmd)
+	rep := replicator.New(config)
+	rep.Output = output
+	rep.Verbose = opts.verbose
+	if opts.screenReader || !isTerminal(out) {
+		rep.Heartbeat = heartbeatInterval
+	}
+	if isTerminal(os.Stdin) {
+		rep.Prompter = replicator.TerminalPrompter{In: os.Stdin, Out: os.Stderr}
+	}
+	if log, ok := writer.(*jsonLogWriter); ok {
+		rep.Progress = jsonProgress{replicator.ProgressWriter{W: mon}, log}
+	}
+	if display != nil {
+		rep.Progress = tuiProgress{replicator.ProgressWriter{W: mon}, display}
+		if isTerminal(os.Stdin) {
+			rep.Prompter = tuiPrompter{replicator.TerminalPrompter{In: os.Stdin, Out: os.Stderr}, display}
+		}
+	}
+	fmt.Fprintln(output, "-> Run ID: ", rep.RunID())
+	mon.setController(rep)
+	return rep, mon
+}
 
-	step = printStep(step, "Drop local database %s", config.LocalDB.Database)
-	runPSQLCmd(
-		config.LocalDB,
-		intermediateDB,
-		fmt.Sprintf("DROP DATABASE %s", config.LocalDB.Database),
-	)
+// checkConfirmable exits unless replacing the local database is confirmed
+// by --yes or can be asked on the terminal.
+func checkConfirmable(yes bool) {
+	if !yes && !isTerminal(os.Stdin) {
+		fmt.Fprintln(os.Stderr, "rep asks before replacing the local database, --yes replaces it when stdin isn't a terminal")
+		os.Exit(2)
+	}
+}
 
-	step = printStep(step, "Rename database %s to %s", restoredDB, config.LocalDB.Database)
-	runPSQLCmd(
-		config.LocalDB,
-		intermediateDB,
-		fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", restoredDB, config.LocalDB.Database),
-	)
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+// manifestCommand handles `rep manifest show <snapshot>`, the snapshot being
+// the run id of a manifest or the path of a manifest file.
+func manifestCommand(args []string) {
+	if len(args) != 2 || args[0] != "show" {
+		fmt.Println("usage: rep manifest show <snapshot>")
+		os.Exit(2)
+	}
+
+	manifest, err := replicator.ReadManifest(replicator.DefaultManifestDir(), args[1])
+	if err != nil {
+		panic(err)
+	}
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(raw))
+}
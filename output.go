@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+// outputOptions are the flags choosing the output of a run.
+type outputOptions struct {
+	screenReader bool
+	tui          bool
+	verbose      bool
+	quiet        bool
+	format       string
+	// result is the --output of the main command, json printing the
+	// document of results to stdout once the runs end.
+	result  string
+	results []replicator.RunResult
+}
+
+// resultDocument is the document of --output json.
+type resultDocument struct {
+	Status string                 `json:"status"`
+	Error  string                 `json:"error,omitempty"`
+	Runs   []replicator.RunResult `json:"runs"`
+}
+
+func addOutputFlags(flags *flag.FlagSet) *outputOptions {
+	var o outputOptions
+	flags.BoolVar(&o.screenReader, "screen-reader", false, screenReaderUsage)
+	flags.BoolVar(&o.tui, "tui", false, tuiUsage)
+	flags.BoolVar(&o.verbose, "verbose", false, verboseUsage)
+	flags.BoolVar(&o.quiet, "quiet", false, quietUsage)
+	flags.StringVar(&o.format, "log-format", "text", logFormatUsage)
+	return &o
+}
+
+// check exits on conflicting output flags.
+func (o *outputOptions) check() {
+	if o.format != "" && o.format != "text" && o.format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown --log-format %q, expected text or json\n", o.format)
+		os.Exit(2)
+	}
+	if o.quiet && o.verbose {
+		fmt.Fprintln(os.Stderr, "--quiet and --verbose can't be combined")
+		os.Exit(2)
+	}
+	if o.tui && (o.quiet || o.screenReader || o.format == "json") {
+		fmt.Fprintln(os.Stderr, "--tui can't be combined with --quiet, --screen-reader or --log-format json")
+		os.Exit(2)
+	}
+}
+
+// writer returns the writer of the output of the run going to out: nothing
+// with --quiet, the error only being reported, JSON events with --log-format
+// json, or timestamped lines for --screen-reader.
+func (o *outputOptions) writer(out io.Writer) io.Writer {
+	switch {
+	case o.quiet:
+		return ioutil.Discard
+	case o.format == "json":
+		return newJSONLogWriter(out)
+	case o.screenReader:
+		return newTimestampWriter(out)
+	}
+	return out
+}
+
+// out is where the output of the runs goes, stderr when stdout is for the
+// document of --output json.
+func (o *outputOptions) out() io.Writer {
+	if o.result == "json" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// fail reports the error of the run, as a JSON event with --log-format json
+// and in the document of --output json, and panics like the other failures
+// of the CLI. With --quiet, the panic is a quietFailure, which exitQuietly
+// turns into the error alone once the deferred calls closed the run.
+func (o *outputOptions) fail(out io.Writer, err error) {
+	if o.format == "json" && !o.quiet {
+		newJSONLogWriter(out).event("error", 0, err.Error())
+	}
+	o.printResult(err)
+	if o.quiet {
+		panic(quietFailure{err})
+	}
+	panic(err)
+}
+
+// quietFailure is the failure of a run with --quiet.
+type quietFailure struct {
+	err error
+}
+
+// exitQuietly, deferred by main, prints the error of a quietFailure to
+// stderr and exits with 1, without the trace of a panic.
+func exitQuietly() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	failure, ok := v.(quietFailure)
+	if !ok {
+		panic(v)
+	}
+	fmt.Fprintln(os.Stderr, "Error:", failure.err)
+	os.Exit(1)
+}
+
+// printResult prints the document of --output json, err being the failure
+// that stopped the runs.
+func (o *outputOptions) printResult(err error) {
+	if o.result != "json" {
+		return
+	}
+	document := resultDocument{Status: "succeeded", Runs: o.results}
+	if document.Runs == nil {
+		document.Runs = []replicator.RunResult{}
+	}
+	if err != nil {
+		document.Status = "failed"
+		document.Error = err.Error()
+	}
+	raw, marshalErr := json.MarshalIndent(document, "", "  ")
+	if marshalErr != nil {
+		panic(marshalErr)
+	}
+	fmt.Println(string(raw))
+}
+
+// timestampWriter starts each line written to w with the time, for the
+// --screen-reader output made of discrete status lines.
+type timestampWriter struct {
+	w         io.Writer
+	midLine   bool
+	timestamp func() string
+}
+
+func newTimestampWriter(w io.Writer) *timestampWriter {
+	return &timestampWriter{w: w, timestamp: func() string {
+		return time.Now().Format("15:04:05")
+	}}
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !t.midLine {
+			out.WriteString("[" + t.timestamp() + "] ")
+		}
+		out.Write(line)
+		t.midLine = line[len(line)-1] != '\n'
+	}
+	if _, err := t.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// jsonLogWriter turns each line written to w into a JSON event, for the log
+// collectors of CI. As a ProgressSink, it is told the steps, which carry
+// their number, and the commands of --verbose and their scripts, which are
+// at the debug level.
+type jsonLogWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	partial []byte
+	now     func() time.Time
+}
+
+type logEvent struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Step  int    `json:"step,omitempty"`
+	Msg   string `json:"msg"`
+}
+
+func newJSONLogWriter(w io.Writer) *jsonLogWriter {
+	return &jsonLogWriter{w: w, now: time.Now}
+}
+
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.partial = append(j.partial, p...)
+	for {
+		i := bytes.IndexByte(j.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := strings.TrimSpace(string(j.partial[:i]))
+		j.partial = j.partial[i+1:]
+		if line == "" {
+			continue
+		}
+		if err := j.write("info", 0, strings.TrimPrefix(line, "-> ")); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (j *jsonLogWriter) Step(n int, title string) {
+	j.event("info", n, title)
+}
+
+func (j *jsonLogWriter) Bytes(copied, total int64) {}
+
+func (j *jsonLogWriter) Command(cmd, script string) {
+	j.event("debug", 0, cmd)
+	for _, line := range strings.Split(strings.TrimSpace(script), "\n") {
+		if line != "" {
+			j.event("debug", 0, line)
+		}
+	}
+}
+
+func (j *jsonLogWriter) event(level string, step int, msg string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.write(level, step, msg)
+}
+
+func (j *jsonLogWriter) write(level string, step int, msg string) error {
+	raw, err := json.Marshal(logEvent{
+		Time:  j.now().Format(time.RFC3339Nano),
+		Level: level,
+		Step:  step,
+		Msg:   msg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(raw, '\n'))
+	return err
+}
+
+// jsonProgress gives the steps and the commands to the JSON log, and as
+// lines to the monitor.
+type jsonProgress struct {
+	replicator.ProgressWriter
+	log *jsonLogWriter
+}
+
+func (p jsonProgress) Step(n int, title string) {
+	p.ProgressWriter.Step(n, title)
+	p.log.Step(n, title)
+}
+
+func (p jsonProgress) Command(cmd, script string) {
+	p.ProgressWriter.Command(cmd, script)
+	p.log.Command(cmd, script)
+}
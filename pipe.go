@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+// dumpCommand handles `rep dump --stdout`, writing the dump to stdout for an
+// external pipeline with the progress on stderr, `rep dump --file`, writing
+// it to a local file for `rep restore --file`, `rep dump --artifact`,
+// keeping the dump on the server for `rep pull --latest`, and `rep dump
+// --store`, uploading it to the artifact store for `rep pull --from-store`.
+func dumpCommand(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	stdout := flags.Bool("stdout", false, "write the dump to stdout")
+	file := flags.String("file", "", "write the dump to this local file")
+	artifact := flags.Bool("artifact", false, "keep the dump on the server as an artifact")
+	store := flags.Bool("store", false, "upload the dump to the artifact store")
+	channel := flags.String("channel", "", "publish the stored dump to this channel, e.g. nightly")
+	output := addOutputFlags(flags)
+	showRemoteLogs := flags.Bool("show-remote-logs", false, showRemoteLogsUsage)
+	flags.Parse(args)
+	if countTrue(*stdout, *file != "", *artifact, *store) != 1 || (*channel != "" && !*store) {
+		fmt.Fprintln(os.Stderr, "usage: rep dump --stdout|--file dump|--artifact|--store [--channel name] [-f config.yml] [--screen-reader|--tui] [--verbose|--quiet] [--log-format json] [--show-remote-logs]")
+		os.Exit(2)
+	}
+
+	if *store {
+		rep, mon := newReplicator(*configFile, os.Stdout, output)
+		defer mon.close()
+		rep.ShowRemoteLogs = *showRemoteLogs
+		rep.Channel = *channel
+		if err := rep.RunStore(context.Background()); err != nil {
+			output.fail(os.Stdout, err)
+		}
+		return
+	}
+
+	if *artifact {
+		rep, mon := newReplicator(*configFile, os.Stdout, output)
+		defer mon.close()
+		rep.ShowRemoteLogs = *showRemoteLogs
+		if err := rep.RunArtifact(context.Background()); err != nil {
+			output.fail(os.Stdout, err)
+		}
+		return
+	}
+
+	if *file != "" {
+		rep, mon := newReplicator(*configFile, os.Stdout, output)
+		defer mon.close()
+		rep.ShowRemoteLogs = *showRemoteLogs
+		dump, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			output.fail(os.Stdout, err)
+		}
+		err = rep.RunTo(context.Background(), dump)
+		if closeErr := dump.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*file)
+			output.fail(os.Stdout, err)
+		}
+		return
+	}
+
+	rep, mon := newReplicator(*configFile, os.Stderr, output)
+	defer mon.close()
+	rep.ShowRemoteLogs = *showRemoteLogs
+	if err := rep.RunTo(context.Background(), os.Stdout); err != nil {
+		output.fail(os.Stderr, err)
+	}
+}
+
+// pullCommand handles `rep pull --latest`, replicating the latest artifact
+// kept on the server if it is fresh enough, `rep pull --from-store`,
+// replicating the latest artifact of the artifact store, and `rep pull
+// --snapshot`, replicating the artifact of a channel.
+func pullCommand(args []string) {
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	latest := flags.Bool("latest", false, "use the latest artifact of the server")
+	fromStore := flags.Bool("from-store", false, "use the latest artifact of the artifact store")
+	snapshot := flags.String("snapshot", "", "use the artifact of this channel of the artifact store, e.g. nightly")
+	forceDisconnect := flags.Bool("force-disconnect", false, forceDisconnectUsage)
+	withGlobals := flags.Bool("with-globals", false, withGlobalsUsage)
+	output := addOutputFlags(flags)
+	showRemoteLogs := flags.Bool("show-remote-logs", false, showRemoteLogsUsage)
+	skipSpaceCheck := flags.Bool("skip-space-check", false, skipSpaceCheckUsage)
+	var bwlimit sizeFlag
+	flags.Var(&bwlimit, "bwlimit", bwlimitUsage)
+	analyze := flags.Bool("analyze", true, analyzeUsage)
+	var keepDump keepDumpFlag
+	flags.Var(&keepDump, "keep-dump", keepDumpUsage)
+	yes := flags.Bool("yes", false, yesUsage)
+	flags.BoolVar(yes, "y", false, yesUsage)
+	flags.Parse(args)
+	if countTrue(*latest, *fromStore, *snapshot != "") != 1 {
+		fmt.Fprintln(os.Stderr, "usage: rep pull --latest|--from-store|--snapshot channel [-f config.yml] [--force-disconnect] [--with-globals] [--screen-reader|--tui] [--verbose|--quiet] [--log-format json] [--show-remote-logs] [--skip-space-check] [--bwlimit 10M] [--analyze=false] [--keep-dump[=dir]] [--yes]")
+		os.Exit(2)
+	}
+	checkConfirmable(*yes)
+
+	rep, mon := newReplicator(*configFile, os.Stdout, output)
+	defer mon.close()
+	rep.ForceDisconnect = *forceDisconnect
+	rep.WithGlobals = *withGlobals
+	rep.ShowRemoteLogs = *showRemoteLogs
+	rep.KeepDump = string(keepDump)
+	rep.SkipSpaceCheck = *skipSpaceCheck
+	rep.BandwidthLimit = int64(bwlimit)
+	rep.SkipAnalyze = !*analyze
+	rep.Channel = *snapshot
+	rep.ConfirmReplace = !*yes
+	run := rep.RunLatest
+	if *fromStore || *snapshot != "" {
+		run = rep.RunStored
+	}
+	if err := run(context.Background()); err != nil {
+		output.fail(os.Stdout, err)
+	}
+}
+
+// restoreCommand handles `rep restore --stdin`, replacing the local database
+// with the dump read from stdin, as written by `rep dump --stdout`, and `rep
+// restore --file`, replacing it with an existing local dump file.
+func restoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	stdin := flags.Bool("stdin", false, "read the dump from stdin")
+	file := flags.String("file", "", "restore this local dump file")
+	forceDisconnect := flags.Bool("force-disconnect", false, forceDisconnectUsage)
+	output := addOutputFlags(flags)
+	analyze := flags.Bool("analyze", true, analyzeUsage)
+	yes := flags.Bool("yes", false, yesUsage)
+	flags.BoolVar(yes, "y", false, yesUsage)
+	flags.Parse(args)
+	if countTrue(*stdin, *file != "") != 1 {
+		fmt.Fprintln(os.Stderr, "usage: rep restore --stdin|--file dump [-f config.yml] [--force-disconnect] [--screen-reader|--tui] [--verbose|--quiet] [--log-format json] [--analyze=false] [--yes]")
+		os.Exit(2)
+	}
+	checkConfirmable(*yes)
+
+	rep, mon := newReplicator(*configFile, os.Stdout, output)
+	defer mon.close()
+	rep.ForceDisconnect = *forceDisconnect
+	rep.SkipAnalyze = !*analyze
+	rep.ConfirmReplace = !*yes
+	run := func(ctx context.Context) error {
+		return rep.RunFrom(ctx, os.Stdin)
+	}
+	if *file != "" {
+		run = func(ctx context.Context) error {
+			return rep.RunFile(ctx, *file)
+		}
+	}
+	if err := run(context.Background()); err != nil {
+		output.fail(os.Stdout, err)
+	}
+}
+
+// countTrue returns how many of flags are set.
+func countTrue(flags ...bool) int {
+	count := 0
+	for _, flag := range flags {
+		if flag {
+			count++
+		}
+	}
+	return count
+}
+
+// publishCommand handles `rep publish --channel`, publishing the latest
+// artifact of the artifact store, or the artifact of another channel, to
+// the channel.
+func publishCommand(args []string) {
+	flags := flag.NewFlagSet("publish", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	channel := flags.String("channel", "", "channel to publish to, e.g. release")
+	from := flags.String("from", "", "publish the artifact of this channel instead of the latest")
+	flags.Parse(args)
+	if *channel == "" || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: rep publish --channel name [--from channel] [-f config.yml]")
+		os.Exit(2)
+	}
+
+	config, err := replicator.ReadConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	if err := replicator.New(config).PublishStored(context.Background(), *channel, *from); err != nil {
+		panic(err)
+	}
+}
+
+// snapshotsCommand handles `rep snapshots gc`, applying the retention of the
+// artifact store and its channels.
+func snapshotsCommand(args []string) {
+	if len(args) == 0 || args[0] != "gc" {
+		fmt.Fprintln(os.Stderr, "usage: rep snapshots gc [--dry-run] [-f config.yml]")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("snapshots gc", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	dryRun := flags.Bool("dry-run", false, "print what would be removed and the space reclaimed")
+	flags.Parse(args[1:])
+
+	config, err := replicator.ReadConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	if err := replicator.New(config).CollectStored(context.Background(), *dryRun); err != nil {
+		panic(err)
+	}
+}
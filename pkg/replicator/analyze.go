@@ -0,0 +1,30 @@
+package replicator
+
+import "context"
+
+// analyzer is implemented by the engines able to gather the statistics of a
+// restored database, which it lacks until autovacuum catches up.
+type analyzer interface {
+	// AnalyzeCommand returns the local command analyzing database with
+	// jobs parallel jobs.
+	AnalyzeCommand(dbConfig DB, database string, jobs int) string
+	// AnalyzeScript returns the script analyzing the database it runs on,
+	// for the built-in client.
+	AnalyzeScript() string
+}
+
+// analyze gathers the statistics of the restored database, unless
+// SkipAnalyze is set.
+func (r *Replicator) analyze(ctx context.Context, database string) error {
+	engine, ok := r.Engine.(analyzer)
+	if !ok || r.SkipAnalyze {
+		return nil
+	}
+	r.printStep("Analyze local restored database %s", database)
+	if r.useDriver {
+		return r.runScript(ctx, database, engine.AnalyzeScript())
+	}
+	cmd := engine.AnalyzeCommand(r.config.LocalDB, database, r.config.Limits.Jobs)
+	r.recordCommand(r.localWhere(), cmd, "")
+	return r.Local.Run(ctx, r.limitCommand(cmd))
+}
@@ -0,0 +1,242 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultArtifactsDir    = "$HOME/.rep/artifacts"
+	defaultArtifactsMaxAge = 24 * time.Hour
+	defaultArtifactsKeep   = 3
+
+	artifactTimeFormat = "20060102T150405Z"
+)
+
+// Artifacts configures the dumps kept on the server by DumpArtifact, for
+// instance from a nightly cron job, so PullLatest can skip the dump.
+type Artifacts struct {
+	// Dir is the directory of the artifacts on the server,
+	// ~/.rep/artifacts by default. It is expanded by the shell.
+	Dir string `yaml:"dir"`
+	// MaxAge is how old an artifact can be to be pulled, 24h by default.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Keep is how many artifacts of the database are kept, 3 by default.
+	Keep int `yaml:"keep"`
+}
+
+func (a Artifacts) withDefaults() Artifacts {
+	if a.Dir == "" {
+		a.Dir = defaultArtifactsDir
+	}
+	if a.MaxAge <= 0 {
+		a.MaxAge = defaultArtifactsMaxAge
+	}
+	if a.Keep <= 0 {
+		a.Keep = defaultArtifactsKeep
+	}
+	return a
+}
+
+// artifactPattern matches the artifacts of database encoded with the
+// extension of the pipeline, capturing their timestamp.
+func artifactPattern(database, ext string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(database) + `_(\d{8}T\d{6}Z)\.dump` + regexp.QuoteMeta(ext) + "$")
+}
+
+// artifactName returns the name of a new artifact of the server database.
+func (r *Replicator) artifactName() string {
+	return fmt.Sprintf(
+		"%s_%s.dump%s",
+		r.config.Server.DB.Database,
+		time.Now().UTC().Format(artifactTimeFormat),
+		r.Pipeline.Extension(),
+	)
+}
+
+// matchingArtifacts returns the artifacts of the server database among
+// names, oldest first.
+func (r *Replicator) matchingArtifacts(names []string) []string {
+	pattern := artifactPattern(r.config.Server.DB.Database, r.Pipeline.Extension())
+	var artifacts []string
+	for _, name := range names {
+		if pattern.MatchString(name) {
+			artifacts = append(artifacts, name)
+		}
+	}
+	sort.Strings(artifacts)
+	return artifacts
+}
+
+// artifactAge returns how old the artifact is from the time in its name.
+func (r *Replicator) artifactAge(name string) (time.Duration, error) {
+	match := artifactPattern(r.config.Server.DB.Database, r.Pipeline.Extension()).FindStringSubmatch(name)
+	if match == nil {
+		return 0, fmt.Errorf("%s isn't an artifact of %s", name, r.config.Server.DB.Database)
+	}
+	created, err := time.Parse(artifactTimeFormat, match[1])
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(created).Round(time.Second), nil
+}
+
+// listArtifacts returns the artifacts of the server database, oldest first.
+func (r *Replicator) listArtifacts(ctx context.Context) ([]string, error) {
+	artifacts := r.config.Artifacts.withDefaults()
+	var out string
+	err := r.withRemote(ctx, "Listing artifacts", func() error {
+		var err error
+		out, err = r.Remote.Output(ctx, fmt.Sprintf("ls -1 %s 2>/dev/null || true", artifacts.Dir))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.matchingArtifacts(strings.Split(out, "\n")), nil
+}
+
+// DumpArtifact runs Dump and keeps the dump on the server as an artifact
+// with its SHA-256, removing the oldest artifacts. Cleanup must follow.
+func (r *Replicator) DumpArtifact(ctx context.Context) error {
+	if err := r.Dump(ctx); err != nil {
+		return err
+	}
+	if r.remoteDumpFile == "" {
+		return fmt.Errorf("artifacts can't be kept in %s mode", r.config.Server.Mode)
+	}
+
+	artifacts := r.config.Artifacts.withDefaults()
+	name := r.artifactName()
+	r.printStep("Keep dump file as artifact %s/%s in %s", artifacts.Dir, name, r.config.Server.Host)
+	err := r.withRemote(ctx, "Keeping artifact", func() error {
+		// The checksum is written first, so an artifact always has one.
+		return r.Remote.Run(ctx, fmt.Sprintf(
+			"umask 077 && mkdir -p -m 700 %s && sum=$(sha256sum %s) && echo \"${sum%%%% *}\" > %s.sha256 && mv %s %s",
+			artifacts.Dir,
+			r.remoteDumpFile,
+			artifacts.Dir+"/"+name,
+			r.remoteDumpFile,
+			artifacts.Dir+"/"+name,
+		))
+	})
+	if err != nil {
+		return err
+	}
+	r.remoteDumpFile = ""
+
+	names, err := r.listArtifacts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) > artifacts.Keep {
+		for _, old := range names[:len(names)-artifacts.Keep] {
+			r.printStep("Remove old artifact %s/%s in %s", artifacts.Dir, old, r.config.Server.Host)
+			err := r.withRemote(ctx, "Removing old artifact", func() error {
+				return r.Remote.Run(ctx, fmt.Sprintf(
+					"%s && rm -f %s/%s.sha256",
+					removeFileCommand(artifacts.Dir+"/"+old, r.config.SecureDelete),
+					artifacts.Dir,
+					old,
+				))
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PullLatest uses the latest artifact of the server database instead of
+// dumping it, if it is fresh enough, and falls back to Dump otherwise.
+// Transfer then verifies the copy against the SHA-256 of the artifact.
+func (r *Replicator) PullLatest(ctx context.Context) error {
+	if err := r.checkEngine(); err != nil {
+		return err
+	}
+	if r.pipelineErr != nil {
+		return r.pipelineErr
+	}
+	if r.useDriver {
+		return errors.New("the artifacts are dumped for the local client tools, which are missing")
+	}
+	if r.Downgrade {
+		return errors.New("the artifacts aren't dumped in plain SQL to be rewritten for an older server")
+	}
+	if r.plainFormat() {
+		return errors.New("the artifacts are dumped in the custom format, not in plain SQL for format: plain")
+	}
+	if err := r.resolveSecrets(ctx); err != nil {
+		return err
+	}
+	if !r.connected {
+		if err := r.Connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := r.storeServerPassword(ctx); err != nil {
+		return err
+	}
+
+	artifacts := r.config.Artifacts.withDefaults()
+	names, err := r.listArtifacts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		fmt.Fprintf(r.Output, "   No artifact in %s, dumping\n", artifacts.Dir)
+		return r.Dump(ctx)
+	}
+
+	latest := names[len(names)-1]
+	age, err := r.artifactAge(latest)
+	if err != nil {
+		return err
+	}
+	if age > artifacts.MaxAge {
+		fmt.Fprintf(r.Output, "   Latest artifact %s is %s old, dumping\n", latest, age)
+		return r.Dump(ctx)
+	}
+
+	file := artifacts.Dir + "/" + latest
+	r.printStep("Use artifact %s in %s, %s old", file, r.config.Server.Host, age)
+	var sum string
+	err = r.withRemote(ctx, "Reading artifact checksum", func() error {
+		var err error
+		sum, err = r.Remote.Output(ctx, fmt.Sprintf("cat %s.sha256", file))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.remoteDumpFile = file
+	r.expectedSum = strings.TrimSpace(sum)
+
+	if _, ok := r.Engine.(versionChecker); ok {
+		r.printStep("Check versions of the database and dump tool in %s", r.config.Server.Host)
+		err := r.withRemote(ctx, "Checking versions", func() error {
+			return r.checkVersions(ctx, r.Remote, r.config.Server.DB)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.WithGlobals {
+		r.printStep("Capturing roles of %s", r.config.Server.Host)
+		return r.withRemote(ctx, "Capturing roles", func() error {
+			return r.captureGlobals(ctx, r.Remote, r.config.Server.DB)
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArtifactStore configures the object storage receiving the dumps of
+// StoreArtifact, for instance from a nightly cron job, so FetchStored can
+// replicate without reaching the server at all.
+type ArtifactStore struct {
+	// URL is the bucket and prefix of the artifacts, s3://bucket/prefix for
+	// S3 with the aws CLI, or gs://bucket/prefix for GCS with gsutil.
+	URL string `yaml:"url"`
+	// MaxAge is how old an artifact can be to be fetched, 24h by default.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Keep is how many artifacts of the database are kept, 3 by default.
+	Keep int `yaml:"keep"`
+	// Channels gives how many of the artifacts last published to each
+	// channel CollectStored keeps, such as nightly: 7, 1 by default.
+	Channels map[string]int `yaml:"channels"`
+}
+
+func (s ArtifactStore) withDefaults() ArtifactStore {
+	if s.MaxAge <= 0 {
+		s.MaxAge = defaultArtifactsMaxAge
+	}
+	if s.Keep <= 0 {
+		s.Keep = defaultArtifactsKeep
+	}
+	return s
+}
+
+// objectStore builds the commands of the CLI of the object storage of url.
+type objectStore struct {
+	url    string
+	scheme string
+}
+
+func newObjectStore(url string) (objectStore, error) {
+	store := objectStore{url: strings.TrimSuffix(url, "/")}
+	switch {
+	case url == "":
+		return store, errors.New("no artifact_store url in the config")
+	case strings.HasPrefix(url, "s3://"):
+		store.scheme = "s3"
+	case strings.HasPrefix(url, "gs://"):
+		store.scheme = "gs"
+	default:
+		return store, fmt.Errorf("unknown artifact store %q, expected s3:// or gs://", url)
+	}
+	return store, nil
+}
+
+func (s objectStore) object(name string) string {
+	return s.url + "/" + name
+}
+
+// CopyCommand copies between a local file and an object, - being stdin or
+// stdout.
+func (s objectStore) CopyCommand(src, dst string) string {
+	if s.scheme == "gs" {
+		return fmt.Sprintf("gsutil -q cp %s %s", shellQuote(src), shellQuote(dst))
+	}
+	return fmt.Sprintf("aws s3 cp --only-show-errors %s %s", shellQuote(src), shellQuote(dst))
+}
+
+func (s objectStore) ListCommand() string {
+	if s.scheme == "gs" {
+		return fmt.Sprintf("gsutil ls -l %s || true", shellQuote(s.url+"/"))
+	}
+	return fmt.Sprintf("aws s3 ls %s || true", shellQuote(s.url+"/"))
+}
+
+// names returns the names of the objects listed by ListCommand: aws lists
+// their date, size and name, gsutil their size, date and URL, then a total.
+func (s objectStore) names(out string) []string {
+	var names []string
+	for name := range s.sizes(out) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sizes returns the sizes of the objects listed by ListCommand, by name.
+func (s objectStore) sizes(out string) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "TOTAL:" {
+			continue
+		}
+		var size int64
+		if s.scheme == "gs" {
+			size, _ = strconv.ParseInt(fields[0], 10, 64)
+		} else if len(fields) > 2 {
+			size, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+		sizes[path.Base(fields[len(fields)-1])] = size
+	}
+	return sizes
+}
+
+func (s objectStore) RemoveCommand(object string) string {
+	if s.scheme == "gs" {
+		return fmt.Sprintf("gsutil -q rm %s", shellQuote(object))
+	}
+	return fmt.Sprintf("aws s3 rm --only-show-errors %s", shellQuote(object))
+}
+
+// StoreArtifact runs Dump and uploads the dump to the artifact store with
+// its SHA-256, from the server or locally in direct mode, publishes it to
+// Channel if set, then removes the oldest artifacts not published to a
+// channel. Cleanup must follow.
+func (r *Replicator) StoreArtifact(ctx context.Context) error {
+	store, err := newObjectStore(r.config.ArtifactStore.URL)
+	if err != nil {
+		return err
+	}
+	if err := r.Dump(ctx); err != nil {
+		return err
+	}
+
+	// The direct mode dumped locally.
+	file, where, recordWhere := r.remoteDumpFile, r.config.Server.Host, "server"
+	run := func(what, cmd string) (string, error) {
+		var out string
+		err := r.withRemote(ctx, what, func() error {
+			var err error
+			out, err = r.Remote.Output(ctx, cmd)
+			return err
+		})
+		return out, err
+	}
+	if file == "" {
+		file, where, recordWhere = r.localDumpFile, "local", "local"
+		run = func(what, cmd string) (string, error) {
+			return r.Local.Output(ctx, cmd)
+		}
+	}
+
+	if r.Channel != "" {
+		if err := checkChannel(r.Channel); err != nil {
+			return err
+		}
+	}
+	name := r.artifactName()
+	object := store.object(name)
+	r.printStep("Upload dump file %s to %s from %s", file, object, where)
+	// The checksum is uploaded first, so an artifact always has one.
+	uploadCmd := fmt.Sprintf(
+		"sum=$(sha256sum %s) && echo \"${sum%%%% *}\" | %s && %s",
+		file,
+		store.CopyCommand("-", object+".sha256"),
+		store.CopyCommand(file, object),
+	)
+	r.recordCommand(recordWhere, uploadCmd, "")
+	_, err = run("Uploading artifact", uploadCmd)
+	if err != nil {
+		return err
+	}
+
+	if r.Channel != "" {
+		r.printStep("Publish artifact %s to channel %s", object, r.Channel)
+		publishCmd := r.publishCommand(store, r.Channel, name)
+		r.recordCommand(recordWhere, publishCmd, "")
+		if _, err := run("Publishing artifact", publishCmd); err != nil {
+			return err
+		}
+	}
+
+	out, err := run("Listing stored artifacts", store.ListCommand())
+	if err != nil {
+		return err
+	}
+	names := r.matchingArtifacts(store.names(out))
+	channels, err := r.channels(store, store.names(out), func(cmd string) (string, error) {
+		return run("Reading channels", cmd)
+	})
+	if err != nil {
+		return err
+	}
+	published := map[string]bool{}
+	for _, history := range channels {
+		for _, artifact := range history {
+			published[artifact] = true
+		}
+	}
+	keep := r.config.ArtifactStore.withDefaults().Keep
+	if len(names) > keep {
+		for _, old := range names[:len(names)-keep] {
+			if published[old] {
+				continue
+			}
+			r.printStep("Remove old artifact %s", store.object(old))
+			_, err := run("Removing old artifact", fmt.Sprintf(
+				"%s && %s",
+				store.RemoveCommand(store.object(old)),
+				store.RemoveCommand(store.object(old)+".sha256"),
+			))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// FetchStored downloads the latest artifact of the artifact store, if it is
+// fresh enough, or the artifact of Channel however old, instead of Dump and
+// Transfer. The server isn't reached, so
+// its roles can't be captured.
+func (r *Replicator) FetchStored(ctx context.Context) error {
+	store, err := newObjectStore(r.config.ArtifactStore.URL)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.target != nil:
+		return errors.New("a target server or container can't restore from the artifact store")
+	case r.WithGlobals:
+		return errors.New("the roles of the server can't be captured from the artifact store")
+	case r.useDriver:
+		return errors.New("the artifacts are dumped for the local client tools, which are missing")
+	case r.Downgrade:
+		return errors.New("the artifacts aren't dumped in plain SQL to be rewritten for an older server")
+	case r.plainFormat():
+		return errors.New("the artifacts are dumped in the custom format, not in plain SQL for format: plain")
+	}
+
+	var latest string
+	if r.Channel != "" {
+		if latest, err = r.channelArtifact(ctx, store, r.Channel); err != nil {
+			return err
+		}
+	} else {
+		out, err := r.Local.Output(ctx, store.ListCommand())
+		if err != nil {
+			return err
+		}
+		names := r.matchingArtifacts(store.names(out))
+		if len(names) == 0 {
+			return fmt.Errorf("no artifact of %s in %s", r.config.Server.DB.Database, store.url)
+		}
+		latest = names[len(names)-1]
+	}
+	age, err := r.artifactAge(latest)
+	if err != nil {
+		return err
+	}
+	if maxAge := r.config.ArtifactStore.withDefaults().MaxAge; age > maxAge && r.Channel == "" {
+		return fmt.Errorf("latest artifact %s is %s old, more than max_age %s", store.object(latest), age, maxAge)
+	}
+
+	object := store.object(latest)
+	localFile := r.localDumpPath() + r.Pipeline.Extension()
+	if err := r.checkFileFree(ctx, localFile); err != nil {
+		return err
+	}
+	r.printStep("Download artifact %s, %s old", object, age)
+	r.onCleanup(func(ctx context.Context) error {
+		r.printStep("Remove local temp downloaded file %s", localFile)
+		return r.Local.Run(ctx, removeFileCommand(localFile, r.config.SecureDelete))
+	})
+	sum, err := r.Local.Output(ctx, store.CopyCommand(object+".sha256", "-"))
+	if err != nil {
+		return err
+	}
+	r.expectedSum = strings.TrimSpace(sum)
+	downloadCmd := "umask 077 && " + store.CopyCommand(object, localFile)
+	r.recordCommand("local", downloadCmd, "")
+	if err := r.Local.Run(ctx, downloadCmd); err != nil {
+		return err
+	}
+
+	return r.useTransferred(ctx, localFile, false)
+}
@@ -0,0 +1,59 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// awsSecretBackend is the aws-sm SecretBackend, reading secrets of AWS
+// Secrets Manager, and the ssm one, reading parameters of SSM Parameter
+// Store. It runs the aws CLI, so the default AWS credential chain and
+// region apply. A reference is written as a URI, aws-sm://<secret id> or
+// ssm://<parameter name>, and #<key> reads a key of a JSON secret.
+type awsSecretBackend struct {
+	service string
+}
+
+func (b awsSecretBackend) Secret(ctx context.Context, ref string) (string, error) {
+	ref = strings.TrimPrefix(ref, "//")
+	var key string
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		ref, key = ref[:i], ref[i+1:]
+	}
+
+	var args []string
+	switch b.service {
+	case "aws-sm":
+		args = []string{"secretsmanager", "get-secret-value", "--secret-id", ref, "--query", "SecretString"}
+	case "ssm":
+		args = []string{"ssm", "get-parameter", "--name", ref, "--with-decryption", "--query", "Parameter.Value"}
+	}
+	cmd := exec.CommandContext(ctx, "aws", append(args, "--output", "text")...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", withStderr(err, stderr.String())
+	}
+	value := strings.TrimSuffix(stdout.String(), "\n")
+	if key == "" {
+		return value, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("%s isn't a JSON secret with key %s", ref, key)
+	}
+	field, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("%s has no key %s", ref, key)
+	}
+	if s, ok := field.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(field), nil
+}
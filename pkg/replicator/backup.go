@@ -0,0 +1,188 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultBackupKeep = 3
+	defaultBackupDir  = "$HOME/.rep/backups"
+)
+
+// Backup keeps the local database replaced by a run, so a bad refresh
+// doesn't destroy local data.
+type Backup struct {
+	// Mode is rename to keep the database as <name>_backup_<timestamp>, dump
+	// to dump it into Dir, or empty for no backup.
+	Mode string `yaml:"mode"`
+	// Keep is how many backups of the database are kept, 3 by default.
+	Keep int `yaml:"keep"`
+	// Dir receives the dumps, ~/.rep/backups by default. It is expanded by
+	// the shell.
+	Dir string `yaml:"dir"`
+}
+
+func (b Backup) withDefaults() Backup {
+	if b.Keep <= 0 {
+		b.Keep = defaultBackupKeep
+	}
+	if b.Dir == "" {
+		b.Dir = defaultBackupDir
+	}
+	return b
+}
+
+// databaseLister is implemented by the engines able to list the local
+// databases, which backing up the local database requires.
+type databaseLister interface {
+	// DatabasesCommand returns the local command listing the databases, one
+	// per line, connected to database.
+	DatabasesCommand(db DB, database string) string
+}
+
+func (r *Replicator) checkBackup() error {
+	switch r.config.Backup.Mode {
+	case "":
+		return nil
+	case "rename", "dump":
+	default:
+		return fmt.Errorf("unknown backup mode %q", r.config.Backup.Mode)
+	}
+	if _, ok := r.Engine.(databaseLister); !ok {
+		return errors.New("the database engine can't back up the local database")
+	}
+	return nil
+}
+
+// previousLocalDB returns the database Swap moves the local database to,
+// and whether it is kept as a backup rather than dropped. Backing up to a
+// dump happens here, before the swap.
+func (r *Replicator) previousLocalDB(ctx context.Context) (string, bool, error) {
+	previous := r.tempDBName("old")
+	backup := r.config.Backup.withDefaults()
+	if backup.Mode == "" {
+		return previous, false, nil
+	}
+	if err := r.checkBackup(); err != nil {
+		return "", false, err
+	}
+	localDB := r.config.LocalDB
+
+	databases, err := r.localDatabases(ctx, r.Engine.(databaseLister))
+	if err != nil {
+		return "", false, err
+	}
+	if !containsString(databases, localDB.Database) {
+		return previous, false, nil
+	}
+
+	name := backupPrefix(localDB.Database) + time.Now().Format("20060102150405")
+	if backup.Mode == "rename" {
+		return name, true, nil
+	}
+
+	file := fmt.Sprintf("%s/%s.dump", backup.Dir, name)
+	r.printStep("Back up local database %s to %s", localDB.Database, file)
+	cmd := fmt.Sprintf("mkdir -p -m 700 %s && %s", backup.Dir, r.Engine.DumpCommand(localDB, file))
+	r.recordCommand(r.localWhere(), cmd, "")
+	if err := r.Local.Run(ctx, cmd); err != nil {
+		return "", false, err
+	}
+
+	out, err := r.Local.Output(ctx, fmt.Sprintf("ls -1 %s", backup.Dir))
+	if err != nil {
+		return "", false, err
+	}
+	var files []string
+	for _, file := range strings.Split(out, "\n") {
+		files = append(files, strings.TrimSuffix(file, ".dump"))
+	}
+	for _, old := range oldBackups(files, backupPattern(localDB.Database), backup.Keep) {
+		file := fmt.Sprintf("%s/%s.dump", backup.Dir, old)
+		r.printStep("Remove old backup %s", file)
+		if err := r.Local.Run(ctx, removeFileCommand(file, r.config.SecureDelete)); err != nil {
+			return "", false, err
+		}
+	}
+	return previous, false, nil
+}
+
+// dropOldBackupDBs drops the backup databases beyond the ones to keep.
+func (r *Replicator) dropOldBackupDBs(ctx context.Context) error {
+	databases, err := r.localDatabases(ctx, r.Engine.(databaseLister))
+	if err != nil {
+		return err
+	}
+	backups := backupPattern(r.config.LocalDB.Database)
+	for _, old := range oldBackups(databases, backups, r.config.Backup.withDefaults().Keep) {
+		r.printStep("Drop old backup database %s", old)
+		if err := r.runScript(ctx, r.intermediateDB, r.Engine.DropDatabaseScript(old)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupPrefix is the name of the backups of database before their
+// timestamp, database being cut so the names fit in the 63 bytes of the
+// names of Postgres, which would cut them instead.
+func backupPrefix(database string) string {
+	const max = 63 - len("_backup_") - len("20060102150405")
+	if len(database) > max {
+		database = database[:max]
+		// Not in the middle of a character.
+		for !utf8.ValidString(database) {
+			database = database[:len(database)-1]
+		}
+	}
+	return database + "_backup_"
+}
+
+// backupPattern matches the backups of database, databases or dump files
+// without their extension.
+func backupPattern(database string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(backupPrefix(database)) + `\d{14}$`)
+}
+
+func (r *Replicator) localDatabases(ctx context.Context, engine databaseLister) ([]string, error) {
+	if r.useDriver {
+		return r.Engine.(driverEngine).DriverDatabases(ctx, r.config.LocalDB, r.intermediateDB)
+	}
+	out, err := r.Local.Output(ctx, engine.DatabasesCommand(r.config.LocalDB, r.intermediateDB))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// oldBackups returns the backups among names beyond the keep most recent
+// ones, the timestamp of their name sorting them.
+func oldBackups(names []string, backups *regexp.Regexp, keep int) []string {
+	var matching []string
+	for _, name := range names {
+		if backups.MatchString(name) {
+			matching = append(matching, name)
+		}
+	}
+	sort.Strings(matching)
+	if len(matching) <= keep {
+		return nil
+	}
+	return matching[:len(matching)-keep]
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
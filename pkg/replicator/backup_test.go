@@ -0,0 +1,65 @@
+package replicator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestBackupPrefix(t *testing.T) {
+	tests := []struct {
+		database string
+		want     string
+	}{
+		{"dev", "dev_backup_"},
+		{strings.Repeat("a", 41), strings.Repeat("a", 41) + "_backup_"},
+		{strings.Repeat("a", 50), strings.Repeat("a", 41) + "_backup_"},
+		// é is 2 bytes, the 41st byte is the middle of the 21st.
+		{strings.Repeat("é", 30), strings.Repeat("é", 20) + "_backup_"},
+	}
+	for _, test := range tests {
+		got := backupPrefix(test.database)
+		if got != test.want {
+			t.Errorf("backupPrefix(%q) = %q, want %q", test.database, got, test.want)
+		}
+		if name := got + "20240102030405"; len(name) > 63 || !utf8.ValidString(name) {
+			t.Errorf("backup name %q is too long or invalid", name)
+		}
+	}
+}
+
+func TestOldBackups(t *testing.T) {
+	long := strings.Repeat("a", 60)
+	tests := []struct {
+		database string
+		names    []string
+		keep     int
+		want     []string
+	}{
+		{
+			database: "dev",
+			names:    []string{"dev", "dev_backup_20240103000000", "dev_backup_20240101000000", "dev_backup_20240102000000", "dev2_backup_20230101000000", "dev_backup_x"},
+			keep:     2,
+			want:     []string{"dev_backup_20240101000000"},
+		},
+		{
+			database: "dev",
+			names:    []string{"dev_backup_20240101000000"},
+			keep:     3,
+		},
+		{
+			// Postgres keeps the names cut by backupPrefix.
+			database: long,
+			names:    []string{long, backupPrefix(long) + "20240102000000", backupPrefix(long) + "20240101000000"},
+			keep:     1,
+			want:     []string{backupPrefix(long) + "20240101000000"},
+		},
+	}
+	for _, test := range tests {
+		got := oldBackups(test.names, backupPattern(test.database), test.keep)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("oldBackups(%q, %d) = %q, want %q", test.names, test.keep, got, test.want)
+		}
+	}
+}
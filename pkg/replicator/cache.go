@@ -0,0 +1,150 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultKeepDumpDir is where the dumps are kept when KeepDump has no better
+// place, ~/.rep/dumps.
+const DefaultKeepDumpDir = "$HOME/.rep/dumps"
+
+// defaultCacheDir caches the dumps when ReuseDump is set without a cache_dir.
+const defaultCacheDir = "~/.rep/cache"
+
+// cachePath returns the local file caching the last dump transferred from
+// the server database, whose SHA-256 is kept in the .sha256 file next to it.
+// The plain dumps are cached apart from the others.
+func (r *Replicator) cachePath() string {
+	dir := r.config.CacheDir
+	if strings.HasPrefix(dir, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, dir[2:])
+		}
+	}
+	format := ""
+	if r.plainDump() {
+		format = "_plain"
+	}
+	return filepath.Join(dir, fmt.Sprintf(
+		"%s_%d_%s%s.dump%s",
+		r.config.Server.Host,
+		r.config.Server.Port,
+		r.config.Server.DB.Database,
+		format,
+		r.Pipeline.Extension(),
+	))
+}
+
+// remoteChecksum returns the SHA-256 of the dump file on the server, known
+// already for an artifact.
+func (r *Replicator) remoteChecksum(ctx context.Context) (string, error) {
+	if r.expectedSum != "" {
+		return r.expectedSum, nil
+	}
+	r.printStep("Compute checksum of %s in %s", r.remoteDumpFile, r.config.Server.Host)
+	var out string
+	err := r.withRemote(ctx, "Computing checksum", func() error {
+		var err error
+		out, err = r.Remote.Output(ctx, fmt.Sprintf("sha256sum %s", r.remoteDumpFile))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Fields(out + " ")[0], nil
+}
+
+// cachedDump reports whether the cached dump has the SHA-256 sum, checking
+// the file itself rather than trusting its .sha256 file.
+func (r *Replicator) cachedDump(ctx context.Context, sum string) bool {
+	file := r.cachePath()
+	cachedSum, err := ioutil.ReadFile(file + ".sha256")
+	if err != nil || strings.TrimSpace(string(cachedSum)) != sum {
+		return false
+	}
+	r.printStep("Verify checksum of cached dump file %s", file)
+	actual, err := r.fileChecksum(ctx, file)
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Hashing %s failed: %v\n", file, err)
+		return false
+	}
+	if actual != sum {
+		fmt.Fprintf(r.Output, "   Cached dump file doesn't match its checksum, transferring again\n")
+		return false
+	}
+	return true
+}
+
+// cacheDump replaces the cached dump with the transferred file, which must
+// be in the cache directory, and records its SHA-256 sum.
+func (r *Replicator) cacheDump(transferred, sum string) error {
+	file := r.cachePath()
+	if err := os.Remove(file + ".sha256"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(transferred, file); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file+".sha256", []byte(sum+"\n"), 0600)
+}
+
+// reuseCachedDump uses the cached dump for Restore, instead of Dump and
+// Transfer, if it was cached less than ReuseDump ago and still matches its
+// SHA-256.
+func (r *Replicator) reuseCachedDump(ctx context.Context) (bool, error) {
+	if r.ReuseDump <= 0 {
+		return false, nil
+	}
+	file := r.cachePath()
+	info, err := os.Stat(file + ".sha256")
+	if err != nil {
+		fmt.Fprintf(r.Output, "   No cached dump file %s, dumping\n", file)
+		return false, nil
+	}
+	age := time.Since(info.ModTime()).Round(time.Second)
+	if age > r.ReuseDump {
+		fmt.Fprintf(r.Output, "   Cached dump file %s is %s old, dumping\n", file, age)
+		return false, nil
+	}
+	sum, err := ioutil.ReadFile(file + ".sha256")
+	if err != nil {
+		return false, err
+	}
+	if !r.cachedDump(ctx, strings.TrimSpace(string(sum))) {
+		return false, nil
+	}
+
+	r.printStep("Reuse cached dump file %s, %s old", file, age)
+	r.expectedSum = strings.TrimSpace(string(sum))
+	return true, r.useTransferred(ctx, file, true)
+}
+
+// keepDump copies the local dump into KeepDump, hard linking it when
+// possible, so the cleanup doesn't remove the only copy.
+func (r *Replicator) keepDump(ctx context.Context) error {
+	if r.KeepDump == "" {
+		return nil
+	}
+	name := fmt.Sprintf("%s_%s.dump", r.config.Server.DB.Database, time.Now().Format("20060102150405"))
+	if r.encrypted {
+		name += r.Pipeline.Extension()
+	}
+	file := r.KeepDump + "/" + name
+	r.printStep("Keep dump file %s as %s", r.localDumpFile, file)
+	cmd := fmt.Sprintf(
+		"mkdir -p -m 700 %s && (ln %s %s 2>/dev/null || cp %s %s)",
+		r.KeepDump,
+		r.localDumpFile,
+		file,
+		r.localDumpFile,
+		file,
+	)
+	r.recordCommand(r.localWhere(), cmd, "")
+	return r.Local.Run(ctx, cmd)
+}
@@ -0,0 +1,215 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// channelPattern matches the names of the channels, such as nightly or
+// pre-release.
+var channelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// channelPrefix starts the objects of the artifact store naming the artifact
+// published to each channel of the server database.
+func (r *Replicator) channelPrefix() string {
+	return r.config.Server.DB.Database + ".channel."
+}
+
+func checkChannel(channel string) error {
+	if !channelPattern.MatchString(channel) {
+		return fmt.Errorf("invalid channel %q, expected letters, digits, dots, dashes or underscores", channel)
+	}
+	return nil
+}
+
+// channels returns the artifacts published to the channels of the server
+// database among the objects names of the store, by channel, oldest first
+// and the current one last, read with output where the store is reachable.
+func (r *Replicator) channels(store objectStore, names []string, output func(cmd string) (string, error)) (map[string][]string, error) {
+	channels := map[string][]string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, r.channelPrefix()) {
+			continue
+		}
+		out, err := output(store.CopyCommand(store.object(name), "-"))
+		if err != nil {
+			return nil, err
+		}
+		channels[strings.TrimPrefix(name, r.channelPrefix())] = strings.Fields(out)
+	}
+	return channels, nil
+}
+
+// publishCommand returns the command publishing artifact to channel, at the
+// end of the history of the artifacts published to it, which is the object
+// of the channel.
+func (r *Replicator) publishCommand(store objectStore, channel, artifact string) string {
+	object := store.object(r.channelPrefix() + channel)
+	return fmt.Sprintf(
+		"{ %s 2>/dev/null || true; echo %s; } | %s",
+		store.CopyCommand(object, "-"),
+		shellQuote(artifact),
+		store.CopyCommand("-", object),
+	)
+}
+
+// channelArtifact returns the artifact published to channel.
+func (r *Replicator) channelArtifact(ctx context.Context, store objectStore, channel string) (string, error) {
+	if err := checkChannel(channel); err != nil {
+		return "", err
+	}
+	out, err := r.Local.Output(ctx, store.ListCommand())
+	if err != nil {
+		return "", err
+	}
+	channels, err := r.channels(store, store.names(out), func(cmd string) (string, error) {
+		return r.Local.Output(ctx, cmd)
+	})
+	if err != nil {
+		return "", err
+	}
+	history := channels[channel]
+	if len(history) == 0 {
+		return "", fmt.Errorf("no artifact of %s published to channel %s in %s", r.config.Server.DB.Database, channel, store.url)
+	}
+	artifact := history[len(history)-1]
+	if !containsString(r.matchingArtifacts(store.names(out)), artifact) {
+		return "", fmt.Errorf("artifact %s of channel %s is missing from %s", artifact, channel, store.url)
+	}
+	return artifact, nil
+}
+
+// PublishStored publishes an artifact of the artifact store to channel, the
+// artifact of the channel from, or the latest artifact if from is empty, so
+// a team can agree on the dataset it develops against. The artifacts
+// published to a channel are only removed by CollectStored.
+func (r *Replicator) PublishStored(ctx context.Context, channel, from string) error {
+	store, err := newObjectStore(r.config.ArtifactStore.URL)
+	if err != nil {
+		return err
+	}
+	if err := checkChannel(channel); err != nil {
+		return err
+	}
+
+	var artifact string
+	if from != "" {
+		if artifact, err = r.channelArtifact(ctx, store, from); err != nil {
+			return err
+		}
+	} else {
+		out, err := r.Local.Output(ctx, store.ListCommand())
+		if err != nil {
+			return err
+		}
+		names := r.matchingArtifacts(store.names(out))
+		if len(names) == 0 {
+			return fmt.Errorf("no artifact of %s in %s", r.config.Server.DB.Database, store.url)
+		}
+		artifact = names[len(names)-1]
+	}
+
+	r.printStep("Publish artifact %s to channel %s", store.object(artifact), channel)
+	return r.Local.Run(ctx, r.publishCommand(store, channel, artifact))
+}
+
+// CollectStored applies the retention of the artifact store: it keeps the
+// last keep artifacts and those last published to each channel, as many as
+// its policy of channels, and removes the others, after trimming the history
+// of the channels. With dryRun, it only reports what it would remove and the
+// space it would reclaim.
+func (r *Replicator) CollectStored(ctx context.Context, dryRun bool) error {
+	store, err := newObjectStore(r.config.ArtifactStore.URL)
+	if err != nil {
+		return err
+	}
+	settings := r.config.ArtifactStore.withDefaults()
+	out, err := r.Local.Output(ctx, store.ListCommand())
+	if err != nil {
+		return err
+	}
+	sizes := store.sizes(out)
+	artifacts := r.matchingArtifacts(store.names(out))
+	channels, err := r.channels(store, store.names(out), func(cmd string) (string, error) {
+		return r.Local.Output(ctx, cmd)
+	})
+	if err != nil {
+		return err
+	}
+
+	trim, remove := "Trim", "Remove"
+	if dryRun {
+		trim, remove = "Would trim", "Would remove"
+	}
+	kept := map[string]bool{}
+	if len(artifacts) > settings.Keep {
+		for _, artifact := range artifacts[len(artifacts)-settings.Keep:] {
+			kept[artifact] = true
+		}
+	} else {
+		for _, artifact := range artifacts {
+			kept[artifact] = true
+		}
+	}
+
+	var names []string
+	for channel := range channels {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+	for _, channel := range names {
+		history := channels[channel]
+		keep := settings.Channels[channel]
+		if keep <= 0 {
+			keep = 1
+		}
+		if len(history) > keep {
+			history = history[len(history)-keep:]
+			r.printStep("%s channel %s to its last %d artifacts", trim, channel, keep)
+			if !dryRun {
+				object := store.object(r.channelPrefix() + channel)
+				var quoted []string
+				for _, artifact := range history {
+					quoted = append(quoted, shellQuote(artifact))
+				}
+				cmd := fmt.Sprintf("printf '%%s\\n' %s | %s", strings.Join(quoted, " "), store.CopyCommand("-", object))
+				if err := r.Local.Run(ctx, cmd); err != nil {
+					return err
+				}
+			}
+		}
+		for _, artifact := range history {
+			kept[artifact] = true
+		}
+	}
+
+	var reclaimed int64
+	for _, artifact := range artifacts {
+		if kept[artifact] {
+			continue
+		}
+		size := sizes[artifact] + sizes[artifact+".sha256"]
+		reclaimed += size
+		r.printStep("%s artifact %s, %s", remove, store.object(artifact), FormatSize(size))
+		if dryRun {
+			continue
+		}
+		err := r.Local.Run(ctx, fmt.Sprintf(
+			"%s && %s",
+			store.RemoveCommand(store.object(artifact)),
+			store.RemoveCommand(store.object(artifact)+".sha256"),
+		))
+		if err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(r.Output, "   %s would be reclaimed\n", FormatSize(reclaimed))
+	} else {
+		fmt.Fprintf(r.Output, "   %s reclaimed\n", FormatSize(reclaimed))
+	}
+	return nil
+}
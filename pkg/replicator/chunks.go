@@ -0,0 +1,191 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// minChunkSize is the smallest chunk a transfer is split into, a smaller dump
+// taking fewer streams.
+const minChunkSize = 64 << 20
+
+// rangeTransferrer is implemented by the FileTransferrers able to copy a
+// range of a remote file, for Server.TransferStreams.
+type rangeTransferrer interface {
+	// CopyRange writes length bytes of the remote file from offset to w,
+	// until done or ctx is done.
+	CopyRange(ctx context.Context, remote string, offset, length int64, w io.Writer) error
+}
+
+// chunk is a range of the remote file, downloaded to its own part file.
+type chunk struct {
+	part   string
+	offset int64
+	length int64
+}
+
+// transferChunks splits the transfer of the size bytes of the dump to local
+// into chunks, or returns nil for a single stream: when TransferStreams isn't
+// set, the Transferrer can't copy ranges, the dump isn't received locally,
+// or a single stream already received part of local.
+func (r *Replicator) transferChunks(local string, size int64) []chunk {
+	streams := int64(r.config.Server.TransferStreams)
+	if streams < 2 {
+		return nil
+	}
+	if _, ok := r.Transferrer.(rangeTransferrer); !ok {
+		return nil
+	}
+	if _, ok := r.Receiver.(LocalFiles); !ok {
+		return nil
+	}
+	if info, err := os.Stat(local); err == nil && info.Size() > 0 {
+		// The single stream, or the join of the parts, continues where it
+		// stopped.
+		removeParts(local)
+		return nil
+	}
+
+	chunkSize := (size + streams - 1) / streams
+	if chunkSize < minChunkSize {
+		chunkSize = minChunkSize
+	}
+	var chunks []chunk
+	for offset := int64(0); offset < size; offset += chunkSize {
+		length := chunkSize
+		if offset+length > size {
+			length = size - offset
+		}
+		chunks = append(chunks, chunk{
+			part:   fmt.Sprintf("%s.part%d", local, len(chunks)),
+			offset: offset,
+			length: length,
+		})
+	}
+	if len(chunks) < 2 {
+		return nil
+	}
+	return chunks
+}
+
+// receivedChunks returns how many bytes of the chunks their part files hold.
+func receivedChunks(chunks []chunk) int64 {
+	var received int64
+	for _, c := range chunks {
+		if info, err := os.Stat(c.part); err == nil {
+			if info.Size() > c.length {
+				received += c.length
+			} else {
+				received += info.Size()
+			}
+		}
+	}
+	return received
+}
+
+// copyChunks copies the rest of each chunk to its part file over its own
+// stream, all at once, stopping the others at the first failure. The
+// bandwidth limit is shared by the streams.
+func (r *Replicator) copyChunks(ctx context.Context, remote string, chunks []chunk) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	transferrer := r.Transferrer.(rangeTransferrer)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, c := range chunks {
+		wg.Add(1)
+		go func(c chunk) {
+			defer wg.Done()
+			err := r.copyChunk(ctx, transferrer, remote, c, len(chunks))
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (r *Replicator) copyChunk(ctx context.Context, transferrer rangeTransferrer, remote string, c chunk, streams int) error {
+	file, err := os.OpenFile(c.part, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return permanent(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return permanent(err)
+	}
+	if info.Size() >= c.length {
+		return file.Close()
+	}
+	var w io.Writer = countingWriter{file, &r.heartbeat}
+	if r.BandwidthLimit > 0 {
+		rate := r.BandwidthLimit / int64(streams)
+		if rate < 1 {
+			rate = 1
+		}
+		w = &throttledWriter{ctx: ctx, w: w, rate: rate, started: time.Now()}
+	}
+	err = transferrer.CopyRange(ctx, remote, c.offset+info.Size(), c.length-info.Size(), w)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// joinChunks appends the part files of the chunks to local in order,
+// removing each once appended.
+func joinChunks(local string, chunks []chunk) error {
+	file, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return permanent(err)
+	}
+	for _, c := range chunks {
+		if err := appendPart(file, c); err != nil {
+			file.Close()
+			return permanent(err)
+		}
+	}
+	return file.Close()
+}
+
+func appendPart(file *os.File, c chunk) error {
+	part, err := os.Open(c.part)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	n, err := io.Copy(file, io.LimitReader(part, c.length))
+	if err != nil {
+		return err
+	}
+	if n != c.length {
+		return fmt.Errorf("part %s has %d bytes, expected %d", c.part, n, c.length)
+	}
+	// Windows can't remove an open file.
+	part.Close()
+	return os.Remove(c.part)
+}
+
+// removeParts removes the part files of local left by an earlier transfer.
+func removeParts(local string) {
+	parts, _ := filepath.Glob(local + ".part*")
+	for _, part := range parts {
+		os.Remove(part)
+	}
+}
@@ -0,0 +1,171 @@
+package replicator
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRangeTransferrer is a fakeTransferrer able to copy ranges, recording
+// the ranges it copied.
+type fakeRangeTransferrer struct {
+	fakeTransferrer
+	mu     sync.Mutex
+	ranges [][2]int64
+}
+
+func (t *fakeRangeTransferrer) CopyRange(ctx context.Context, remote string, offset, length int64, w io.Writer) error {
+	t.mu.Lock()
+	t.ranges = append(t.ranges, [2]int64{offset, length})
+	t.mu.Unlock()
+	_, err := io.WriteString(w, t.content[offset:offset+length])
+	return err
+}
+
+func TestTransferChunks(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name    string
+		streams int
+		size    int64
+		want    [][2]int64
+	}{
+		{name: "single stream", streams: 1, size: 1024 * mb},
+		{name: "too small", streams: 4, size: 64 * mb},
+		{name: "even", streams: 4, size: 400 * mb, want: [][2]int64{{0, 100 * mb}, {100 * mb, 100 * mb}, {200 * mb, 100 * mb}, {300 * mb, 100 * mb}}},
+		{name: "uneven", streams: 3, size: 200 * mb, want: [][2]int64{{0, 69905067}, {69905067, 69905067}, {139810134, 69905066}}},
+		{name: "minimum chunk", streams: 8, size: 130 * mb, want: [][2]int64{{0, 64 * mb}, {64 * mb, 64 * mb}, {128 * mb, 2 * mb}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, log := newFakeReplicator(t, "", "")
+			r.config.Server.TransferStreams = test.streams
+			r.Transferrer = &fakeRangeTransferrer{fakeTransferrer: fakeTransferrer{log: log}}
+			r.Receiver = LocalFiles{}
+			local := filepath.Join(os.Getenv("TMPDIR"), "dump")
+			var got [][2]int64
+			for i, c := range r.transferChunks(local, test.size) {
+				if want := local + ".part" + string(rune('0'+i)); c.part != want {
+					t.Errorf("chunk %d goes to %s, want %s", i, c.part, want)
+				}
+				got = append(got, [2]int64{c.offset, c.length})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("transferChunks = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransferChunksSingleStream(t *testing.T) {
+	r, log := newFakeReplicator(t, "", "")
+	r.config.Server.TransferStreams = 4
+	r.Receiver = LocalFiles{}
+	local := filepath.Join(os.Getenv("TMPDIR"), "dump")
+
+	// The Transferrer can't copy ranges.
+	r.Transferrer = &fakeTransferrer{log: log}
+	if chunks := r.transferChunks(local, 1<<30); chunks != nil {
+		t.Errorf("transferChunks = %v without ranges, want nil", chunks)
+	}
+
+	// A single stream already received part of the dump.
+	r.Transferrer = &fakeRangeTransferrer{fakeTransferrer: fakeTransferrer{log: log}}
+	if err := ioutil.WriteFile(local, []byte("dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(local+".part1", []byte("left over"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := r.transferChunks(local, 1<<30); chunks != nil {
+		t.Errorf("transferChunks = %v after a single stream, want nil", chunks)
+	}
+	if _, err := os.Stat(local + ".part1"); !os.IsNotExist(err) {
+		t.Errorf("the parts of an earlier transfer are left: %v", err)
+	}
+}
+
+func TestCopyAndJoinChunks(t *testing.T) {
+	r, log := newFakeReplicator(t, "", "")
+	content := strings.Repeat("0123456789", 10)
+	transferrer := &fakeRangeTransferrer{fakeTransferrer: fakeTransferrer{log: log, content: content}}
+	r.Transferrer = transferrer
+	local := filepath.Join(os.Getenv("TMPDIR"), "dump")
+	chunks := []chunk{
+		{part: local + ".part0", offset: 0, length: 40},
+		{part: local + ".part1", offset: 40, length: 40},
+		{part: local + ".part2", offset: 80, length: 20},
+	}
+	// The first part is complete and the second was stopped halfway.
+	if err := ioutil.WriteFile(chunks[0].part, []byte(content[:40]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(chunks[1].part, []byte(content[40:55]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := receivedChunks(chunks); got != 55 {
+		t.Errorf("receivedChunks = %d, want 55", got)
+	}
+
+	if err := r.copyChunks(context.Background(), "/tmp/dump", chunks); err != nil {
+		t.Fatal(err)
+	}
+	ranges := map[[2]int64]bool{}
+	for _, copied := range transferrer.ranges {
+		ranges[copied] = true
+	}
+	if want := map[[2]int64]bool{{55, 25}: true, {80, 20}: true}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("copyChunks copied %v, want %v", transferrer.ranges, want)
+	}
+	if got := receivedChunks(chunks); got != 100 {
+		t.Errorf("receivedChunks = %d, want 100", got)
+	}
+
+	if err := joinChunks(local, chunks); err != nil {
+		t.Fatal(err)
+	}
+	joined, err := ioutil.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(joined) != content {
+		t.Errorf("joinChunks wrote %q, want %q", joined, content)
+	}
+	for _, c := range chunks {
+		if _, err := os.Stat(c.part); !os.IsNotExist(err) {
+			t.Errorf("%s is left: %v", c.part, err)
+		}
+	}
+}
+
+func TestJoinChunksShortPart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rep-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	local := filepath.Join(dir, "dump")
+	chunks := []chunk{
+		{part: local + ".part0", offset: 0, length: 4},
+		{part: local + ".part1", offset: 4, length: 4},
+	}
+	if err := ioutil.WriteFile(chunks[0].part, []byte("dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(chunks[1].part, []byte("ed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = joinChunks(local, chunks)
+	if err == nil || !strings.Contains(err.Error(), "has 2 bytes, expected 4") {
+		t.Errorf("joinChunks = %v, want a short part", err)
+	}
+	if _, err := os.Stat(chunks[1].part); err != nil {
+		t.Errorf("the short part was removed: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type DB struct {
+	// Engine is postgres (default), mysql, mariadb, mongodb or the name of
+	// an engine plugin.
+	Engine   string `yaml:"engine" json:"engine"`
+	Host     string `yaml:"host" json:"host"`
+	Port     int    `yaml:"port" json:"port"`
+	Database string `yaml:"database" json:"database"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// PasswordSecret replaces Password with a secret of a secret backend,
+	// as backend:reference.
+	PasswordSecret string `yaml:"password_secret" json:"-"`
+	// PasswordEnv replaces Password with an environment variable, such as
+	// one set by a CI pipeline.
+	PasswordEnv string `yaml:"password_env" json:"-"`
+	// IAMAuth replaces Password with a token generated at run time from the
+	// local credentials of the cloud, aws for RDS or gcp for Cloud SQL.
+	// Server database only.
+	IAMAuth string `yaml:"iam_auth" json:"iam_auth,omitempty"`
+	// IAMRegion is the region of the RDS instance, the one of the aws CLI
+	// by default.
+	IAMRegion string `yaml:"iam_region" json:"iam_region,omitempty"`
+	// PasswordFile is the private temp file the replicator writes the
+	// password to, for the commands to read it from rather than include it.
+	PasswordFile string `yaml:"-" json:"-"`
+	// DumpRole is the role the dump runs as, for instance one owning the
+	// tables with row-level security. Postgres only.
+	DumpRole string `yaml:"dump_role" json:"dump_role,omitempty"`
+	// EnableRowSecurity dumps only the rows the policies of the tables with
+	// row-level security let the user see, instead of failing. Postgres
+	// only.
+	EnableRowSecurity bool `yaml:"enable_row_security" json:"enable_row_security,omitempty"`
+	// DumpOptions are extra arguments of the dump tool when dumping this
+	// database, each quoted for the shell.
+	DumpOptions []string `yaml:"dump_options" json:"dump_options,omitempty"`
+	// RestoreOptions are extra arguments of the restore tool when restoring
+	// into this database, each quoted for the shell.
+	RestoreOptions []string `yaml:"restore_options" json:"restore_options,omitempty"`
+	// DockerContainer restores into the database of this local Docker
+	// container, the local commands running in it with docker exec. Host
+	// and Port are then seen from the container. Local database only.
+	DockerContainer string `yaml:"docker_container" json:"docker_container,omitempty"`
+	// PsqlPath and PgRestorePath are the psql and pg_restore run against
+	// this database, such as /usr/lib/postgresql/15/bin/psql, found in the
+	// PATH by default. Postgres only.
+	PsqlPath      string `yaml:"psql_path" json:"psql_path,omitempty"`
+	PgRestorePath string `yaml:"pg_restore_path" json:"pg_restore_path,omitempty"`
+	// PgDumpPath is the pg_dump dumping this database, set from
+	// Server.PgDumpPath for the server database.
+	PgDumpPath string `yaml:"-" json:"-"`
+}
+
+// SSHPort is the port of a Server, also read quoted as rep init used to
+// write it.
+type SSHPort int
+
+func (p *SSHPort) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	if s == "" {
+		*p = 0
+		return nil
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("port %q isn't a number", s)
+	}
+	*p = SSHPort(port)
+	return nil
+}
+
+type Server struct {
+	Host           string  `yaml:"host"`
+	Port           SSHPort `yaml:"port"`
+	User           string  `yaml:"user"`
+	PrivateKeyFile string  `yaml:"private_key_file"`
+	// PrivateKeySecret replaces PrivateKeyFile with a secret of a secret
+	// backend, as backend:reference.
+	PrivateKeySecret string `yaml:"private_key_secret"`
+	// PrivateKey is the key of PrivateKeySecret once resolved.
+	PrivateKey string `yaml:"-"`
+	// Mode is remote (default) to dump on the server and copy the dump, or
+	// direct to dump locally through a port forwarded over SSH.
+	Mode string `yaml:"mode"`
+	// DSCP marks the packets of the SSH connection, which carries the
+	// transfer, such as cs1 or le for a low priority so large transfers
+	// don't degrade calls on the same network. Linux and macOS only.
+	DSCP string `yaml:"dscp"`
+	// Proxy connects to the server through a SOCKS5 or HTTP proxy, as
+	// socks5://host:port or http://host:port with an optional
+	// user:password@.
+	Proxy string `yaml:"proxy"`
+	// KeepaliveInterval is how often a keepalive is sent over the SSH
+	// connection, 30s by default, so a firewall doesn't drop it while the
+	// dump runs and a dropped one is noticed.
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval"`
+	// Kubernetes runs the commands in a pod with kubectl instead of over
+	// SSH, Host naming the pod in the steps if empty.
+	Kubernetes *Kubernetes `yaml:"kubernetes"`
+	// DockerContainer runs the commands in this Docker container of the
+	// server with docker exec, for a database running in Docker whose
+	// client tools aren't installed on the server itself. The dump is
+	// written in the container.
+	DockerContainer string `yaml:"docker_container"`
+	// TempDir is the directory of the server the run directory and the
+	// temp files are created in, /tmp by default, for a server whose /tmp
+	// is small or mounted noexec.
+	TempDir string `yaml:"temp_dir"`
+	// TransferStreams splits the transfer of the dump into this many chunks
+	// copied at once over as many SSH channels, for a link one stream can't
+	// saturate, such as a distant server. 1 by default.
+	TransferStreams int `yaml:"transfer_streams"`
+	// PgDumpPath is the pg_dump of the server, such as
+	// /usr/lib/postgresql/15/bin/pg_dump, found in the PATH by default.
+	PgDumpPath string `yaml:"pg_dump_path"`
+	DB         DB     `yaml:"db"`
+}
+
+// Timeouts bounds the duration of each step, zero means no limit.
+type Timeouts struct {
+	Connect time.Duration `yaml:"connect"`
+	Dump    time.Duration `yaml:"dump"`
+	Copy    time.Duration `yaml:"copy"`
+	Restore time.Duration `yaml:"restore"`
+}
+
+// Tables selects how the tables of the server database are dumped.
+type Tables struct {
+	// SchemaOnly are the tables restored empty, their rows left out of the
+	// dump, such as large append-only tables of events, as table or
+	// schema.table patterns of pg_dump. Postgres only.
+	SchemaOnly []string `yaml:"schema_only"`
+}
+
+type Config struct {
+	Server   Server      `yaml:"server"`
+	LocalDB  DB          `yaml:"local_db"`
+	Timeouts Timeouts    `yaml:"timeouts"`
+	Retry    RetryPolicy `yaml:"retry"`
+	// Target replicates into the database of another server instead of
+	// local_db, the dump being streamed from one server to the other.
+	Target *Server `yaml:"target"`
+	// Pipeline encodes the dump on the server and decodes it locally, in
+	// this order. It is not used in direct mode.
+	Pipeline []StageConfig `yaml:"pipeline"`
+	// SecureDelete overwrites the temp dump files with shred before removing
+	// them, see removeFileCommand for its limits.
+	SecureDelete bool `yaml:"secure_delete"`
+	// Artifacts keeps dumps on the server for PullLatest.
+	Artifacts Artifacts `yaml:"artifacts"`
+	// ArtifactStore keeps dumps in S3 or GCS for FetchStored.
+	ArtifactStore ArtifactStore `yaml:"artifact_store"`
+	// Backup keeps the local database replaced by a run.
+	Backup Backup `yaml:"backup"`
+	// Notify lists the notifiers told about the outcome of each run.
+	Notify []string `yaml:"notify"`
+	// Metrics pushes the metrics of each run to a Prometheus Pushgateway.
+	Metrics Metrics `yaml:"metrics"`
+	// CacheDir keeps the last dump transferred from the server database, so
+	// a run whose dump has the same SHA-256, retrying a failed restore for
+	// instance, doesn't transfer it again.
+	CacheDir string `yaml:"cache_dir"`
+	// RoleMap gives the objects restored without their owners the local
+	// owner mapped to their owner on the server, such as app_prod: postgres.
+	RoleMap map[string]string `yaml:"role_map"`
+	// PostSwapCheck checks the local database once replaced.
+	PostSwapCheck PostSwapCheck `yaml:"post_swap_check"`
+	// Teammates are the machines Send can push the cached dump to, by name.
+	Teammates map[string]Teammate `yaml:"teammates"`
+	// Limits caps the resources of the local restore.
+	Limits Limits `yaml:"limits"`
+	// RefreshMatviews refreshes the materialized views a restore left
+	// unpopulated. Postgres only.
+	RefreshMatviews bool `yaml:"refresh_matviews"`
+	// DeferIndexes restores the rows of the tables before building their
+	// indexes and constraints, one by one with their progress, Limits.Jobs
+	// at once. Postgres only.
+	DeferIndexes bool `yaml:"defer_indexes"`
+	// Format is the format of the dump, custom by default, or plain for
+	// plain SQL compressed with gzip, restored with the client of the
+	// engine. Postgres only.
+	Format string `yaml:"format"`
+	// Verify compares the restored database with the server database before
+	// the swap.
+	Verify Verify `yaml:"verify"`
+	// Tables selects how the tables of the server database are dumped.
+	Tables Tables `yaml:"tables"`
+	// SchemaDiff prints the tables, columns and indexes the refresh adds,
+	// removes or changes in the local database before the swap. Postgres
+	// only.
+	SchemaDiff bool `yaml:"schema_diff"`
+	// PreDump are shell commands run on the server before the dump, such as
+	// pausing a worker.
+	PreDump []string `yaml:"pre_dump"`
+	// PostRestore runs against the restored database, for instance to reset
+	// the passwords of the users or disable the webhooks.
+	PostRestore []Hook `yaml:"post_restore"`
+}
+
+func ReadConfig(configFile string) (*Config, error) {
+	raw, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConfigFields(raw); err != nil {
+		return nil, fmt.Errorf("invalid config %s:\n%v", configFile, err)
+	}
+	raw, err = expandConfig(context.Background(), raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", configFile, err)
+	}
+
+	config := &Config{}
+	err = yaml.UnmarshalStrict(raw, &config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", configFile, err)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,201 @@
+package replicator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// unknownField matches the errors of yaml.UnmarshalStrict about the fields a
+// type doesn't have.
+var unknownField = regexp.MustCompile(`^line (\d+): field (\S+) not found in type (\S+)$`)
+
+// checkConfigFields fails on the mistakes of the YAML config that would
+// otherwise be cryptic errors or options silently left empty: indentation
+// with tabs and unknown fields, with a suggestion for each.
+func checkConfigFields(raw []byte) error {
+	for i, line := range strings.Split(string(raw), "\n") {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.Contains(indent, "\t") {
+			return fmt.Errorf("line %d is indented with a tab, YAML needs spaces", i+1)
+		}
+	}
+
+	err := yaml.UnmarshalStrict(raw, &Config{})
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	fields := configFields()
+	var problems []string
+	for _, msg := range typeErr.Errors {
+		match := unknownField.FindStringSubmatch(msg)
+		if match == nil {
+			// Type mismatches are reported once the values are expanded.
+			continue
+		}
+		problem := fmt.Sprintf("line %s: unknown option %s", match[1], match[2])
+		if suggestion := suggestField(fields, match[3], match[2]); suggestion != "" {
+			problem += ", " + suggestion
+		}
+		problems = append(problems, problem)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "\n"))
+}
+
+// configType describes a type of the config for the suggestions: where it is
+// in the config and its options.
+type configType struct {
+	path    string
+	options []string
+}
+
+// configFields returns the types of the config by their name in the yaml
+// errors, such as replicator.Server.
+func configFields() map[string]*configType {
+	types := map[string]*configType{}
+	var walk func(t reflect.Type, path string)
+	walk = func(t reflect.Type, path string) {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || t.PkgPath() != reflect.TypeOf(Config{}).PkgPath() {
+			return
+		}
+		if _, ok := types[t.String()]; ok {
+			return
+		}
+		ct := &configType{path: path}
+		types[t.String()] = ct
+		var fields func(t reflect.Type)
+		fields = func(t reflect.Type) {
+			for i := 0; i < t.NumField(); i++ {
+				field := t.Field(i)
+				tag := strings.Split(field.Tag.Get("yaml"), ",")
+				switch {
+				case len(tag) > 1 && tag[1] == "inline":
+					fields(field.Type)
+				case tag[0] == "-" || tag[0] == "" || field.PkgPath != "":
+				default:
+					ct.options = append(ct.options, tag[0])
+					walk(field.Type, strings.TrimPrefix(path+"."+tag[0], "."))
+				}
+			}
+		}
+		fields(t)
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return types
+}
+
+// suggestField returns the option of typeName close to field, or else where
+// field is an option.
+func suggestField(types map[string]*configType, typeName, field string) string {
+	if t, ok := types[typeName]; ok {
+		best, bestDistance := "", len(field)/3+2
+		for _, option := range t.options {
+			d := editDistance(field, option)
+			if strings.HasPrefix(option, field) || strings.HasPrefix(field, option) {
+				// Such as private_key for private_key_file.
+				d = 1
+			}
+			if d < bestDistance {
+				best, bestDistance = option, d
+			}
+		}
+		if best != "" {
+			return fmt.Sprintf("did you mean %s?", best)
+		}
+	}
+
+	var paths []string
+	for _, t := range types {
+		for _, option := range t.options {
+			if option == field {
+				where := "the top level"
+				if t.path != "" {
+					where = t.path
+				}
+				paths = append(paths, where)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return ""
+	}
+	sort.Strings(paths)
+	return fmt.Sprintf("it belongs under %s", strings.Join(paths, " or "))
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// RedactedConfig returns a copy of config without its passwords and private
+// keys, to show what was parsed.
+func RedactedConfig(config *Config) *Config {
+	copied := *config
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "***"
+	}
+	copied.Server.DB.Password = redact(copied.Server.DB.Password)
+	copied.Server.PrivateKey = ""
+	copied.Server.Proxy = redactProxy(copied.Server.Proxy)
+	copied.LocalDB.Password = redact(copied.LocalDB.Password)
+	if copied.Target != nil {
+		target := *copied.Target
+		target.DB.Password = redact(target.DB.Password)
+		target.PrivateKey = ""
+		target.Proxy = redactProxy(target.Proxy)
+		copied.Target = &target
+	}
+	if len(copied.Teammates) > 0 {
+		teammates := map[string]Teammate{}
+		for name, teammate := range copied.Teammates {
+			teammate.DB.Password = redact(teammate.DB.Password)
+			teammate.PrivateKey = ""
+			teammate.Proxy = redactProxy(teammate.Proxy)
+			teammates[name] = teammate
+		}
+		copied.Teammates = teammates
+	}
+	return &copied
+}
@@ -0,0 +1,99 @@
+package replicator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigFields(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		err  string
+	}{
+		{
+			name: "valid",
+			raw:  "server:\n  host: db.example.com\n  db:\n    database: app\nlocal_db:\n  database: dev\n",
+		},
+		{
+			name: "tab",
+			raw:  "server:\n\thost: db.example.com\n",
+			err:  "line 2 is indented with a tab, YAML needs spaces",
+		},
+		{
+			name: "typo",
+			raw:  "server:\n  hots: db.example.com\n",
+			err:  "line 2: unknown option hots, did you mean host?",
+		},
+		{
+			name: "prefix",
+			raw:  "server:\n  private_key: ~/.ssh/id_rsa\n",
+			err:  "line 2: unknown option private_key, did you mean private_key_file?",
+		},
+		{
+			name: "misplaced",
+			raw:  "server:\n  db:\n    secure_delete: true\n",
+			err:  "line 3: unknown option secure_delete, it belongs under the top level",
+		},
+		{
+			name: "nested",
+			raw:  "transfer_streams: 4\n",
+			err:  "line 1: unknown option transfer_streams, it belongs under server or teammates",
+		},
+		{
+			name: "unknown",
+			raw:  "local_db:\n  zzzzzzzz: 1\n",
+			err:  "line 2: unknown option zzzzzzzz",
+		},
+		{
+			name: "type mismatch",
+			raw:  "local_db:\n  port: ${PGPORT}\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkConfigFields([]byte(test.raw))
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("checkConfigFields: %v", err)
+			case test.err != "" && (err == nil || err.Error() != test.err):
+				t.Errorf("checkConfigFields = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"host", "host", 0},
+		{"hots", "host", 2},
+		{"", "port", 4},
+		{"usernme", "username", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestConfigFields(t *testing.T) {
+	types := configFields()
+	server, ok := types["replicator.Server"]
+	if !ok || server.path != "server" {
+		t.Fatalf("replicator.Server = %+v, want the path server", server)
+	}
+	if !strings.Contains(" "+strings.Join(server.options, " ")+" ", " private_key_file ") {
+		t.Errorf("the options of server %q miss private_key_file", server.options)
+	}
+	for _, option := range server.options {
+		if option == "private_key" || option == "-" {
+			t.Errorf("the options of server have %q", option)
+		}
+	}
+}
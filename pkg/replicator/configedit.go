@@ -0,0 +1,131 @@
+package replicator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SetServerCredentials sets the username and password of the server database
+// in the config file, keeping its comments and layout. A config reading the
+// password from password_secret or password_env is left to the user.
+func SetServerCredentials(file, username, password string) error {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(raw), "\n")
+	start, end, indent, err := yamlBlock(lines, 0, len(lines), "server")
+	if err == nil {
+		start, end, indent, err = yamlBlock(lines, start, end, "db")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	usernameLine, passwordLine := -1, -1
+	for i := start; i < end; i++ {
+		if lineIndent(lines[i]) != indent {
+			continue
+		}
+		switch yamlKey(lines[i]) {
+		case "username":
+			usernameLine = i
+		case "password":
+			passwordLine = i
+		case "password_secret", "password_env":
+			return fmt.Errorf("%s: server.db reads its password from %s, update it by hand", file, yamlKey(lines[i]))
+		}
+	}
+
+	prefix := strings.Repeat(" ", indent)
+	set := func(line int, key, value string) int {
+		entry := prefix + key + ": " + strconv.Quote(value)
+		if line >= 0 {
+			lines[line] = entry
+			return line
+		}
+		at := end
+		if usernameLine >= 0 {
+			at = usernameLine + 1
+		}
+		lines = append(lines[:at], append([]string{entry}, lines[at:]...)...)
+		end++
+		return at
+	}
+	usernameLine = set(usernameLine, "username", username)
+	set(passwordLine, "password", password)
+
+	// The password is written with the permissions of the file, through a
+	// temp file renamed over it so an interruption doesn't truncate it.
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// yamlBlock finds key among the mappings of lines[start:end] at the lowest
+// indentation and returns the lines of its value and their indentation.
+func yamlBlock(lines []string, start, end int, key string) (int, int, int, error) {
+	indent := -1
+	for i := start; i < end; i++ {
+		if yamlKey(lines[i]) == "" {
+			continue
+		}
+		if indent < 0 {
+			indent = lineIndent(lines[i])
+		}
+		if lineIndent(lines[i]) != indent || yamlKey(lines[i]) != key {
+			continue
+		}
+		if value := strings.TrimSpace(strings.SplitN(lines[i], ":", 2)[1]); value != "" && !strings.HasPrefix(value, "#") {
+			return 0, 0, 0, fmt.Errorf("%s isn't a block mapping", key)
+		}
+
+		blockEnd, childIndent := end, -1
+		for j := i + 1; j < end; j++ {
+			if yamlKey(lines[j]) == "" {
+				continue
+			}
+			if lineIndent(lines[j]) <= indent {
+				blockEnd = j
+				break
+			}
+			if childIndent < 0 {
+				childIndent = lineIndent(lines[j])
+			}
+		}
+		if childIndent < 0 {
+			return 0, 0, 0, fmt.Errorf("%s is empty", key)
+		}
+		// The entries added at the end of the block go before the blank and
+		// comment lines ending it.
+		for blockEnd > i+1 && yamlKey(lines[blockEnd-1]) == "" {
+			blockEnd--
+		}
+		return i + 1, blockEnd, childIndent, nil
+	}
+	return 0, 0, 0, fmt.Errorf("no %s section", key)
+}
+
+// yamlKey returns the key of a mapping entry line, or "" for blank and
+// comment lines.
+func yamlKey(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || !strings.Contains(trimmed, ":") {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(trimmed, ":", 2)[0])
+}
+
+func lineIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
@@ -0,0 +1,85 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// databaseInfoLister is implemented by the engines able to list the databases
+// of a server with their size.
+type databaseInfoLister interface {
+	// DatabaseListCommand returns the command printing the databases of the
+	// server of db as name|bytes|last activity lines, the size and the last
+	// activity being empty when unknown.
+	DatabaseListCommand(db DB) string
+}
+
+// DatabaseInfo is a database of the server, as listed by ListDatabases.
+type DatabaseInfo struct {
+	Name string
+	// Bytes is the size of the database, -1 if the user can't read it.
+	Bytes int64
+	// LastActivity is when the database was last used as far as the server
+	// knows, empty if it doesn't.
+	LastActivity string
+	// Configured is set for the server database of the config.
+	Configured bool
+}
+
+// ListDatabases connects to the server and lists the databases of the server
+// of the server database, for `rep list` to help pick the database of the
+// config.
+func (r *Replicator) ListDatabases(ctx context.Context) ([]DatabaseInfo, error) {
+	if err := r.checkEngine(); err != nil {
+		return nil, err
+	}
+	lister, ok := r.Engine.(databaseInfoLister)
+	if !ok {
+		return nil, errors.New("the database engine can't list the databases")
+	}
+	if r.config.Server.Mode == "direct" {
+		return nil, errors.New("the databases are listed through SSH, which the direct mode doesn't use")
+	}
+	if err := r.resolveSecrets(ctx); err != nil {
+		return nil, err
+	}
+	if !r.connected {
+		if err := r.Connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	defer r.Cleanup(ctx)
+	if err := r.storeServerPassword(ctx); err != nil {
+		return nil, err
+	}
+
+	r.printStep("List databases in %s", r.config.Server.Host)
+	var out string
+	err := r.withRemote(ctx, "Listing databases", func() error {
+		var err error
+		out, err = r.Remote.Output(ctx, lister.DatabaseListCommand(r.config.Server.DB))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var databases []DatabaseInfo
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		// The name of the database may hold a |, the size and the time
+		// can't.
+		n := len(fields)
+		info := DatabaseInfo{Name: strings.Join(fields[:n-2], "|"), Bytes: -1, LastActivity: fields[n-1]}
+		info.Configured = info.Name == r.config.Server.DB.Database
+		if bytes, err := strconv.ParseInt(fields[n-2], 10, 64); err == nil {
+			info.Bytes = bytes
+		}
+		databases = append(databases, info)
+	}
+	return databases, nil
+}
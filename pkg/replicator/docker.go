@@ -0,0 +1,100 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// DockerExecutor runs the local commands in a local Docker container with
+// docker exec, for a local database running in Docker, and stores the
+// transferred files in the container. The commands run with sh, the images
+// of the databases don't all have bash.
+type DockerExecutor struct {
+	Container string
+}
+
+func NewDockerExecutor(container string) *DockerExecutor {
+	return &DockerExecutor{Container: container}
+}
+
+// Connect checks the container is running.
+func (e *DockerExecutor) Connect(ctx context.Context) error {
+	out, err := e.docker(ctx, "inspect", "--format", "{{.State.Running}}", e.Container)
+	if err != nil {
+		return permanent(err)
+	}
+	if strings.TrimSpace(out) != "true" {
+		return permanent(fmt.Errorf("Docker container %s isn't running", e.Container))
+	}
+	return nil
+}
+
+func (e *DockerExecutor) Close() error {
+	return nil
+}
+
+func (e *DockerExecutor) Run(ctx context.Context, cmd string) error {
+	_, err := e.Output(ctx, cmd)
+	return err
+}
+
+func (e *DockerExecutor) Output(ctx context.Context, cmd string) (string, error) {
+	return e.docker(ctx, "exec", e.Container, "sh", "-c", cmd)
+}
+
+func (e *DockerExecutor) ReceivedSize(ctx context.Context, name string) (int64, error) {
+	out, err := e.Output(ctx, fmt.Sprintf("if test -f %s; then wc -c < %s; else echo 0; fi", name, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+func (e *DockerExecutor) Append(ctx context.Context, name string) (io.WriteCloser, error) {
+	cmd := exec.CommandContext(ctx, "docker", "exec", "-i", e.Container, "sh", "-c", fmt.Sprintf("umask 077 && cat >> %s", name))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	w := &dockerWriter{WriteCloser: stdin, cmd: cmd}
+	cmd.Stderr = &w.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, permanent(err)
+	}
+	return w, nil
+}
+
+// dockerWriter writes to the stdin of docker exec, closing it waits for the
+// command to complete.
+type dockerWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+func (w *dockerWriter) Close() error {
+	w.WriteCloser.Close()
+	if err := w.cmd.Wait(); err != nil {
+		return withStderr(err, w.stderr.String())
+	}
+	return nil
+}
+
+// docker runs the docker CLI with args and returns its output.
+func (e *DockerExecutor) docker(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", permanent(ctx.Err())
+		}
+		return "", withStderr(err, stderr.String())
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,66 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// dockerRemote runs the commands of the server in a Docker container of the
+// server, wrapping them in docker exec over the SSH connection.
+type dockerRemote struct {
+	*SSHExecutor
+	container string
+}
+
+func newDockerRemote(server *SSHExecutor, container string) *dockerRemote {
+	return &dockerRemote{SSHExecutor: server, container: container}
+}
+
+// wrap returns the command running cmd in the container, with its stdin
+// attached if stdin is set.
+func (e *dockerRemote) wrap(cmd string, stdin bool) string {
+	options := ""
+	if stdin {
+		options = "-i "
+	}
+	return fmt.Sprintf("docker exec %s%s sh -c %s", options, shellQuote(e.container), shellQuote(cmd))
+}
+
+func (e *dockerRemote) Run(ctx context.Context, cmd string) error {
+	return e.SSHExecutor.Run(ctx, e.wrap(cmd, false))
+}
+
+func (e *dockerRemote) Output(ctx context.Context, cmd string) (string, error) {
+	return e.SSHExecutor.Output(ctx, e.wrap(cmd, false))
+}
+
+func (e *dockerRemote) Pipe(ctx context.Context, cmd string, in io.Reader, out io.Writer) error {
+	return e.SSHExecutor.Pipe(ctx, e.wrap(cmd, in != nil), in, out)
+}
+
+func (e *dockerRemote) Size(ctx context.Context, remote string) (int64, error) {
+	out, err := e.Output(ctx, fmt.Sprintf("wc -c < %s", remote))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+func (e *dockerRemote) CopyFrom(ctx context.Context, remote string, offset int64, w io.Writer) error {
+	return e.streamFrom(ctx, e.wrap(fmt.Sprintf("tail -c +%d %s", offset+1, remote), false), w)
+}
+
+func (e *dockerRemote) ReceivedSize(ctx context.Context, name string) (int64, error) {
+	out, err := e.Output(ctx, fmt.Sprintf("if test -f %s; then wc -c < %s; else echo 0; fi", name, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+func (e *dockerRemote) Append(ctx context.Context, name string) (io.WriteCloser, error) {
+	return e.streamTo(e.wrap(fmt.Sprintf("umask 077 && cat >> %s", name), true))
+}
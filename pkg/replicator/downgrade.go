@@ -0,0 +1,106 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// downgradeEngine is implemented by the engines able to restore a dump into
+// a local server older than the server database, by rewriting a plain SQL
+// dump for it on a best-effort basis.
+type downgradeEngine interface {
+	versionChecker
+	// PlainDump returns db with the dump options dumping in plain SQL.
+	PlainDump(db DB) DB
+	// DowngradeDump rewrites the plain dump in for a server of the major
+	// version, as returned by MajorVersion, into out. It reports what it
+	// changed or dropped, and what it left that the server may reject.
+	DowngradeDump(in, out string, major int) (changed, left []string, err error)
+}
+
+// checkDowngrade reads the version of the local server when Downgrade is
+// set, for Restore to rewrite the dump for it.
+func (r *Replicator) checkDowngrade(ctx context.Context) error {
+	if !r.Downgrade {
+		return nil
+	}
+	engine, ok := r.Engine.(downgradeEngine)
+	switch {
+	case !ok:
+		return errors.New("the database engine can't rewrite a dump for an older local server")
+	case r.target != nil:
+		return errors.New("a target server or container can't be used with a dump rewritten for an older server")
+	case r.useDriver:
+		return errors.New("the dump is rewritten for an older server with the local client tools, which are missing")
+	case len(r.config.RoleMap) > 0:
+		return errors.New("the role_map can't read a dump rewritten for an older server")
+	}
+
+	out, err := r.Local.Output(ctx, engine.ServerVersionCommand(r.config.LocalDB))
+	if err != nil {
+		return fmt.Errorf("getting the version of the local server failed: %v", err)
+	}
+	major, ok := engine.MajorVersion(firstLine(out))
+	if !ok {
+		return fmt.Errorf("unknown version of the local server %q", firstLine(out))
+	}
+	r.localMajor = major
+	fmt.Fprintf(r.Output, "   Local server %s, the dump is rewritten for it\n", firstLine(out))
+	return nil
+}
+
+// plainDump reports whether the dump is made in plain SQL, for the built-in
+// client, to be rewritten for an older server, or for format: plain.
+func (r *Replicator) plainDump() bool {
+	return r.useDriver || r.Downgrade || r.plainFormat()
+}
+
+// dumpDB returns the database config the dump tool runs with.
+func (r *Replicator) dumpDB(db DB) DB {
+	if excluder, ok := r.Engine.(tableDataExcluder); ok && len(r.config.Tables.SchemaOnly) > 0 {
+		db.DumpOptions = append(append([]string{}, db.DumpOptions...), excluder.ExcludeTableDataOptions(r.config.Tables.SchemaOnly)...)
+	}
+	if r.useDriver {
+		return r.Engine.(driverEngine).PlainDump(db)
+	}
+	if r.Downgrade {
+		return r.Engine.(downgradeEngine).PlainDump(db)
+	}
+	if r.plainFormat() {
+		return r.Engine.(plainFormatter).CompressedPlainDump(db)
+	}
+	return db
+}
+
+// restoreDowngraded rewrites the plain dump for the local server, reporting
+// the changes, and restores it as a script.
+func (r *Replicator) restoreDowngraded(ctx context.Context, database string) error {
+	engine := r.Engine.(downgradeEngine)
+	rewritten := r.localDumpPath() + ".sql"
+	r.printStep("Rewrite %s for the local server to %s", r.localDumpFile, rewritten)
+	defer func() {
+		if err := os.Remove(rewritten); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(r.Output, "   Removing %s failed: %v\n", rewritten, err)
+		}
+	}()
+	changed, left, err := engine.DowngradeDump(r.localDumpFile, rewritten, r.localMajor)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		fmt.Fprintf(r.Output, "   Nothing to rewrite\n")
+	}
+	for _, change := range changed {
+		fmt.Fprintf(r.Output, "   Rewrote: %s\n", change)
+	}
+	for _, unsupported := range left {
+		fmt.Fprintf(r.Output, "   !!! Left as is, the restore may fail: %s\n", unsupported)
+	}
+
+	r.printStep("Restoring %s to database %s", rewritten, database)
+	cmd := r.Engine.ScriptCommand(r.config.LocalDB, database, rewritten)
+	r.recordCommand(r.localWhere(), cmd, "")
+	return r.Local.Run(ctx, cmd)
+}
@@ -0,0 +1,62 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// driverEngine is implemented by the engines able to restore without the
+// local client tools, speaking the protocol of the database themselves. When
+// the tools are missing, the dump is made in a plain SQL format, which the
+// engine can restore statement by statement.
+type driverEngine interface {
+	// ClientToolsCommand returns the local command failing when a client
+	// tool is missing.
+	ClientToolsCommand(db DB) string
+	// PlainDump returns db with the dump options dumping in plain SQL.
+	PlainDump(db DB) DB
+	// DriverLimitations describes what the restore without the tools can't
+	// do.
+	DriverLimitations() string
+	// DriverScript runs script in database. Errors of the statements are
+	// permanent, connection errors are not.
+	DriverScript(ctx context.Context, db DB, database, script string) error
+	// DriverDatabases lists the databases, connected to database.
+	DriverDatabases(ctx context.Context, db DB, database string) ([]string, error)
+	// DriverRestore restores the plain dump fileName into database.
+	DriverRestore(ctx context.Context, db DB, database, fileName string) error
+}
+
+// checkClientTools falls back to restoring with the engine itself when the
+// local client tools are missing, rather than failing.
+func (r *Replicator) checkClientTools(ctx context.Context) error {
+	engine, ok := r.Engine.(driverEngine)
+	if !ok || r.target != nil {
+		return nil
+	}
+	if _, err := r.Local.Output(ctx, engine.ClientToolsCommand(r.config.LocalDB)); err == nil {
+		return nil
+	}
+
+	switch {
+	case r.config.Server.Mode == "direct":
+		return errors.New("the direct mode dumps with the local client tools, which are missing")
+	case r.config.Backup.Mode == "dump":
+		return errors.New("the dump backup mode dumps with the local client tools, which are missing")
+	case len(r.config.RoleMap) > 0:
+		return errors.New("the role_map reads the dump with the local client tools, which are missing")
+	}
+	fmt.Fprintf(r.Output, "   !!! The local client tools are missing, restoring with the built-in client\n")
+	fmt.Fprintf(r.Output, "   %s\n", engine.DriverLimitations())
+	r.useDriver = true
+	return nil
+}
+
+// runDriverScript runs script with the engine, the runScript of useDriver.
+func (r *Replicator) runDriverScript(ctx context.Context, database, script string) error {
+	r.recordCommand(r.localWhere(), "(built-in client) "+database, script)
+	return r.retry(ctx, "Connecting to local database", func(attempt int) error {
+		return r.Engine.(driverEngine).DriverScript(ctx, r.config.LocalDB, database, script)
+	})
+}
@@ -0,0 +1,50 @@
+package replicator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dscpNames are the DSCP code points Server.DSCP accepts by name, besides a
+// number from 0 to 63.
+var dscpNames = map[string]int{
+	"le":  1,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+}
+
+// parseDSCP returns the DSCP code point named or numbered by s.
+func parseDSCP(s string) (int, error) {
+	if dscp, ok := dscpNames[strings.ToLower(s)]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.Atoi(s)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("invalid dscp %q, expected a name such as cs1 or a number from 0 to 63", s)
+	}
+	return dscp, nil
+}
+
+// dscpControl returns the dialer control marking the packets of the
+// connection with dscp, in the traffic class of IPv6 or the TOS of IPv4.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			err = setTrafficClass(fd, strings.HasSuffix(network, "6"), dscp<<2)
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		if err != nil {
+			return fmt.Errorf("marking the connection with dscp %d failed: %v", dscp, err)
+		}
+		return nil
+	}
+}
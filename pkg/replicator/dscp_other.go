@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package replicator
+
+import "errors"
+
+func setTrafficClass(fd uintptr, ipv6 bool, class int) error {
+	return errors.New("only supported on Linux and macOS")
+}
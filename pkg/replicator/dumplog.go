@@ -0,0 +1,124 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dumpLogTail is how many lines of the dump log a failed dump reports.
+const dumpLogTail = 20
+
+// verboseDumper is implemented by the engines whose dump tool can log its
+// progress, which the dump on the server writes to a log file next to the
+// dump.
+type verboseDumper interface {
+	// VerboseDumpCommand returns DumpCommand logging to stderr.
+	VerboseDumpCommand(db DB, fileName string) string
+}
+
+// remotePiper is implemented by the RemoteExecutors able to stream the
+// output of a command, such as the SSHExecutor.
+type remotePiper interface {
+	Pipe(ctx context.Context, cmd string, in io.Reader, out io.Writer) error
+}
+
+// DefaultLogDir is where the logs of failed server commands are copied by
+// default, ~/.rep/logs.
+func DefaultLogDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".rep", "logs")
+}
+
+// loggedDumpCommand returns the command dumping to dumpFile on the server
+// with its log written to logFile, and with ShowRemoteLogs or Verbose also
+// to its output.
+func (r *Replicator) loggedDumpCommand(engine verboseDumper, db DB, dumpFile, logFile string) string {
+	cmd := engine.VerboseDumpCommand(db, dumpFile)
+	if !r.ShowRemoteLogs && !r.Verbose {
+		return fmt.Sprintf("{ %s; } 2> %s", cmd, logFile)
+	}
+	return "bash -o pipefail -c " + shellQuote(fmt.Sprintf("{ %s; } 2>&1 | tee %s", cmd, logFile))
+}
+
+// runLoggedDump runs the dump command of loggedDumpCommand, streaming its
+// log with ShowRemoteLogs or Verbose. If it fails, the end of the log is added to the
+// error and the whole log is copied to LogDir.
+func (r *Replicator) runLoggedDump(ctx context.Context, cmd, logFile string) error {
+	var err error
+	piper, ok := r.Remote.(remotePiper)
+	if (r.ShowRemoteLogs || r.Verbose) && ok {
+		err = piper.Pipe(ctx, cmd, nil, &linePrefixWriter{w: r.Output, prefix: "   remote: "})
+	} else {
+		err = r.Remote.Run(ctx, cmd)
+	}
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	// The connection may be gone, the log is then only left on the server.
+	tail, tailErr := r.Remote.Output(ctx, fmt.Sprintf("tail -n %d %s", dumpLogTail, logFile))
+	if tailErr != nil {
+		return err
+	}
+	r.copyLog(ctx, logFile)
+	if tail = strings.TrimSpace(tail); tail != "" {
+		err = fmt.Errorf("%w, end of %s:\n%s", err, logFile, tail)
+	}
+	return err
+}
+
+// copyLog copies the log file of the server to LogDir. It only helps the
+// diagnosis, so a failure is only reported.
+func (r *Replicator) copyLog(ctx context.Context, logFile string) {
+	if r.LogDir == "" {
+		return
+	}
+	local := filepath.Join(r.LogDir, filepath.Base(logFile))
+	err := os.MkdirAll(r.LogDir, 0700)
+	if err == nil {
+		var log bytes.Buffer
+		if err = r.Transferrer.CopyFrom(ctx, logFile, 0, &log); err == nil {
+			err = ioutil.WriteFile(local, log.Bytes(), 0600)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Copying %s failed: %v\n", logFile, err)
+		return
+	}
+	fmt.Fprintf(r.Output, "   Dump log copied to %s\n", local)
+}
+
+// linePrefixWriter writes each line with prefix, for output interleaved
+// with the steps.
+type linePrefixWriter struct {
+	w       io.Writer
+	prefix  string
+	midLine bool
+}
+
+func (p *linePrefixWriter) Write(b []byte) (int, error) {
+	var out bytes.Buffer
+	for _, c := range b {
+		if !p.midLine {
+			out.WriteString(p.prefix)
+			p.midLine = true
+		}
+		out.WriteByte(c)
+		if c == '\n' {
+			p.midLine = false
+		}
+	}
+	if _, err := p.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,137 @@
+package replicator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ProgressSink receives the progress of a run, for applications embedding
+// the replicator to show it in their own UI.
+type ProgressSink interface {
+	// Step is called as a step starts, numbered from 1.
+	Step(n int, title string)
+	// Bytes is called as the step copies the dump, with the bytes copied so
+	// far and the total, zero when unknown. It is called often and must
+	// return quickly.
+	Bytes(copied, total int64)
+}
+
+// ProgressWriter is the default ProgressSink, writing the steps to W as
+// numbered lines. The copied bytes are left to the heartbeat lines.
+type ProgressWriter struct {
+	W io.Writer
+}
+
+func (p ProgressWriter) Step(n int, title string) {
+	fmt.Fprintf(p.W, "%d. %s\n", n, title)
+}
+
+func (ProgressWriter) Bytes(copied, total int64) {}
+
+// Command writes cmd and the lines of script indented below the step.
+func (p ProgressWriter) Command(cmd, script string) {
+	fmt.Fprintf(p.W, "   $ %s\n", cmd)
+	for _, line := range strings.Split(strings.TrimSpace(script), "\n") {
+		if line != "" {
+			fmt.Fprintf(p.W, "   > %s\n", line)
+		}
+	}
+}
+
+// CommandLogger is implemented by the ProgressSinks also told the commands
+// run with Verbose.
+type CommandLogger interface {
+	// Command is called as a command runs, with the script it runs, if
+	// any, the passwords redacted.
+	Command(cmd, script string)
+}
+
+// ProgressEstimator is implemented by the ProgressSinks also told how long
+// a step copying no bytes, such as the restore, took in the previous run.
+type ProgressEstimator interface {
+	// Estimate is called after Step when the previous run measured it.
+	Estimate(took time.Duration)
+}
+
+// Prompter asks the user to confirm the decisions a run can't make alone,
+// such as rolling back after the post swap check failed.
+type Prompter interface {
+	// Confirm asks question and reports whether the user agreed, false if
+	// ctx is done first.
+	Confirm(ctx context.Context, question string) bool
+}
+
+// NoPrompter is the default Prompter, for runs without a user to ask: it
+// declines.
+type NoPrompter struct{}
+
+func (NoPrompter) Confirm(ctx context.Context, question string) bool {
+	return false
+}
+
+// TerminalPrompter asks on a terminal, writing the question to Out and
+// reading a y or yes from In.
+type TerminalPrompter struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+func (p TerminalPrompter) Confirm(ctx context.Context, question string) bool {
+	fmt.Fprintf(p.Out, "%s [y/N] ", question)
+	answers := make(chan string, 1)
+	go func() {
+		answer, _ := bufio.NewReader(p.In).ReadString('\n')
+		answers <- answer
+	}()
+	select {
+	case answer := <-answers:
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	case <-ctx.Done():
+		fmt.Fprintln(p.Out)
+		return false
+	}
+}
+
+// SecretResolver gives the passwords of the databases, for applications
+// embedding the replicator with their own secret sources.
+type SecretResolver interface {
+	// Password returns the password of db, its Password if it has no other
+	// source.
+	Password(ctx context.Context, db DB) (string, error)
+	// PrivateKey returns the SSH private key of server in PEM, empty to read
+	// its PrivateKeyFile.
+	PrivateKey(ctx context.Context, server Server) (string, error)
+}
+
+// ConfigSecrets is the default SecretResolver, reading the password from
+// the environment variable of password_env or the secret backend of
+// password_secret, and the private key from the secret backend of
+// private_key_secret.
+type ConfigSecrets struct{}
+
+func (ConfigSecrets) Password(ctx context.Context, db DB) (string, error) {
+	if db.PasswordEnv != "" {
+		password, ok := os.LookupEnv(db.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s of the password isn't set", db.PasswordEnv)
+		}
+		return password, nil
+	}
+	if db.PasswordSecret != "" {
+		return resolveSecret(ctx, db.PasswordSecret)
+	}
+	return db.Password, nil
+}
+
+func (ConfigSecrets) PrivateKey(ctx context.Context, server Server) (string, error) {
+	if server.PrivateKeySecret == "" {
+		return "", nil
+	}
+	return resolveSecret(ctx, server.PrivateKeySecret)
+}
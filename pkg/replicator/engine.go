@@ -0,0 +1,196 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Engine builds the commands and scripts of a database engine, the
+// Replicator runs them with its executors. Scripts are the statements the
+// client of the engine runs, SQL for Postgres and MySQL and JavaScript for
+// MongoDB.
+type Engine interface {
+	// DumpCommand returns the command dumping db into fileName on the
+	// server.
+	DumpCommand(db DB, fileName string) string
+	// RestoreCommand returns the local command restoring fileName into
+	// database.
+	RestoreCommand(db DB, database, fileName string) string
+	// ScriptCommand returns the local command running the script file
+	// fileName against database, stopping at the first error.
+	ScriptCommand(db DB, database, fileName string) string
+	// IsConnectionError reports whether a local command failed to reach the
+	// server, in which case no statement ran and it can be retried.
+	IsConnectionError(err error) bool
+	// PingScript returns a script that only succeeds if the database is
+	// reachable.
+	PingScript() string
+	CreateDatabaseScript(database string) string
+	DropDatabaseScript(database string) string
+	// SwapScripts returns the scripts moving target, if it exists, to the
+	// new database backup and restored to target, each run on its own. A
+	// failure must leave target as it was.
+	SwapScripts(restored, target, backup string) []string
+}
+
+// disconnecter is implemented by the engines able to end the sessions
+// connected to a local database, which would prevent replacing it.
+type disconnecter interface {
+	// DisconnectScript returns the script ending the sessions connected to
+	// database, other than its own.
+	DisconnectScript(database string) string
+}
+
+// databaseSettings is the database-level state missing from a dump.
+type databaseSettings interface {
+	// SQL returns the statements applying the settings to database.
+	SQL(database string) string
+}
+
+// databaseCreator is implemented by the settings that must be given when
+// creating the database, such as its encoding.
+type databaseCreator interface {
+	CreateDatabaseScript(database string) string
+}
+
+// settingsCapturer is implemented by the engines whose dumps don't include
+// database-level settings. The client runs with exec, on the server or
+// locally in direct mode.
+type settingsCapturer interface {
+	CaptureSettings(ctx context.Context, exec outputExecutor, db DB) (databaseSettings, error)
+}
+
+var engines = map[string]Engine{
+	"":         postgresEngine{},
+	"postgres": postgresEngine{},
+	"mysql":    mysqlEngine{},
+	"mariadb":  mysqlEngine{},
+	"mongodb":  mongoEngine{},
+	"mongo":    mongoEngine{},
+}
+
+var enginesMu sync.Mutex
+
+// RegisterEngine makes engine available to the config under name, replacing
+// the engine registered under the same name if any.
+func RegisterEngine(name string, engine Engine) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	engines[name] = engine
+}
+
+// engineFor falls back to the exec plugin rep-engine-<name>, kept so the
+// server and local engines compare equal.
+func engineFor(name string) (Engine, error) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	engine, ok := engines[name]
+	if ok {
+		return engine, nil
+	}
+	if path, ok := findPlugin("engine", name); ok {
+		engine = &execEngine{path: path}
+		engines[name] = engine
+		return engine, nil
+	}
+	return nil, fmt.Errorf("unknown database engine %q", name)
+}
+
+// runClient runs a client command against the local server, retrying only
+// when it could not connect.
+func (r *Replicator) runClient(ctx context.Context, runCmd string) error {
+	return r.retry(ctx, "Connecting to local database", func(attempt int) error {
+		err := r.Local.Run(ctx, runCmd)
+		if err != nil && !r.Engine.IsConnectionError(err) {
+			return permanent(err)
+		}
+		return err
+	})
+}
+
+// scriptDelimiter ends the here-document holding a script.
+const scriptDelimiter = "REP_SCRIPT_END"
+
+// runScript runs script against database through a temporary file, written
+// by the command itself with a here-document so it works the same on the
+// target server. The last statement doesn't need to be terminated.
+func (r *Replicator) runScript(ctx context.Context, database, script string) error {
+	if r.useDriver {
+		return r.runDriverScript(ctx, database, script)
+	}
+	script = terminateScript(script)
+
+	if _, ok := r.Local.(NoShellExecutor); ok {
+		return r.runScriptFile(ctx, database, script)
+	}
+	scriptCmd := r.Engine.ScriptCommand(r.config.LocalDB, database, `"$script"`)
+	r.recordCommand(r.localWhere(), scriptCmd, script)
+	cmd := fmt.Sprintf(
+		"umask 077 && script=$(mktemp \"${TMPDIR:-/tmp}/rep_XXXXXX\") && cat > \"$script\" <<'%s'\n%s%s\n"+
+			"%s; status=$?; rm -f \"$script\"; exit $status",
+		scriptDelimiter,
+		script,
+		scriptDelimiter,
+		scriptCmd,
+	)
+	return r.runClient(ctx, cmd)
+}
+
+// terminateScript terminates the last statement and line of script.
+func terminateScript(script string) string {
+	if !strings.HasSuffix(strings.TrimSpace(script), ";") {
+		script += ";\n"
+	}
+	if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+	return script
+}
+
+// runPrivateScript runs script, holding a password, like runScript, but
+// writes it to the temporary file through the Receiver, as the here-document
+// of runScript is in the arguments of the shell, which any user can list.
+func (r *Replicator) runPrivateScript(ctx context.Context, database, script string) error {
+	if _, ok := r.Local.(NoShellExecutor); ok || r.useDriver {
+		return r.runScript(ctx, database, script)
+	}
+	out, err := r.Local.Output(ctx, mktempCommand("", "rep_"))
+	if err != nil {
+		return err
+	}
+	file := strings.TrimSpace(out)
+	defer r.Local.Run(ctx, fmt.Sprintf("rm -f %s", file))
+
+	w, err := r.Receiver.Append(ctx, file)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, terminateScript(script))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	scriptCmd := r.Engine.ScriptCommand(r.config.LocalDB, database, file)
+	r.recordCommand(r.localWhere(), scriptCmd, script)
+	return r.runClient(ctx, scriptCmd)
+}
+
+// runScriptFile runs script against database with the NoShellExecutor,
+// writing the temporary file itself.
+func (r *Replicator) runScriptFile(ctx context.Context, database, script string) error {
+	file, err := writeLocalTempFile("rep_", script)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+
+	scriptCmd := r.Engine.ScriptCommand(r.config.LocalDB, database, shellQuote(file))
+	r.recordCommand(r.localWhere(), scriptCmd, script)
+	return r.runClient(ctx, scriptCmd)
+}
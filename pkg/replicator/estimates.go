@@ -0,0 +1,200 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tableSizer is implemented by the engines able to list the sizes of the
+// tables of a database, for the estimates of the run.
+type tableSizer interface {
+	// TableSizesCommand returns the command printing the tables of db and
+	// their size in bytes, as table|size lines.
+	TableSizesCommand(db DB) string
+}
+
+// runStats is what the previous runs measured for a server database, kept
+// in ~/.rep/stats.json to estimate the next ones.
+type runStats struct {
+	// TableBytes is the size of the tables when last dumped.
+	TableBytes int64 `json:"table_bytes"`
+	// DumpBytes and Transfer are the size of the last transferred dump and
+	// how long its transfer took.
+	DumpBytes int64         `json:"dump_bytes"`
+	Transfer  time.Duration `json:"transfer"`
+	// Restore is how long the last restore took.
+	Restore time.Duration `json:"restore"`
+	Updated time.Time     `json:"updated"`
+}
+
+var statsMu sync.Mutex
+
+// statsFile returns ~/.rep/stats.json, or empty without a home directory.
+func statsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".rep", "stats.json")
+}
+
+// statsID identifies the server database in stats.json.
+func (r *Replicator) statsID() string {
+	server := r.config.Server
+	return fmt.Sprintf("%s:%d/%s", server.Host, server.Port, server.DB.Database)
+}
+
+// readStats returns the stats of stats.json, none if it can't be read.
+func readStats() map[string]runStats {
+	stats := map[string]runStats{}
+	file := statsFile()
+	if file == "" {
+		return stats
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return stats
+	}
+	json.Unmarshal(raw, &stats)
+	return stats
+}
+
+// updateStats records a measure of the run with update. The stats only
+// serve the estimates, so a failure to write them is ignored.
+func (r *Replicator) updateStats(update func(stats *runStats)) {
+	file := statsFile()
+	if file == "" {
+		return
+	}
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	all := readStats()
+	stats := all[r.statsID()]
+	update(&stats)
+	stats.Updated = time.Now()
+	all[r.statsID()] = stats
+	raw, err := json.MarshalIndent(all, "", "  ")
+	if err != nil || os.MkdirAll(filepath.Dir(file), 0700) != nil {
+		return
+	}
+	// Written then renamed, so concurrent runs never read a partial file.
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	if ioutil.WriteFile(tmp, append(raw, '\n'), 0600) != nil {
+		return
+	}
+	if os.Rename(tmp, file) != nil {
+		os.Remove(tmp)
+	}
+}
+
+// recordTransfer records the size of the transferred file and how long the
+// transfer took, a failure to read the size only leaving it out.
+func (r *Replicator) recordTransfer(ctx context.Context, name string, took time.Duration) {
+	var size int64
+	if r.target != nil {
+		out, err := r.target.Output(ctx, fmt.Sprintf("wc -c < %s", name))
+		if err != nil {
+			return
+		}
+		if size, err = strconv.ParseInt(strings.TrimSpace(out), 10, 64); err != nil {
+			return
+		}
+	} else {
+		info, err := os.Stat(name)
+		if err != nil {
+			return
+		}
+		size = info.Size()
+	}
+	r.result.DumpBytes = size
+	r.updateStats(func(stats *runStats) {
+		stats.DumpBytes = size
+		stats.Transfer = took
+	})
+}
+
+// printEstimates prints the size of the tables of the server database, read
+// with exec, and estimates the size of the dump and the time of its transfer
+// and restore from the previous runs, so users know how long the run takes
+// before it goes on. A failure is only reported. The engine must be a
+// tableSizer.
+func (r *Replicator) printEstimates(ctx context.Context, exec outputExecutor, db DB) {
+	out, err := exec.Output(ctx, r.Engine.(tableSizer).TableSizesCommand(db))
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Getting the sizes of the tables failed: %v\n", err)
+		return
+	}
+
+	type table struct {
+		name string
+		size int64
+	}
+	var tables []table
+	var total, leftOut int64
+	schemaOnly := 0
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		i := strings.LastIndex(line, "|")
+		if i < 0 {
+			continue
+		}
+		size, err := strconv.ParseInt(line[i+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		// The rows of tables.schema_only aren't dumped.
+		if r.schemaOnly(line[:i]) {
+			schemaOnly++
+			leftOut += size
+			continue
+		}
+		tables = append(tables, table{line[:i], size})
+		total += size
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].size > tables[j].size })
+	var largest []string
+	for i := 0; i < len(tables) && i < 3; i++ {
+		largest = append(largest, fmt.Sprintf("%s %s", tables[i].name, FormatSize(tables[i].size)))
+	}
+	fmt.Fprintf(r.Output, "   %d tables, %s", len(tables), FormatSize(total))
+	if len(largest) > 0 {
+		fmt.Fprintf(r.Output, ", the largest %s", strings.Join(largest, ", "))
+	}
+	if schemaOnly > 0 {
+		fmt.Fprintf(r.Output, ", and %d schema only tables leaving out %s", schemaOnly, FormatSize(leftOut))
+	}
+	fmt.Fprintln(r.Output)
+
+	previous, ok := readStats()[r.statsID()]
+	r.updateStats(func(stats *runStats) {
+		stats.TableBytes = total
+	})
+	if !ok || previous.TableBytes == 0 || previous.DumpBytes == 0 {
+		fmt.Fprintf(r.Output, "   Estimated dump up to %s, no previous run to estimate the transfer and restore times from\n", FormatSize(total))
+		return
+	}
+
+	// The dump and the restore are assumed to grow with the tables.
+	growth := float64(total) / float64(previous.TableBytes)
+	dump := int64(float64(previous.DumpBytes) * growth)
+	estimate := fmt.Sprintf("   Estimated dump %s", FormatSize(dump))
+	if previous.Transfer > 0 {
+		rate := float64(previous.DumpBytes) / previous.Transfer.Seconds()
+		transfer := time.Duration(float64(dump)/rate) * time.Second
+		estimate += fmt.Sprintf(", transfer %s at %s/s", transfer.Round(time.Second), FormatSize(int64(rate)))
+	}
+	if previous.Restore > 0 {
+		restore := time.Duration(float64(previous.Restore) * growth)
+		estimate += fmt.Sprintf(", restore %s", restore.Round(time.Second))
+	}
+	fmt.Fprintf(r.Output, "%s, from the run of %s\n", estimate, previous.Updated.Format("2006-01-02 15:04"))
+}
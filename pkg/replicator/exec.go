@@ -0,0 +1,89 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandError carries the stderr of a failed command along with its error.
+type commandError struct {
+	err    error
+	stderr string
+}
+
+func (e *commandError) Error() string {
+	if e.stderr == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.err, e.stderr)
+}
+
+func (e *commandError) Unwrap() error { return e.err }
+
+func withStderr(err error, stderr string) error {
+	return &commandError{err: err, stderr: strings.TrimSpace(stderr)}
+}
+
+// shellQuote quotes s as a single word for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// mktempCommand creates a private temp file named prefix and a random
+// suffix in dir, or in $TMPDIR or /tmp if empty, printing its path.
+func mktempCommand(dir, prefix string) string {
+	if dir == "" {
+		return fmt.Sprintf(`umask 077 && mktemp "${TMPDIR:-/tmp}/%sXXXXXX"`, prefix)
+	}
+	return fmt.Sprintf("umask 077 && mktemp %s", shellQuote(dir+"/"+prefix+"XXXXXX"))
+}
+
+// shellArgs quotes each of args for the shell, with a leading space if any.
+func shellArgs(args []string) string {
+	var quoted strings.Builder
+	for _, arg := range args {
+		quoted.WriteString(" " + shellQuote(arg))
+	}
+	return quoted.String()
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ShellExecutor is the LocalExecutor running commands with a shell.
+type ShellExecutor struct {
+	// Shell is the shell running the commands, bash by default.
+	Shell string
+}
+
+func (e ShellExecutor) Run(ctx context.Context, runCmd string) error {
+	_, err := e.Output(ctx, runCmd)
+	return err
+}
+
+func (e ShellExecutor) Output(ctx context.Context, runCmd string) (string, error) {
+	shell := e.Shell
+	if shell == "" {
+		shell = "bash"
+	}
+	cmd := exec.CommandContext(ctx, shell, "-c", runCmd)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", permanent(ctx.Err())
+		}
+		return "", withStderr(err, stderr.String())
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,57 @@
+package replicator
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// RemoteExecutor runs shell commands on the server.
+type RemoteExecutor interface {
+	// Connect opens the connection to the server, replacing the previous
+	// one unless it is still alive. It is called again to recover from
+	// transient failures.
+	Connect(ctx context.Context) error
+	Run(ctx context.Context, cmd string) error
+	Output(ctx context.Context, cmd string) (string, error)
+	Close() error
+}
+
+// LocalExecutor runs shell commands on the local machine.
+type LocalExecutor interface {
+	Run(ctx context.Context, cmd string) error
+	Output(ctx context.Context, cmd string) (string, error)
+}
+
+// outputExecutor runs commands either on the server or locally.
+type outputExecutor interface {
+	Output(ctx context.Context, cmd string) (string, error)
+}
+
+// FileTransferrer downloads files from the server. Transfers are made of
+// ranged copies so they can resume where they stopped.
+type FileTransferrer interface {
+	// Size returns the size in bytes of the remote file.
+	Size(ctx context.Context, remote string) (int64, error)
+	// CopyFrom writes the remote file from offset to w, until the end of the
+	// file or ctx is done.
+	CopyFrom(ctx context.Context, remote string, offset int64, w io.Writer) error
+}
+
+// FileReceiver stores the transferred files at their destination, the local
+// machine or the target server.
+type FileReceiver interface {
+	// ReceivedSize returns the size in bytes of name, 0 if it doesn't exist.
+	ReceivedSize(ctx context.Context, name string) (int64, error)
+	// Append opens name to append to it, creating it only readable by its
+	// owner. Closing the writer reports whether everything was stored.
+	Append(ctx context.Context, name string) (io.WriteCloser, error)
+}
+
+// PortForwarder opens local ports forwarded through the server, for the
+// direct mode.
+type PortForwarder interface {
+	// Forward listens on a local port and forwards its connections to addr,
+	// resolved by the server, until the listener is closed.
+	Forward(addr string) (net.Listener, error)
+}
@@ -0,0 +1,114 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envReference matches the ${VAR} references of the config values, $${ being
+// a literal ${.
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// secretURIs are the prefixes of the config values that are references to
+// secrets, resolved by the secret backend of the same name.
+var secretURIs = []string{"aws-sm://", "ssm://"}
+
+// expandConfig replaces the ${VAR} references in the values of the YAML
+// config with the environment variables, and the values that are secret
+// URIs, such as aws-sm://prod/db#password, with the secrets. The config is
+// parsed first so a value can't change its structure. A value that is a
+// number or a boolean once expanded can fill the fields of these types.
+func expandConfig(ctx context.Context, raw []byte) ([]byte, error) {
+	if !bytes.Contains(raw, []byte("${")) && !containsSecretURI(raw) {
+		return raw, nil
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(raw, &tree); err != nil {
+		return nil, err
+	}
+	expanded, err := expandNode(ctx, tree, true)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(expanded)
+}
+
+func containsSecretURI(raw []byte) bool {
+	for _, prefix := range secretURIs {
+		if bytes.Contains(raw, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandNode expands the values of node, the secret URIs only with
+// resolveURIs. The *_secret fields keep theirs, resolved later.
+func expandNode(ctx context.Context, node interface{}, resolveURIs bool) (interface{}, error) {
+	switch node := node.(type) {
+	case map[interface{}]interface{}:
+		for key, value := range node {
+			name, _ := key.(string)
+			expanded, err := expandNode(ctx, value, !strings.HasSuffix(name, "_secret"))
+			if err != nil {
+				return nil, err
+			}
+			node[key] = expanded
+		}
+	case []interface{}:
+		for i, value := range node {
+			expanded, err := expandNode(ctx, value, resolveURIs)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = expanded
+		}
+	case string:
+		expanded, err := expandString(ctx, node, resolveURIs)
+		if err != nil || expanded == node {
+			return node, err
+		}
+		// Only the values written the same way as the number or boolean are
+		// converted, as the string fields get the text of the value back.
+		if n, err := strconv.ParseInt(expanded, 10, 64); err == nil && strconv.FormatInt(n, 10) == expanded {
+			return n, nil
+		}
+		if b, err := strconv.ParseBool(expanded); err == nil && strconv.FormatBool(b) == expanded {
+			return b, nil
+		}
+		return expanded, nil
+	}
+	return node, nil
+}
+
+func expandString(ctx context.Context, s string, resolveURIs bool) (string, error) {
+	var missing string
+	s = envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref[1] == '$' {
+			return ref[1:]
+		}
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s of the config isn't set", missing)
+	}
+
+	for _, prefix := range secretURIs {
+		if resolveURIs && strings.HasPrefix(s, prefix) {
+			return resolveSecret(ctx, s)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,61 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// fakeSecretBackend answers the references with their secret.
+type fakeSecretBackend map[string]string
+
+func (b fakeSecretBackend) Secret(ctx context.Context, ref string) (string, error) {
+	if secret, ok := b[ref]; ok {
+		return secret, nil
+	}
+	return "", fmt.Errorf("no secret %s", ref)
+}
+
+func TestExpandConfig(t *testing.T) {
+	for name, value := range map[string]string{"REP_HOST": "db.example.com", "REP_PORT": "5433", "REP_ZERO": "05", "REP_ON": "true", "REP_QUOTE": "a: b"} {
+		os.Setenv(name, value)
+		name := name
+		t.Cleanup(func() { os.Unsetenv(name) })
+	}
+	RegisterSecretBackend("aws-sm", fakeSecretBackend{"//prod/db#password": "s3cret"})
+	t.Cleanup(func() { RegisterSecretBackend("aws-sm", awsSecretBackend{service: "aws-sm"}) })
+
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"host: plain\n", "host: plain\n"},
+		{"host: ${REP_HOST}\n", "host: db.example.com\n"},
+		{"url: http://${REP_HOST}:${REP_PORT}/\n", "url: http://db.example.com:5433/\n"},
+		{"port: ${REP_PORT}\n", "port: 5433\n"},
+		{"port: ${REP_ZERO}\n", `port: "05"` + "\n"},
+		{"enabled: ${REP_ON}\n", "enabled: true\n"},
+		{"name: ${REP_QUOTE}\n", "name: 'a: b'\n"},
+		{"name: $${REP_HOST}\n", "name: ${REP_HOST}\n"},
+		{"hosts:\n- ${REP_HOST}\n- other\n", "hosts:\n- db.example.com\n- other\n"},
+		{"password: aws-sm://prod/db#password\n", "password: s3cret\n"},
+		{"password_secret: aws-sm://prod/db#password\n", "password_secret: aws-sm://prod/db#password\n"},
+	}
+	for _, test := range tests {
+		got, err := expandConfig(context.Background(), []byte(test.raw))
+		if err != nil || string(got) != test.want {
+			t.Errorf("expandConfig(%q) = %q, %v, want %q", test.raw, got, err, test.want)
+		}
+	}
+
+	for _, raw := range []string{
+		"host: ${REP_MISSING}\n",
+		"password: aws-sm://prod/other\n",
+		"host: [${REP_HOST}\n",
+	} {
+		if got, err := expandConfig(context.Background(), []byte(raw)); err == nil {
+			t.Errorf("expandConfig(%q) = %q, want an error", raw, got)
+		}
+	}
+}
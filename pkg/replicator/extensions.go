@@ -0,0 +1,65 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// extensionEngine is implemented by the engines whose dumps require
+// extensions, created before the restore so a missing one fails the run
+// early rather than halfway through the restore.
+type extensionEngine interface {
+	// ExtensionsCommand returns the local command listing the contents of
+	// the dump file, which RequiredExtensions reads the extensions from. It
+	// runs without a pipe, for the NoShellExecutor.
+	ExtensionsCommand(db DB, fileName string) string
+	RequiredExtensions(contents string) []string
+	// AvailableExtensionsCommand returns the local command listing the
+	// extensions that can be created, one per line.
+	AvailableExtensionsCommand(db DB, database string) string
+	CreateExtensionScript(name string) string
+}
+
+// createExtensions creates the extensions the dump requires in database, or
+// fails with those that aren't available locally.
+func (r *Replicator) createExtensions(ctx context.Context, database string) error {
+	engine, ok := r.Engine.(extensionEngine)
+	if !ok || r.plainDump() {
+		// A plain dump creates its extensions itself.
+		return nil
+	}
+
+	r.printStep("Create extensions required by %s", r.localDumpFile)
+	out, err := r.Local.Output(ctx, engine.ExtensionsCommand(r.config.LocalDB, r.localDumpFile))
+	if err != nil {
+		return err
+	}
+	required := engine.RequiredExtensions(out)
+	if len(required) == 0 {
+		fmt.Fprintf(r.Output, "   No extension required\n")
+		return nil
+	}
+
+	out, err = r.Local.Output(ctx, engine.AvailableExtensionsCommand(r.config.LocalDB, database))
+	if err != nil {
+		return err
+	}
+	available := strings.Fields(out)
+	var missing []string
+	for _, name := range required {
+		if !containsString(available, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the dump requires extensions not installed locally: %s", strings.Join(missing, ", "))
+	}
+
+	var script strings.Builder
+	for _, name := range required {
+		fmt.Fprintf(&script, "%s;\n", engine.CreateExtensionScript(name))
+	}
+	fmt.Fprintf(r.Output, "   %s\n", strings.Join(required, ", "))
+	return r.runScript(ctx, database, script.String())
+}
@@ -0,0 +1,166 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// commandLog records the commands of the fakes in the order they ran, each
+// prefixed with where it ran.
+type commandLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *commandLog) add(entry string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+// index returns the position of the first entry containing s after from, or
+// -1.
+func (l *commandLog) index(s string, from int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := from; i < len(l.entries); i++ {
+		if strings.Contains(l.entries[i], s) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *commandLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.entries, "\n")
+}
+
+// fakeExecutor is the RemoteExecutor, LocalExecutor and FileReceiver
+// answering the commands containing a key of outputs with its value, and
+// failing those containing failOn. The files it receives are discarded.
+type fakeExecutor struct {
+	where   string
+	log     *commandLog
+	outputs map[string]string
+	failOn  string
+	// connectErr is the error of Connect.
+	connectErr error
+}
+
+func (e *fakeExecutor) Connect(ctx context.Context) error {
+	e.log.add(e.where + " connect")
+	return e.connectErr
+}
+
+func (e *fakeExecutor) Close() error {
+	return nil
+}
+
+func (e *fakeExecutor) Run(ctx context.Context, cmd string) error {
+	_, err := e.Output(ctx, cmd)
+	return err
+}
+
+func (e *fakeExecutor) Output(ctx context.Context, cmd string) (string, error) {
+	e.log.add(e.where + " " + cmd)
+	if e.failOn != "" && strings.Contains(cmd, e.failOn) {
+		return "", permanent(withStderr(errors.New("exit status 1"), "failed by the test"))
+	}
+	for key, out := range e.outputs {
+		if strings.Contains(cmd, key) {
+			return out, nil
+		}
+	}
+	return "", nil
+}
+
+func (e *fakeExecutor) ReceivedSize(ctx context.Context, file string) (int64, error) {
+	return 0, nil
+}
+
+func (e *fakeExecutor) Append(ctx context.Context, file string) (io.WriteCloser, error) {
+	e.log.add(e.where + " append " + file)
+	return nopWriteCloser{ioutil.Discard}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// fakeTransferrer is the FileTransferrer of remote files all holding
+// content.
+type fakeTransferrer struct {
+	log     *commandLog
+	content string
+}
+
+func (t *fakeTransferrer) Size(ctx context.Context, remote string) (int64, error) {
+	return int64(len(t.content)), nil
+}
+
+func (t *fakeTransferrer) CopyFrom(ctx context.Context, remote string, offset int64, w io.Writer) error {
+	t.log.add("copy " + remote)
+	_, err := io.WriteString(w, t.content[offset:])
+	return err
+}
+
+// postgresOutputs answer the checks of the Postgres engine.
+var postgresOutputs = map[string]string{
+	"SHOW server_version": "14.5",
+	"--version":           "pg_dump (PostgreSQL) 14.5",
+}
+
+// newFakeReplicator returns a Replicator of a Postgres server running its
+// commands with fakes and writing the local files to a temp directory. The local commands containing
+// failLocal fail, as do the remote ones containing failRemote.
+func newFakeReplicator(t *testing.T, failRemote, failLocal string) (*Replicator, *commandLog) {
+	dir, err := ioutil.TempDir("", "rep_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpdir, hadTmpdir := os.LookupEnv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	t.Cleanup(func() {
+		if hadTmpdir {
+			os.Setenv("TMPDIR", tmpdir)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+		os.RemoveAll(dir)
+	})
+
+	key := filepath.Join(dir, "id_test")
+	if err := ioutil.WriteFile(key, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := New(&Config{
+		Server: Server{
+			Host:           "server",
+			User:           "rep",
+			PrivateKeyFile: key,
+			DB:             DB{Host: "localhost", Database: "app", Username: "postgres"},
+		},
+		LocalDB: DB{Host: "localhost", Database: "dev", Username: "postgres"},
+	})
+	log := &commandLog{}
+	r.Output = ioutil.Discard
+	r.Remote = &fakeExecutor{where: "remote", log: log, outputs: postgresOutputs, failOn: failRemote}
+	r.Local = &fakeExecutor{where: "local", log: log, outputs: postgresOutputs, failOn: failLocal}
+	r.Transferrer = &fakeTransferrer{log: log, content: "dump"}
+	r.SkipSpaceCheck = true
+	r.ManifestDir, r.StateDir, r.LockDir, r.HistoryFile, r.LogDir = "", "", "", "", ""
+	return r, log
+}
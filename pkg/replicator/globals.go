@@ -0,0 +1,141 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// globalsEngine is implemented by the engines able to replicate the roles of
+// the server, which the dump of a single database doesn't include.
+type globalsEngine interface {
+	// GlobalsCommand returns the command writing the roles of the server and
+	// their memberships to stdout.
+	GlobalsCommand(db DB) string
+	// GlobalsScript returns the local script creating the roles of globals
+	// that don't exist yet. Existing roles are left untouched.
+	GlobalsScript(globals string) string
+}
+
+func (r *Replicator) checkGlobals() error {
+	if !r.WithGlobals {
+		return nil
+	}
+	if _, ok := r.Engine.(globalsEngine); !ok {
+		return errors.New("the database engine can't replicate the roles of the server")
+	}
+	return nil
+}
+
+// captureGlobals reads the roles of the server with exec, on the server or
+// locally in direct mode, if WithGlobals is set.
+func (r *Replicator) captureGlobals(ctx context.Context, exec outputExecutor, db DB) error {
+	if !r.WithGlobals {
+		return nil
+	}
+	if err := r.checkGlobals(); err != nil {
+		return err
+	}
+	cmd := r.Engine.(globalsEngine).GlobalsCommand(db)
+	where := "server"
+	if r.config.Server.Mode == "direct" {
+		where = "local"
+	}
+	r.recordCommand(where, cmd, "")
+	out, err := exec.Output(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	r.globals = out
+	return nil
+}
+
+// applyGlobals creates the roles captured by captureGlobals that are missing
+// locally.
+func (r *Replicator) applyGlobals(ctx context.Context, database string) error {
+	if r.globals == "" {
+		if r.WithGlobals {
+			fmt.Fprintf(r.Output, "   No roles captured from the server, skipping them\n")
+		}
+		return nil
+	}
+	r.printStep("Create local roles missing from the server roles")
+	return r.runScript(ctx, database, r.Engine.(globalsEngine).GlobalsScript(r.globals))
+}
+
+// pgRolesScript rewrites the output of pg_dumpall --roles-only: each role is
+// created along with its attributes and settings only if it doesn't exist,
+// so the local roles, such as the superuser, keep theirs. The memberships
+// and other statements only warn when they fail, for instance because the
+// grantor is missing.
+func pgRolesScript(globals string) string {
+	var sets, roles, others []string
+	alters := map[string][]string{}
+	for _, line := range strings.Split(globals, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "--"):
+		case strings.HasPrefix(line, "SET "):
+			sets = append(sets, line)
+		case strings.HasPrefix(line, "CREATE ROLE "):
+			role := strings.TrimSuffix(strings.TrimPrefix(line, "CREATE ROLE "), ";")
+			roles = append(roles, role)
+		case strings.HasPrefix(line, "ALTER ROLE "):
+			role := pgRoleOf(strings.TrimPrefix(line, "ALTER ROLE "))
+			alters[role] = append(alters[role], strings.TrimSuffix(line, ";"))
+		default:
+			others = append(others, fmt.Sprintf(
+				"DO $rep$BEGIN EXECUTE %s; EXCEPTION WHEN OTHERS THEN RAISE WARNING '%%', SQLERRM; END$rep$;",
+				quoteLiteral(strings.TrimSuffix(line, ";")),
+			))
+		}
+	}
+
+	var script strings.Builder
+	for _, set := range sets {
+		script.WriteString(set + "\n")
+	}
+	for _, role := range roles {
+		fmt.Fprintf(
+			&script,
+			"DO $rep$BEGIN IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = %s) THEN\n  EXECUTE %s;\n",
+			quoteLiteral(unquoteIdent(role)),
+			quoteLiteral("CREATE ROLE "+role),
+		)
+		for _, alter := range alters[role] {
+			fmt.Fprintf(&script, "  EXECUTE %s;\n", quoteLiteral(alter))
+		}
+		script.WriteString("END IF; END$rep$;\n")
+	}
+	for _, other := range others {
+		script.WriteString(other + "\n")
+	}
+	return script.String()
+}
+
+// pgRoleOf returns the role name, as written, that starts s.
+func pgRoleOf(s string) string {
+	if !strings.HasPrefix(s, `"`) {
+		return strings.Fields(s + " ")[0]
+	}
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			i++
+			continue
+		}
+		return s[:i+1]
+	}
+	return s
+}
+
+// unquoteIdent returns the name of an identifier as written in SQL.
+func unquoteIdent(s string) string {
+	if len(s) < 2 || !strings.HasPrefix(s, `"`) || !strings.HasSuffix(s, `"`) {
+		return s
+	}
+	return strings.Replace(s[1:len(s)-1], `""`, `"`, -1)
+}
@@ -0,0 +1,121 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// heartbeat tracks the running step for the heartbeat lines.
+type heartbeat struct {
+	mu      sync.Mutex
+	step    string
+	started time.Time
+	// bytes and total count the bytes copied by the step, total being zero
+	// when unknown.
+	bytes int64
+	total int64
+	// progress is told about the copied bytes.
+	progress ProgressSink
+}
+
+func (h *heartbeat) begin(step string, progress ProgressSink) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.step = step
+	h.started = time.Now()
+	h.bytes = 0
+	h.total = 0
+	h.progress = progress
+}
+
+// setBytes records that bytes of total were copied so far.
+func (h *heartbeat) setBytes(bytes, total int64) {
+	h.mu.Lock()
+	h.bytes = bytes
+	h.total = total
+	progress := h.progress
+	h.mu.Unlock()
+	if progress != nil {
+		progress.Bytes(bytes, total)
+	}
+}
+
+func (h *heartbeat) add(n int64) {
+	h.mu.Lock()
+	h.bytes += n
+	bytes, total, progress := h.bytes, h.total, h.progress
+	h.mu.Unlock()
+	if progress != nil {
+		progress.Bytes(bytes, total)
+	}
+}
+
+func (h *heartbeat) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := fmt.Sprintf("%s: %s elapsed", h.step, time.Since(h.started).Round(time.Second))
+	switch {
+	case h.total > 0:
+		s += fmt.Sprintf(", %d/%d bytes", h.bytes, h.total)
+	case h.bytes > 0:
+		s += fmt.Sprintf(", %d bytes", h.bytes)
+	}
+	return s
+}
+
+// countingWriter counts the bytes written to w in the heartbeat.
+type countingWriter struct {
+	w         io.Writer
+	heartbeat *heartbeat
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.heartbeat.add(int64(n))
+	return n, err
+}
+
+// lockedWriter serializes the writes of the steps and of the heartbeat.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// startHeartbeat prints a heartbeat line every Heartbeat until the returned
+// function is called.
+func (r *Replicator) startHeartbeat(ctx context.Context) func() {
+	output := r.Output
+	locked := &lockedWriter{w: output}
+	r.Output = locked
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(r.Heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(locked, "   Still running %s\n", &r.heartbeat)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		r.Output = output
+	}
+}
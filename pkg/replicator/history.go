@@ -0,0 +1,174 @@
+package replicator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// StepTiming is how long a step of a run took, until the next one started.
+type StepTiming struct {
+	Step    int     `json:"step"`
+	Title   string  `json:"title"`
+	Seconds float64 `json:"seconds"`
+}
+
+// HistoryEntry is a line of the history file, one per run.
+type HistoryEntry struct {
+	RunID     string       `json:"run_id"`
+	StartedAt time.Time    `json:"started_at"`
+	Server    string       `json:"server"`
+	Database  string       `json:"database"`
+	Target    string       `json:"target"`
+	Succeeded bool         `json:"succeeded"`
+	Seconds   float64      `json:"seconds"`
+	Pipeline  []string     `json:"pipeline"`
+	Jobs      int          `json:"jobs,omitempty"`
+	Steps     []StepTiming `json:"steps"`
+}
+
+// DefaultHistoryFile returns ~/.rep/history.jsonl, or "" if the home
+// directory is unknown.
+func DefaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".rep", "history.jsonl")
+}
+
+// beginStepTiming ends the timing of the running step, if any, and starts
+// the one of title.
+func (r *Replicator) beginStepTiming(title string) {
+	r.endStepTiming()
+	r.stepStarted = time.Now()
+	r.timings = append(r.timings, StepTiming{Step: r.step, Title: r.redact(title)})
+}
+
+func (r *Replicator) endStepTiming() {
+	if r.stepStarted.IsZero() {
+		return
+	}
+	r.timings[len(r.timings)-1].Seconds = time.Since(r.stepStarted).Seconds()
+	r.stepStarted = time.Time{}
+}
+
+// printTimings prints how long the steps of at least a second took, for the
+// summary at the end of the run.
+func (r *Replicator) printTimings(total time.Duration) {
+	r.endStepTiming()
+	fmt.Fprintf(r.Output, "   Time per step:\n")
+	w := tabwriter.NewWriter(r.Output, 0, 0, 2, ' ', 0)
+	for _, timing := range r.timings {
+		if timing.Seconds < 1 {
+			continue
+		}
+		fmt.Fprintf(w, "   %d. %s\t%s\n", timing.Step, timing.Title, time.Duration(timing.Seconds*float64(time.Second)).Round(time.Second))
+	}
+	fmt.Fprintf(w, "   Total\t%s\n", total.Round(time.Second))
+	w.Flush()
+}
+
+// appendHistory appends the run to HistoryFile, so the durations of the runs
+// can be compared over time, after a change of the pipeline or of the jobs
+// for instance. The history only serves the user, a failure to write it is
+// reported but doesn't fail the run.
+func (r *Replicator) appendHistory(started time.Time, runErr error) {
+	if r.HistoryFile == "" {
+		return
+	}
+	entry := HistoryEntry{
+		RunID:     r.runID,
+		StartedAt: started,
+		Server:    r.config.Server.Host,
+		Database:  r.config.Server.DB.Database,
+		Target:    r.config.LocalDB.Database,
+		Succeeded: runErr == nil,
+		Seconds:   time.Since(started).Seconds(),
+		Pipeline:  []string{},
+		Jobs:      r.config.Limits.Jobs,
+		Steps:     append([]StepTiming{}, r.timings...),
+	}
+	for _, stage := range r.Pipeline {
+		entry.Pipeline = append(entry.Pipeline, stage.Name())
+	}
+	raw, err := json.Marshal(entry)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.HistoryFile), 0700)
+	}
+	var file *os.File
+	if err == nil {
+		file, err = os.OpenFile(r.HistoryFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	if err == nil {
+		_, err = file.Write(append(raw, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Writing history failed: %v\n", err)
+	}
+}
+
+// RunResult sums up a run, for the callers reporting it to machines, such as
+// the JSON output of the CLI for CI.
+type RunResult struct {
+	RunID     string `json:"run_id"`
+	Succeeded bool   `json:"succeeded"`
+	Error     string `json:"error,omitempty"`
+	Server    string `json:"server"`
+	Database  string `json:"database"`
+	// LocalDatabase is the local database, replaced by the restored one if
+	// Replaced is set, its previous version being kept as PreviousDatabase
+	// with a backup.
+	LocalDatabase    string    `json:"local_database"`
+	Replaced         bool      `json:"replaced"`
+	PreviousDatabase string    `json:"previous_database,omitempty"`
+	DumpBytes        int64     `json:"dump_bytes,omitempty"`
+	StartedAt        time.Time `json:"started_at"`
+	FinishedAt       time.Time `json:"finished_at"`
+	Seconds          float64   `json:"seconds"`
+	// Phases are the seconds taken by Dump, Transfer, Restore and Swap,
+	// named dump, transfer, restore and swap, those that ran.
+	Phases map[string]float64 `json:"phases"`
+	Steps  []StepTiming       `json:"steps"`
+}
+
+// timePhase times the phase name of the run, until the returned function is
+// called.
+func (r *Replicator) timePhase(name string) func() {
+	started := time.Now()
+	return func() {
+		if r.result.Phases == nil {
+			r.result.Phases = map[string]float64{}
+		}
+		r.result.Phases[name] += time.Since(started).Seconds()
+	}
+}
+
+// Result returns the result of the last run.
+func (r *Replicator) Result() RunResult {
+	return r.result
+}
+
+func (r *Replicator) finishResult(started time.Time, runErr error) {
+	r.result.RunID = r.runID
+	r.result.Succeeded = runErr == nil
+	if runErr != nil {
+		r.result.Error = runErr.Error()
+	}
+	r.result.Server = r.config.Server.Host
+	r.result.Database = r.config.Server.DB.Database
+	r.result.LocalDatabase = r.config.LocalDB.Database
+	r.result.StartedAt = started
+	r.result.FinishedAt = time.Now()
+	r.result.Seconds = r.result.FinishedAt.Sub(started).Seconds()
+	r.result.Steps = append([]StepTiming{}, r.timings...)
+	if r.result.Phases == nil {
+		r.result.Phases = map[string]float64{}
+	}
+}
@@ -0,0 +1,86 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Hook is a SQL statement or file run against a database by the run.
+type Hook struct {
+	// SQL is the statements to run, such as TRUNCATE jobs.
+	SQL string `yaml:"sql"`
+	// File is a local SQL file to run instead.
+	File string `yaml:"file"`
+	// AfterSwap runs a post_restore hook against the local database once
+	// replaced, rather than against the restored database before the swap.
+	AfterSwap bool `yaml:"after_swap"`
+}
+
+func (h Hook) String() string {
+	if h.File != "" {
+		return h.File
+	}
+	return h.SQL
+}
+
+// script returns the SQL of the hook, reading its file if any.
+func (h Hook) script() (string, error) {
+	if (h.SQL == "") == (h.File == "") {
+		return "", errors.New("a hook needs either sql or file")
+	}
+	if h.SQL != "" {
+		return h.SQL, nil
+	}
+	raw, err := ioutil.ReadFile(h.File)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// checkHooks fails on the hooks that can't run, before anything is dumped.
+func (r *Replicator) checkHooks() error {
+	for _, hook := range r.config.PostRestore {
+		if _, err := hook.script(); err != nil {
+			return fmt.Errorf("invalid post_restore hook %s: %v", hook, err)
+		}
+	}
+	return nil
+}
+
+// runPreDump runs the pre_dump commands on the server, in the order of the
+// config, the first failing aborting the run.
+func (r *Replicator) runPreDump(ctx context.Context) error {
+	for _, cmd := range r.config.PreDump {
+		r.printStep("Run pre dump hook %s in %s", cmd, r.config.Server.Host)
+		r.recordCommand("server", cmd, "")
+		err := r.withRemote(ctx, "Running pre dump hook", func() error {
+			return r.Remote.Run(ctx, cmd)
+		})
+		if err != nil {
+			return fmt.Errorf("pre_dump hook %s failed: %v", cmd, err)
+		}
+	}
+	return nil
+}
+
+// runPostRestore runs the post_restore hooks with afterSwap against
+// database, in the order of the config.
+func (r *Replicator) runPostRestore(ctx context.Context, database string, afterSwap bool) error {
+	for _, hook := range r.config.PostRestore {
+		if hook.AfterSwap != afterSwap {
+			continue
+		}
+		script, err := hook.script()
+		if err != nil {
+			return err
+		}
+		r.printStep("Run post restore hook %s on database %s", hook, database)
+		if err := r.runScript(ctx, database, script); err != nil {
+			return fmt.Errorf("post_restore hook %s failed: %v", hook, err)
+		}
+	}
+	return nil
+}
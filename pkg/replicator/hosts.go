@@ -0,0 +1,143 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostRecord is what the last successful connection to a server used, kept
+// in ~/.rep/hosts.json to explain what changed when a connection fails,
+// rather than only reporting the dial error.
+type hostRecord struct {
+	IP        string    `json:"ip"`
+	Auth      string    `json:"auth"`
+	Key       string    `json:"key"`
+	HostKey   string    `json:"host_key"`
+	Connected time.Time `json:"connected"`
+}
+
+var hostsMu sync.Mutex
+
+// hostsFile returns ~/.rep/hosts.json, or empty without a home directory.
+func hostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".rep", "hosts.json")
+}
+
+// hostID identifies the records of hosts.json.
+func hostID(config Server) string {
+	return config.User + "@" + net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+}
+
+// readHosts returns the records of hosts.json, none if it can't be read.
+func readHosts() map[string]hostRecord {
+	hosts := map[string]hostRecord{}
+	file := hostsFile()
+	if file == "" {
+		return hosts
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return hosts
+	}
+	json.Unmarshal(raw, &hosts)
+	return hosts
+}
+
+// rememberHost records a successful connection. It is only a cache, so a
+// failure to write it is ignored.
+func rememberHost(id string, record hostRecord) {
+	file := hostsFile()
+	if file == "" {
+		return
+	}
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+
+	hosts := readHosts()
+	hosts[id] = record
+	raw, err := json.MarshalIndent(hosts, "", "  ")
+	if err != nil || os.MkdirAll(filepath.Dir(file), 0700) != nil {
+		return
+	}
+	// Written then renamed, so concurrent runs never read a partial file.
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	if ioutil.WriteFile(tmp, append(raw, '\n'), 0600) != nil {
+		return
+	}
+	if os.Rename(tmp, file) != nil {
+		os.Remove(tmp)
+	}
+}
+
+// hostKeyFingerprint presents a host key like ssh-keygen -l.
+func hostKeyFingerprint(key ssh.PublicKey) string {
+	return key.Type() + " " + ssh.FingerprintSHA256(key)
+}
+
+// diagnoseDial explains why the server at the IP of the last successful
+// connection can no longer be reached.
+func (previous hostRecord) diagnoseDial(ctx context.Context, config Server) string {
+	ips, err := net.DefaultResolver.LookupHost(ctx, config.Host)
+	if err != nil {
+		return fmt.Sprintf("the last successful connection on %s was to %s", previous.connected(), previous.IP)
+	}
+	for _, ip := range ips {
+		if ip == previous.IP {
+			return ""
+		}
+	}
+	return fmt.Sprintf(
+		"%s now resolves to %s, the last successful connection on %s was to %s",
+		config.Host,
+		strings.Join(ips, ", "),
+		previous.connected(),
+		previous.IP,
+	)
+}
+
+// diagnoseAuth explains why the authentication, which succeeded with
+// previous, failed with current.
+func (previous hostRecord) diagnoseAuth(current hostRecord, config Server) string {
+	var changes []string
+	if current.IP != previous.IP {
+		changes = append(changes, fmt.Sprintf("the server IP changed from %s to %s", previous.IP, current.IP))
+	}
+	if current.Key != previous.Key {
+		changes = append(changes, fmt.Sprintf("the private key changed from %s to %s", previous.Key, current.Key))
+	}
+	if len(changes) == 0 {
+		return fmt.Sprintf(
+			"the same key was accepted on %s, it may have been removed from the authorized keys of %s",
+			previous.connected(),
+			config.User,
+		)
+	}
+	return strings.Join(changes, " and ") + " since the last successful connection on " + previous.connected()
+}
+
+func (previous hostRecord) connected() string {
+	return previous.Connected.Format("2006-01-02 15:04")
+}
+
+// withDiagnosis adds the diagnosis of a connection failure to err.
+func withDiagnosis(err error, diagnosis string) error {
+	if diagnosis == "" {
+		return err
+	}
+	return fmt.Errorf("%w (%s)", err, diagnosis)
+}
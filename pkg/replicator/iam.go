@@ -0,0 +1,47 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// iamToken generates the token db authenticates with instead of a password,
+// with the cloud CLI and so its local credential chain: an RDS IAM
+// authentication token for aws, valid 15 minutes, or the access token of
+// the gcloud account for the IAM database users of Cloud SQL.
+func iamToken(ctx context.Context, db DB) (string, error) {
+	var name string
+	var args []string
+	switch db.IAMAuth {
+	case "aws":
+		name = "aws"
+		args = []string{
+			"rds", "generate-db-auth-token",
+			"--hostname", db.Host,
+			"--port", strconv.Itoa(db.Port),
+			"--username", db.Username,
+			"--output", "text",
+		}
+		if db.IAMRegion != "" {
+			args = append(args, "--region", db.IAMRegion)
+		}
+	case "gcp":
+		name = "gcloud"
+		args = []string{"auth", "print-access-token"}
+	default:
+		return "", fmt.Errorf("unknown iam_auth %q, expected aws or gcp", db.IAMAuth)
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("generating the %s IAM token: %v", db.IAMAuth, withStderr(err, stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,232 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// repPublication is the publication of the server database the local
+// databases subscribe to, shared by all of them.
+const repPublication = "rep_all_tables"
+
+// incrementalPoll is how often RunIncremental checks whether the local
+// database caught up with the server, and incrementalReport how often it
+// reports how far behind it is.
+const (
+	incrementalPoll   = 2 * time.Second
+	incrementalReport = 30 * time.Second
+)
+
+// logicalReplicator is implemented by the engines able to apply the changes
+// of the server database to the local one with logical replication, the
+// local server subscribing to the server database through a forwarded
+// port.
+type logicalReplicator interface {
+	// PublishCommand returns the command checking the database of dbConfig
+	// can publish its changes, creating publication for all its tables if
+	// missing, and printing the current position of its log.
+	PublishCommand(dbConfig DB, publication string) string
+	// SubscriptionCommand returns the command printing t if database has
+	// the subscription enabled, f if disabled, and nothing if missing.
+	SubscriptionCommand(dbConfig DB, database, subscription string) string
+	// SubscribeScript returns the script connecting the subscription of
+	// the database it runs on to the server database with conninfo, then
+	// enabling it, or creating it if missing, which copies the rows of the
+	// tables before applying the changes.
+	SubscribeScript(subscription, publication, conninfo string, exists bool) string
+	// PauseScript returns the script disabling the subscription until the
+	// next refresh, the server keeping the changes meanwhile.
+	PauseScript(subscription string) string
+	// UnsubscribeScript returns the script dropping the subscription, and
+	// the replication slot of the server database it reaches with conninfo.
+	UnsubscribeScript(subscription, conninfo string) string
+	// CopyingTablesCommand returns the command printing how many tables of
+	// the subscription of database still have their rows being copied.
+	CopyingTablesCommand(dbConfig DB, database, subscription string) string
+	// LagCommand returns the command printing how many bytes of the log of
+	// the database of dbConfig, up to position, the subscription has yet to
+	// apply, nothing if it has no replication slot yet.
+	LagCommand(dbConfig DB, subscription, position string) string
+	// ConnInfo returns the connection string of the local server to the
+	// server database.
+	ConnInfo(dbConfig DB) string
+	// SchemaDumpOptions are the options of the dump tool dumping the schema
+	// only, the rows being copied by the subscription.
+	SchemaDumpOptions() []string
+}
+
+// RunIncremental refreshes the local database with the changes of the
+// server database since the last refresh, instead of replacing it. The first
+// run copies the schema of the server database with a dump, replacing the
+// local database, then subscribes the local server to the server database,
+// which copies the rows. Each refresh enables the subscription through a
+// port forwarded over SSH until the local database caught up, then disables
+// it, the server keeping the changes until the next refresh.
+func (r *Replicator) RunIncremental(ctx context.Context) error {
+	r.preflightServer = true
+	return r.run(ctx, r.lockLocalDB, r.Check, r.checkIncremental, r.refreshIncremental)
+}
+
+func (r *Replicator) checkIncremental(ctx context.Context) error {
+	if _, ok := r.Engine.(logicalReplicator); !ok {
+		return errors.New("the database engine can't refresh the local database incrementally")
+	}
+	switch {
+	case r.useDriver:
+		return errors.New("an incremental refresh needs the local client tools")
+	case r.target != nil:
+		return errors.New("an incremental refresh needs the local database on this machine, the local server connecting to a port forwarded by rep")
+	case r.config.Server.Kubernetes != nil || r.config.Server.DockerContainer != "":
+		return errors.New("an incremental refresh reaches the server database through SSH, which kubernetes and the docker_container of the server don't use")
+	}
+	return nil
+}
+
+// subscriptionName names the subscription of the local database and its
+// replication slot in the server database, which must be unique among the
+// machines subscribing to it.
+func (r *Replicator) subscriptionName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = ""
+	}
+	name := fmt.Sprintf("rep_%s_%s_%s", sanitizeName(host), r.user, sanitizeName(r.config.LocalDB.Database))
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+func (r *Replicator) refreshIncremental(ctx context.Context) error {
+	engine := r.Engine.(logicalReplicator)
+	server := r.config.Server
+	localDB := r.config.LocalDB
+	subscription := r.subscriptionName()
+
+	if !r.connected {
+		if err := r.Connect(ctx); err != nil {
+			return err
+		}
+	}
+	tunneledDB, err := r.forwardServerDB()
+	if err != nil {
+		return err
+	}
+	tunneledDB.PasswordFile = ""
+	if err := r.storePassword(ctx, r.Local, r.Receiver, &tunneledDB, "local"); err != nil {
+		return err
+	}
+	// The local server reaches the server database through the same port.
+	conninfo := engine.ConnInfo(tunneledDB)
+
+	r.printStep("Publish the changes of database %s in %s", server.DB.Database, server.Host)
+	out, err := r.Local.Output(ctx, engine.PublishCommand(tunneledDB, repPublication))
+	if err != nil {
+		return err
+	}
+	position := firstLine(out)
+
+	r.printStep("Find subscription %s of local database %s", subscription, localDB.Database)
+	out, err = r.Local.Output(ctx, engine.SubscriptionCommand(localDB, localDB.Database, subscription))
+	if err != nil {
+		return err
+	}
+	exists := strings.TrimSpace(out) != ""
+	if exists && r.ResetIncremental {
+		r.printStep("Drop subscription %s of local database %s", subscription, localDB.Database)
+		if err := r.runPrivateScript(ctx, localDB.Database, engine.UnsubscribeScript(subscription, conninfo)); err != nil {
+			return err
+		}
+		exists = false
+	}
+	if !exists {
+		fmt.Fprintf(r.Output, "   None yet, copying the schema of database %s, then the rows of its tables\n", server.DB.Database)
+		if err := r.copySchema(ctx, engine); err != nil {
+			return err
+		}
+	}
+
+	what := "Enable"
+	if !exists {
+		what = "Create"
+	}
+	r.printStep("%s subscription %s of local database %s", what, subscription, localDB.Database)
+	if err := r.runPrivateScript(ctx, localDB.Database, engine.SubscribeScript(subscription, repPublication, conninfo, exists)); err != nil {
+		return err
+	}
+	r.onCleanup(func(ctx context.Context) error {
+		r.printStep("Pause subscription %s of local database %s", subscription, localDB.Database)
+		return r.runScript(ctx, localDB.Database, engine.PauseScript(subscription))
+	})
+
+	r.printStep("Apply the changes of database %s in %s", server.DB.Database, server.Host)
+	return r.waitCaughtUp(ctx, engine, tunneledDB, subscription, position)
+}
+
+// copySchema replaces the local database with the schema of the server
+// database, for the subscription to copy the rows into. The dump isn't
+// verified nor cached, having no rows.
+func (r *Replicator) copySchema(ctx context.Context, engine logicalReplicator) error {
+	r.config.Server.DB.DumpOptions = append(r.config.Server.DB.DumpOptions, engine.SchemaDumpOptions()...)
+	r.config.Verify = Verify{}
+	r.config.CacheDir = ""
+	r.ReuseDump = 0
+	steps := []func(ctx context.Context) error{r.confirmReplace(r.serverSource()), r.Dump, r.Transfer, r.Restore, r.Swap}
+	for _, step := range steps {
+		if err := step(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitCaughtUp waits until the rows of the tables of the subscription are
+// copied and it applied the changes of the server database up to position,
+// within the copy timeout.
+func (r *Replicator) waitCaughtUp(ctx context.Context, engine logicalReplicator, tunneledDB DB, subscription, position string) error {
+	localDB := r.config.LocalDB
+	waitCtx, cancel := withTimeout(ctx, r.config.Timeouts.Copy)
+	defer cancel()
+	started := time.Now()
+	reported := started
+	for {
+		out, err := r.Local.Output(waitCtx, engine.CopyingTablesCommand(localDB, localDB.Database, subscription))
+		if err != nil {
+			return err
+		}
+		copying, _ := strconv.Atoi(strings.TrimSpace(out))
+		out, err = r.Local.Output(waitCtx, engine.LagCommand(tunneledDB, subscription, position))
+		if err != nil {
+			return err
+		}
+		// The slot is created once the subscription connected, the lag
+		// being empty until then, and negative past position.
+		lag, lagErr := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+		if copying == 0 && lagErr == nil && lag <= 0 {
+			fmt.Fprintf(r.Output, "   Caught up with the server in %s\n", time.Since(started).Round(time.Second))
+			return nil
+		}
+		if time.Since(reported) >= incrementalReport {
+			reported = time.Now()
+			switch {
+			case copying > 0:
+				fmt.Fprintf(r.Output, "   Copying the rows of %d tables\n", copying)
+			case lagErr == nil && lag > 0:
+				fmt.Fprintf(r.Output, "   %s of changes to apply\n", FormatSize(lag))
+			default:
+				fmt.Fprintf(r.Output, "   Waiting for the subscription to connect\n")
+			}
+		}
+		select {
+		case <-time.After(incrementalPoll):
+		case <-waitCtx.Done():
+			return fmt.Errorf("local database %s didn't catch up with the server: %v, the log of the local server tells why, "+
+				"such as a change of the schema of the server database, which --incremental-reset copies again", localDB.Database, waitCtx.Err())
+		}
+	}
+}
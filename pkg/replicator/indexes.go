@@ -0,0 +1,174 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deferredIndex is an index or a constraint of a dump built once the rows of
+// its table are restored.
+type deferredIndex struct {
+	// Item is the line of the item in the list of the dump.
+	Item string
+	// Name describes it in the progress, such as INDEX public users_email.
+	Name string
+}
+
+// indexDeferrer is implemented by the engines able to restore the rows of a
+// dump before building its indexes and constraints, for defer_indexes.
+type indexDeferrer interface {
+	// DataRestoreCommand returns the RestoreCommand leaving out the
+	// indexes, constraints and triggers, within limits.
+	DataRestoreCommand(dbConfig DB, database, fileName string, limits Limits) string
+	// PostDataListCommand returns the local command listing the items of
+	// fileName DataRestoreCommand left out, one per line.
+	PostDataListCommand(db DB, fileName string) string
+	// SplitPostData splits the list of PostDataListCommand into the indexes
+	// and constraints built one by one, and the rest, such as the foreign
+	// keys, restored together once they are built.
+	SplitPostData(list string) (indexes []deferredIndex, rest []string)
+	// ListRestoreCommand returns the RestoreCommand restoring only the items
+	// of fileName in listFile, within limits.
+	ListRestoreCommand(dbConfig DB, database, fileName, listFile string, limits Limits) string
+}
+
+// checkDeferIndexes fails if the indexes can't be deferred in this restore.
+func (r *Replicator) checkDeferIndexes() error {
+	if !r.config.DeferIndexes {
+		return nil
+	}
+	if _, ok := r.Engine.(indexDeferrer); !ok {
+		return errors.New("the database engine can't defer the indexes of the restore")
+	}
+	switch {
+	case r.useDriver:
+		return errors.New("the built-in client can't defer the indexes of the restore")
+	case r.Downgrade:
+		return errors.New("the dump rewritten for an older server can't defer its indexes")
+	case r.config.Limits.WriteMBps > 0:
+		return errors.New("defer_indexes can't be set with limits.write_mbps, which restores as a single stream")
+	}
+	return nil
+}
+
+// restoreDeferred restores the rows of the dump to database first, then
+// builds its indexes and constraints, limits.jobs at once, printing each
+// as it is built, and restores the rest, such as the foreign keys.
+func (r *Replicator) restoreDeferred(ctx context.Context, database string) error {
+	engine := r.Engine.(indexDeferrer)
+	localDB := r.config.LocalDB
+	limits := r.config.Limits
+
+	r.printStep("Restoring the rows of %s to database %s", r.localDumpFile, database)
+	restoreCmd := r.limitCommand(engine.DataRestoreCommand(localDB, database, r.localDumpFile, limits))
+	r.recordCommand(r.localWhere(), restoreCmd, "")
+	if err := r.Local.Run(ctx, restoreCmd); err != nil {
+		return err
+	}
+
+	list, err := r.Local.Output(ctx, engine.PostDataListCommand(localDB, r.localDumpFile))
+	if err != nil {
+		return err
+	}
+	indexes, rest := engine.SplitPostData(list)
+
+	if len(indexes) > 0 {
+		jobs := limits.Jobs
+		if jobs < 1 {
+			jobs = 1
+		}
+		r.printStep("Build %d indexes and constraints of database %s, %d at once", len(indexes), database, jobs)
+		if err := r.buildIndexes(ctx, engine, database, indexes, jobs); err != nil {
+			return err
+		}
+	}
+	if len(rest) > 0 {
+		r.printStep("Restore the foreign keys and triggers of database %s", database)
+		if err := r.restoreList(ctx, engine, database, rest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndexes builds the indexes with jobs restores at once, stopping at
+// the first failure.
+func (r *Replicator) buildIndexes(ctx context.Context, engine indexDeferrer, database string, indexes []deferredIndex, jobs int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		built    int
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	queue := make(chan deferredIndex)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				started := time.Now()
+				err := r.restoreList(ctx, engine, database, []string{index.Item})
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("building %s: %v", index.Name, err)
+						cancel()
+					}
+				} else {
+					built++
+					fmt.Fprintf(r.Output, "   %s (%d/%d) took %s\n", index.Name, built, len(indexes), time.Since(started).Round(time.Second))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, index := range indexes {
+		select {
+		case queue <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// restoreList restores the items of the dump to database through a list
+// file, written by the command itself like runScript.
+func (r *Replicator) restoreList(ctx context.Context, engine indexDeferrer, database string, items []string) error {
+	list := strings.Join(items, "\n") + "\n"
+	if _, ok := r.Local.(NoShellExecutor); ok {
+		file, err := writeLocalTempFile("rep_", list)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file)
+		restoreCmd := engine.ListRestoreCommand(r.config.LocalDB, database, r.localDumpFile, shellQuote(file), r.config.Limits)
+		r.recordCommand(r.localWhere(), restoreCmd, list)
+		return r.Local.Run(ctx, restoreCmd)
+	}
+	restoreCmd := engine.ListRestoreCommand(r.config.LocalDB, database, r.localDumpFile, `"$list"`, r.config.Limits)
+	r.recordCommand(r.localWhere(), restoreCmd, list)
+	cmd := fmt.Sprintf(
+		"umask 077 && list=$(mktemp \"${TMPDIR:-/tmp}/rep_XXXXXX\") && cat > \"$list\" <<'%s'\n%s%s\n"+
+			"%s; status=$?; rm -f \"$list\"; exit $status",
+		scriptDelimiter,
+		list,
+		scriptDelimiter,
+		restoreCmd,
+	)
+	return r.Local.Run(ctx, r.limitCommand(cmd))
+}
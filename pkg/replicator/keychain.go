@@ -0,0 +1,44 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// keychainService names the items of rep in the keychain of the OS.
+const keychainService = "rep"
+
+// keychainBackend is the keychain SecretBackend, reading the secrets stored
+// by SetKeychainSecret in the keychain of the OS: the macOS Keychain, the
+// Secret Service of Linux through secret-tool, or the Windows Credential
+// Manager. A reference is written <env>/<field>, such as staging/password.
+type keychainBackend struct{}
+
+func (keychainBackend) Secret(ctx context.Context, ref string) (string, error) {
+	secret, err := keychainGet(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("reading %s from the keychain: %v", ref, err)
+	}
+	return secret, nil
+}
+
+// KeychainSecret returns the password_secret reading the field of env
+// stored by SetKeychainSecret.
+func KeychainSecret(env, field string) string {
+	return "keychain:" + env + "/" + field
+}
+
+// SetKeychainSecret stores secret as the field of env, such as the password
+// of the staging database, in the keychain of the OS, replacing the previous
+// one, so the config refers to it with KeychainSecret instead of keeping it
+// on disk.
+func SetKeychainSecret(ctx context.Context, env, field, secret string) error {
+	if env == "" || field == "" || strings.Contains(env, "/") {
+		return fmt.Errorf("invalid keychain secret %q %q, expected an environment without / and a field", env, field)
+	}
+	if err := keychainSet(ctx, env+"/"+field, secret); err != nil {
+		return fmt.Errorf("storing %s/%s in the keychain: %v", env, field, err)
+	}
+	return nil
+}
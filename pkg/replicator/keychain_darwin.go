@@ -0,0 +1,51 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keychainGet reads the password of a generic item of the login keychain
+// with the security tool.
+func keychainGet(ctx context.Context, account string) (string, error) {
+	cmd := exec.CommandContext(ctx, "security", "find-generic-password", "-s", keychainService, "-a", account, "-w")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", withStderr(err, stderr.String())
+	}
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
+
+// keychainSet adds or updates the generic item. The command is written to
+// the interactive mode of security, so the secret isn't in the process list.
+func keychainSet(ctx context.Context, account, secret string) error {
+	cmd := exec.CommandContext(ctx, "security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf(
+		"add-generic-password -U -s %s -a %s -w %s\n",
+		securityQuote(keychainService),
+		securityQuote(account),
+		securityQuote(secret),
+	))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return withStderr(err, stderr.String())
+	}
+	// The interactive mode doesn't exit with the status of its commands.
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// securityQuote quotes s as a single word for the interactive mode of
+// security.
+func securityQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
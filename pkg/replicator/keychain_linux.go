@@ -0,0 +1,42 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// keychainGet reads the secret of the Secret Service, such as GNOME Keyring
+// or KWallet, with secret-tool.
+func keychainGet(ctx context.Context, account string) (string, error) {
+	cmd := exec.CommandContext(ctx, "secret-tool", "lookup", "service", keychainService, "account", account)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() == 0 {
+			return "", withStderr(err, "no such secret")
+		}
+		return "", withStderr(err, stderr.String())
+	}
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
+
+// keychainSet stores the secret with secret-tool, which reads it from stdin.
+func keychainSet(ctx context.Context, account, secret string) error {
+	cmd := exec.CommandContext(
+		ctx,
+		"secret-tool", "store",
+		"--label", keychainService+" "+account,
+		"service", keychainService,
+		"account", account,
+	)
+	cmd.Stdin = strings.NewReader(secret)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return withStderr(err, stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package replicator
+
+import (
+	"context"
+	"errors"
+)
+
+func keychainGet(ctx context.Context, account string) (string, error) {
+	return "", errors.New("only supported on macOS, Linux and Windows")
+}
+
+func keychainSet(ctx context.Context, account, secret string) error {
+	return errors.New("only supported on macOS, Linux and Windows")
+}
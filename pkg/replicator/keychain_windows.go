@@ -0,0 +1,89 @@
+package replicator
+
+import (
+	"context"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+var (
+	advapi32      = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead  = advapi32.NewProc("CredReadW")
+	procCredWrite = advapi32.NewProc("CredWriteW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+// credential is the CREDENTIALW structure of the Credential Manager.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// keychainTarget is the target name of the generic credential of account.
+func keychainTarget(account string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(keychainService + ":" + account)
+}
+
+// keychainGet reads the generic credential of the Credential Manager.
+func keychainGet(ctx context.Context, account string) (string, error) {
+	target, err := keychainTarget(account)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	ok, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ok == 0 {
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	blob := make([]byte, cred.CredentialBlobSize)
+	for i := range blob {
+		blob[i] = *(*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(cred.CredentialBlob)) + uintptr(i)))
+	}
+	return string(blob), nil
+}
+
+// keychainSet writes the generic credential, persisted for the user on this
+// machine.
+func keychainSet(ctx context.Context, account, secret string) error {
+	target, err := keychainTarget(account)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(account)
+	if err != nil {
+		return err
+	}
+	blob := []byte(secret)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+	ok, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Kubernetes runs the commands of the server in a pod with kubectl exec
+// instead of over SSH, for the databases only reachable inside a cluster.
+type Kubernetes struct {
+	// Context is the kubectl context, the current one by default.
+	Context   string `yaml:"context"`
+	Namespace string `yaml:"namespace"`
+	// Pod is the pod running the commands, or Selector a label selector,
+	// such as app=postgres, whose first running pod runs them.
+	Pod      string `yaml:"pod"`
+	Selector string `yaml:"selector"`
+	// Container is the container of the pod, its default one if empty.
+	Container string `yaml:"container"`
+}
+
+// name names the pod of k in the steps, as namespace/pod.
+func (k Kubernetes) name() string {
+	name := k.Pod
+	if name == "" {
+		name = k.Selector
+	}
+	if k.Namespace != "" {
+		name = k.Namespace + "/" + name
+	}
+	return name
+}
+
+// kubectlExitStatus is how kubectl exec reports the failure of the command,
+// as opposed to a failure of kubectl itself.
+const kubectlExitStatus = "command terminated with exit code"
+
+// KubernetesExecutor is the RemoteExecutor, FileTransferrer and FileReceiver
+// running the commands of the server in a pod with kubectl, with sh as the
+// images of the databases don't all have bash.
+type KubernetesExecutor struct {
+	config Kubernetes
+	// pod is the pod found by Connect.
+	pod string
+}
+
+func NewKubernetesExecutor(config Kubernetes) *KubernetesExecutor {
+	return &KubernetesExecutor{config: config}
+}
+
+// Connect finds the pod, the first running one matching the selector, and
+// checks it is running.
+func (e *KubernetesExecutor) Connect(ctx context.Context) error {
+	if e.config.Pod == "" && e.config.Selector == "" {
+		return permanent(errors.New("the kubernetes server needs a pod or a selector"))
+	}
+	if e.config.Pod != "" {
+		out, err := e.output(ctx, "get", "pod", e.config.Pod, "-o", "jsonpath={.status.phase}")
+		if err != nil {
+			return err
+		}
+		if phase := strings.TrimSpace(out); phase != "Running" {
+			return fmt.Errorf("pod %s is %s", e.config.Pod, phase)
+		}
+		e.pod = e.config.Pod
+		return nil
+	}
+
+	out, err := e.output(ctx, "get", "pods", "-l", e.config.Selector, "--field-selector=status.phase=Running", "-o", "jsonpath={.items[*].metadata.name}")
+	if err != nil {
+		return err
+	}
+	pods := strings.Fields(out)
+	if len(pods) == 0 {
+		return fmt.Errorf("no running pod matches %s", e.config.Selector)
+	}
+	e.pod = pods[0]
+	return nil
+}
+
+func (e *KubernetesExecutor) Close() error {
+	return nil
+}
+
+func (e *KubernetesExecutor) Run(ctx context.Context, cmd string) error {
+	_, err := e.Output(ctx, cmd)
+	return err
+}
+
+func (e *KubernetesExecutor) Output(ctx context.Context, cmd string) (string, error) {
+	var stdout bytes.Buffer
+	err := e.execInPod(ctx, cmd, nil, &stdout, nil)
+	return stdout.String(), err
+}
+
+// Pipe runs cmd with in as its stdin, writing its stdout and stderr to out.
+func (e *KubernetesExecutor) Pipe(ctx context.Context, cmd string, in io.Reader, out io.Writer) error {
+	return e.execInPod(ctx, cmd, in, out, out)
+}
+
+func (e *KubernetesExecutor) execInPod(ctx context.Context, cmd string, in io.Reader, stdout, stderr io.Writer) error {
+	if e.pod == "" {
+		return errors.New("not connected to " + e.config.name())
+	}
+	args := []string{"exec"}
+	if in != nil {
+		args = append(args, "-i")
+	}
+	args = append(args, e.pod)
+	if e.config.Container != "" {
+		args = append(args, "-c", e.config.Container)
+	}
+	args = append(args, "--", "sh", "-c", cmd)
+	return e.run(ctx, in, stdout, stderr, args...)
+}
+
+func (e *KubernetesExecutor) Size(ctx context.Context, remote string) (int64, error) {
+	out, err := e.Output(ctx, fmt.Sprintf("wc -c < %s", remote))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+func (e *KubernetesExecutor) CopyFrom(ctx context.Context, remote string, offset int64, w io.Writer) error {
+	return e.execInPod(ctx, fmt.Sprintf("tail -c +%d %s", offset+1, remote), nil, w, nil)
+}
+
+func (e *KubernetesExecutor) ReceivedSize(ctx context.Context, name string) (int64, error) {
+	out, err := e.Output(ctx, fmt.Sprintf("if test -f %s; then wc -c < %s; else echo 0; fi", name, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// Append writes to name through the stdin of kubectl exec, so the content,
+// such as a password, isn't in the arguments of kubectl.
+func (e *KubernetesExecutor) Append(ctx context.Context, name string) (io.WriteCloser, error) {
+	if e.pod == "" {
+		return nil, errors.New("not connected to " + e.config.name())
+	}
+	in, out := io.Pipe()
+	w := &podWriter{PipeWriter: out, done: make(chan error, 1)}
+	go func() {
+		err := e.execInPod(ctx, fmt.Sprintf("umask 077 && cat >> %s", name), in, ioutil.Discard, nil)
+		// A failed command stops the writes rather than block them.
+		in.CloseWithError(io.ErrClosedPipe)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// podWriter writes to the stdin of kubectl exec, closing it waits for the
+// command to complete.
+type podWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *podWriter) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+func (e *KubernetesExecutor) output(ctx context.Context, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	err := e.run(ctx, nil, &stdout, nil, args...)
+	return stdout.String(), err
+}
+
+// run runs kubectl with args in the context and namespace of the config,
+// also writing its stderr to stderr if not nil. The failures of the command
+// in the pod are permanent, while those of kubectl, such as a broken
+// connection to the cluster, may be retried.
+func (e *KubernetesExecutor) run(ctx context.Context, in io.Reader, stdout, stderr io.Writer, args ...string) error {
+	var global []string
+	if e.config.Context != "" {
+		global = append(global, "--context", e.config.Context)
+	}
+	if e.config.Namespace != "" {
+		global = append(global, "-n", e.config.Namespace)
+	}
+	cmd := exec.CommandContext(ctx, "kubectl", append(global, args...)...)
+	var errOut bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, stdout, &errOut
+	if stderr != nil {
+		cmd.Stderr = io.MultiWriter(stderr, &errOut)
+	}
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return permanent(ctx.Err())
+		}
+		err = withStderr(err, errOut.String())
+		if strings.Contains(errOut.String(), kubectlExitStatus) {
+			return permanent(err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Limits caps the resources the restore takes on the local machine, so a
+// scheduled refresh leaves it usable.
+type Limits struct {
+	// Jobs is how many jobs restore the dump in parallel, 1 by default.
+	Jobs int `yaml:"jobs"`
+	// CPUPercent caps the CPU of the restore commands, 100 being one core,
+	// with a systemd scope. The local server sessions of the restore don't
+	// use parallel workers either.
+	CPUPercent int `yaml:"cpu_percent"`
+	// WriteMBps caps how many MB of the dump per second are fed to the local
+	// server, restoring it as a single stream through pv.
+	WriteMBps int `yaml:"write_mbps"`
+}
+
+func (l Limits) set() bool {
+	return l.Jobs > 1 || l.CPUPercent > 0 || l.WriteMBps > 0
+}
+
+// restoreLimiter is implemented by the engines able to restore within
+// Limits.
+type restoreLimiter interface {
+	// LimitedRestoreCommand returns the RestoreCommand running limits.Jobs
+	// jobs, feeding at most limits.WriteMBps to the server, and keeping the
+	// server sessions to one core each if limits.CPUPercent is set.
+	LimitedRestoreCommand(dbConfig DB, database, fileName string, limits Limits) string
+	// LimitToolsCommand returns the local command failing if a tool the
+	// limits need is missing.
+	LimitToolsCommand(limits Limits) string
+}
+
+// checkLimits fails if the limits can't be applied to this restore.
+func (r *Replicator) checkLimits(ctx context.Context) error {
+	limits := r.config.Limits
+	if !limits.set() {
+		return nil
+	}
+	if limits.Jobs < 0 || limits.CPUPercent < 0 || limits.WriteMBps < 0 {
+		return errors.New("the limits can't be negative")
+	}
+	limiter, ok := r.Engine.(restoreLimiter)
+	switch {
+	case !ok:
+		return errors.New("the database engine can't restore within limits")
+	case r.useDriver:
+		return errors.New("the built-in client can't restore within limits")
+	case r.Downgrade:
+		return errors.New("the dump rewritten for an older server can't be restored within limits")
+	case limits.Jobs > 1 && limits.WriteMBps > 0:
+		return errors.New("limits.jobs can't be set with limits.write_mbps, which restores as a single stream")
+	}
+	if _, err := r.Local.Output(ctx, limiter.LimitToolsCommand(limits)); err != nil {
+		return fmt.Errorf("restoring within limits: %v", err)
+	}
+	return nil
+}
+
+// limitCommand runs cmd in a systemd scope capping its CPU, if
+// limits.cpu_percent is set.
+func (r *Replicator) limitCommand(cmd string) string {
+	if r.config.Limits.CPUPercent <= 0 {
+		return cmd
+	}
+	return fmt.Sprintf(
+		"systemd-run --user --scope --quiet -p CPUQuota=%d%% bash -c %s",
+		r.config.Limits.CPUPercent,
+		shellQuote(cmd),
+	)
+}
@@ -0,0 +1,144 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultLockDir returns ~/.rep/locks, or "" if the home directory is
+// unknown.
+func DefaultLockDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".rep", "locks")
+}
+
+// AcquireLock locks the lock file path, writing the pid of the process to
+// it, and returns the function removing it. When another process holds the
+// lock, its pid is returned instead. The lock is an advisory lock of the
+// file, which the system releases when its process dies, so a lock left by
+// a process that died is taken over.
+func AcquireLock(path string) (func(), int, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, 0, err
+		}
+		locked, err := lockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		if !locked {
+			pid, err := lockHolder(file)
+			file.Close()
+			if err != nil {
+				return nil, 0, fmt.Errorf("the lock %s is held by another process: %v", path, err)
+			}
+			return nil, pid, nil
+		}
+
+		// The file may have been removed by the process releasing it before
+		// this one locked it, locking a file no other process can find.
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		if current, err := os.Stat(path); err != nil || !os.SameFile(info, current) {
+			file.Close()
+			continue
+		}
+		if err := writeLockPid(file); err != nil {
+			releaseLock(file, path)
+			return nil, 0, err
+		}
+		return func() { releaseLock(file, path) }, 0, nil
+	}
+}
+
+// writeLockPid replaces the content of the locked file with the pid of the
+// process.
+func writeLockPid(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return err
+}
+
+// lockHolder reads the pid of the process holding the lock of file, waiting
+// a moment for a process that just locked it to write its pid.
+func lockHolder(file *os.File) (int, error) {
+	var err error
+	for attempt := 0; attempt < 20; attempt++ {
+		if attempt > 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		buf := make([]byte, 32)
+		var n int
+		n, err = file.ReadAt(buf, 0)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		var pid int
+		if pid, err = strconv.Atoi(strings.TrimSpace(string(buf[:n]))); err == nil && pid > 0 {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no pid in the lock: %v", err)
+}
+
+// ProcessAlive reports whether the process pid is running.
+func ProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess only finds running processes on Windows.
+		return true
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// lockLocalDB makes sure no other run replaces the local database at the
+// same time, as both would drop and rename the same databases. The lock is
+// released by the cleanup.
+func (r *Replicator) lockLocalDB(ctx context.Context) error {
+	if r.LockDir == "" {
+		return nil
+	}
+	db := r.config.LocalDB
+	where := r.targetName
+	if where == "" {
+		where = "local"
+	}
+	name := fileName(fmt.Sprintf("%s_%s_%d_%s", where, db.Host, db.Port, db.Database))
+	if err := os.MkdirAll(r.LockDir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(r.LockDir, name+".lock")
+	unlock, pid, err := AcquireLock(path)
+	if err != nil {
+		return err
+	}
+	if pid != 0 {
+		return permanent(fmt.Errorf("local database %s is being replaced by another run of rep, process %d", db.Database, pid))
+	}
+	r.onCleanup(func(ctx context.Context) error {
+		unlock()
+		return nil
+	})
+	return nil
+}
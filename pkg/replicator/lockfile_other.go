@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package replicator
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+func lockFile(file *os.File) (bool, error) {
+	return false, errors.New("locking files isn't supported on " + runtime.GOOS)
+}
+
+func releaseLock(file *os.File, path string) {
+	file.Close()
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package replicator
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes the exclusive flock of file, reporting false if another
+// process holds it.
+func lockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseLock removes the file while still locked, for no other process to
+// lock it once removed, then releases the lock by closing it.
+func releaseLock(file *os.File, path string) {
+	os.Remove(path)
+	file.Close()
+}
@@ -0,0 +1,54 @@
+package replicator
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 1
+	lockfileExclusiveLock   = 2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// lockOverlapped locks a byte past the pid, as the locks of Windows also
+// keep the other processes from reading the locked bytes.
+func lockOverlapped() *syscall.Overlapped {
+	return &syscall.Overlapped{OffsetHigh: 1}
+}
+
+// lockFile takes the exclusive lock of file with LockFileEx, reporting false
+// if another process holds it.
+func lockFile(file *os.File) (bool, error) {
+	ret, _, err := procLockFileEx.Call(
+		file.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(lockOverlapped())),
+	)
+	if ret != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
+
+// releaseLock unlocks and closes the file, then removes it. Windows can't
+// remove a file another process has opened, so a process about to lock it
+// keeps it.
+func releaseLock(file *os.File, path string) {
+	procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockOverlapped())))
+	file.Close()
+	os.Remove(path)
+}
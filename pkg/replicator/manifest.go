@@ -0,0 +1,237 @@
+package replicator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Version is the version of rep, set at build time with
+// -ldflags "-X github.com/phuocph/rep/pkg/replicator.Version=...".
+var Version = "dev"
+
+// Manifest records how a run produced its snapshot, so it can be audited or
+// reproduced later. Passwords and key paths are redacted from the commands.
+type Manifest struct {
+	RunID       string            `json:"run_id"`
+	ToolVersion string            `json:"tool_version"`
+	StartedAt   time.Time         `json:"started_at"`
+	FinishedAt  time.Time         `json:"finished_at"`
+	Succeeded   bool              `json:"succeeded"`
+	Error       string            `json:"error,omitempty"`
+	Source      ManifestDatabase  `json:"source"`
+	Target      ManifestDatabase  `json:"target"`
+	Mode        string            `json:"mode"`
+	Pipeline    []string          `json:"pipeline"`
+	Commands    []ManifestCommand `json:"commands"`
+	// Steps are the steps run until the manifest was written, before the
+	// cleanup.
+	Steps    []StepTiming      `json:"steps"`
+	Snapshot *ManifestSnapshot `json:"snapshot,omitempty"`
+}
+
+type ManifestDatabase struct {
+	Host          string `json:"host"`
+	Engine        string `json:"engine"`
+	Database      string `json:"database"`
+	ServerVersion string `json:"server_version,omitempty"`
+}
+
+// ManifestCommand is a command run by a step, Where being server, local or
+// target.
+type ManifestCommand struct {
+	Where   string `json:"where"`
+	Command string `json:"command"`
+	Script  string `json:"script,omitempty"`
+}
+
+// ManifestSnapshot identifies the dump restored by the run.
+type ManifestSnapshot struct {
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+}
+
+// versionReporter is implemented by the engines that can report the version
+// of the database server.
+type versionReporter interface {
+	ServerVersionCommand(db DB) string
+}
+
+// DefaultManifestDir is where Run writes the manifests by default,
+// ~/.rep/manifests.
+func DefaultManifestDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".rep", "manifests")
+}
+
+// ReadManifest reads the manifest of the run id from dir, or from the file
+// id if it exists.
+func ReadManifest(dir, id string) (*Manifest, error) {
+	file := id
+	if _, err := os.Stat(file); err != nil {
+		file = filepath.Join(dir, id+".json")
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", file, err)
+	}
+	return manifest, nil
+}
+
+func (r *Replicator) newManifest(started time.Time) *Manifest {
+	manifest := &Manifest{
+		RunID:       r.runID,
+		ToolVersion: Version,
+		StartedAt:   started,
+		Source: ManifestDatabase{
+			Host:     r.config.Server.Host,
+			Engine:   r.config.Server.DB.Engine,
+			Database: r.config.Server.DB.Database,
+		},
+		Target: ManifestDatabase{
+			Host:     "local",
+			Engine:   r.config.LocalDB.Engine,
+			Database: r.config.LocalDB.Database,
+		},
+		Mode:     r.config.Server.Mode,
+		Pipeline: []string{},
+		Commands: []ManifestCommand{},
+	}
+	if manifest.Source.Engine == "" {
+		manifest.Source.Engine = "postgres"
+	}
+	if manifest.Target.Engine == "" {
+		manifest.Target.Engine = manifest.Source.Engine
+	}
+	if manifest.Mode == "" {
+		manifest.Mode = "remote"
+	}
+	if r.target != nil {
+		manifest.Target.Host = r.targetName
+	}
+	for _, stage := range r.Pipeline {
+		manifest.Pipeline = append(manifest.Pipeline, stage.Name())
+	}
+	return manifest
+}
+
+// recordCommand adds cmd to the manifest of the run, if any, and tells the
+// ProgressSink with Verbose.
+func (r *Replicator) recordCommand(where, cmd, script string) {
+	if r.Verbose {
+		logger, ok := r.progress().(CommandLogger)
+		if !ok {
+			logger = ProgressWriter{W: r.Output}
+		}
+		logger.Command(r.redact(cmd), r.redact(script))
+	}
+	if r.manifest == nil {
+		return
+	}
+	r.manifest.Commands = append(r.manifest.Commands, ManifestCommand{
+		Where:   where,
+		Command: r.redact(cmd),
+		Script:  r.redact(script),
+	})
+}
+
+// localWhere names where the local commands run in the manifest.
+func (r *Replicator) localWhere() string {
+	if r.target != nil {
+		return "target"
+	}
+	return "local"
+}
+
+// captureServerVersion records the version of the database server in the
+// manifest, a failure only leaves it out.
+func (r *Replicator) captureServerVersion(ctx context.Context, exec outputExecutor, db DB) {
+	reporter, ok := r.Engine.(versionReporter)
+	if !ok || r.manifest == nil {
+		return
+	}
+	out, err := exec.Output(ctx, reporter.ServerVersionCommand(db))
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Getting the server version failed: %v\n", err)
+		return
+	}
+	r.manifest.Source.ServerVersion = strings.TrimSpace(out)
+}
+
+// fileChecksum returns the SHA-256 of a transferred file.
+func (r *Replicator) fileChecksum(ctx context.Context, name string) (string, error) {
+	if r.target != nil {
+		out, err := r.target.Output(ctx, fmt.Sprintf("sha256sum %s", name))
+		if err != nil {
+			return "", err
+		}
+		return strings.Fields(out + " ")[0], nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeManifest completes the manifest of the run and writes it to
+// ManifestDir, before the dump is cleaned up. A failure is only reported.
+func (r *Replicator) writeManifest(ctx context.Context, runErr error) {
+	if r.manifest == nil || r.ManifestDir == "" {
+		return
+	}
+
+	manifest := r.manifest
+	manifest.FinishedAt = time.Now()
+	manifest.Succeeded = runErr == nil
+	r.endStepTiming()
+	manifest.Steps = append([]StepTiming{}, r.timings...)
+	if runErr != nil {
+		manifest.Error = r.redact(runErr.Error())
+	}
+	if r.localDumpFile != "" {
+		sum, err := r.fileChecksum(ctx, r.localDumpFile)
+		if err != nil {
+			fmt.Fprintf(r.Output, "   Hashing %s failed: %v\n", r.localDumpFile, err)
+		} else {
+			manifest.Snapshot = &ManifestSnapshot{File: r.localDumpFile, SHA256: sum}
+		}
+	}
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(r.ManifestDir, 0700)
+	}
+	file := filepath.Join(r.ManifestDir, manifest.RunID+".json")
+	if err == nil {
+		err = ioutil.WriteFile(file, append(raw, '\n'), 0600)
+	}
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Writing manifest failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(r.Output, "   Manifest written to %s\n", file)
+}
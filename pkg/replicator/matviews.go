@@ -0,0 +1,23 @@
+package replicator
+
+import "context"
+
+// matviewRefresher is implemented by the engines with materialized views,
+// which a restore can leave unpopulated.
+type matviewRefresher interface {
+	// RefreshMatviewsScript returns the script refreshing the unpopulated
+	// materialized views of the database it runs on, those they read from
+	// first.
+	RefreshMatviewsScript() string
+}
+
+// refreshMatviews refreshes the unpopulated materialized views of the
+// restored database if the config asks for it.
+func (r *Replicator) refreshMatviews(ctx context.Context, database string) error {
+	engine, ok := r.Engine.(matviewRefresher)
+	if !ok || !r.config.RefreshMatviews {
+		return nil
+	}
+	r.printStep("Refresh unpopulated materialized views of %s", database)
+	return r.runScript(ctx, database, engine.RefreshMatviewsScript())
+}
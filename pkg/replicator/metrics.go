@@ -0,0 +1,104 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metrics pushes the metrics of each run to a Prometheus Pushgateway, so an
+// alert can fire when the scheduled refreshes fail or stop running.
+type Metrics struct {
+	// Pushgateway is the URL of the Pushgateway, such as
+	// http://pushgateway:9091.
+	Pushgateway string `yaml:"pushgateway"`
+	// Job is the job of the metrics, rep by default. They are grouped by
+	// local database.
+	Job string `yaml:"job"`
+}
+
+// metricsPushTimeout bounds the push, which runs after the cleanup.
+const metricsPushTimeout = 30 * time.Second
+
+// pushMetrics pushes the metrics of the result of the run to the
+// Pushgateway of the config. Its failure is only reported, it doesn't fail
+// the run.
+func (r *Replicator) pushMetrics(ctx context.Context) {
+	metrics := r.config.Metrics
+	if metrics.Pushgateway == "" {
+		return
+	}
+	job := metrics.Job
+	if job == "" {
+		job = "rep"
+	}
+	var body bytes.Buffer
+	writeMetrics(&body, r.result)
+	// POST only replaces the metrics pushed, so a failed run leaves the
+	// last success time of the previous one.
+	pushURL := fmt.Sprintf("%s/metrics/job/%s/database/%s", strings.TrimSuffix(metrics.Pushgateway, "/"), url.PathEscape(job), url.PathEscape(r.config.LocalDB.Database))
+	if ctx.Err() != nil {
+		// The run was canceled, its metrics are still pushed.
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, metricsPushTimeout)
+	defer cancel()
+	err := func() error {
+		req, err := http.NewRequest(http.MethodPost, pushURL, &body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s answered %s", metrics.Pushgateway, resp.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Pushing metrics failed: %v\n", err)
+	}
+}
+
+// writeMetrics writes the metrics of result in the text format of
+// Prometheus.
+func writeMetrics(w io.Writer, result RunResult) {
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+	success := 0.0
+	if result.Succeeded {
+		success = 1
+	}
+	gauge("rep_last_run_success", "Whether the last run succeeded.", success)
+	gauge("rep_last_run_timestamp_seconds", "When the last run finished.", float64(result.FinishedAt.Unix()))
+	gauge("rep_last_run_duration_seconds", "How long the last run took.", result.Seconds)
+	if result.Succeeded {
+		gauge("rep_last_success_timestamp_seconds", "When the last successful run finished.", float64(result.FinishedAt.Unix()))
+	}
+	if result.DumpBytes > 0 {
+		gauge("rep_last_run_dump_bytes", "The size of the dump of the last run.", float64(result.DumpBytes))
+	}
+
+	var phases []string
+	for phase := range result.Phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	if len(phases) > 0 {
+		fmt.Fprintf(w, "# HELP rep_last_run_phase_duration_seconds How long the phases of the last run took.\n# TYPE rep_last_run_phase_duration_seconds gauge\n")
+	}
+	for _, phase := range phases {
+		fmt.Fprintf(w, "rep_last_run_phase_duration_seconds{phase=%q} %g\n", phase, result.Phases[phase])
+	}
+}
@@ -0,0 +1,194 @@
+package replicator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// mongoEngine replicates MongoDB databases with mongodump, mongorestore and
+// mongosh. Scripts are mongosh JavaScript.
+//
+// MongoDB can't rename a database either, so the swap moves the collections
+// one by one. Unlike the MySQL swap it is not atomic, but a failure moves the
+// collections back where they were.
+type mongoEngine struct{}
+
+// mongoConnectionErrors are the errors of the MongoDB tools and mongosh
+// when the server can't be reached.
+var mongoConnectionErrors = regexp.MustCompile(`MongoServerSelectionError|MongoNetworkError|ECONNREFUSED|no reachable servers`)
+
+// buildMongoCommand authenticates against admin, where the users of a
+// deployment are usually defined. Servers without authentication have no
+// username. mongodump and mongorestore read the password from PasswordFile,
+// given as their config file.
+func buildMongoCommand(program string, dbConfig DB) string {
+	cmd := fmt.Sprintf("%s --host %s --port %d", program, dbConfig.Host, dbConfig.Port)
+	if dbConfig.Username == "" {
+		return cmd
+	}
+	cmd += fmt.Sprintf(" -u %s --authenticationDatabase admin", dbConfig.Username)
+	switch {
+	case dbConfig.PasswordFile != "":
+		return cmd + " --config=" + dbConfig.PasswordFile
+	case dbConfig.Password != "":
+		return cmd + " -p " + shellQuote(dbConfig.Password)
+	}
+	return cmd
+}
+
+// mongoshCommand runs js with mongosh on database. mongosh has no option
+// reading the password from a file, so with a PasswordFile it starts without
+// a connection and js first connects, reading the password from the file.
+func mongoshCommand(dbConfig DB, database, js string) string {
+	if dbConfig.Username == "" || dbConfig.PasswordFile == "" {
+		cmd := buildMongoCommand("mongosh", dbConfig) + " --quiet"
+		if database != "" {
+			cmd += " " + database
+		}
+		return cmd + " --eval " + shellQuote(js)
+	}
+	if database == "" {
+		database = "admin"
+	}
+	connect := fmt.Sprintf(
+		`db = connect(%s); db.auth(%s, JSON.parse(require("fs").readFileSync(%s, "utf8").replace(/^password: /, ""))); db = db.getSiblingDB(%s); `,
+		jsString(fmt.Sprintf("mongodb://%s:%d/admin", dbConfig.Host, dbConfig.Port)),
+		jsString(dbConfig.Username),
+		jsString(dbConfig.PasswordFile),
+		jsString(database),
+	)
+	return "mongosh --nodb --quiet --eval " + shellQuote(connect+js)
+}
+
+// PasswordFileContent is a config file of mongodump and mongorestore, the
+// password being a JSON string mongosh parses as well.
+func (mongoEngine) PasswordFileContent(dbConfig DB) string {
+	return "password: " + jsString(dbConfig.Password) + "\n"
+}
+
+// DumpCommand dumps into a gzipped archive through a partial file, like the
+// Postgres engine.
+func (mongoEngine) DumpCommand(dbConfig DB, fileName string) string {
+	return fmt.Sprintf(
+		"umask 077 && %s --db %s --archive=%s.partial --gzip%s && mv %s.partial %s",
+		buildMongoCommand("mongodump", dbConfig),
+		dbConfig.Database,
+		fileName,
+		shellArgs(dbConfig.DumpOptions),
+		fileName,
+		fileName,
+	)
+}
+
+// RestoreCommand renames the namespaces of the archive so its collections
+// land in database, whatever the name of the server database.
+func (mongoEngine) RestoreCommand(dbConfig DB, database, fileName string) string {
+	return fmt.Sprintf(
+		"%s --archive=%s --gzip --drop --nsFrom '$db$.$coll$' --nsTo '%s.$coll$'%s",
+		buildMongoCommand("mongorestore", dbConfig),
+		fileName,
+		database,
+		shellArgs(dbConfig.RestoreOptions),
+	)
+}
+
+// ScriptCommand runs the script with mongosh, which exits with an error on
+// the first uncaught exception.
+func (mongoEngine) ScriptCommand(dbConfig DB, database, fileName string) string {
+	// The file name is a shell word, given to load through the environment.
+	return "REP_SCRIPT=" + fileName + " " + mongoshCommand(dbConfig, database, "load(process.env.REP_SCRIPT)")
+}
+
+func (mongoEngine) IsConnectionError(err error) bool {
+	var cmdErr *commandError
+	return errors.As(err, &cmdErr) && mongoConnectionErrors.MatchString(cmdErr.stderr)
+}
+
+// jsString quotes s as a JavaScript string literal.
+func jsString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+func (mongoEngine) ServerVersionCommand(dbConfig DB) string {
+	return mongoshCommand(dbConfig, "", "db.version()")
+}
+
+func (mongoEngine) PingScript() string {
+	return `db.adminCommand({ping: 1})`
+}
+
+// CreateDatabaseScript does nothing, MongoDB creates a database on its first
+// write.
+func (mongoEngine) CreateDatabaseScript(database string) string {
+	return "// " + jsString(database) + " is created on its first write"
+}
+
+func (mongoEngine) DropDatabaseScript(database string) string {
+	return fmt.Sprintf("db.getSiblingDB(%s).dropDatabase()", jsString(database))
+}
+
+// SwapScripts moves the collections of target to backup, then those of
+// restored to target, moving them back if either fails.
+func (mongoEngine) SwapScripts(restored, target, backup string) []string {
+	return []string{fmt.Sprintf(`%s
+try {
+  moveCollections(%s, %s);
+} catch (e) {
+  moveCollections(%s, %s);
+  throw e;
+}
+try {
+  moveCollections(%s, %s);
+} catch (e) {
+  moveCollections(%s, %s);
+  moveCollections(%s, %s);
+  throw e;
+}
+`,
+		mongoMoveCollections,
+		jsString(target), jsString(backup),
+		jsString(backup), jsString(target),
+		jsString(restored), jsString(target),
+		jsString(target), jsString(restored),
+		jsString(backup), jsString(target),
+	)}
+}
+
+// DatabaseListCommand gives the size of the databases on disk, MongoDB not
+// tracking their last activity.
+func (mongoEngine) DatabaseListCommand(dbConfig DB) string {
+	return mongoshCommand(dbConfig, "", `db.adminCommand({listDatabases: 1}).databases.forEach(function (d) { print(d.name + "|" + d.sizeOnDisk + "|") })`)
+}
+
+func (mongoEngine) DatabasesCommand(dbConfig DB, database string) string {
+	return mongoshCommand(dbConfig, "", `db.adminCommand({listDatabases: 1, nameOnly: true}).databases.forEach(function (d) { print(d.name) })`)
+}
+
+// mongoMoveCollections defines moveCollections, which moves the collections
+// and views of the database from into the database to. Indexes move along
+// with their collection.
+const mongoMoveCollections = `function moveCollections(fromName, toName) {
+  const from = db.getSiblingDB(fromName);
+  const to = db.getSiblingDB(toName);
+  from.getCollectionInfos({type: "collection"}).forEach(function (info) {
+    if (info.name.startsWith("system.")) {
+      return;
+    }
+    const res = db.adminCommand({
+      renameCollection: fromName + "." + info.name,
+      to: toName + "." + info.name,
+      dropTarget: true,
+    });
+    if (!res.ok) {
+      throw new Error("moving collection " + info.name + ": " + res.errmsg);
+    }
+  });
+  from.getCollectionInfos({type: "view"}).forEach(function (info) {
+    to.getCollection(info.name).drop();
+    to.createView(info.name, info.options.viewOn, info.options.pipeline || []);
+    from.getCollection(info.name).drop();
+  });
+}`
@@ -0,0 +1,153 @@
+package replicator
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// mysqlEngine replicates MySQL and MariaDB databases with mysqldump and the
+// mysql client.
+//
+// MySQL can't rename a database, so the swap moves the tables instead, in a
+// single atomic RENAME TABLE. Only base tables are moved: views, triggers
+// and routines of the server database are not replicated.
+type mysqlEngine struct{}
+
+// mysqlConnectionErrors are the client errors raised before any statement
+// ran: can't connect (2002, 2003), unknown host (2005) and lost connection
+// (2006, 2013).
+var mysqlConnectionErrors = regexp.MustCompile(`ERROR 20(0[2356]|13)`)
+
+func buildMySQLCommand(program string, dbConfig DB) string {
+	if dbConfig.PasswordFile != "" {
+		// The option file must be the first option.
+		return fmt.Sprintf(
+			"%s --defaults-extra-file=%s -h %s -P %d -u %s",
+			program,
+			dbConfig.PasswordFile,
+			dbConfig.Host,
+			dbConfig.Port,
+			dbConfig.Username,
+		)
+	}
+	return fmt.Sprintf(
+		"MYSQL_PWD=%s %s -h %s -P %d -u %s",
+		shellQuote(dbConfig.Password),
+		program,
+		dbConfig.Host,
+		dbConfig.Port,
+		dbConfig.Username,
+	)
+}
+
+// PasswordFileContent is an option file giving the password to the clients.
+func (mysqlEngine) PasswordFileContent(dbConfig DB) string {
+	password := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(dbConfig.Password)
+	return "[client]\npassword=\"" + password + "\"\n"
+}
+
+// DumpCommand dumps into a partial file that is only renamed to fileName
+// once mysqldump succeeded, like the Postgres engine.
+func (mysqlEngine) DumpCommand(dbConfig DB, fileName string) string {
+	return fmt.Sprintf(
+		"umask 077 && %s --single-transaction --quick --skip-triggers%s %s > %s.partial && mv %s.partial %s",
+		buildMySQLCommand("mysqldump", dbConfig),
+		shellArgs(dbConfig.DumpOptions),
+		dbConfig.Database,
+		fileName,
+		fileName,
+		fileName,
+	)
+}
+
+func (mysqlEngine) RestoreCommand(dbConfig DB, database, fileName string) string {
+	return fmt.Sprintf(
+		"%s%s %s < %s",
+		buildMySQLCommand("mysql", dbConfig),
+		shellArgs(dbConfig.RestoreOptions),
+		database,
+		fileName,
+	)
+}
+
+func (mysqlEngine) ScriptCommand(dbConfig DB, database, fileName string) string {
+	return fmt.Sprintf("%s %s < %s", buildMySQLCommand("mysql", dbConfig), database, fileName)
+}
+
+func (mysqlEngine) IsConnectionError(err error) bool {
+	var cmdErr *commandError
+	return errors.As(err, &cmdErr) && mysqlConnectionErrors.MatchString(cmdErr.stderr)
+}
+
+func quoteMySQLIdent(s string) string {
+	return "`" + strings.Replace(s, "`", "``", -1) + "`"
+}
+
+func (mysqlEngine) ServerVersionCommand(dbConfig DB) string {
+	return buildMySQLCommand("mysql", dbConfig) + ` -N -B -e "SELECT VERSION()"`
+}
+
+func (mysqlEngine) PingScript() string {
+	return "SELECT 1"
+}
+
+func (mysqlEngine) CreateDatabaseScript(database string) string {
+	return fmt.Sprintf("CREATE DATABASE %s", quoteMySQLIdent(database))
+}
+
+func (mysqlEngine) DropDatabaseScript(database string) string {
+	return fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteMySQLIdent(database))
+}
+
+// mysqlTableMoves selects "`db`.`table` TO `to`.`table`" for each table of
+// db, ordered by order among other moves.
+func mysqlTableMoves(db, to string, order int) string {
+	return fmt.Sprintf(
+		"SELECT %d AS ord, CONCAT(%s, REPLACE(table_name, '`', '``'), %s, REPLACE(table_name, '`', '``'), '`') AS move "+
+			"FROM information_schema.tables WHERE table_schema = %s AND table_type = 'BASE TABLE'",
+		order,
+		quoteLiteral(quoteMySQLIdent(db)+".`"),
+		quoteLiteral("` TO "+quoteMySQLIdent(to)+".`"),
+		quoteLiteral(db),
+	)
+}
+
+// mysqlRenameTables runs the moves in one RENAME TABLE, after creating
+// database.
+func mysqlRenameTables(database string, moves ...string) string {
+	return fmt.Sprintf(
+		"SET SESSION group_concat_max_len = 16777216;\n"+
+			"CREATE DATABASE IF NOT EXISTS %s;\n"+
+			"SET @moves = (SELECT GROUP_CONCAT(move ORDER BY ord SEPARATOR ', ') FROM (%s) AS moves);\n"+
+			"SET @swap = IF(@moves IS NULL, 'DO 0', CONCAT('RENAME TABLE ', @moves));\n"+
+			"PREPARE swap FROM @swap;\n"+
+			"EXECUTE swap;\n"+
+			"DEALLOCATE PREPARE swap;\n",
+		quoteMySQLIdent(database),
+		strings.Join(moves, " UNION ALL "),
+	)
+}
+
+// SwapScripts moves the tables of target to backup and the tables of restored to
+// target in one RENAME TABLE, so target is never left half replaced.
+func (mysqlEngine) SwapScripts(restored, target, backup string) []string {
+	return []string{fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;\n", quoteMySQLIdent(backup)) +
+		mysqlRenameTables(
+			target,
+			mysqlTableMoves(target, backup, 0),
+			mysqlTableMoves(restored, target, 1),
+		)}
+}
+
+// DatabaseListCommand sizes the databases with the data and indexes of their
+// tables, and gives the last update of their tables, which InnoDB only
+// tracks since the server started.
+func (mysqlEngine) DatabaseListCommand(dbConfig DB) string {
+	return buildMySQLCommand("mysql", dbConfig) + ` -N -B -e "SELECT CONCAT_WS('|', s.schema_name, COALESCE(SUM(t.data_length + t.index_length), 0), COALESCE(DATE_FORMAT(MAX(t.update_time), '%Y-%m-%d %H:%i'), '')) FROM information_schema.schemata s LEFT JOIN information_schema.tables t ON t.table_schema = s.schema_name WHERE s.schema_name NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys') GROUP BY s.schema_name ORDER BY SUM(t.data_length + t.index_length) DESC"`
+}
+
+func (mysqlEngine) DatabasesCommand(dbConfig DB, database string) string {
+	return fmt.Sprintf("%s -N -B -e \"SHOW DATABASES\"", buildMySQLCommand("mysql", dbConfig))
+}
@@ -0,0 +1,121 @@
+package replicator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// maxUserNameLength keeps the generated database names well within the 63
+// bytes limit of Postgres identifiers. It also bounds the database name they
+// contain.
+const maxUserNameLength = 20
+
+// newRunID returns the id of a run, its start time and a random suffix keeping
+// concurrent runs apart, such as 20060102150405_1a2b3c. It can be used
+// unquoted in SQL and in file names.
+func newRunID() string {
+	random := make([]byte, 3)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%s_%s", time.Now().UTC().Format("20060102150405"), hex.EncodeToString(random))
+}
+
+// tempDBName returns the name of a temp database of the run, such as
+// restored_mydb_20060102150405_1a2b3c.
+func (r *Replicator) tempDBName(kind string) string {
+	return fmt.Sprintf("%s_%s_%s", kind, sanitizeName(r.config.LocalDB.Database), r.runID)
+}
+
+// localUserName returns the name of the user running rep, used to keep the
+// artifacts of users sharing a machine apart.
+func localUserName() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return sanitizeName(name)
+}
+
+// sanitizeName turns s into a lowercase name that can be used unquoted in SQL
+// and in file names.
+func sanitizeName(s string) string {
+	// Windows user names are DOMAIN\user.
+	if i := strings.LastIndex(s, `\`); i >= 0 {
+		s = s[i+1:]
+	}
+
+	var name strings.Builder
+	for _, c := range strings.ToLower(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '_':
+			name.WriteRune(c)
+		default:
+			name.WriteRune('_')
+		}
+	}
+
+	if name.Len() == 0 {
+		return "unknown"
+	}
+	if name.Len() > maxUserNameLength {
+		return name.String()[:maxUserNameLength]
+	}
+	return name.String()
+}
+
+// checkNamesFree fails if one of the temp databases of the run already exists,
+// which would mean another run uses the same names. Engines that can't list
+// the databases are not checked.
+func (r *Replicator) checkNamesFree(ctx context.Context, databases ...string) error {
+	lister, ok := r.Engine.(databaseLister)
+	if !ok {
+		return nil
+	}
+	existing, err := r.localDatabases(ctx, lister)
+	if err != nil {
+		return err
+	}
+	for _, database := range databases {
+		if containsString(existing, database) {
+			return fmt.Errorf("local database %s already exists, another run may be using it", database)
+		}
+	}
+	return nil
+}
+
+// checkFileFree fails if the local file already exists, like checkNamesFree.
+func (r *Replicator) checkFileFree(ctx context.Context, file string) error {
+	out, err := r.Local.Output(ctx, fmt.Sprintf("test -e %s && echo exists || true", file))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) != "" {
+		return fmt.Errorf("local file %s already exists, another run may be using it", file)
+	}
+	return nil
+}
+
+// RunID returns the id of the run, found in the names of its temp databases
+// and files and of its manifest.
+func (r *Replicator) RunID() string {
+	return r.runID
+}
+
+// fileName turns s into a file name, keeping its letters, digits, dots and
+// dashes.
+func fileName(s string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-':
+			return c
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,441 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// NoShellExecutor is the LocalExecutor running commands without a shell, on
+// Windows. It understands the part of the shell the local commands of a run
+// use: quoted words, leading environment variables, &&, || and ;, output
+// discarded to /dev/null, and the rm, mv, mkdir, chmod, test, echo, ls, cp,
+// ln, command, true, false and umask builtins, umask doing nothing as
+// Windows has no permission bits to mask. Pipes and substitutions, which
+// some options need, fail asking for bash.
+type NoShellExecutor struct{}
+
+// defaultLocalExecutor returns the ShellExecutor, with sh where bash is
+// missing, or the NoShellExecutor on Windows, where a bash on the PATH may
+// run in WSL.
+func defaultLocalExecutor() LocalExecutor {
+	if runtime.GOOS == "windows" {
+		return NoShellExecutor{}
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		return ShellExecutor{Shell: "sh"}
+	}
+	return ShellExecutor{}
+}
+
+func (e NoShellExecutor) Run(ctx context.Context, runCmd string) error {
+	_, err := e.Output(ctx, runCmd)
+	return err
+}
+
+func (NoShellExecutor) Output(ctx context.Context, runCmd string) (string, error) {
+	list, err := parseCommandList(runCmd)
+	if err != nil {
+		return "", permanent(err)
+	}
+
+	var stdout bytes.Buffer
+	var status error
+	for i, cmd := range list {
+		if i > 0 && (cmd.op == "&&" && status != nil || cmd.op == "||" && status == nil) {
+			continue
+		}
+		status = cmd.run(ctx, &stdout)
+		if ctx.Err() != nil {
+			return "", permanent(ctx.Err())
+		}
+	}
+	if status != nil {
+		return "", status
+	}
+	return stdout.String(), nil
+}
+
+// simpleCommand is a command of a list, run after the previous one as op,
+// &&, || or ; says.
+type simpleCommand struct {
+	op            string
+	words         []string
+	discardStdout bool
+	discardStderr bool
+}
+
+var envAssignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// errNeedsShell is the error of the commands NoShellExecutor can't run.
+type errNeedsShell struct {
+	cmd string
+	why string
+}
+
+func (e errNeedsShell) Error() string {
+	return fmt.Sprintf("running %q needs bash, which is missing: %s", e.cmd, e.why)
+}
+
+// parseCommandList splits line into its simple commands and their words,
+// removing the quotes like the shell.
+func parseCommandList(line string) ([]simpleCommand, error) {
+	var list []simpleCommand
+	current := simpleCommand{}
+	var word strings.Builder
+	inWord := false
+	flush := func() {
+		if inWord {
+			current.words = append(current.words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	end := func(op string) error {
+		flush()
+		if len(current.words) == 0 {
+			return errNeedsShell{line, "empty command before " + op}
+		}
+		list = append(list, current)
+		current = simpleCommand{op: op}
+		return nil
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		next := byte(0)
+		if i+1 < len(line) {
+			next = line[i+1]
+		}
+		switch {
+		case c == '\'':
+			j := strings.IndexByte(line[i+1:], '\'')
+			if j < 0 {
+				return nil, errNeedsShell{line, "unterminated quote"}
+			}
+			word.WriteString(line[i+1 : i+1+j])
+			inWord = true
+			i += j + 1
+		case c == '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '$' || line[i] == '`' {
+					return nil, errNeedsShell{line, "substitution"}
+				}
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, errNeedsShell{line, "unterminated quote"}
+			}
+			inWord = true
+		case c == '\\' && strings.IndexByte("'\" \\", next) >= 0 && next != 0:
+			// Other backslashes are kept, for the Windows paths.
+			word.WriteByte(next)
+			inWord = true
+			i++
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '&' && next == '&', c == '|' && next == '|':
+			if err := end(line[i : i+2]); err != nil {
+				return nil, err
+			}
+			i++
+		case c == ';':
+			if err := end(";"); err != nil {
+				return nil, err
+			}
+		case c == '>' && !inWord, c == '2' && next == '>' && !inWord:
+			stderr := c == '2'
+			if stderr {
+				i++
+			}
+			rest := strings.TrimLeft(line[i+1:], " ")
+			if !strings.HasPrefix(rest, "/dev/null") {
+				return nil, errNeedsShell{line, "redirection"}
+			}
+			if stderr {
+				current.discardStderr = true
+			} else {
+				current.discardStdout = true
+			}
+			i = len(line) - len(rest) + len("/dev/null") - 1
+		case strings.IndexByte("|&<>$`()", c) >= 0:
+			return nil, errNeedsShell{line, fmt.Sprintf("%q", c)}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	flush()
+	if len(current.words) > 0 {
+		list = append(list, current)
+	} else if current.op != ";" && current.op != "" {
+		return nil, errNeedsShell{line, "missing command after " + current.op}
+	}
+	for _, cmd := range list {
+		if cmd.words[0] == "{" || cmd.words[0] == "!" {
+			return nil, errNeedsShell{line, "compound command"}
+		}
+	}
+	return list, nil
+}
+
+// run runs the command, writing its output to stdout.
+func (c simpleCommand) run(ctx context.Context, stdout io.Writer) error {
+	words := c.words
+	var env []string
+	for len(words) > 0 && envAssignment.MatchString(words[0]) {
+		env = append(env, words[0])
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	if c.discardStdout {
+		stdout = ioutil.Discard
+	}
+
+	if builtin, ok := noShellBuiltins[words[0]]; ok {
+		return builtin(words[1:], stdout)
+	}
+	cmd := exec.CommandContext(ctx, words[0], words[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = stdout, &stderr
+	if c.discardStderr {
+		cmd.Stderr = ioutil.Discard
+	}
+	if err := cmd.Run(); err != nil {
+		return withStderr(err, stderr.String())
+	}
+	return nil
+}
+
+// errFalse is the failure of the builtins, such as a false test.
+var errFalse = errors.New("exit status 1")
+
+var noShellBuiltins map[string]func(args []string, stdout io.Writer) error
+
+func init() {
+	noShellBuiltins = map[string]func(args []string, stdout io.Writer) error{
+		"true":  func([]string, io.Writer) error { return nil },
+		"false": func([]string, io.Writer) error { return errFalse },
+		"umask": func([]string, io.Writer) error { return nil },
+		"echo": func(args []string, stdout io.Writer) error {
+			_, err := fmt.Fprintln(stdout, strings.Join(args, " "))
+			return err
+		},
+		"rm":      builtinRm,
+		"mv":      builtinMv,
+		"mkdir":   builtinMkdir,
+		"chmod":   builtinChmod,
+		"test":    builtinTest,
+		"ls":      builtinLs,
+		"cp":      builtinCp,
+		"ln":      builtinLn,
+		"command": builtinCommand,
+	}
+}
+
+// options splits the leading -x options of args from the operands.
+func options(args []string) (string, []string) {
+	var flags string
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		flags += args[0][1:]
+		args = args[1:]
+	}
+	return flags, args
+}
+
+func builtinRm(args []string, _ io.Writer) error {
+	flags, files := options(args)
+	for _, file := range files {
+		var err error
+		if strings.ContainsAny(flags, "rR") {
+			err = os.RemoveAll(file)
+		} else {
+			err = os.Remove(file)
+		}
+		if err != nil && !(os.IsNotExist(err) && strings.Contains(flags, "f")) {
+			return err
+		}
+	}
+	return nil
+}
+
+func builtinMv(args []string, _ io.Writer) error {
+	_, files := options(args)
+	if len(files) != 2 {
+		return errors.New("mv: only renames a file to a file")
+	}
+	return os.Rename(files[0], files[1])
+}
+
+func builtinChmod(args []string, _ io.Writer) error {
+	_, args = options(args)
+	if len(args) < 2 {
+		return errors.New("chmod: missing operand")
+	}
+	m, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil {
+		return fmt.Errorf("chmod: only octal modes are supported, not %s", args[0])
+	}
+	for _, file := range args[1:] {
+		if err := os.Chmod(file, os.FileMode(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func builtinMkdir(args []string, _ io.Writer) error {
+	mode := os.FileMode(0777)
+	parents := false
+	var dirs []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-p":
+			parents = true
+		case "-m":
+			if i+1 == len(args) {
+				return errors.New("mkdir: missing mode")
+			}
+			i++
+			m, err := strconv.ParseUint(args[i], 8, 32)
+			if err != nil {
+				return fmt.Errorf("mkdir: invalid mode %s", args[i])
+			}
+			mode = os.FileMode(m)
+		default:
+			dirs = append(dirs, args[i])
+		}
+	}
+	for _, dir := range dirs {
+		var err error
+		if parents {
+			err = os.MkdirAll(dir, mode)
+		} else {
+			err = os.Mkdir(dir, mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func builtinTest(args []string, _ io.Writer) error {
+	negate := len(args) > 0 && args[0] == "!"
+	if negate {
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("test: unsupported expression %s", strings.Join(args, " "))
+	}
+	info, err := os.Stat(args[1])
+	var result bool
+	switch args[0] {
+	case "-e":
+		result = err == nil
+	case "-f":
+		result = err == nil && info.Mode().IsRegular()
+	case "-d":
+		result = err == nil && info.IsDir()
+	default:
+		return fmt.Errorf("test: unsupported operator %s", args[0])
+	}
+	if result == negate {
+		return errFalse
+	}
+	return nil
+}
+
+func builtinLs(args []string, stdout io.Writer) error {
+	_, dirs := options(args)
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			fmt.Fprintln(stdout, file.Name())
+		}
+	}
+	return nil
+}
+
+func builtinCp(args []string, _ io.Writer) error {
+	_, files := options(args)
+	if len(files) != 2 {
+		return errors.New("cp: only copies a file to a file")
+	}
+	src, err := os.Open(files[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(files[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func builtinLn(args []string, _ io.Writer) error {
+	flags, files := options(args)
+	if len(files) != 2 {
+		return errors.New("ln: only links a file to a file")
+	}
+	if strings.Contains(flags, "s") {
+		return os.Symlink(files[0], files[1])
+	}
+	return os.Link(files[0], files[1])
+}
+
+func builtinCommand(args []string, stdout io.Writer) error {
+	if len(args) < 2 || args[0] != "-v" {
+		return errors.New("command: only -v is supported")
+	}
+	for _, name := range args[1:] {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return errFalse
+		}
+		fmt.Fprintln(stdout, path)
+	}
+	return nil
+}
+
+// writeLocalTempFile writes content to a new private temp file, for the
+// commands of the NoShellExecutor, which can't create it themselves.
+func writeLocalTempFile(prefix, content string) (string, error) {
+	file, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(file, content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
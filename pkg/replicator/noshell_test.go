@@ -0,0 +1,117 @@
+package replicator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandList(t *testing.T) {
+	tests := []struct {
+		line string
+		want []simpleCommand
+	}{
+		{"pg_restore -h localhost", []simpleCommand{{words: []string{"pg_restore", "-h", "localhost"}}}},
+		{"echo 'a b' \"c d\" e\\ f", []simpleCommand{{words: []string{"echo", "a b", "c d", "e f"}}}},
+		{`echo 'pa'\''ss'`, []simpleCommand{{words: []string{"echo", "pa'ss"}}}},
+		{`echo "a\"b\\c"`, []simpleCommand{{words: []string{"echo", `a"b\c`}}}},
+		{`dir C:\Users\dev`, []simpleCommand{{words: []string{"dir", `C:\Users\dev`}}}},
+		{"PGPASSFILE=/tmp/p psql -l", []simpleCommand{{words: []string{"PGPASSFILE=/tmp/p", "psql", "-l"}}}},
+		{"umask 077 && pg_dump -f x.partial && mv x.partial x", []simpleCommand{
+			{words: []string{"umask", "077"}},
+			{op: "&&", words: []string{"pg_dump", "-f", "x.partial"}},
+			{op: "&&", words: []string{"mv", "x.partial", "x"}},
+		}},
+		{"test -f x || true; rm -f x", []simpleCommand{
+			{words: []string{"test", "-f", "x"}},
+			{op: "||", words: []string{"true"}},
+			{op: ";", words: []string{"rm", "-f", "x"}},
+		}},
+		{"command -v psql >/dev/null 2> /dev/null", []simpleCommand{
+			{words: []string{"command", "-v", "psql"}, discardStdout: true, discardStderr: true},
+		}},
+		{"rm -f x;", []simpleCommand{{words: []string{"rm", "-f", "x"}}}},
+	}
+	for _, test := range tests {
+		got, err := parseCommandList(test.line)
+		if err != nil {
+			t.Errorf("parseCommandList(%q): %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCommandList(%q) = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseCommandListNeedsShell(t *testing.T) {
+	tests := []struct {
+		line string
+		why  string
+	}{
+		{"pg_dump dev | gzip", `'|'`},
+		{"psql dev < dump.sql", `'<'`},
+		{"pg_dump dev > dump.sql", "redirection"},
+		{"echo $HOME", `'$'`},
+		{`echo "$HOME"`, "substitution"},
+		{"echo `date`", "'`'"},
+		{"echo $(date)", `'$'`},
+		{"(cd /tmp && ls)", `'('`},
+		{"{ pg_dump dev; }", "compound command"},
+		{"! test -f x", "compound command"},
+		{"pg_dump dev &", `'&'`},
+		{"echo 'open", "unterminated quote"},
+		{`echo "open`, "unterminated quote"},
+		{"&& true", "empty command before &&"},
+		{"true &&", "missing command after &&"},
+	}
+	for _, test := range tests {
+		_, err := parseCommandList(test.line)
+		e, ok := err.(errNeedsShell)
+		if !ok {
+			t.Errorf("parseCommandList(%q) = %v, want errNeedsShell", test.line, err)
+			continue
+		}
+		if e.why != test.why {
+			t.Errorf("parseCommandList(%q) fails with %q, want %q", test.line, e.why, test.why)
+		}
+	}
+}
+
+func TestNoShellExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rep-noshell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	partial := filepath.Join(dir, "dump.partial")
+	dump := filepath.Join(dir, "dump")
+	if err := ioutil.WriteFile(partial, []byte("dump"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NoShellExecutor{}
+	run := "test -f" + shellArgs([]string{partial}) + " && mv" + shellArgs([]string{partial, dump}) +
+		" && chmod 600" + shellArgs([]string{dump}) + " && mkdir -p" + shellArgs([]string{filepath.Join(dir, "a", "b")})
+	if err := e.Run(context.Background(), run); err != nil {
+		t.Fatalf("Run(%q): %v", run, err)
+	}
+	if _, err := os.Stat(dump); err != nil {
+		t.Errorf("the dump wasn't renamed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "b")); err != nil {
+		t.Errorf("the directories weren't made: %v", err)
+	}
+
+	out, err := e.Output(context.Background(), "false || echo fallback; test -f"+shellArgs([]string{partial})+" && echo kept")
+	if err == nil {
+		t.Errorf("Output = %q, want the failure of the last test", out)
+	}
+	out, err = e.Output(context.Background(), "false || echo 'fall back'")
+	if err != nil || out != "fall back\n" {
+		t.Errorf("Output = %q, %v, want %q", out, err, "fall back\n")
+	}
+}
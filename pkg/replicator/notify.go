@@ -0,0 +1,90 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Event describes the outcome of a run for the notifiers.
+type Event struct {
+	RunID     string `json:"run_id"`
+	Server    string `json:"server"`
+	Database  string `json:"database"`
+	Target    string `json:"target"`
+	Succeeded bool   `json:"succeeded"`
+	Error     string `json:"error,omitempty"`
+	// Duration is in nanoseconds in JSON.
+	Duration time.Duration `json:"duration"`
+}
+
+// Notifier is told about the outcome of each run, for instance to post it to
+// a chat.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+var (
+	notifiersMu sync.Mutex
+	notifiers   = map[string]Notifier{}
+)
+
+// RegisterNotifier makes notifier available to the notify list of the config
+// under name.
+func RegisterNotifier(name string, notifier Notifier) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	notifiers[name] = notifier
+}
+
+// execNotifier is a Notifier implemented by an exec plugin, called with the
+// notify method.
+type execNotifier struct {
+	path string
+}
+
+func (n execNotifier) Notify(ctx context.Context, event Event) error {
+	return callPlugin(ctx, n.path, "notify", event, nil)
+}
+
+func notifierFor(name string) (Notifier, error) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	if notifier, ok := notifiers[name]; ok {
+		return notifier, nil
+	}
+	if path, ok := findPlugin("notify", name); ok {
+		return execNotifier{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", name)
+}
+
+// notify sends the outcome of the run to the notifiers of the config. Their
+// failures are only reported, they don't fail the run.
+func (r *Replicator) notify(ctx context.Context, started time.Time, runErr error) {
+	if len(r.config.Notify) == 0 {
+		return
+	}
+
+	event := Event{
+		RunID:     r.runID,
+		Server:    r.config.Server.Host,
+		Database:  r.config.Server.DB.Database,
+		Target:    r.config.LocalDB.Database,
+		Succeeded: runErr == nil,
+		Duration:  time.Since(started),
+	}
+	if runErr != nil {
+		event.Error = runErr.Error()
+	}
+	for _, name := range r.config.Notify {
+		notifier, err := notifierFor(name)
+		if err == nil {
+			err = notifier.Notify(ctx, event)
+		}
+		if err != nil {
+			fmt.Fprintf(r.Output, "   Notifying %s failed: %v\n", name, err)
+		}
+	}
+}
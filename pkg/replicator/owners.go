@@ -0,0 +1,59 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ownerMapper is implemented by the engines able to give the objects of the
+// restored database the local owners of the role map.
+type ownerMapper interface {
+	// OwnersCommand returns the local command listing the statements of the
+	// dump file setting the owners of its objects, one per line.
+	OwnersCommand(db DB, fileName string) string
+	// MapOwnersScript returns the statements of owners setting an owner of
+	// roleMap, with the local owner it maps to instead.
+	MapOwnersScript(owners string, roleMap map[string]string) string
+}
+
+func (r *Replicator) checkRoleMap() error {
+	if len(r.config.RoleMap) == 0 {
+		return nil
+	}
+	if _, ok := r.Engine.(ownerMapper); !ok {
+		return errors.New("the database engine can't map the owners of the restored database")
+	}
+	return nil
+}
+
+// mapOwners gives the objects of database, restored without their owners,
+// the local owners the role map gives to their owners on the server.
+func (r *Replicator) mapOwners(ctx context.Context, database string) error {
+	if len(r.config.RoleMap) == 0 {
+		return nil
+	}
+	if err := r.checkRoleMap(); err != nil {
+		return err
+	}
+	mapper := r.Engine.(ownerMapper)
+
+	// The owner of the database itself comes with its settings.
+	if settings, ok := r.settings.(*dbSettings); ok {
+		if owner, ok := r.config.RoleMap[settings.Owner]; ok {
+			settings.Owner = owner
+		}
+	}
+
+	r.printStep("Map owners of database %s with the role map", database)
+	owners, err := r.Local.Output(ctx, mapper.OwnersCommand(r.config.LocalDB, r.localDumpFile))
+	if err != nil {
+		return err
+	}
+	script := mapper.MapOwnersScript(owners, r.config.RoleMap)
+	if script == "" {
+		fmt.Fprintf(r.Output, "   No object owned by a role of the role map\n")
+		return nil
+	}
+	return r.runScript(ctx, database, script)
+}
@@ -0,0 +1,106 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// passwordFileEngine is implemented by the engines whose clients can read the
+// password from a file, which keeps it out of the commands, the process list
+// and the shell history.
+type passwordFileEngine interface {
+	// PasswordFileContent returns the content of the file giving the password
+	// of db to the clients.
+	PasswordFileContent(db DB) string
+}
+
+// storeServerPassword writes the password of the server database to a
+// private temp file, on the server or locally in direct mode, for the
+// commands to read it from. It fails if the Remote can't write files, rather
+// than leave the password in the commands.
+func (r *Replicator) storeServerPassword(ctx context.Context) error {
+	db := &r.config.Server.DB
+	if r.config.Server.Mode == "direct" {
+		return r.storePassword(ctx, r.Local, r.Receiver, db, "local")
+	}
+	receiver, ok := r.Remote.(FileReceiver)
+	if !ok {
+		if r.needsPasswordFile(*db) {
+			return errors.New("the password of the server database can't be written to a file on the server")
+		}
+		return nil
+	}
+	return r.withRemote(ctx, "Storing password", func() error {
+		return r.storePassword(ctx, r.Remote, receiver, db, "server")
+	})
+}
+
+// storeLocalPassword writes the password of the local database to a private
+// temp file, on the target server if any.
+func (r *Replicator) storeLocalPassword(ctx context.Context) error {
+	return r.storePassword(ctx, r.Local, r.Receiver, &r.config.LocalDB, r.localWhere())
+}
+
+// needsPasswordFile reports whether the password of db is still to be
+// written to a file for the clients of the engine.
+func (r *Replicator) needsPasswordFile(db DB) bool {
+	_, ok := r.Engine.(passwordFileEngine)
+	return ok && db.Password != "" && db.PasswordFile == ""
+}
+
+// storePassword writes the password of db to a private temp file created with
+// exec and receiver, which Cleanup removes, and sets its PasswordFile.
+func (r *Replicator) storePassword(ctx context.Context, exec outputExecutor, receiver FileReceiver, db *DB, where string) error {
+	if !r.needsPasswordFile(*db) {
+		return nil
+	}
+	engine := r.Engine.(passwordFileEngine)
+	var file string
+	if _, ok := exec.(NoShellExecutor); ok {
+		var err error
+		if file, err = writeLocalTempFile("rep_pass_", ""); err != nil {
+			return err
+		}
+	} else {
+		dir := ""
+		if where == "server" {
+			dir = r.config.Server.TempDir
+		}
+		out, err := exec.Output(ctx, mktempCommand(dir, "rep_pass_"))
+		if err != nil {
+			return err
+		}
+		file = strings.TrimSpace(out)
+	}
+	if where == "server" {
+		r.onRemoteCleanup("password file "+file, func(ctx context.Context) error {
+			r.printStep("Remove password file %s in %s", file, where)
+			return r.withRemote(ctx, "Removing password file", func() error {
+				return r.Remote.Run(ctx, fmt.Sprintf("rm -f %s", file))
+			})
+		})
+	} else {
+		r.onCleanup(func(ctx context.Context) error {
+			r.printStep("Remove password file %s in %s", file, where)
+			_, err := exec.Output(ctx, fmt.Sprintf("rm -f %s", file))
+			return err
+		})
+	}
+
+	w, err := receiver.Append(ctx, file)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, engine.PasswordFileContent(*db))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	db.PasswordFile = file
+	return nil
+}
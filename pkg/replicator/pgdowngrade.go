@@ -0,0 +1,259 @@
+package replicator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// pgSettingsSince gives the settings pg_dump sets at the start of a plain
+// dump the major version of Postgres that introduced them.
+var pgSettingsSince = map[string]int{
+	"row_security":                        905,
+	"idle_in_transaction_session_timeout": 906,
+	"default_table_access_method":         1200,
+	"transaction_timeout":                 1700,
+}
+
+// pgRewrite is a rewrite of the lines of a plain dump matching pattern, for
+// the servers older than since. A line rewritten to "" is dropped.
+type pgRewrite struct {
+	since   int
+	what    string
+	pattern *regexp.Regexp
+	replace string
+}
+
+var pgRewrites = []pgRewrite{
+	{1000, "dropped AS of the sequences", regexp.MustCompile(`^    AS \w+$`), ""},
+	{1100, "replaced EXECUTE FUNCTION of the triggers with EXECUTE PROCEDURE", regexp.MustCompile(`^(CREATE (?:CONSTRAINT )?TRIGGER .*) EXECUTE FUNCTION (.*)$`), "$1 EXECUTE PROCEDURE $2"},
+	{1100, "dropped INCLUDE of the indexes", regexp.MustCompile(`^((?:CREATE (?:UNIQUE )?INDEX|    ADD CONSTRAINT) .*) INCLUDE \([^)]*\)(.*)$`), "$1$2"},
+	{1400, "dropped SET COMPRESSION of the columns", regexp.MustCompile(`^ALTER TABLE .* ALTER COLUMN .* SET COMPRESSION \w+;$`), ""},
+	{1500, "dropped NULLS NOT DISTINCT of the unique indexes", regexp.MustCompile(`^((?:CREATE UNIQUE INDEX|    ADD CONSTRAINT) .*) NULLS NOT DISTINCT(.*)$`), "$1$2"},
+}
+
+// pgUnsupported are the constructs that can't be rewritten for the servers
+// older than since.
+var pgUnsupported = []pgRewrite{
+	{1000, "partitioned tables", regexp.MustCompile(`^\) PARTITION BY |^    PARTITION OF |^ALTER TABLE .* ATTACH PARTITION `), ""},
+	{1200, "generated columns", regexp.MustCompile(`GENERATED ALWAYS AS \(.*\) STORED`), ""},
+}
+
+// pgDroppedTypes gives the types of the entries of a plain dump that are
+// dropped, along with their comments, for the servers older than the
+// version.
+var pgDroppedTypes = map[string]int{
+	"PROCEDURE":                    1100,
+	"PUBLICATION":                  1000,
+	"PUBLICATION TABLE":            1000,
+	"PUBLICATION TABLES IN SCHEMA": 1500,
+	"SUBSCRIPTION":                 1000,
+	"STATISTICS":                   1000,
+}
+
+var (
+	pgEntryHeader = regexp.MustCompile(`^-- (?:Data for )?Name: (.*); Type: ([^;]*); Schema: `)
+	pgCopyStart   = regexp.MustCompile(`^COPY .* FROM stdin;$`)
+	pgIdentity    = regexp.MustCompile(`^ALTER TABLE (?:ONLY )?(\S+) ALTER COLUMN (\S+) ADD GENERATED (?:ALWAYS|BY DEFAULT) AS IDENTITY \($`)
+)
+
+// pgDowngrade counts the changes of a rewrite, in the order they first
+// happened.
+type pgDowngrade struct {
+	major   int
+	order   []string
+	changed map[string]int
+	left    map[string][]int
+}
+
+func (d *pgDowngrade) change(what string, since int) {
+	key := fmt.Sprintf("%s, new in PostgreSQL %s", what, pgVersionName(since))
+	if d.changed[key] == 0 {
+		d.order = append(d.order, key)
+	}
+	d.changed[key]++
+}
+
+// DowngradeDump rewrites a plain dump of pg_dump for an older server, line
+// by line, leaving the data of the COPY statements untouched. The identity
+// columns become columns defaulting to their sequence.
+func (postgresEngine) DowngradeDump(in, out string, major int) ([]string, []string, error) {
+	src, err := os.Open(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer dst.Close()
+
+	d := &pgDowngrade{major: major, changed: map[string]int{}, left: map[string][]int{}}
+	w := bufio.NewWriter(dst)
+	if err := d.rewrite(bufio.NewReader(src), w); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	var changed, left []string
+	for _, key := range d.order {
+		changed = append(changed, fmt.Sprintf("%s (%d)", key, d.changed[key]))
+	}
+	for _, unsupported := range pgUnsupported {
+		key := fmt.Sprintf("%s, new in PostgreSQL %s", unsupported.what, pgVersionName(unsupported.since))
+		if lines := d.left[key]; len(lines) > 0 {
+			left = append(left, fmt.Sprintf("%s, line %d (%d)", key, lines[0], len(lines)))
+		}
+	}
+	return changed, left, nil
+}
+
+func (d *pgDowngrade) rewrite(r *bufio.Reader, w io.Writer) error {
+	var inCopy, dropping bool
+	var identity []string
+	number := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		number++
+		text := strings.TrimSuffix(line, "\n")
+
+		switch {
+		case inCopy:
+			inCopy = text != `\.`
+		case identity != nil:
+			identity = append(identity, text)
+			if text == ");" {
+				text = d.identitySequence(identity)
+				identity = nil
+			} else {
+				continue
+			}
+		case pgIdentity.MatchString(text) && d.major < 1000:
+			identity = []string{text}
+			continue
+		default:
+			if match := pgEntryHeader.FindStringSubmatch(text); match != nil {
+				dropping = d.dropsEntry(match[1], match[2])
+			}
+			if dropping {
+				continue
+			}
+			inCopy = pgCopyStart.MatchString(text)
+			if !inCopy {
+				text = d.rewriteLine(text, number)
+			}
+		}
+
+		if text == "" && strings.TrimSpace(line) != "" {
+			continue
+		}
+		if _, err := io.WriteString(w, text+"\n"); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return nil
+}
+
+// dropsEntry reports whether the entry of a plain dump with the header name
+// and type is dropped, a comment on a dropped object being dropped too.
+func (d *pgDowngrade) dropsEntry(name, typ string) bool {
+	if typ == "COMMENT" {
+		for dropped := range pgDroppedTypes {
+			if strings.HasPrefix(name, dropped+" ") {
+				typ = dropped
+			}
+		}
+	}
+	since, ok := pgDroppedTypes[typ]
+	if !ok || d.major >= since {
+		return false
+	}
+	d.change("dropped "+strings.ToLower(typ)+" entries", since)
+	return true
+}
+
+func (d *pgDowngrade) rewriteLine(text string, number int) string {
+	if fields := strings.Fields(text); len(fields) > 1 && fields[0] == "SET" {
+		if since, ok := pgSettingsSince[fields[1]]; ok && d.major < since {
+			d.change("dropped SET "+fields[1], since)
+			return ""
+		}
+	}
+	for _, rewrite := range pgRewrites {
+		if d.major < rewrite.since && rewrite.pattern.MatchString(text) {
+			d.change(rewrite.what, rewrite.since)
+			text = rewrite.pattern.ReplaceAllString(text, rewrite.replace)
+			if text == "" {
+				return ""
+			}
+		}
+	}
+	for _, unsupported := range pgUnsupported {
+		if d.major < unsupported.since && unsupported.pattern.MatchString(text) {
+			key := fmt.Sprintf("%s, new in PostgreSQL %s", unsupported.what, pgVersionName(unsupported.since))
+			d.left[key] = append(d.left[key], number)
+		}
+	}
+	return text
+}
+
+// identitySequence rewrites the statement adding an identity column, as its
+// lines, into a sequence owned by the column, which defaults to it.
+func (d *pgDowngrade) identitySequence(lines []string) string {
+	match := pgIdentity.FindStringSubmatch(lines[0])
+	table, column := match[1], match[2]
+	var sequence string
+	var options []string
+	for _, line := range lines[1 : len(lines)-1] {
+		option := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(option, "SEQUENCE NAME "):
+			sequence = strings.TrimPrefix(option, "SEQUENCE NAME ")
+		case strings.HasPrefix(option, "AS "):
+		default:
+			options = append(options, "    "+option)
+		}
+	}
+	if sequence == "" {
+		sequence = strings.Trim(table, `"`) + "_" + strings.Trim(column, `"`) + "_seq"
+	}
+	d.change("replaced identity columns with sequences", 1000)
+	return fmt.Sprintf(
+		"CREATE SEQUENCE %s\n%s;\nALTER SEQUENCE %s OWNED BY %s.%s;\nALTER TABLE ONLY %s ALTER COLUMN %s SET DEFAULT nextval(%s::regclass);",
+		sequence,
+		strings.Join(options, "\n"),
+		sequence,
+		table,
+		column,
+		table,
+		column,
+		quoteLiteral(sequence),
+	)
+}
+
+// pgVersionName returns the version of a major version of MajorVersion, 9.6
+// for 906 and 12 for 1200.
+func pgVersionName(major int) string {
+	if major >= 1000 {
+		return fmt.Sprint(major / 100)
+	}
+	return fmt.Sprintf("%d.%d", major/100, major%100)
+}
@@ -0,0 +1,185 @@
+package replicator
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPGDowngradeRewrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		major   int
+		in      []string
+		out     []string
+		changed []string
+		left    map[string][]int
+	}{
+		{
+			name:  "settings",
+			major: 906,
+			in: []string{
+				"SET statement_timeout = 0;",
+				"SET row_security = off;",
+				"SET default_table_access_method = heap;",
+				"SET transaction_timeout = 0;",
+			},
+			out:     []string{"SET statement_timeout = 0;", "SET row_security = off;"},
+			changed: []string{"dropped SET default_table_access_method, new in PostgreSQL 12", "dropped SET transaction_timeout, new in PostgreSQL 17"},
+		},
+		{
+			name:  "sequence AS",
+			major: 906,
+			in:    []string{"CREATE SEQUENCE public.t_id_seq", "    AS integer", "    START WITH 1;"},
+			out:   []string{"CREATE SEQUENCE public.t_id_seq", "    START WITH 1;"},
+			changed: []string{
+				"dropped AS of the sequences, new in PostgreSQL 10",
+			},
+		},
+		{
+			name:    "sequence AS kept",
+			major:   1000,
+			in:      []string{"CREATE SEQUENCE public.t_id_seq", "    AS integer", "    START WITH 1;"},
+			out:     []string{"CREATE SEQUENCE public.t_id_seq", "    AS integer", "    START WITH 1;"},
+			changed: nil,
+		},
+		{
+			name:    "trigger",
+			major:   1000,
+			in:      []string{"CREATE TRIGGER t BEFORE INSERT ON public.t FOR EACH ROW EXECUTE FUNCTION public.f();"},
+			out:     []string{"CREATE TRIGGER t BEFORE INSERT ON public.t FOR EACH ROW EXECUTE PROCEDURE public.f();"},
+			changed: []string{"replaced EXECUTE FUNCTION of the triggers with EXECUTE PROCEDURE, new in PostgreSQL 11"},
+		},
+		{
+			name:  "index options",
+			major: 1000,
+			in: []string{
+				"CREATE UNIQUE INDEX t_a ON public.t USING btree (a) INCLUDE (b) NULLS NOT DISTINCT;",
+				"ALTER TABLE ONLY public.t ALTER COLUMN body SET COMPRESSION lz4;",
+			},
+			out: []string{"CREATE UNIQUE INDEX t_a ON public.t USING btree (a);"},
+			changed: []string{
+				"dropped INCLUDE of the indexes, new in PostgreSQL 11",
+				"dropped NULLS NOT DISTINCT of the unique indexes, new in PostgreSQL 15",
+				"dropped SET COMPRESSION of the columns, new in PostgreSQL 14",
+			},
+		},
+		{
+			name:  "dropped entries",
+			major: 906,
+			in: []string{
+				"--",
+				"-- Name: p; Type: PUBLICATION; Schema: -; Owner: dev",
+				"--",
+				"",
+				"CREATE PUBLICATION p FOR ALL TABLES;",
+				"",
+				"--",
+				"-- Name: PUBLICATION p; Type: COMMENT; Schema: -; Owner: dev",
+				"--",
+				"",
+				"COMMENT ON PUBLICATION p IS 'all';",
+				"",
+				"--",
+				"-- Name: t; Type: TABLE; Schema: public; Owner: dev",
+				"--",
+				"",
+				"CREATE TABLE public.t (id integer);",
+			},
+			out: []string{
+				"--",
+				"-- Name: t; Type: TABLE; Schema: public; Owner: dev",
+				"--",
+				"",
+				"CREATE TABLE public.t (id integer);",
+			},
+			changed: []string{"dropped publication entries, new in PostgreSQL 10"},
+		},
+		{
+			name:  "identity",
+			major: 906,
+			in: []string{
+				"ALTER TABLE public.t ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (",
+				"    SEQUENCE NAME public.t_id_seq",
+				"    AS integer",
+				"    START WITH 1",
+				"    CACHE 1",
+				");",
+			},
+			out: []string{
+				"CREATE SEQUENCE public.t_id_seq",
+				"    START WITH 1",
+				"    CACHE 1;",
+				"ALTER SEQUENCE public.t_id_seq OWNED BY public.t.id;",
+				"ALTER TABLE ONLY public.t ALTER COLUMN id SET DEFAULT nextval('public.t_id_seq'::regclass);",
+			},
+			changed: []string{"replaced identity columns with sequences, new in PostgreSQL 10"},
+		},
+		{
+			name:  "COPY data",
+			major: 906,
+			in: []string{
+				"COPY public.t (id, body) FROM stdin;",
+				"1\tSET row_security = off;",
+				"2\t    AS integer",
+				`\.`,
+				"    AS bigint",
+			},
+			out: []string{
+				"COPY public.t (id, body) FROM stdin;",
+				"1\tSET row_security = off;",
+				"2\t    AS integer",
+				`\.`,
+			},
+			changed: []string{"dropped AS of the sequences, new in PostgreSQL 10"},
+		},
+		{
+			name:  "unsupported",
+			major: 1100,
+			in: []string{
+				"CREATE TABLE public.t (",
+				"    a integer,",
+				"    b integer GENERATED ALWAYS AS ((a * 2)) STORED",
+				") PARTITION BY RANGE (a);",
+			},
+			out: []string{
+				"CREATE TABLE public.t (",
+				"    a integer,",
+				"    b integer GENERATED ALWAYS AS ((a * 2)) STORED",
+				") PARTITION BY RANGE (a);",
+			},
+			left: map[string][]int{"generated columns, new in PostgreSQL 12": {3}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &pgDowngrade{major: test.major, changed: map[string]int{}, left: map[string][]int{}}
+			var out strings.Builder
+			in := strings.Join(test.in, "\n") + "\n"
+			if err := d.rewrite(bufio.NewReader(strings.NewReader(in)), &out); err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(test.out, "\n") + "\n"; out.String() != want {
+				t.Errorf("rewrote\n%s\nwant\n%s", out.String(), want)
+			}
+			if !reflect.DeepEqual(d.order, test.changed) {
+				t.Errorf("changed %q, want %q", d.order, test.changed)
+			}
+			if test.left == nil {
+				test.left = map[string][]int{}
+			}
+			if !reflect.DeepEqual(d.left, test.left) {
+				t.Errorf("left %v, want %v", d.left, test.left)
+			}
+		})
+	}
+}
+
+func TestPGVersionName(t *testing.T) {
+	for major, want := range map[int]string{906: "9.6", 1000: "10", 1200: "12", 1700: "17"} {
+		if got := pgVersionName(major); got != want {
+			t.Errorf("pgVersionName(%d) = %q, want %q", major, got, want)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package replicator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The restore of postgres without psql and pg_restore, speaking the
+// frontend/backend protocol of Postgres. It is kept to what a plain dump
+// needs: the simple query protocol, COPY FROM STDIN, and the password, MD5
+// and SCRAM-SHA-256 authentications. Over TCP, it encrypts with TLS when the
+// server supports it, like the sslmode=prefer of libpq, without verifying
+// the certificate, and only sends a password in clear over TLS or a Unix
+// socket.
+
+// pgCopyEnd is the line ending the data of a table in a plain dump.
+const pgCopyEnd = "\\.\n"
+
+// pgFlushSize is how much SQL of a plain dump is sent at most in one query,
+// unless it can't be split.
+const pgFlushSize = 1 << 20
+
+// pgMaxMessage is the longest message accepted from the server, the limit of
+// the allocations of Postgres itself.
+const pgMaxMessage = 1 << 30
+
+// pgSSLRequest is the code of the SSLRequest message.
+const pgSSLRequest = 80877103
+
+func (postgresEngine) ClientToolsCommand(dbConfig DB) string {
+	return fmt.Sprintf("command -v %s && command -v %s", pgTool(dbConfig.PsqlPath, "psql"), pgTool(dbConfig.PgRestorePath, "pg_restore"))
+}
+
+func (postgresEngine) PlainDump(dbConfig DB) DB {
+	// The owners and privileges are left out like pg_restore -x -O does.
+	options := []string{"--format=plain", "--no-owner", "--no-privileges"}
+	dbConfig.DumpOptions = append(append([]string{}, dbConfig.DumpOptions...), options...)
+	return dbConfig
+}
+
+func (postgresEngine) DriverLimitations() string {
+	return "The built-in client doesn't verify the TLS certificate of the server, restores in a single session without parallelism, " +
+		"stops at the first error, and skips the checks of the restore tool version and of the extensions."
+}
+
+func (postgresEngine) DriverScript(ctx context.Context, dbConfig DB, database, script string) error {
+	conn, err := pgConnect(ctx, dbConfig, database)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.query(script, nil)
+	return permanent(err)
+}
+
+func (postgresEngine) DriverDatabases(ctx context.Context, dbConfig DB, database string) ([]string, error) {
+	conn, err := pgConnect(ctx, dbConfig, database)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.query("SELECT datname FROM pg_database", nil)
+}
+
+// DriverRestore runs the SQL of the plain dump in chunks, between the COPY
+// statements whose data it streams.
+func (postgresEngine) DriverRestore(ctx context.Context, dbConfig DB, database, fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dump := bufio.NewReaderSize(file, 64<<10)
+	if header, _ := dump.Peek(5); string(header) == "PGDMP" {
+		return errors.New("the dump is in the custom format, which needs pg_restore")
+	}
+
+	conn, err := pgConnect(ctx, dbConfig, database)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return restorePlainDump(ctx, dump, conn.query)
+}
+
+// restorePlainDump runs the SQL of dump with query in chunks, and its COPY
+// statements alone, query reading their data from dump. The psql
+// meta-commands, such as \restrict, are skipped. Both are only recognized
+// at the start of a statement, not within a function body or a string.
+func restorePlainDump(ctx context.Context, dump *bufio.Reader, query func(sql string, copyData *bufio.Reader) ([]string, error)) error {
+	var sql strings.Builder
+	flush := func() error {
+		if strings.TrimSpace(sql.String()) == "" {
+			return nil
+		}
+		_, err := query(sql.String(), nil)
+		sql.Reset()
+		return err
+	}
+	var scanner pgScanner
+	var previous string
+	for {
+		line, err := dump.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		atStart := scanner.atStatementStart()
+		switch {
+		case line == "":
+		case atStart && strings.HasPrefix(line, `\`):
+		case atStart && pgCopyFromStdin.MatchString(line):
+			if err := flush(); err != nil {
+				return err
+			}
+			if _, err := query(line, dump); err != nil {
+				return err
+			}
+		case atStart && line == "--\n" && previous == "\n" && sql.Len() > pgFlushSize:
+			// The header of the next entry of the dump, so a statement
+			// isn't split.
+			if err := flush(); err != nil {
+				return err
+			}
+			sql.WriteString(line)
+		default:
+			sql.WriteString(line)
+			scanner.scan(line)
+		}
+		previous = line
+		if err == io.EOF {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return flush()
+}
+
+// pgCopyFromStdin matches the COPY statements of a plain dump, followed by
+// their data.
+var pgCopyFromStdin = regexp.MustCompile(`^COPY .* FROM stdin;\n$`)
+
+// pgDollarQuote matches the opening of a dollar quoted string, $$ or $tag$.
+var pgDollarQuote = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// pgScanner follows the SQL of a dump line by line, to tell where its
+// statements start.
+type pgScanner struct {
+	// quote is the end of the quoted string or identifier the last line
+	// ended in: ', ", or the dollar quote. escapes is set in an E'' string.
+	quote   string
+	escapes bool
+	// comments is the depth of the /* */ comments the last line ended in.
+	comments int
+	// pending is set when a statement started and isn't terminated yet.
+	pending bool
+}
+
+func (s *pgScanner) atStatementStart() bool {
+	return !s.pending && s.quote == "" && s.comments == 0
+}
+
+// scan follows line, which ends with its newline.
+func (s *pgScanner) scan(line string) {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case s.comments > 0:
+			if strings.HasPrefix(line[i:], "*/") {
+				s.comments--
+				i++
+			} else if strings.HasPrefix(line[i:], "/*") {
+				s.comments++
+				i++
+			}
+		case s.quote != "":
+			if s.escapes && c == '\\' {
+				i++
+			} else if strings.HasPrefix(line[i:], s.quote) {
+				i += len(s.quote) - 1
+				s.quote, s.escapes = "", false
+			}
+		case strings.HasPrefix(line[i:], "--"):
+			return
+		case strings.HasPrefix(line[i:], "/*"):
+			s.comments++
+			i++
+		case c == '\'' || c == '"':
+			s.quote = string(c)
+			s.escapes = c == '\'' && i > 0 && (line[i-1] == 'E' || line[i-1] == 'e') && (i == 1 || !isIdentByte(line[i-2]))
+			s.pending = true
+		case c == '$' && (i == 0 || !isIdentByte(line[i-1])) && pgDollarQuote.MatchString(line[i:]):
+			s.quote = pgDollarQuote.FindString(line[i:])
+			i += len(s.quote) - 1
+			s.pending = true
+		case c == ';':
+			s.pending = false
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			s.pending = true
+		}
+	}
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// pgConn is a connection speaking the protocol version 3.0.
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// private is set over TLS or a Unix socket, where the password can be
+	// sent in clear.
+	private bool
+}
+
+// pgConnect connects to database and authenticates. The host can be the
+// directory of a Unix socket, like for psql.
+func pgConnect(ctx context.Context, dbConfig DB, database string) (*pgConn, error) {
+	network, address := "tcp", net.JoinHostPort(dbConfig.Host, strconv.Itoa(dbConfig.Port))
+	if strings.HasPrefix(dbConfig.Host, "/") {
+		network, address = "unix", fmt.Sprintf("%s/.s.PGSQL.%d", dbConfig.Host, dbConfig.Port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	private := network == "unix"
+	if !private {
+		if conn, private, err = pgStartTLS(conn, dbConfig.Host); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	c := &pgConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), private: private}
+	if err := c.startup(dbConfig, database); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pgStartTLS asks the server to encrypt conn, and returns the TLS connection
+// if it agreed, or conn if it doesn't support TLS.
+func pgStartTLS(conn net.Conn, host string) (net.Conn, bool, error) {
+	var request [8]byte
+	binary.BigEndian.PutUint32(request[:4], 8)
+	binary.BigEndian.PutUint32(request[4:], pgSSLRequest)
+	if _, err := conn.Write(request[:]); err != nil {
+		return conn, false, err
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(conn, answer[:]); err != nil {
+		return conn, false, err
+	}
+	switch answer[0] {
+	case 'N':
+		return conn, false, nil
+	case 'S':
+	default:
+		return conn, false, fmt.Errorf("invalid answer %q of the server to the TLS request", answer[0])
+	}
+	// Like the sslmode=prefer of libpq, the certificate isn't verified, the
+	// local servers having self-signed ones.
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		return conn, false, err
+	}
+	return tlsConn, true, nil
+}
+
+func (c *pgConn) Close() error {
+	c.send('X', nil)
+	c.w.Flush()
+	return c.conn.Close()
+}
+
+// send writes a message, typ 0 being the startup message without a type.
+func (c *pgConn) send(typ byte, body []byte) {
+	if typ != 0 {
+		c.w.WriteByte(typ)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)+4))
+	c.w.Write(length[:])
+	c.w.Write(body)
+}
+
+func (c *pgConn) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > pgMaxMessage {
+		return 0, nil, fmt.Errorf("invalid length %d of a message of the server", length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+func (c *pgConn) startup(dbConfig DB, database string) error {
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, uint32(196608))
+	for _, param := range []string{"user", dbConfig.Username, "database", database, "application_name", "rep", "client_encoding", "UTF8"} {
+		body.WriteString(param + "\x00")
+	}
+	body.WriteByte(0)
+	c.send(0, body.Bytes())
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	var scram *pgSCRAM
+	for {
+		typ, msg, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			return pgError(msg)
+		case 'Z':
+			return nil
+		case 'R':
+		default:
+			continue
+		}
+
+		if len(msg) < 4 {
+			return errors.New("invalid authentication message from the server")
+		}
+		switch binary.BigEndian.Uint32(msg) {
+		case 0:
+			continue
+		case 3:
+			if !c.private {
+				return errors.New("the server asks for the password in clear without TLS")
+			}
+			c.send('p', []byte(dbConfig.Password+"\x00"))
+		case 5:
+			if len(msg) < 8 {
+				return errors.New("invalid authentication message from the server")
+			}
+			inner := md5.Sum([]byte(dbConfig.Password + dbConfig.Username))
+			outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), msg[4:8]...))
+			c.send('p', []byte("md5"+hex.EncodeToString(outer[:])+"\x00"))
+		case 10:
+			if !bytes.Contains(msg[4:], []byte("SCRAM-SHA-256\x00")) {
+				return errors.New("the server asks for an unsupported SASL authentication")
+			}
+			if scram, err = newPGSCRAM(dbConfig.Password); err != nil {
+				return err
+			}
+			first := scram.clientFirst()
+			var initial bytes.Buffer
+			initial.WriteString("SCRAM-SHA-256\x00")
+			binary.Write(&initial, binary.BigEndian, uint32(len(first)))
+			initial.WriteString(first)
+			c.send('p', initial.Bytes())
+		case 11:
+			if scram == nil {
+				return errors.New("the server continues a SASL authentication it didn't start")
+			}
+			final, err := scram.clientFinal(string(msg[4:]))
+			if err != nil {
+				return err
+			}
+			c.send('p', []byte(final))
+		case 12:
+			if scram == nil {
+				return errors.New("the server ends a SASL authentication it didn't start")
+			}
+			if err := scram.verify(string(msg[4:])); err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("the server asks for an unsupported authentication %d", binary.BigEndian.Uint32(msg))
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// query runs sql with the simple query protocol and returns the first column
+// of the rows. The data of a COPY FROM STDIN is read from copyData up to its
+// \. line.
+func (c *pgConn) query(sql string, copyData *bufio.Reader) ([]string, error) {
+	c.send('Q', []byte(sql+"\x00"))
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var rows []string
+	var queryErr error
+	for {
+		typ, msg, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'D':
+			if len(msg) < 6 || binary.BigEndian.Uint16(msg) == 0 {
+				break
+			}
+			length := int32(binary.BigEndian.Uint32(msg[2:]))
+			if int64(length) > int64(len(msg)-6) {
+				return nil, errors.New("invalid data row from the server")
+			}
+			if length >= 0 {
+				rows = append(rows, string(msg[6:6+length]))
+			}
+		case 'E':
+			if queryErr == nil {
+				queryErr = pgError(msg)
+			}
+		case 'G':
+			if err := c.copyIn(copyData); err != nil {
+				return nil, err
+			}
+		case 'Z':
+			return rows, queryErr
+		}
+	}
+}
+
+// copyIn sends the lines of the data of a COPY, up to its end line.
+func (c *pgConn) copyIn(data *bufio.Reader) error {
+	if data == nil {
+		c.send('f', []byte("no COPY data\x00"))
+		return c.w.Flush()
+	}
+	for {
+		line, err := data.ReadString('\n')
+		if line == pgCopyEnd {
+			break
+		}
+		if err != nil {
+			c.send('f', []byte("unexpected end of the COPY data\x00"))
+			return c.w.Flush()
+		}
+		c.send('d', []byte(line))
+	}
+	c.send('c', nil)
+	return c.w.Flush()
+}
+
+// pgError reads an ErrorResponse.
+func pgError(msg []byte) error {
+	fields := map[byte]string{}
+	for len(msg) > 1 {
+		end := bytes.IndexByte(msg[1:], 0)
+		if end < 0 {
+			break
+		}
+		fields[msg[0]] = string(msg[1 : 1+end])
+		msg = msg[2+end:]
+	}
+	return fmt.Errorf("%s: %s (SQLSTATE %s)", fields['S'], fields['M'], fields['C'])
+}
+
+// pgSCRAM is the client side of a SCRAM-SHA-256 authentication, without
+// channel binding.
+type pgSCRAM struct {
+	password    string
+	nonce       string
+	firstBare   string
+	authMessage string
+	salted      []byte
+}
+
+func newPGSCRAM(password string) (*pgSCRAM, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &pgSCRAM{password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}, nil
+}
+
+func (s *pgSCRAM) clientFirst() string {
+	// The user name is the one of the startup message.
+	s.firstBare = "n=,r=" + s.nonce
+	return "n,," + s.firstBare
+}
+
+func (s *pgSCRAM) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttributes(serverFirst)
+	iterations, err := strconv.Atoi(attrs["i"])
+	salt, saltErr := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || saltErr != nil || iterations < 1 || !strings.HasPrefix(attrs["r"], s.nonce) {
+		return "", errors.New("invalid SCRAM message from the server")
+	}
+
+	s.salted = scramHi([]byte(s.password), salt, iterations)
+	clientKey := hmacSHA256(s.salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	s.authMessage = s.firstBare + "," + serverFirst + "," + withoutProof
+	signature := hmacSHA256(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (s *pgSCRAM) verify(serverFinal string) error {
+	signature, err := base64.StdEncoding.DecodeString(scramAttributes(serverFinal)["v"])
+	expected := hmacSHA256(hmacSHA256(s.salted, "Server Key"), s.authMessage)
+	if err != nil || !hmac.Equal(signature, expected) {
+		return errors.New("the SCRAM signature of the server is invalid")
+	}
+	return nil
+}
+
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) > 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+// scramHi is the PBKDF2 of SCRAM with HMAC-SHA-256.
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
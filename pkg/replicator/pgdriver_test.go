@@ -0,0 +1,279 @@
+package replicator
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRestorePlainDump(t *testing.T) {
+	dump := strings.Join([]string{
+		`\restrict abc`,
+		"SET standard_conforming_strings = on;",
+		"CREATE FUNCTION f() RETURNS void AS $body$",
+		"COPY t FROM stdin;",
+		`\copy t from 'x'`,
+		"$body$ LANGUAGE sql;",
+		"INSERT INTO notes VALUES ('it''s",
+		"COPY t FROM stdin;",
+		"', E'\\'",
+		"COPY t FROM stdin;",
+		"');",
+		"/* a comment",
+		"COPY t FROM stdin;",
+		"*/",
+		"COPY public.t (id, name) FROM stdin;",
+		"1\ta",
+		"2\t\\N",
+		`\.`,
+		"SELECT 1;",
+		`\unrestrict abc`,
+		"",
+	}, "\n")
+
+	type call struct {
+		sql  string
+		data []string
+	}
+	var calls []call
+	query := func(sql string, copyData *bufio.Reader) ([]string, error) {
+		c := call{sql: sql}
+		for copyData != nil {
+			line, err := copyData.ReadString('\n')
+			if line == pgCopyEnd || err != nil {
+				break
+			}
+			c.data = append(c.data, line)
+		}
+		calls = append(calls, c)
+		return nil, nil
+	}
+	if err := restorePlainDump(context.Background(), bufio.NewReader(strings.NewReader(dump)), query); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []call{
+		{sql: strings.Join([]string{
+			"SET standard_conforming_strings = on;",
+			"CREATE FUNCTION f() RETURNS void AS $body$",
+			"COPY t FROM stdin;",
+			`\copy t from 'x'`,
+			"$body$ LANGUAGE sql;",
+			"INSERT INTO notes VALUES ('it''s",
+			"COPY t FROM stdin;",
+			"', E'\\'",
+			"COPY t FROM stdin;",
+			"');",
+			"/* a comment",
+			"COPY t FROM stdin;",
+			"*/",
+			"",
+		}, "\n")},
+		{sql: "COPY public.t (id, name) FROM stdin;\n", data: []string{"1\ta\n", "2\t\\N\n"}},
+		{sql: "SELECT 1;\n"},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("restorePlainDump ran\n%q\nwant\n%q", calls, want)
+	}
+}
+
+func TestPGScanner(t *testing.T) {
+	tests := []struct {
+		sql     string
+		atStart bool
+	}{
+		{"SELECT 1;\n", true},
+		{"SELECT 1\n", false},
+		{"-- SELECT 1\n", true},
+		{"SELECT ';'\n", false},
+		{"SELECT 'a;\n", false},
+		{"SELECT $$;$$;\n", true},
+		{"SELECT $a$ $$; $a$;\n", true},
+		{"SELECT $1;\n", true},
+		{"SELECT a$b$;\n", true},
+		{"SELECT \"a;\"\n", false},
+		{"SELECT E'\\';';\n", true},
+		{"SELECT 'a\\';\n", true},
+		{"/* /* */ ; */\n", true},
+		{"/* /* */ ;\n", false},
+		{"SELECT 1 /* ; */\n", false},
+	}
+	for _, test := range tests {
+		var s pgScanner
+		s.scan(test.sql)
+		if got := s.atStatementStart(); got != test.atStart {
+			t.Errorf("after %q, atStatementStart() = %v, want %v", test.sql, got, test.atStart)
+		}
+	}
+	var s pgScanner
+	s.scan("/* /* */\n")
+	if s.comments != 1 {
+		t.Errorf("nested comments: depth %d, want 1", s.comments)
+	}
+}
+
+// fakePGServer answers the messages of the client with the replies, as
+// messages of type and body.
+func fakePGServer(t *testing.T, replies ...[]byte) *pgConn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	// The pipe has no buffer, what the client sends is drained meanwhile.
+	go io.Copy(ioutil.Discard, server)
+	go func() {
+		for _, reply := range replies {
+			if _, err := server.Write(reply); err != nil {
+				return
+			}
+		}
+	}()
+	return &pgConn{conn: client, r: bufio.NewReader(client), w: bufio.NewWriter(client)}
+}
+
+func pgMessage(typ byte, body []byte) []byte {
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+func pgAuth(code uint32, rest ...byte) []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, code)
+	return pgMessage('R', append(body, rest...))
+}
+
+func TestPGStartup(t *testing.T) {
+	tests := []struct {
+		name    string
+		private bool
+		replies [][]byte
+		err     string
+	}{
+		{
+			name:    "trusted",
+			replies: [][]byte{pgAuth(0), pgMessage('Z', []byte{'I'})},
+		},
+		{
+			name:    "cleartext over TLS",
+			private: true,
+			replies: [][]byte{pgAuth(3), pgAuth(0), pgMessage('Z', []byte{'I'})},
+		},
+		{
+			name:    "cleartext without TLS",
+			replies: [][]byte{pgAuth(3)},
+			err:     "password in clear without TLS",
+		},
+		{
+			name:    "short length",
+			replies: [][]byte{{'R', 0, 0, 0, 3}},
+			err:     "invalid length 3",
+		},
+		{
+			name:    "short authentication",
+			replies: [][]byte{pgMessage('R', []byte{0, 0})},
+			err:     "invalid authentication message",
+		},
+		{
+			name:    "short md5 salt",
+			replies: [][]byte{pgAuth(5, 1, 2)},
+			err:     "invalid authentication message",
+		},
+		{
+			name:    "SASL continue first",
+			replies: [][]byte{pgAuth(11, 'r', '=')},
+			err:     "didn't start",
+		},
+		{
+			name:    "error",
+			replies: [][]byte{pgMessage('E', []byte("SFATAL\x00Mno such role\x00C28000\x00\x00"))},
+			err:     "FATAL: no such role (SQLSTATE 28000)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := fakePGServer(t, test.replies...)
+			c.private = test.private
+			err := c.startup(DB{Username: "dev", Password: "secret"}, "dev")
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("startup: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("startup = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPGDataRowTooShort(t *testing.T) {
+	row := []byte{0, 1, 0, 0, 0, 10, 'a'}
+	c := fakePGServer(t, pgAuth(0), pgMessage('Z', []byte{'I'}), pgMessage('D', row), pgMessage('Z', []byte{'I'}))
+	if err := c.startup(DB{Username: "dev"}, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.query("SELECT 1", nil); err == nil || !strings.Contains(err.Error(), "invalid data row") {
+		t.Errorf("query = %v, want an invalid data row", err)
+	}
+}
+
+// The example of RFC 7677, whose client sends its user name.
+func TestSCRAM(t *testing.T) {
+	s := &pgSCRAM{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	s.clientFirst()
+	s.firstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+	final, err := s.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if final != want {
+		t.Errorf("clientFinal = %q, want %q", final, want)
+	}
+	if err := s.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if err := s.verify("v=AAAA"); err == nil {
+		t.Error("verify accepted an invalid signature")
+	}
+}
+
+func TestSCRAMInvalid(t *testing.T) {
+	for _, serverFirst := range []string{
+		"r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=nonce1,s=!!!,i=4096",
+		"r=nonce1,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=x",
+		"r=nonce1,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+	} {
+		s := &pgSCRAM{password: "pencil", nonce: "nonce"}
+		s.clientFirst()
+		if _, err := s.clientFinal(serverFirst); err == nil {
+			t.Errorf("clientFinal(%q) succeeded, want an error", serverFirst)
+		}
+	}
+}
+
+func TestPGStartTLSRefused(t *testing.T) {
+	for _, answer := range []byte{'N', 'E'} {
+		client, server := net.Pipe()
+		go func() {
+			var request [8]byte
+			io.ReadFull(server, request[:])
+			if binary.BigEndian.Uint32(request[4:]) == pgSSLRequest {
+				server.Write([]byte{answer})
+			}
+		}()
+		conn, private, err := pgStartTLS(client, "localhost")
+		switch {
+		case answer == 'N' && (err != nil || private || conn != client):
+			t.Errorf("pgStartTLS = %v, %v, want the connection in clear", private, err)
+		case answer == 'E' && err == nil:
+			t.Errorf("pgStartTLS accepted the answer %q", answer)
+		}
+		client.Close()
+		server.Close()
+	}
+}
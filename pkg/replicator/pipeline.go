@@ -0,0 +1,217 @@
+package replicator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Stage is a step of the pipeline the dump goes through between the server
+// and the local machine, such as a compression or an encryption. The dump
+// is encoded on the server before the transfer, which keeps the transfer
+// resumable, and decoded locally as a stream once transferred.
+type Stage interface {
+	// Name identifies the stage in the output.
+	Name() string
+	// Extension is appended to the name of the encoded file, such as ".gz".
+	Extension() string
+	// EncodeCommand returns the shell command run on the server to encode
+	// its stdin to its stdout.
+	EncodeCommand() string
+	// Decode returns a reader of the decoded content of r. Closing it
+	// reports whether the decoding succeeded.
+	Decode(r io.Reader) (io.ReadCloser, error)
+}
+
+// EncryptingStage is implemented by the stages encrypting the dump. With one
+// in the pipeline, the plain dump is removed from the server as soon as it
+// is encoded, and only decoded locally for the time of the restore.
+type EncryptingStage interface {
+	Stage
+	Encrypts() bool
+}
+
+// StageFactory builds a stage from its options in the config.
+type StageFactory func(options map[string]string) (Stage, error)
+
+// StageConfig configures a stage of the pipeline.
+type StageConfig struct {
+	Name    string            `yaml:"name"`
+	Options map[string]string `yaml:"options"`
+}
+
+var stageFactories = map[string]StageFactory{
+	"gzip": newGzipStage,
+	"zstd": newZstdStage,
+	"age":  newAgeStage,
+	"gpg":  newGPGStage,
+}
+
+// RegisterStage makes a stage available to the pipeline of the config under
+// name, replacing the stage registered under the same name if any. It is
+// meant to be called from an init function.
+func RegisterStage(name string, factory StageFactory) {
+	stageFactories[name] = factory
+}
+
+// Pipeline is the list of stages of the transfer, in encoding order.
+type Pipeline []Stage
+
+// NewPipeline builds the stages of configs.
+func NewPipeline(configs []StageConfig) (Pipeline, error) {
+	var pipeline Pipeline
+	for _, config := range configs {
+		factory, ok := stageFactories[config.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline stage %q, available stages: %s", config.Name, strings.Join(stageNames(), ", "))
+		}
+		stage, err := factory(config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline stage %s: %v", config.Name, err)
+		}
+		pipeline = append(pipeline, stage)
+	}
+	return pipeline, nil
+}
+
+func stageNames() []string {
+	var names []string
+	for name := range stageFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p Pipeline) String() string {
+	var names []string
+	for _, stage := range p {
+		names = append(names, stage.Name())
+	}
+	return strings.Join(names, " | ")
+}
+
+// encrypts reports whether a stage of the pipeline encrypts the dump.
+func (p Pipeline) encrypts() bool {
+	for _, stage := range p {
+		if encrypting, ok := stage.(EncryptingStage); ok && encrypting.Encrypts() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Pipeline) Extension() string {
+	var ext string
+	for _, stage := range p {
+		ext += stage.Extension()
+	}
+	return ext
+}
+
+// EncodeCommand returns the command encoding in into out with all the
+// stages. It runs with pipefail so the failure of any stage fails it.
+func (p Pipeline) EncodeCommand(in, out string) string {
+	var filters []string
+	for _, stage := range p {
+		filters = append(filters, stage.EncodeCommand())
+	}
+	return fmt.Sprintf(
+		"umask 077 && bash -o pipefail -c %s && mv %s.partial %s",
+		shellQuote(fmt.Sprintf("< %s %s > %s.partial", in, strings.Join(filters, " | "), out)),
+		out,
+		out,
+	)
+}
+
+// Decode returns a reader of r decoded by all the stages, in reverse order.
+// Closing it closes all the stages and returns the first error.
+func (p Pipeline) Decode(r io.Reader) (io.ReadCloser, error) {
+	var decoders multiCloser
+	for i := len(p) - 1; i >= 0; i-- {
+		decoder, err := p[i].Decode(r)
+		if err != nil {
+			decoders.Close()
+			return nil, err
+		}
+		decoders = append(decoders, decoder)
+		r = decoder
+	}
+	return readCloser{Reader: r, Closer: decoders}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// multiCloser closes the last stage first, as it reads from the previous
+// ones.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var firstErr error
+	for i := len(m) - 1; i >= 0; i-- {
+		if err := m[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// commandReader reads the stdout of a local command decoding its stdin, for
+// stages relying on an external tool.
+type commandReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+	err    error
+}
+
+func newCommandReader(command string, r io.Reader) (io.ReadCloser, error) {
+	c := &commandReader{cmd: exec.Command("bash", "-c", command)}
+	c.cmd.Stdin = r
+	c.cmd.Stderr = &c.stderr
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.stdout = stdout
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read returns the error of the command at the end of its output, so a
+// failed decoding isn't mistaken for a complete one.
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		if waitErr := c.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *commandReader) wait() error {
+	if !c.done {
+		c.done = true
+		if err := c.cmd.Wait(); err != nil {
+			c.err = withStderr(err, c.stderr.String())
+		}
+	}
+	return c.err
+}
+
+func (c *commandReader) Close() error {
+	if !c.done {
+		c.stdout.Close()
+	}
+	return c.wait()
+}
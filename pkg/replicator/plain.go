@@ -0,0 +1,64 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// plainFormatter is implemented by the engines able to dump in compressed
+// plain SQL, for format: plain.
+type plainFormatter interface {
+	// CompressedPlainDump returns db with the dump options dumping in plain
+	// SQL compressed with gzip.
+	CompressedPlainDump(db DB) DB
+	// PlainRestoreCommand returns the command restoring the compressed plain
+	// dump fileName into database with the client of the engine.
+	PlainRestoreCommand(dbConfig DB, database, fileName string) string
+}
+
+// plainFormat reports whether the dump is made in compressed plain SQL for
+// format: plain. The built-in client and Downgrade dump uncompressed plain
+// SQL of their own instead.
+func (r *Replicator) plainFormat() bool {
+	return r.config.Format == "plain" && !r.useDriver && !r.Downgrade
+}
+
+// dumpExtension is the extension of the dump files.
+func (r *Replicator) dumpExtension() string {
+	if r.plainFormat() {
+		return ".sql.gz"
+	}
+	return ".dump"
+}
+
+// checkFormat fails if the dump can't be made in the format of the config.
+func (r *Replicator) checkFormat() error {
+	switch r.config.Format {
+	case "", "custom":
+		return nil
+	case "plain":
+	default:
+		return fmt.Errorf("unknown format %q, expected custom or plain", r.config.Format)
+	}
+	if _, ok := r.Engine.(plainFormatter); !ok {
+		return errors.New("the database engine can't dump in plain SQL")
+	}
+	switch {
+	case r.config.Limits.set():
+		return errors.New("the plain dump can't be restored within limits")
+	case len(r.config.RoleMap) > 0:
+		return errors.New("the role_map can't read a plain dump")
+	case r.config.DeferIndexes:
+		return errors.New("defer_indexes can't split a plain dump")
+	}
+	return nil
+}
+
+// restorePlain restores the compressed plain dump as a script.
+func (r *Replicator) restorePlain(ctx context.Context, database string) error {
+	r.printStep("Restoring %s to database %s", r.localDumpFile, database)
+	cmd := r.Engine.(plainFormatter).PlainRestoreCommand(r.config.LocalDB, database, r.localDumpFile)
+	r.recordCommand(r.localWhere(), cmd, "")
+	return r.Local.Run(ctx, cmd)
+}
@@ -0,0 +1,167 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// Engines, secret backends and notifiers can be added without forking rep in
+// two ways: a Go package registering them with RegisterEngine,
+// RegisterSecretBackend or RegisterNotifier from an init function, built
+// into a custom binary, or an exec plugin.
+//
+// An exec plugin is an executable named rep-<kind>-<name> in the PATH, kind
+// being engine, secret or notify. rep runs it once per call, writes a
+// pluginRequest to its stdin and reads a pluginResponse from its stdout. A
+// non-zero exit status fails the call, with the stderr of the plugin.
+
+type pluginRequest struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type pluginResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// findPlugin returns the path of the exec plugin of kind named name.
+func findPlugin(kind, name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	path, err := exec.LookPath(fmt.Sprintf("rep-%s-%s", kind, name))
+	return path, err == nil
+}
+
+// callPlugin calls method of the plugin at path and decodes its result into
+// result, unless result is nil.
+func callPlugin(ctx context.Context, path, method string, params, result interface{}) error {
+	request, err := json.Marshal(pluginRequest{Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("plugin %s: %v", path, withStderr(err, stderr.String()))
+	}
+
+	var response pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return fmt.Errorf("plugin %s: invalid response: %v", path, err)
+	}
+	if response.Error != "" {
+		return fmt.Errorf("plugin %s: %s", path, response.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("plugin %s: invalid %s result: %v", path, method, err)
+	}
+	return nil
+}
+
+// execEngine is an Engine implemented by an exec plugin, each method is a
+// call named after it in snake case.
+//
+// Engine methods can't fail, so the first failed call is kept and fails the
+// next command, which reports it: a command of the plugin always follows the
+// scripts it built.
+type execEngine struct {
+	path string
+
+	mu  sync.Mutex
+	err error
+}
+
+type pluginCommandParams struct {
+	DB       DB     `json:"db"`
+	Database string `json:"database,omitempty"`
+	File     string `json:"file"`
+}
+
+func (e *execEngine) call(method string, params, result interface{}) bool {
+	err := callPlugin(context.Background(), e.path, method, params, result)
+	if err != nil {
+		e.mu.Lock()
+		if e.err == nil {
+			e.err = err
+		}
+		e.mu.Unlock()
+	}
+	return err == nil
+}
+
+func (e *execEngine) command(method string, params interface{}) string {
+	var cmd string
+	e.call(method, params, &cmd)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.err; err != nil {
+		e.err = nil
+		return fmt.Sprintf("echo %s >&2; exit 1", shellQuote(err.Error()))
+	}
+	return cmd
+}
+
+func (e *execEngine) script(method string, params interface{}) string {
+	var script string
+	e.call(method, params, &script)
+	return script
+}
+
+func (e *execEngine) DumpCommand(db DB, fileName string) string {
+	return e.command("dump_command", pluginCommandParams{DB: db, File: fileName})
+}
+
+func (e *execEngine) RestoreCommand(db DB, database, fileName string) string {
+	return e.command("restore_command", pluginCommandParams{DB: db, Database: database, File: fileName})
+}
+
+func (e *execEngine) ScriptCommand(db DB, database, fileName string) string {
+	return e.command("script_command", pluginCommandParams{DB: db, Database: database, File: fileName})
+}
+
+func (e *execEngine) IsConnectionError(err error) bool {
+	var connectionError bool
+	params := map[string]string{"error": err.Error()}
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		params["stderr"] = cmdErr.stderr
+	}
+	err = callPlugin(context.Background(), e.path, "is_connection_error", params, &connectionError)
+	return err == nil && connectionError
+}
+
+func (e *execEngine) PingScript() string {
+	return e.script("ping_script", nil)
+}
+
+func (e *execEngine) CreateDatabaseScript(database string) string {
+	return e.script("create_database_script", map[string]string{"database": database})
+}
+
+func (e *execEngine) DropDatabaseScript(database string) string {
+	return e.script("drop_database_script", map[string]string{"database": database})
+}
+
+func (e *execEngine) SwapScripts(restored, target, backup string) []string {
+	var scripts []string
+	if !e.call("swap_scripts", map[string]string{"restored": restored, "target": target, "backup": backup}, &scripts) {
+		// Running a script reports the error.
+		return []string{""}
+	}
+	return scripts
+}
@@ -0,0 +1,759 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type postgresEngine struct{}
+
+// DumpCommand dumps into a partial file that is only renamed to fileName
+// once pg_dump succeeded, so an existing fileName is always a complete dump.
+// The file is only readable by the SSH user.
+func (postgresEngine) DumpCommand(dbConfig DB, fileName string) string {
+	// options := "--no-privileges --no-owner --blobs --format=custom --verbose"
+	options := "-Fc -x"
+	if dbConfig.DumpRole != "" {
+		options += " --role=" + dbConfig.DumpRole
+	}
+	if dbConfig.EnableRowSecurity {
+		options += " --enable-row-security"
+	}
+	options += shellArgs(dbConfig.DumpOptions)
+	cmd := fmt.Sprintf(
+		"umask 077 && %s %s -h %s -p %d -U %s -d %s %s -f %s.partial && mv %s.partial %s",
+		pgPasswordEnv(dbConfig),
+		pgTool(dbConfig.PgDumpPath, "pg_dump"),
+		dbConfig.Host,
+		dbConfig.Port,
+		dbConfig.Username,
+		dbConfig.Database,
+		options,
+		fileName,
+		fileName,
+		fileName,
+	)
+
+	return cmd
+}
+
+func (e postgresEngine) VerboseDumpCommand(dbConfig DB, fileName string) string {
+	dbConfig.DumpOptions = append([]string{"--verbose"}, dbConfig.DumpOptions...)
+	return e.DumpCommand(dbConfig, fileName)
+}
+
+func (postgresEngine) RestoreCommand(dbConfig DB, database, fileName string) string {
+	return pgRestoreCommand(dbConfig, database, fileName, "")
+}
+
+// pgRestoreCommand is RestoreCommand with extraOptions, each followed by a
+// space.
+func pgRestoreCommand(dbConfig DB, database, fileName, extraOptions string) string {
+	// options := "--no-privileges --no-owner --blobs --format=custom --verbose"
+	options := extraOptions + "-x -O -c --if-exists" + shellArgs(dbConfig.RestoreOptions)
+	cmd := fmt.Sprintf(
+		"%s %s -h %s -p %d -U %s -d %s %s %s",
+		pgPasswordEnv(dbConfig),
+		pgTool(dbConfig.PgRestorePath, "pg_restore"),
+		dbConfig.Host,
+		dbConfig.Port,
+		dbConfig.Username,
+		database,
+		options,
+		fileName,
+	)
+
+	return cmd
+}
+
+// LimitedRestoreCommand feeds the SQL of the dump to psql through pv to cap
+// the rate, as pg_restore can't throttle its own connection.
+func (postgresEngine) LimitedRestoreCommand(dbConfig DB, database, fileName string, limits Limits) string {
+	env := pgLimitsEnv(limits)
+	if limits.WriteMBps <= 0 {
+		return env + pgRestoreCommand(dbConfig, database, fileName, pgJobsOption(limits))
+	}
+	return fmt.Sprintf(
+		"set -o pipefail; %s -x -O -c --if-exists%s -f - %s | pv -q -L %dm | %s%s -q -v ON_ERROR_STOP=1",
+		pgTool(dbConfig.PgRestorePath, "pg_restore"),
+		shellArgs(dbConfig.RestoreOptions),
+		fileName,
+		limits.WriteMBps,
+		env,
+		buildPSQLCommand(dbConfig, database),
+	)
+}
+
+// pgLimitsEnv keeps the server sessions of a restore to one core each if
+// limits.CPUPercent is set.
+func pgLimitsEnv(limits Limits) string {
+	if limits.CPUPercent > 0 {
+		return "PGOPTIONS='-c max_parallel_maintenance_workers=0 -c max_parallel_workers_per_gather=0' "
+	}
+	return ""
+}
+
+func pgJobsOption(limits Limits) string {
+	if limits.Jobs > 1 {
+		return fmt.Sprintf("--jobs=%d ", limits.Jobs)
+	}
+	return ""
+}
+
+// DataRestoreCommand restores the sections before the indexes, which
+// pg_restore calls pre-data and data.
+func (postgresEngine) DataRestoreCommand(dbConfig DB, database, fileName string, limits Limits) string {
+	return pgLimitsEnv(limits) + pgRestoreCommand(dbConfig, database, fileName, pgJobsOption(limits)+"--section=pre-data --section=data ")
+}
+
+func (postgresEngine) PostDataListCommand(dbConfig DB, fileName string) string {
+	return fmt.Sprintf("%s -l --section=post-data %s", pgTool(dbConfig.PgRestorePath, "pg_restore"), fileName)
+}
+
+// pgListItem matches an item of the list of pg_restore -l, such as
+// 3412; 1259 16502 INDEX public users_email_idx app.
+var pgListItem = regexp.MustCompile(`^\d+; \d+ \d+ (.+)$`)
+
+// SplitPostData builds the indexes and the primary key, unique, check and
+// exclusion constraints one by one, the foreign keys needing them, as
+// FK CONSTRAINT items, being restored with the rest.
+func (postgresEngine) SplitPostData(list string) ([]deferredIndex, []string) {
+	var indexes []deferredIndex
+	var rest []string
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		m := pgListItem.FindStringSubmatch(line)
+		if m == nil {
+			rest = append(rest, line)
+			continue
+		}
+		fields := strings.Fields(m[1])
+		if len(fields) >= 3 && (fields[0] == "INDEX" || fields[0] == "CONSTRAINT") && fields[1] != "ATTACH" {
+			// The owner ends the item.
+			name := strings.Join(fields[:len(fields)-1], " ")
+			indexes = append(indexes, deferredIndex{Item: line, Name: name})
+			continue
+		}
+		rest = append(rest, line)
+	}
+	return indexes, rest
+}
+
+func (postgresEngine) ListRestoreCommand(dbConfig DB, database, fileName, listFile string, limits Limits) string {
+	return pgLimitsEnv(limits) + pgRestoreCommand(dbConfig, database, fileName, pgJobsOption(limits)+"-L "+listFile+" ")
+}
+
+// CompressedPlainDump is PlainDump compressed by pg_dump itself.
+func (e postgresEngine) CompressedPlainDump(dbConfig DB) DB {
+	dbConfig = e.PlainDump(dbConfig)
+	dbConfig.DumpOptions = append(dbConfig.DumpOptions, "--compress=6")
+	return dbConfig
+}
+
+func (postgresEngine) PlainRestoreCommand(dbConfig DB, database, fileName string) string {
+	return fmt.Sprintf(
+		"set -o pipefail; gzip -dc %s | %s -q -v ON_ERROR_STOP=1",
+		fileName,
+		buildPSQLCommand(dbConfig, database),
+	)
+}
+
+func (postgresEngine) LimitToolsCommand(limits Limits) string {
+	var tools []string
+	if limits.WriteMBps > 0 {
+		tools = append(tools, "pv")
+	}
+	if limits.CPUPercent > 0 {
+		tools = append(tools, "systemd-run")
+	}
+	if len(tools) == 0 {
+		return "true"
+	}
+	return fmt.Sprintf("for tool in %s; do command -v $tool >/dev/null || { echo \"$tool is missing\" >&2; exit 1; }; done", strings.Join(tools, " "))
+}
+
+// AnalyzeCommand analyzes in stages, so the planner gets rough statistics
+// quickly.
+func (postgresEngine) AnalyzeCommand(dbConfig DB, database string, jobs int) string {
+	options := "--analyze-in-stages"
+	if jobs > 1 {
+		options += fmt.Sprintf(" --jobs=%d", jobs)
+	}
+	return fmt.Sprintf(
+		"%s %s -h %s -p %d -U %s -d %s %s",
+		pgPasswordEnv(dbConfig),
+		pgSiblingTool(dbConfig.PsqlPath, "vacuumdb"),
+		dbConfig.Host,
+		dbConfig.Port,
+		dbConfig.Username,
+		database,
+		options,
+	)
+}
+
+func (postgresEngine) AnalyzeScript() string {
+	return "ANALYZE;"
+}
+
+// RefreshMatviewsScript orders the views by the longest chain of
+// materialized views they read from, through the rules of the views.
+func (postgresEngine) RefreshMatviewsScript() string {
+	return `DO $$
+DECLARE
+	matview record;
+BEGIN
+	FOR matview IN
+		WITH RECURSIVE dependencies AS (
+			SELECT DISTINCT r.ev_class AS view, d.refobjid AS dependency
+			FROM pg_rewrite r
+			JOIN pg_depend d ON d.classid = 'pg_rewrite'::regclass AND d.objid = r.oid
+			JOIN pg_class c ON c.oid = d.refobjid AND c.relkind = 'm'
+			WHERE d.refobjid <> r.ev_class
+		), depths AS (
+			SELECT oid AS view, 0 AS depth FROM pg_class WHERE relkind = 'm'
+			UNION ALL
+			SELECT dependencies.view, depths.depth + 1
+			FROM dependencies JOIN depths ON depths.view = dependencies.dependency
+		)
+		SELECT n.nspname, c.relname, max(depths.depth) AS depth
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN depths ON depths.view = c.oid
+		WHERE c.relkind = 'm' AND NOT c.relispopulated
+		GROUP BY n.nspname, c.relname
+		ORDER BY depth
+	LOOP
+		EXECUTE format('REFRESH MATERIALIZED VIEW %I.%I', matview.nspname, matview.relname);
+	END LOOP;
+END
+$$;
+`
+}
+
+// TableChecksumsCommand generates a query per table run by \gexec, the
+// settings making the text of the rows the same on both servers.
+func (postgresEngine) TableChecksumsCommand(dbConfig DB, database string, checksumRows int) string {
+	script := fmt.Sprintf(`SET TimeZone = 'UTC';
+SET DateStyle = 'ISO';
+SET IntervalStyle = 'postgres';
+SET extra_float_digits = 3;
+SELECT format(
+	'SELECT %%L, count(*), %%s FROM %%I.%%I',
+	n.nspname || '.' || c.relname,
+	CASE WHEN pk.key_columns IS NULL OR %[1]d = 0 THEN 'NULL'
+	ELSE format('(SELECT md5(string_agg(t::text, chr(10))) FROM (SELECT * FROM %%I.%%I ORDER BY %%s LIMIT %[1]d) t)', n.nspname, c.relname, pk.key_columns)
+	END,
+	n.nspname,
+	c.relname
+)
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN LATERAL (
+	SELECT string_agg(quote_ident(a.attname), ', ' ORDER BY k.ord) AS key_columns
+	FROM pg_index i
+	CROSS JOIN unnest(i.indkey) WITH ORDINALITY k(attnum, ord)
+	JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+	WHERE i.indrelid = c.oid AND i.indisprimary
+) pk ON true
+WHERE c.relkind = 'r' AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_%%'
+ORDER BY 1
+\gexec
+`, checksumRows)
+	return fmt.Sprintf("printf '%%s\\n' %s | %s -X -q -At", shellQuote(script), buildPSQLCommand(dbConfig, database))
+}
+
+// pgSchemaQuery describes the user schemas, the columns by their type and
+// nullability, the indexes by their definition.
+const pgSchemaQuery = `WITH relations AS (
+	SELECT c.oid, c.relkind, quote_ident(n.nspname) || '.' || quote_ident(c.relname) AS name
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_%'
+)
+SELECT CASE relkind WHEN 'v' THEN 'view' WHEN 'm' THEN 'materialized view' ELSE 'table' END || '|' || name || '|'
+FROM relations WHERE relkind IN ('r', 'p', 'v', 'm')
+UNION ALL
+SELECT 'column|' || name || '.' || quote_ident(a.attname) || '|' || format_type(a.atttypid, a.atttypmod) || CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END
+FROM relations JOIN pg_attribute a ON a.attrelid = relations.oid
+WHERE relkind IN ('r', 'p') AND a.attnum > 0 AND NOT a.attisdropped
+UNION ALL
+SELECT 'index|' || name || '|' || pg_get_indexdef(oid)
+FROM relations WHERE relkind = 'i'`
+
+func (postgresEngine) SchemaCommand(dbConfig DB, database string) string {
+	return buildPSQLCommand(dbConfig, database) + " -X -At -c " + shellQuote(pgSchemaQuery)
+}
+
+// pgPasswordEnv returns the environment giving the password to the client,
+// the password file if any so the password isn't in the command.
+func pgPasswordEnv(dbConfig DB) string {
+	if dbConfig.PasswordFile != "" {
+		return "PGPASSFILE=" + dbConfig.PasswordFile
+	}
+	return "PGPASSWORD=" + shellQuote(dbConfig.Password)
+}
+
+// PasswordFileContent is a pgpass file matching any connection.
+func (postgresEngine) PasswordFileContent(dbConfig DB) string {
+	password := strings.NewReplacer(`\`, `\\`, ":", `\:`).Replace(dbConfig.Password)
+	return "*:*:*:*:" + password + "\n"
+}
+
+// pgTool returns the client tool at path, or name to find it in the PATH.
+func pgTool(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return shellQuote(path)
+}
+
+// pgSiblingTool returns the client tool name in the directory of the tool
+// at path, which may be on the server, or name to find it in the PATH.
+func pgSiblingTool(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return shellQuote(path[:strings.LastIndexAny(path, `/\`)+1] + name)
+}
+
+func buildPSQLCommand(dbConfig DB, accessForRunningDB string) string {
+	return fmt.Sprintf(
+		"%s %s -h %s -p %d -U %s -d %s",
+		pgPasswordEnv(dbConfig),
+		pgTool(dbConfig.PsqlPath, "psql"),
+		dbConfig.Host,
+		dbConfig.Port,
+		dbConfig.Username,
+		accessForRunningDB,
+	)
+}
+
+func (postgresEngine) ScriptCommand(dbConfig DB, database, fileName string) string {
+	psqlCmd := buildPSQLCommand(dbConfig, database)
+	return fmt.Sprintf("%s -v ON_ERROR_STOP=1 -f %s", psqlCmd, fileName)
+}
+
+// IsConnectionError only accepts the exit status 2 of psql, so statements
+// that reached the server are never run twice.
+func (postgresEngine) IsConnectionError(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == 2
+}
+
+func (postgresEngine) ServerVersionCommand(dbConfig DB) string {
+	return buildPSQLCommand(dbConfig, dbConfig.Database) + ` -At -c "SHOW server_version"`
+}
+
+func (postgresEngine) DatabaseSizeCommand(dbConfig DB) string {
+	return buildPSQLCommand(dbConfig, dbConfig.Database) + ` -At -c "SELECT pg_database_size(current_database())"`
+}
+
+// DatabaseListCommand sizes the databases the user can connect to, and
+// gives the last change of state of the sessions connected to each, as
+// Postgres keeps no record of past sessions.
+func (postgresEngine) DatabaseListCommand(dbConfig DB) string {
+	return buildPSQLCommand(dbConfig, dbConfig.Database) + ` -At -c "SELECT d.datname, CASE WHEN has_database_privilege(d.datname, 'CONNECT') THEN pg_database_size(d.datname) END, coalesce(to_char(max(a.state_change), 'YYYY-MM-DD HH24:MI'), '') FROM pg_database d LEFT JOIN pg_stat_activity a ON a.datid = d.oid AND a.pid <> pg_backend_pid() WHERE NOT d.datistemplate GROUP BY d.oid, d.datname ORDER BY 2 DESC NULLS LAST"`
+}
+
+// TableSizesCommand counts the TOAST of the tables in their size, not their
+// indexes, which the dump doesn't hold.
+func (postgresEngine) TableSizesCommand(dbConfig DB) string {
+	return buildPSQLCommand(dbConfig, dbConfig.Database) + ` -At -c "SELECT n.nspname || '.' || c.relname, pg_table_size(c.oid) FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relkind IN ('r', 'm') AND n.nspname NOT IN ('pg_catalog', 'information_schema')"`
+}
+
+// DataDirectoryCommand requires a superuser or pg_read_all_settings, which
+// local users usually are.
+func (postgresEngine) DataDirectoryCommand(dbConfig DB) string {
+	return buildPSQLCommand(dbConfig, dbConfig.Database) + ` -At -c "SHOW data_directory"`
+}
+
+func (postgresEngine) DumpVersionCommand(dbConfig DB) string {
+	return pgTool(dbConfig.PgDumpPath, "pg_dump") + " --version"
+}
+
+func (postgresEngine) RestoreVersionCommand(dbConfig DB) string {
+	return pgTool(dbConfig.PgRestorePath, "pg_restore") + " --version"
+}
+
+var pgVersion = regexp.MustCompile(`(\d+)(?:\.(\d+))?`)
+
+// MajorVersion returns the major version in the output of SHOW
+// server_version or --version, such as 906 for 9.6.24 and 1500 for
+// pg_dump (PostgreSQL) 15.4, 9.6 preceding 10.
+func (postgresEngine) MajorVersion(version string) (int, bool) {
+	match := pgVersion.FindStringSubmatch(version)
+	if match == nil {
+		return 0, false
+	}
+	major, _ := strconv.Atoi(match[1])
+	if major >= 10 {
+		return major * 100, true
+	}
+	minor, _ := strconv.Atoi(match[2])
+	return major*100 + minor, true
+}
+
+func (postgresEngine) PingScript() string {
+	return "SELECT 1"
+}
+
+func (postgresEngine) CreateDatabaseScript(database string) string {
+	return fmt.Sprintf("CREATE DATABASE %s", database)
+}
+
+func (postgresEngine) DropDatabaseScript(database string) string {
+	return fmt.Sprintf("DROP DATABASE IF EXISTS %s", database)
+}
+
+// SwapScripts renames target to backup, if it exists, and restored to target
+// in one transaction, which a failure of either rename rolls back.
+func (postgresEngine) SwapScripts(restored, target, backup string) []string {
+	return []string{fmt.Sprintf(
+		"BEGIN;\n"+
+			"DO $rep$ BEGIN\n"+
+			"  IF EXISTS (SELECT 1 FROM pg_database WHERE datname = %s) THEN\n"+
+			"    ALTER DATABASE %s RENAME TO %s;\n"+
+			"  END IF;\n"+
+			"END $rep$;\n"+
+			"ALTER DATABASE %s RENAME TO %s;\n"+
+			"COMMIT;\n",
+		quoteLiteral(target),
+		target,
+		backup,
+		restored,
+		target,
+	)}
+}
+
+// DisconnectScript terminates the other sessions of database and waits up to
+// 5s for them to end, pg_terminate_backend only signaling them.
+func (postgresEngine) DisconnectScript(database string) string {
+	return fmt.Sprintf(
+		"DO $rep$\n"+
+			"DECLARE\n"+
+			"  waited int := 0;\n"+
+			"BEGIN\n"+
+			"  PERFORM pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = %s AND pid <> pg_backend_pid();\n"+
+			"  LOOP\n"+
+			"    PERFORM pg_stat_clear_snapshot();\n"+
+			"    EXIT WHEN waited >= 50 OR NOT EXISTS (SELECT 1 FROM pg_stat_activity WHERE datname = %s AND pid <> pg_backend_pid());\n"+
+			"    PERFORM pg_sleep(0.1);\n"+
+			"    waited := waited + 1;\n"+
+			"  END LOOP;\n"+
+			"END $rep$;\n",
+		quoteLiteral(database),
+		quoteLiteral(database),
+	)
+}
+
+// GlobalsCommand dumps the roles without their passwords, which only needs
+// to read pg_roles rather than pg_authid, so it works without superuser.
+func (postgresEngine) GlobalsCommand(dbConfig DB) string {
+	return fmt.Sprintf(
+		"%s %s -h %s -p %d -U %s -l %s --roles-only --no-role-passwords",
+		pgPasswordEnv(dbConfig),
+		pgSiblingTool(dbConfig.PgDumpPath, "pg_dumpall"),
+		dbConfig.Host,
+		dbConfig.Port,
+		dbConfig.Username,
+		dbConfig.Database,
+	)
+}
+
+func (postgresEngine) GlobalsScript(globals string) string {
+	return pgRolesScript(globals)
+}
+
+// ReaderRoleScript grants the privileges pgMissingPrivilegesQuery checks, on
+// the existing objects and, by default, on those the admin creates later, and
+// SELECT on the large objects.
+func (postgresEngine) ReaderRoleScript(role, password, database string) string {
+	return fmt.Sprintf(`DO $rep$BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = %[1]s) THEN
+    CREATE ROLE %[2]s;
+  END IF;
+END$rep$;
+ALTER ROLE %[2]s WITH LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION PASSWORD %[3]s;
+GRANT CONNECT ON DATABASE %[4]s TO %[2]s;
+DO $rep$DECLARE
+  s text;
+  lo oid;
+BEGIN
+  FOR s IN SELECT nspname FROM pg_namespace WHERE nspname <> 'information_schema' AND nspname !~ '^pg_' LOOP
+    EXECUTE format('GRANT USAGE ON SCHEMA %%I TO %%I', s, %[1]s);
+    EXECUTE format('GRANT SELECT ON ALL TABLES IN SCHEMA %%I TO %%I', s, %[1]s);
+    EXECUTE format('GRANT SELECT ON ALL SEQUENCES IN SCHEMA %%I TO %%I', s, %[1]s);
+    EXECUTE format('ALTER DEFAULT PRIVILEGES IN SCHEMA %%I GRANT SELECT ON TABLES TO %%I', s, %[1]s);
+    EXECUTE format('ALTER DEFAULT PRIVILEGES IN SCHEMA %%I GRANT SELECT ON SEQUENCES TO %%I', s, %[1]s);
+  END LOOP;
+  FOR lo IN SELECT oid FROM pg_largeobject_metadata LOOP
+    EXECUTE format('GRANT SELECT ON LARGE OBJECT %%s TO %%I', lo, %[1]s);
+  END LOOP;
+END$rep$;
+`, quoteLiteral(role), quoteIdent(role), quoteLiteral(password), quoteIdent(database))
+}
+
+// pgMissingPrivilegesQuery lists the grants pg_dump needs and the user lacks:
+// USAGE on the schemas and SELECT on the tables and sequences, whose data is
+// dumped. It avoids double quotes, being passed to psql within them.
+const pgMissingPrivilegesQuery = "SELECT format('GRANT USAGE ON SCHEMA %I TO %I;', n.nspname, current_user) " +
+	"FROM pg_namespace n " +
+	"WHERE n.nspname <> 'information_schema' AND n.nspname !~ '^pg_' AND NOT has_schema_privilege(n.oid, 'USAGE') " +
+	"UNION ALL " +
+	"SELECT format('GRANT SELECT ON %s %I.%I TO %I;', CASE c.relkind WHEN 'S' THEN 'SEQUENCE' ELSE 'TABLE' END, n.nspname, c.relname, current_user) " +
+	"FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace " +
+	"WHERE c.relkind IN ('r', 'p', 'S') AND n.nspname <> 'information_schema' AND n.nspname !~ '^pg_' " +
+	"AND NOT has_table_privilege(c.oid, 'SELECT')"
+
+// pgRowSecurityQuery lists the tables whose row-level security applies to
+// the user, which pg_dump refuses to dump unless --enable-row-security is
+// given.
+const pgRowSecurityQuery = "SELECT format('%I.%I', n.nspname, c.relname) " +
+	"FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace " +
+	"WHERE c.relkind IN ('r', 'p') AND c.relrowsecurity AND n.nspname <> 'information_schema' AND n.nspname !~ '^pg_' " +
+	"AND (c.relforcerowsecurity OR NOT pg_has_role(c.relowner, 'USAGE')) " +
+	"AND NOT (SELECT rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user)"
+
+// buildPSQLQueryCommand runs query as the dump role, if any, like pg_dump.
+func buildPSQLQueryCommand(dbConfig DB, query string) string {
+	if dbConfig.DumpRole != "" {
+		query = fmt.Sprintf("SET ROLE %s; %s", dbConfig.DumpRole, query)
+	}
+	return fmt.Sprintf("%s -At -c \"%s\"", buildPSQLCommand(dbConfig, dbConfig.Database), query)
+}
+
+func (postgresEngine) MissingPrivilegesCommand(dbConfig DB) string {
+	return buildPSQLQueryCommand(dbConfig, pgMissingPrivilegesQuery)
+}
+
+func (postgresEngine) RowSecurityCommand(dbConfig DB) string {
+	return buildPSQLQueryCommand(dbConfig, pgRowSecurityQuery)
+}
+
+// pgOwnerStatement matches the ALTER ... OWNER TO statements of pg_restore,
+// capturing the owner.
+var pgOwnerStatement = regexp.MustCompile(`^(ALTER .+ OWNER TO )(.+);$`)
+
+// OwnersCommand lists the owner statements of the schema of the dump, which
+// pg_restore writes quoted as needed, one per line.
+func (postgresEngine) OwnersCommand(dbConfig DB, fileName string) string {
+	list := fmt.Sprintf(`%s -s -f - %s | { grep "^ALTER .* OWNER TO " || true; }`, pgTool(dbConfig.PgRestorePath, "pg_restore"), fileName)
+	return "bash -o pipefail -c " + shellQuote(list)
+}
+
+func (postgresEngine) MapOwnersScript(owners string, roleMap map[string]string) string {
+	var script strings.Builder
+	for _, line := range strings.Split(owners, "\n") {
+		match := pgOwnerStatement.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		owner, ok := roleMap[unquoteIdent(match[2])]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&script, "%s%s;\n", match[1], quoteIdent(owner))
+	}
+	return script.String()
+}
+
+// ExtensionsCommand lists the table of contents of the dump.
+func (postgresEngine) ExtensionsCommand(dbConfig DB, fileName string) string {
+	return fmt.Sprintf("%s -l %s", pgTool(dbConfig.PgRestorePath, "pg_restore"), fileName)
+}
+
+// RequiredExtensions reads the EXTENSION entries of the table of contents,
+// such as "2; 3079 16385 EXTENSION - pg_trgm".
+func (postgresEngine) RequiredExtensions(contents string) []string {
+	var extensions []string
+	for _, line := range strings.Split(contents, "\n") {
+		if fields := strings.Fields(line); len(fields) > 5 && fields[3] == "EXTENSION" {
+			extensions = append(extensions, fields[5])
+		}
+	}
+	return extensions
+}
+
+func (postgresEngine) AvailableExtensionsCommand(dbConfig DB, database string) string {
+	return buildPSQLCommand(dbConfig, database) + ` -At -c "SELECT name FROM pg_available_extensions"`
+}
+
+func (postgresEngine) CreateExtensionScript(name string) string {
+	return fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s", quoteIdent(name))
+}
+
+func (postgresEngine) DatabasesCommand(dbConfig DB, database string) string {
+	return buildPSQLCommand(dbConfig, database) + ` -At -c "SELECT datname FROM pg_database"`
+}
+
+// PublishCommand needs a wal_level of logical on the server, and a
+// superuser to publish all the tables.
+func (postgresEngine) PublishCommand(dbConfig DB, publication string) string {
+	publish := fmt.Sprintf(
+		"DO $rep$ BEGIN\n"+
+			"  IF current_setting('wal_level') <> 'logical' THEN\n"+
+			"    RAISE EXCEPTION 'the wal_level of the server is %%, logical replication needs logical', current_setting('wal_level');\n"+
+			"  END IF;\n"+
+			"  IF NOT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = %s) THEN\n"+
+			"    CREATE PUBLICATION %s FOR ALL TABLES;\n"+
+			"  END IF;\n"+
+			"END $rep$",
+		quoteLiteral(publication),
+		quoteIdent(publication),
+	)
+	return fmt.Sprintf("%s -X -At -v ON_ERROR_STOP=1 -c %s -c %s", buildPSQLCommand(dbConfig, dbConfig.Database), shellQuote(publish), shellQuote("SELECT pg_current_wal_lsn()"))
+}
+
+func (postgresEngine) SubscriptionCommand(dbConfig DB, database, subscription string) string {
+	query := fmt.Sprintf(
+		"SELECT subenabled FROM pg_subscription WHERE subname = %s AND subdbid = (SELECT oid FROM pg_database WHERE datname = current_database())",
+		quoteLiteral(subscription),
+	)
+	return fmt.Sprintf("%s -X -At -c %s", buildPSQLCommand(dbConfig, database), shellQuote(query))
+}
+
+// SubscribeScript creates the replication slot of the subscription in the
+// server database along with it, which needs the REPLICATION attribute
+// there, and a local superuser.
+func (postgresEngine) SubscribeScript(subscription, publication, conninfo string, exists bool) string {
+	if exists {
+		return fmt.Sprintf(
+			"ALTER SUBSCRIPTION %s CONNECTION %s;\nALTER SUBSCRIPTION %s ENABLE;\n",
+			quoteIdent(subscription),
+			quoteLiteral(conninfo),
+			quoteIdent(subscription),
+		)
+	}
+	return fmt.Sprintf(
+		"CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s WITH (copy_data = true);\n",
+		quoteIdent(subscription),
+		quoteLiteral(conninfo),
+		quoteIdent(publication),
+	)
+}
+
+func (postgresEngine) PauseScript(subscription string) string {
+	return fmt.Sprintf("ALTER SUBSCRIPTION %s DISABLE", quoteIdent(subscription))
+}
+
+// UnsubscribeScript connects the subscription to the server database first,
+// for it to drop its replication slot, which would otherwise keep the
+// changes of the server forever.
+func (postgresEngine) UnsubscribeScript(subscription, conninfo string) string {
+	return fmt.Sprintf(
+		"ALTER SUBSCRIPTION %s DISABLE;\nALTER SUBSCRIPTION %s CONNECTION %s;\nDROP SUBSCRIPTION %s;\n",
+		quoteIdent(subscription),
+		quoteIdent(subscription),
+		quoteLiteral(conninfo),
+		quoteIdent(subscription),
+	)
+}
+
+// CopyingTablesCommand counts the tables of the subscription not yet ready
+// nor synchronizing their last changes.
+func (postgresEngine) CopyingTablesCommand(dbConfig DB, database, subscription string) string {
+	query := fmt.Sprintf(
+		"SELECT count(*) FROM pg_subscription_rel r JOIN pg_subscription s ON s.oid = r.srsubid WHERE s.subname = %s AND r.srsubstate NOT IN ('r', 's')",
+		quoteLiteral(subscription),
+	)
+	return fmt.Sprintf("%s -X -At -c %s", buildPSQLCommand(dbConfig, database), shellQuote(query))
+}
+
+// LagCommand compares position with the last position the subscription
+// confirmed to its replication slot, named after it.
+func (postgresEngine) LagCommand(dbConfig DB, subscription, position string) string {
+	query := fmt.Sprintf(
+		"SELECT pg_wal_lsn_diff(%s, confirmed_flush_lsn)::bigint FROM pg_replication_slots WHERE slot_name = %s AND confirmed_flush_lsn IS NOT NULL",
+		quoteLiteral(position),
+		quoteLiteral(subscription),
+	)
+	return fmt.Sprintf("%s -X -At -c %s", buildPSQLCommand(dbConfig, dbConfig.Database), shellQuote(query))
+}
+
+// ConnInfo quotes the values of the libpq connection string. The password
+// is kept in the subscription, only readable by the local superusers.
+func (postgresEngine) ConnInfo(dbConfig DB) string {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	}
+	conninfo := fmt.Sprintf(
+		"host=%s port=%d dbname=%s user=%s",
+		quote(dbConfig.Host),
+		dbConfig.Port,
+		quote(dbConfig.Database),
+		quote(dbConfig.Username),
+	)
+	if dbConfig.Password != "" {
+		conninfo += " password=" + quote(dbConfig.Password)
+	}
+	return conninfo
+}
+
+// SchemaDumpOptions leave out the publications and subscriptions of the
+// server database, rep_all_tables included.
+func (postgresEngine) SchemaDumpOptions() []string {
+	return []string{"--schema-only", "--no-publications", "--no-subscriptions"}
+}
+
+// ExcludeTableDataOptions keeps the definition of the tables, their
+// indexes and constraints in the dump.
+func (postgresEngine) ExcludeTableDataOptions(patterns []string) []string {
+	var options []string
+	for _, pattern := range patterns {
+		options = append(options, "--exclude-table-data="+pattern)
+	}
+	return options
+}
+
+// pgTable quotes table, given as schema.table or table, for SQL.
+func pgTable(table string) string {
+	parts := strings.SplitN(table, ".", 2)
+	for i, part := range parts {
+		parts[i] = quoteIdent(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// CopyTableCommand copies the rows in the text format of COPY, which loads
+// into a local server of another version.
+func (postgresEngine) CopyTableCommand(dbConfig DB, table, fileName string) string {
+	return fmt.Sprintf(
+		"%s -X -v ON_ERROR_STOP=1 -o %s -c %s",
+		buildPSQLCommand(dbConfig, dbConfig.Database),
+		shellQuote(fileName),
+		shellQuote("COPY "+pgTable(table)+" TO STDOUT"),
+	)
+}
+
+// LoadTablesScript truncates the tables together, which fails if a table
+// not copied refers to one of them.
+func (postgresEngine) LoadTablesScript(tables, files []string) string {
+	var quoted []string
+	for _, table := range tables {
+		quoted = append(quoted, pgTable(table))
+	}
+	var script strings.Builder
+	fmt.Fprintf(&script, "BEGIN;\nTRUNCATE %s;\n", strings.Join(quoted, ", "))
+	for i, table := range quoted {
+		// psql reads the file, which takes forward slashes on Windows too.
+		fmt.Fprintf(&script, "\\copy %s FROM %s\n", table, quoteLiteral(filepath.ToSlash(files[i])))
+	}
+	script.WriteString("COMMIT;\n")
+	return script.String()
+}
+
+func (postgresEngine) CaptureSettings(ctx context.Context, exec outputExecutor, dbConfig DB) (databaseSettings, error) {
+	settings, err := captureDBSettings(ctx, exec, dbConfig)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
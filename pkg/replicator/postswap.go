@@ -0,0 +1,119 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const defaultPostSwapCheckTimeout = 5 * time.Minute
+
+// PostSwapCheck checks that the application works with the replaced local
+// database, the previous one being kept until it passes.
+type PostSwapCheck struct {
+	// Command is a local command that must succeed, such as make db-smoke.
+	// With a target server it runs on the target.
+	Command string `yaml:"command"`
+	// URL must answer a GET with a 2xx status, such as a health endpoint.
+	URL string `yaml:"url"`
+	// Timeout bounds the check, 5m by default.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c PostSwapCheck) enabled() bool {
+	return c.Command != "" || c.URL != ""
+}
+
+// runPostSwapCheck runs the command and then requests the URL of the check.
+func (r *Replicator) runPostSwapCheck(ctx context.Context) error {
+	check := r.config.PostSwapCheck
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = defaultPostSwapCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if check.Command != "" {
+		r.printStep("Run post swap check %s", check.Command)
+		if err := r.Local.Run(ctx, check.Command); err != nil {
+			return err
+		}
+	}
+	if check.URL != "" {
+		r.printStep("Request post swap check %s", check.URL)
+		req, err := http.NewRequest(http.MethodGet, check.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s answered %s", check.URL, resp.Status)
+		}
+	}
+	return nil
+}
+
+// checkSwap runs the post swap check, if any, and rolls the local database
+// back to previousDB if it fails and the Prompter agrees. Otherwise
+// previousDB is kept for a manual rollback.
+func (r *Replicator) checkSwap(ctx context.Context, previousDB string) error {
+	if !r.config.PostSwapCheck.enabled() {
+		return nil
+	}
+	checkErr := r.runPostSwapCheck(ctx)
+	if checkErr == nil {
+		return nil
+	}
+
+	localDB := r.config.LocalDB
+	fmt.Fprintf(r.Output, "\n   !!! Post swap check of local database %s FAILED: %v\n\n", localDB.Database, checkErr)
+	if !r.Prompter.Confirm(ctx, "Roll back to the previous local database?") {
+		return fmt.Errorf(
+			"post swap check failed: %v, the previous local database is kept as %s",
+			checkErr,
+			previousDB,
+		)
+	}
+
+	if err := r.rollback(ctx, previousDB); err != nil {
+		return fmt.Errorf("post swap check failed: %v, rolling back failed: %v", checkErr, err)
+	}
+	return fmt.Errorf("post swap check failed: %v, rolled back to the previous local database", checkErr)
+}
+
+// rollback replaces the local database with previousDB, by the same scripts
+// as Swap, and drops the replaced one. Without a previous database, the
+// local database is only dropped.
+func (r *Replicator) rollback(ctx context.Context, previousDB string) error {
+	localDB := r.config.LocalDB
+	if err := r.disconnect(ctx, localDB.Database); err != nil {
+		return err
+	}
+
+	if lister, ok := r.Engine.(databaseLister); ok {
+		databases, err := r.localDatabases(ctx, lister)
+		if err != nil {
+			return err
+		}
+		if !containsString(databases, previousDB) {
+			r.printStep("Drop local database %s, there was none before", localDB.Database)
+			return r.runScript(ctx, r.intermediateDB, r.Engine.DropDatabaseScript(localDB.Database))
+		}
+	}
+
+	failedDB := r.tempDBName("failed")
+	r.printStep("Roll back local database %s to %s", localDB.Database, previousDB)
+	for _, sql := range r.Engine.SwapScripts(previousDB, localDB.Database, failedDB) {
+		if err := r.runScript(ctx, r.intermediateDB, sql); err != nil {
+			return err
+		}
+	}
+	r.printStep("Drop local database %s that failed the check", failedDB)
+	return r.runScript(ctx, r.intermediateDB, r.Engine.DropDatabaseScript(failedDB))
+}
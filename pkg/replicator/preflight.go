@@ -0,0 +1,202 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// preflightError lists all the problems Check found, for them to be fixed
+// at once rather than one run at a time.
+type preflightError []string
+
+func (e preflightError) Error() string {
+	if len(e) == 1 {
+		return e[0]
+	}
+	return fmt.Sprintf("%d problems:\n - %s", len(e), strings.Join(e, "\n - "))
+}
+
+// DefaultPort returns the port of the database engine, 0 for the engine
+// plugins.
+func DefaultPort(engine string) int {
+	switch engine {
+	case "", "postgres":
+		return 5432
+	case "mysql", "mariadb":
+		return 3306
+	case "mongodb", "mongo":
+		return 27017
+	}
+	return 0
+}
+
+// applyDefaults fills the ports left empty: 22 for SSH and the port of the
+// engine for the databases. Target is copied first, being shared with the
+// caller.
+func applyDefaults(config *Config) {
+	engine := config.Server.DB.Engine
+	if config.Server.Port == 0 && config.Server.Kubernetes == nil {
+		config.Server.Port = 22
+	}
+	defaultDBPort(&config.Server.DB, engine)
+	defaultDBPort(&config.LocalDB, engine)
+	if config.Target != nil {
+		target := *config.Target
+		config.Target = &target
+		if target.Port == 0 {
+			target.Port = 22
+		}
+		defaultDBPort(&target.DB, engine)
+	}
+}
+
+func defaultDBPort(db *DB, engine string) {
+	if db.Engine != "" {
+		engine = db.Engine
+	}
+	if db.Port == 0 {
+		db.Port = DefaultPort(engine)
+	}
+}
+
+// validateConfig returns the problems of the config itself, all of them,
+// before anything is run.
+func (r *Replicator) validateConfig() []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	server := r.config.Server
+
+	localName := "local_db"
+	if r.config.Target != nil {
+		localName = "target.db"
+	}
+	if r.preflightServer {
+		problems = append(problems, validateServer(server)...)
+		problems = append(problems, validateDB("server.db", server.DB)...)
+	}
+	problems = append(problems, validateDB(localName, r.config.LocalDB)...)
+
+	// The options that can't be used together.
+	if r.config.Target != nil && r.config.Target.DB.DockerContainer != "" {
+		add("the docker_container of a target server isn't supported")
+	}
+	if server.Kubernetes != nil && server.Mode == "direct" {
+		add("the direct mode can't be used with a kubernetes server")
+	}
+	if server.DockerContainer != "" && (server.Kubernetes != nil || server.Mode == "direct") {
+		add("the docker_container of the server can't be used with kubernetes or the direct mode")
+	}
+	if r.target != nil && (server.Mode == "direct" || len(r.Pipeline) > 0) {
+		add("a target server or container can't be used with the direct mode or a pipeline")
+	}
+	if r.target != nil && r.config.CacheDir != "" {
+		add("a target server or container can't be used with a cache_dir")
+	}
+	if r.ReuseDump > 0 && r.target != nil {
+		add("a target server or container can't reuse a cached dump")
+	}
+	for _, check := range []func() error{r.checkBackup, r.checkGlobals, r.checkRoleMap, r.checkHooks} {
+		if err := check(); err != nil {
+			add("%v", err)
+		}
+	}
+	return problems
+}
+
+// validateServer returns the problems of the options of the server.
+func validateServer(server Server) []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if server.Kubernetes == nil {
+		if server.Host == "" {
+			add("server.host is required")
+		}
+		if server.User == "" {
+			add("server.user is required")
+		}
+		if server.Port < 1 || server.Port > 65535 {
+			add("server.port %d isn't a port number", server.Port)
+		}
+		switch {
+		case server.PrivateKeySecret != "":
+		case server.PrivateKeyFile == "":
+			add("server.private_key_file or server.private_key_secret is required")
+		default:
+			if _, err := os.Stat(server.PrivateKeyFile); err != nil {
+				add("server.private_key_file can't be read: %v", err)
+			}
+		}
+	}
+	switch server.Mode {
+	case "", "remote", "direct":
+	default:
+		add("server.mode %q isn't remote or direct", server.Mode)
+	}
+	if server.TransferStreams < 0 {
+		add("server.transfer_streams can't be negative")
+	}
+	return problems
+}
+
+// validateDB returns the problems of the database name of the config.
+func validateDB(name string, db DB) []string {
+	var problems []string
+	if db.Database == "" {
+		problems = append(problems, name+".database is required")
+	}
+	if db.Host == "" {
+		problems = append(problems, name+".host is required")
+	}
+	if db.Port < 0 || db.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("%s.port %d isn't a port number", name, db.Port))
+	}
+	return problems
+}
+
+// checkServerAccess connects to the server, then checks its dump tool runs
+// and its database accepts the credentials of the config, for the runs
+// dumping it. It returns the problems found, an SSH connection failing
+// ending the checks.
+func (r *Replicator) checkServerAccess(ctx context.Context) []string {
+	server := r.config.Server
+	if !r.connected {
+		if err := r.Connect(ctx); err != nil {
+			return []string{fmt.Sprintf("connecting to %s failed: %v", server.Host, err)}
+		}
+	}
+	if server.Mode == "direct" {
+		// The dump runs locally through a port forwarded once dumping.
+		return nil
+	}
+
+	var problems []string
+	r.printStep("Check the dump tool and database %s in %s", server.DB.Database, server.Host)
+	if checker, ok := r.Engine.(versionChecker); ok {
+		err := r.withRemote(ctx, "Checking the dump tool", func() error {
+			_, err := r.Remote.Output(ctx, checker.DumpVersionCommand(server.DB))
+			return err
+		})
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("the dump tool doesn't run in %s: %v", server.Host, err))
+		}
+	}
+	if reporter, ok := r.Engine.(versionReporter); ok {
+		err := r.storeServerPassword(ctx)
+		if err == nil {
+			err = r.withRemote(ctx, "Checking the server database", func() error {
+				_, err := r.Remote.Output(ctx, reporter.ServerVersionCommand(r.config.Server.DB))
+				return err
+			})
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("database %s in %s can't be reached with the credentials of the config: %v", server.DB.Database, server.Host, err))
+		}
+	}
+	return problems
+}
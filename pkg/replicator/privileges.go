@@ -0,0 +1,71 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// privilegeChecker is implemented by the engines able to tell, before the
+// dump starts, which privileges the server user lacks to dump the database.
+type privilegeChecker interface {
+	// MissingPrivilegesCommand returns the command listing the statements
+	// granting the missing privileges, one per line.
+	MissingPrivilegesCommand(db DB) string
+	// RowSecurityCommand returns the command listing the tables whose
+	// row-level security applies to the user, one per line.
+	RowSecurityCommand(db DB) string
+}
+
+// checkPrivileges fails with the missing grants if the server user can't
+// dump the whole database, rather than the dump failing on the first
+// unreadable table, and warns about the tables with row-level security. The
+// client runs with exec, like CaptureSettings.
+func (r *Replicator) checkPrivileges(ctx context.Context, exec outputExecutor, db DB) error {
+	checker, ok := r.Engine.(privilegeChecker)
+	if !ok {
+		return nil
+	}
+	out, err := exec.Output(ctx, checker.MissingPrivilegesCommand(db))
+	if err != nil {
+		return err
+	}
+	missing := strings.TrimSpace(out)
+	if missing != "" {
+		return permanent(fmt.Errorf(
+			"user %s lacks privileges to dump database %s, grant them with:\n%s",
+			db.Username,
+			db.Database,
+			missing,
+		))
+	}
+
+	out, err = exec.Output(ctx, checker.RowSecurityCommand(db))
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for _, table := range strings.Split(out, "\n") {
+		if table = strings.TrimSpace(table); table != "" {
+			tables = append(tables, table)
+		}
+	}
+	switch {
+	case len(tables) == 0:
+	case db.EnableRowSecurity:
+		fmt.Fprintf(
+			r.Output,
+			"   Only the rows visible to %s are dumped from the tables with row-level security: %s\n",
+			db.Username,
+			strings.Join(tables, ", "),
+		)
+	default:
+		return permanent(fmt.Errorf(
+			"row-level security applies to %s on %s, set dump_role to a role owning them or with BYPASSRLS, "+
+				"or enable_row_security to dump only the visible rows",
+			db.Username,
+			strings.Join(tables, ", "),
+		))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package replicator
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseProxy parses Server.Proxy, a socks5:// or http:// URL with an
+// optional user:password, the port defaulting to 1080 and 80.
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		// The error would include the password.
+		return nil, errors.New("invalid proxy, expected socks5://host:port or http://host:port")
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1080")
+		}
+	case "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	default:
+		return nil, fmt.Errorf("invalid proxy %q, expected socks5://host:port or http://host:port", redactProxy(proxy))
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %q, it has no host", redactProxy(proxy))
+	}
+	return u, nil
+}
+
+// redactProxy masks the password of the proxy URL.
+func redactProxy(proxy string) string {
+	if proxy == "" {
+		return ""
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "***"
+	}
+	if _, ok := u.User.Password(); u.User != nil && ok {
+		// The user escapes its @, the first one ends it.
+		u.User = url.User(u.User.Username())
+		return strings.Replace(u.String(), "@", ":***@", 1)
+	}
+	return u.String()
+}
+
+// dialProxy connects to address through proxy with dialer, the name of
+// address being resolved by the proxy.
+func dialProxy(ctx context.Context, dialer net.Dialer, proxy *url.URL, address string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the proxy %s failed: %v", proxy.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tunnel := conn
+	if proxy.Scheme == "http" {
+		tunnel, err = httpConnect(conn, proxy, address)
+	} else {
+		err = socks5Connect(conn, proxy, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("the proxy %s didn't connect to %s: %v", proxy.Host, address, err)
+	}
+	return tunnel, nil
+}
+
+// httpConnect asks the HTTP proxy for a tunnel to address with CONNECT.
+func httpConnect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	// The SSH server sends its version first, it may already be read.
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn reads what its reader buffered before the rest of the
+// connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// socks5Replies are the errors of the replies of a SOCKS5 proxy, RFC 1928.
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by the ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy to connect to address, authenticating
+// with the user and password of the URL if it has them, RFC 1929.
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portString)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("host name %s too long", host)
+	}
+
+	methods := []byte{0}
+	if proxy.User != nil {
+		methods = []byte{0, 2}
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	switch {
+	case reply[1] == 0:
+	case reply[1] == 2 && proxy.User != nil:
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("proxy user or password too long")
+		}
+		auth := append([]byte{1, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy authentication failed")
+		}
+	default:
+		return errors.New("the proxy requires an authentication, add user:password@ to its URL")
+	}
+
+	request := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		message, ok := socks5Replies[header[1]]
+		if !ok {
+			message = fmt.Sprintf("error %d", header[1])
+		}
+		return errors.New(message)
+	}
+	// The bound address, which isn't needed, then the port.
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d in the reply", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
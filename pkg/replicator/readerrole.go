@@ -0,0 +1,93 @@
+package replicator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultReaderRole is the role SetupRemote creates by default.
+const DefaultReaderRole = "rep_reader"
+
+// readerRoleEngine is implemented by the engines able to create a role with
+// only the privileges the dump needs, so the routine dumps don't run as the
+// application user or a superuser.
+type readerRoleEngine interface {
+	// ReaderRoleScript returns the script creating role, or updating it if
+	// it exists, with password and the privileges to dump database.
+	ReaderRoleScript(role, password, database string) string
+}
+
+// SetupRemote creates role on the server database, connecting as admin with
+// adminPassword, with a new random password and only the privileges its
+// dump needs, and returns the password. The script runs with the client of
+// the server, through a private temp file so the password isn't in the
+// commands.
+func (r *Replicator) SetupRemote(ctx context.Context, role, admin, adminPassword string) (string, error) {
+	engine, ok := r.Engine.(readerRoleEngine)
+	if !ok {
+		return "", errors.New("the database engine can't create a dump role")
+	}
+	if r.config.Server.Mode == "direct" {
+		return "", errors.New("the dump role is set up through SSH, which the direct mode doesn't use")
+	}
+	if err := r.resolveSecrets(ctx); err != nil {
+		return "", err
+	}
+	if !r.connected {
+		if err := r.Connect(ctx); err != nil {
+			return "", err
+		}
+	}
+	defer r.Cleanup(ctx)
+	receiver, ok := r.Remote.(FileReceiver)
+	if !ok {
+		return "", errors.New("the remote executor can't write the script of the dump role")
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	password := base64.RawURLEncoding.EncodeToString(random)
+
+	adminDB := r.config.Server.DB
+	adminDB.Username = admin
+	adminDB.Password = adminPassword
+	adminDB.PasswordSecret = ""
+	adminDB.PasswordEnv = ""
+	adminDB.DumpRole = ""
+	r.printStep("Create dump role %s on database %s in %s as %s", role, adminDB.Database, r.config.Server.Host, admin)
+	err := r.withRemote(ctx, "Creating dump role", func() error {
+		if err := r.storePassword(ctx, r.Remote, receiver, &adminDB, "server"); err != nil {
+			return err
+		}
+		out, err := r.Remote.Output(ctx, mktempCommand(r.config.Server.TempDir, "rep_"))
+		if err != nil {
+			return err
+		}
+		script := strings.TrimSpace(out)
+		defer r.Remote.Run(ctx, fmt.Sprintf("rm -f %s", script))
+
+		w, err := receiver.Append(ctx, script)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, engine.ReaderRoleScript(role, password, adminDB.Database))
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return r.Remote.Run(ctx, r.Engine.ScriptCommand(adminDB, adminDB.Database, script))
+	})
+	if err != nil {
+		return "", r.redactError(err)
+	}
+	return password, nil
+}
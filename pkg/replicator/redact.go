@@ -0,0 +1,104 @@
+package replicator
+
+import (
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// secrets returns the values of the config that the output and the errors
+// must not show: the passwords and the paths of the private keys.
+func (r *Replicator) secrets() []string {
+	secrets := []string{
+		r.config.Server.DB.Password,
+		r.config.LocalDB.Password,
+		r.config.Server.PrivateKeyFile,
+	}
+	if r.config.Target != nil {
+		secrets = append(secrets, r.config.Target.PrivateKeyFile)
+	}
+	return secrets
+}
+
+// redact hides the secrets of the config in s, in any of their forms.
+func (r *Replicator) redact(s string) string {
+	for _, secret := range r.secrets() {
+		if secret == "" {
+			continue
+		}
+		for _, form := range secretForms(secret) {
+			s = strings.Replace(s, form, "***", -1)
+		}
+	}
+	return s
+}
+
+// secretForms returns the forms secret takes in the commands and their
+// output, the longest first: as is, quoted for the shell, also within a
+// quoted command, URL-encoded in a DSN, escaped in a value of a libpq
+// conninfo, and in a JSON or JavaScript string.
+func secretForms(secret string) []string {
+	shellEscape := func(s string) string {
+		return strings.Replace(s, "'", `'\''`, -1)
+	}
+	userinfo := strings.TrimPrefix(url.UserPassword("", secret).String(), ":")
+	json := jsString(secret)
+	candidates := []string{
+		secret,
+		shellEscape(secret),
+		shellEscape(shellQuote(secret)),
+		url.QueryEscape(secret),
+		url.PathEscape(secret),
+		userinfo,
+		strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(secret),
+		json[1 : len(json)-1],
+	}
+
+	var forms []string
+	seen := map[string]bool{}
+	for _, form := range candidates {
+		if !seen[form] {
+			seen[form] = true
+			forms = append(forms, form)
+		}
+	}
+	sort.SliceStable(forms, func(i, j int) bool { return len(forms[i]) > len(forms[j]) })
+	return forms
+}
+
+// redactError hides the secrets of the config in the message of err, which
+// still unwraps to err.
+func (r *Replicator) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := r.redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactingWriter hides the secrets of the config in the output, each write
+// being a whole message.
+type redactingWriter struct {
+	w io.Writer
+	r *Replicator
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,73 @@
+package replicator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	const password = `pa'ss w@rd/\"%`
+	r := New(&Config{
+		Server:  Server{DB: DB{Host: "db", Port: 5432, Database: "app", Username: "app", Password: password}},
+		LocalDB: DB{Password: "local"},
+	})
+	dsn := url.URL{Scheme: "postgres", User: url.UserPassword("app", password), Host: "db", Path: "app"}
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{"literal", "password " + password},
+		{"shell quoted", "PGPASSWORD=" + shellQuote(password) + " pg_dump"},
+		{"shell quoted twice", "bash -c " + shellQuote("PGPASSWORD="+shellQuote(password)+" pg_dump")},
+		{"DSN", "mysqldump " + dsn.String()},
+		{"query escaped", "?password=" + url.QueryEscape(password)},
+		{"path escaped", "/" + url.PathEscape(password) + "/"},
+		{"conninfo", postgresEngine{}.ConnInfo(r.config.Server.DB)},
+		{"JSON", `{"password": ` + jsString(password) + `}`},
+		{"local", "MYSQL_PWD=local mysql"},
+	}
+	for _, test := range tests {
+		got := r.redact(test.s)
+		if !strings.Contains(got, "***") {
+			t.Errorf("%s: redact(%q) = %q, nothing redacted", test.name, test.s, got)
+		}
+		for _, leak := range []string{"w@rd", "w%40rd", "ss w", "ss+w", "ss%20w", "local"} {
+			if strings.Contains(got, leak) {
+				t.Errorf("%s: redact(%q) = %q, leaking %q", test.name, test.s, got, leak)
+			}
+		}
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	r := New(&Config{Server: Server{DB: DB{Password: "s3cret"}}})
+	cause := errors.New("exit status 1")
+	err := r.redactError(fmt.Errorf("psql -c 'PASSWORD '\\''s3cret'\\''': %w", cause))
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("redactError = %q, leaking the password", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("redactError = %v, not unwrapping to its cause", err)
+	}
+	if plain := errors.New("no secret"); r.redactError(plain) != plain {
+		t.Error("redactError wrapped an error without a secret")
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	r := New(&Config{LocalDB: DB{Password: "it's"}})
+	var out bytes.Buffer
+	w := redactingWriter{w: &out, r: r}
+	msg := "   $ MYSQL_PWD=" + shellQuote("it's") + " mysql\n"
+	n, err := w.Write([]byte(msg))
+	if err != nil || n != len(msg) {
+		t.Fatalf("Write = %d, %v, want %d", n, err, len(msg))
+	}
+	if want := "   $ MYSQL_PWD='***' mysql\n"; out.String() != want {
+		t.Errorf("wrote %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,1589 @@
+// Package replicator replicates a remote database to a local one: the
+// database is dumped on the server, copied over SSH and restored into a new
+// local database that then replaces the local one. Postgres is the default
+// engine, MySQL, MariaDB and MongoDB are supported too.
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cleanupTimeout bounds Cleanup after the run was canceled.
+const cleanupTimeout = time.Minute
+
+// Replicator runs the replication described by a Config. Run goes through
+// all the steps, or Check, Dump, Transfer, Restore and Swap can be called
+// one by one, in this order, followed by Cleanup.
+type Replicator struct {
+	// Output receives the messages of the replication, and its steps unless
+	// Progress is set, os.Stdout by default.
+	Output io.Writer
+	// Remote, Local, Transferrer, Receiver and Forwarder run the commands
+	// of the steps, by default over SSH for the server and with bash
+	// locally, sh without bash, or the NoShellExecutor on Windows. With a
+	// target server, Local and Receiver run over SSH on the target, with
+	// the docker_container of the local database, in the container.
+	Remote      RemoteExecutor
+	Local       LocalExecutor
+	Transferrer FileTransferrer
+	Receiver    FileReceiver
+	Forwarder   PortForwarder
+	// Engine builds the commands of the database engine of the config,
+	// nil if the engine is unknown.
+	Engine Engine
+	// Pipeline encodes the dump for the transfer, it is built from the
+	// config.
+	Pipeline Pipeline
+	// ManifestDir is where Run writes the manifest of the run, none if
+	// empty. It defaults to DefaultManifestDir.
+	ManifestDir string
+	// StateDir is where Run records where it failed, keeping the dump for
+	// ResumeFailed, none if empty. It defaults to DefaultStateDir.
+	StateDir string
+	// ResumeFailed makes Run continue the failed run recorded in StateDir,
+	// from its dump on the server or its transferred dump, instead of
+	// dumping again.
+	ResumeFailed bool
+	// LockDir is where the lock files keep two runs from replacing the same
+	// local database at the same time, none if empty. It defaults to
+	// DefaultLockDir.
+	LockDir string
+	// HistoryFile is where each run appends its durations, as a line of
+	// JSON, none if empty. It defaults to DefaultHistoryFile.
+	HistoryFile string
+	// LogDir is where the log of a failed dump on the server is copied, none
+	// if empty. It defaults to DefaultLogDir.
+	LogDir string
+	// ShowRemoteLogs streams the log of the dump on the server to Output
+	// while it runs.
+	ShowRemoteLogs bool
+	// Verbose writes the commands of the steps to Output, as lines starting
+	// with $ followed by their script with >, and streams the log of the dump like ShowRemoteLogs.
+	Verbose bool
+	// ReuseDump makes Run restore the cached dump instead of dumping and
+	// transferring the server database when the dump was cached less than
+	// ReuseDump ago. The cache is in defaultCacheDir without a cache_dir.
+	ReuseDump time.Duration
+	// Downgrade dumps in plain SQL and rewrites the dump for a local server
+	// older than the server database, dropping what it doesn't support,
+	// rather than failing when the local restore tool is too old.
+	Downgrade bool
+	// KeepDump is a directory where Transfer keeps a copy of the local dump,
+	// decoded unless the pipeline encrypts, named after the database and the
+	// time, for a later RunFile. It is expanded by the shell.
+	KeepDump string
+	// Channel publishes the artifact of StoreArtifact to this channel of the
+	// artifact store, such as nightly, and makes FetchStored fetch the
+	// artifact of the channel instead of the latest.
+	Channel string
+	// SkipAnalyze skips gathering the statistics of the restored database
+	// before Swap.
+	SkipAnalyze bool
+	// SkipSpaceCheck skips checking the free space for the dump and the
+	// restore before dumping.
+	SkipSpaceCheck bool
+	// BandwidthLimit caps the transfer of the dump to this many bytes per
+	// second, so it doesn't saturate a shared uplink. None if zero.
+	BandwidthLimit int64
+	// ResetIncremental makes RunIncremental drop the subscription of the
+	// local database and copy the server database again, after a change of
+	// its schema for instance.
+	ResetIncremental bool
+	// ConfirmReplace asks the Prompter to confirm replacing the local
+	// database before dumping, the run failing if it declines.
+	ConfirmReplace bool
+	// ForceDisconnect ends the sessions connected to the local database
+	// before Swap replaces it, instead of failing because of them.
+	ForceDisconnect bool
+	// WithGlobals creates the roles of the server missing locally before
+	// Restore, so the grants of the dump aren't lost.
+	WithGlobals bool
+	// SharedRemote leaves Remote connected after Cleanup, for an executor
+	// shared with the Replicators of other databases of the server. The
+	// caller closes it.
+	SharedRemote bool
+	// Progress receives the steps and the copied bytes, by default a
+	// ProgressWriter writing the steps to Output.
+	Progress ProgressSink
+	// Prompter asks whether to roll the local database back to the previous
+	// one after the post swap check failed, NoPrompter by default.
+	Prompter Prompter
+	// Secrets gives the passwords of the databases, ConfigSecrets by
+	// default.
+	Secrets SecretResolver
+	// Heartbeat is the interval of the lines printed while a step runs, with
+	// its elapsed time and copied bytes, so logs that aren't a terminal show
+	// the run is alive. None if zero.
+	Heartbeat time.Duration
+
+	config    *Config
+	connected bool
+	pauser    pauser
+	step      int
+	user      string
+	runID     string
+	settings  databaseSettings
+	manifest  *Manifest
+	cleanups  []cleanup
+	heartbeat heartbeat
+	// timings are the durations of the steps, stepStarted the start of the
+	// running one.
+	timings     []StepTiming
+	stepStarted time.Time
+	// result sums up the run for Result.
+	result RunResult
+	// resumable is set by Run, whose failure is recorded for ResumeFailed,
+	// and resumeKept holds the files the cleanup of the failure keeps.
+	resumable  bool
+	resumeKept map[string]bool
+	// preflightServer is set by the runs dumping the server database, for
+	// Check to validate the server options and connect to it first.
+	preflightServer bool
+	// globals are the roles captured from the server for WithGlobals.
+	globals string
+	// sourceTables summarizes the tables of the server database when the
+	// dump started, for Verify.
+	sourceTables map[string]tableSummary
+	// restoreVersion is the version of the local restore tool, read by Check.
+	restoreVersion string
+
+	remoteRunDir   string
+	remoteDumpFile string
+	// expectedSum is the SHA-256 of the remote dump file, when known.
+	expectedSum   string
+	localDumpFile string
+	// encrypted is set when Transfer left localDumpFile encrypted, for
+	// Restore to decrypt.
+	encrypted      bool
+	intermediateDB string
+	restoredDB     string
+
+	// target connects to the target server or the Docker container of the
+	// local database, nil without one. targetName names it in the steps.
+	target          RemoteExecutor
+	targetName      string
+	targetConnected bool
+	targetDir       string
+
+	// useDriver restores with the engine itself, the local client tools
+	// being missing.
+	useDriver bool
+	// localMajor is the major version of the local server, read by Check
+	// when Downgrade is set.
+	localMajor int
+	// databaseSize is the size of the server database, measured by Dump
+	// to check the free space.
+	databaseSize int64
+	// pipelineErr is the error building the pipeline of the config.
+	pipelineErr     error
+	secretsResolved bool
+	// iamTokenAt is when the IAM token of the server database was
+	// generated.
+	iamTokenAt time.Time
+}
+
+func New(config *Config) *Replicator {
+	// The secrets are resolved into a copy, the caller's config is left
+	// untouched.
+	copied := *config
+	config = &copied
+	applyDefaults(config)
+	config.Server.DB.PgDumpPath = config.Server.PgDumpPath
+	sshExecutor := NewSSHExecutor(config.Server)
+	engine, _ := engineFor(config.Server.DB.Engine)
+	pipeline, pipelineErr := NewPipeline(config.Pipeline)
+	r := &Replicator{
+		Output:      os.Stdout,
+		Remote:      sshExecutor,
+		Local:       defaultLocalExecutor(),
+		Transferrer: sshExecutor,
+		Receiver:    LocalFiles{},
+		Forwarder:   sshExecutor,
+		Engine:      engine,
+		Pipeline:    pipeline,
+		ManifestDir: DefaultManifestDir(),
+		StateDir:    DefaultStateDir(),
+		LockDir:     DefaultLockDir(),
+		HistoryFile: DefaultHistoryFile(),
+		LogDir:      DefaultLogDir(),
+		Prompter:    NoPrompter{},
+		Secrets:     ConfigSecrets{},
+		config:      config,
+		pipelineErr: pipelineErr,
+		user:        localUserName(),
+		runID:       newRunID(),
+	}
+	if config.Server.Kubernetes != nil {
+		if config.Server.Host == "" {
+			config.Server.Host = config.Server.Kubernetes.name()
+		}
+		pod := NewKubernetesExecutor(*config.Server.Kubernetes)
+		r.Remote = pod
+		r.Transferrer = pod
+	} else if config.Server.DockerContainer != "" {
+		container := newDockerRemote(sshExecutor, config.Server.DockerContainer)
+		r.Remote = container
+		r.Transferrer = container
+	}
+	if config.Target != nil {
+		config.LocalDB = config.Target.DB
+		target := NewSSHExecutor(*config.Target)
+		r.Local = target
+		r.Receiver = target
+		r.target = target
+		r.targetName = config.Target.Host
+	} else if config.LocalDB.DockerContainer != "" {
+		container := NewDockerExecutor(config.LocalDB.DockerContainer)
+		r.Local = container
+		r.Receiver = container
+		r.target = container
+		r.targetName = "Docker container " + config.LocalDB.DockerContainer
+	}
+	return r
+}
+
+func (r *Replicator) printStep(s string, args ...interface{}) {
+	r.step++
+	s = fmt.Sprintf(s, args...)
+	progress := r.progress()
+	r.heartbeat.begin(fmt.Sprintf("%d. %s", r.step, s), progress)
+	r.beginStepTiming(s)
+	progress.Step(r.step, s)
+}
+
+// progress returns the Progress, or the ProgressWriter to Output.
+func (r *Replicator) progress() ProgressSink {
+	if r.Progress == nil {
+		return ProgressWriter{W: r.Output}
+	}
+	return r.Progress
+}
+
+// estimateStep tells the ProgressSink how long the running step took in the
+// previous run, if it was measured.
+func (r *Replicator) estimateStep(took time.Duration) {
+	if estimator, ok := r.Progress.(ProgressEstimator); ok && took > 0 {
+		estimator.Estimate(took)
+	}
+}
+
+// cleanup is a function run by Cleanup.
+type cleanup struct {
+	fn func(ctx context.Context) error
+	// remote names what fn removes on the server, empty for the local
+	// cleanups.
+	remote string
+}
+
+// onCleanup registers fn to be run by Cleanup, in reverse order.
+func (r *Replicator) onCleanup(fn func(ctx context.Context) error) {
+	r.cleanups = append(r.cleanups, cleanup{fn: fn})
+}
+
+// onRemoteCleanup registers fn, removing what on the server, to be run by
+// Cleanup, which reports it left over if the server can't be reached.
+func (r *Replicator) onRemoteCleanup(what string, fn func(ctx context.Context) error) {
+	r.cleanups = append(r.cleanups, cleanup{fn: fn, remote: what})
+}
+
+// Run replicates the database and removes the temporary artifacts, whether
+// the replication succeeded or not. The manifest of the run is written
+// before the cleanup.
+func (r *Replicator) Run(ctx context.Context) error {
+	r.resumable = true
+	r.preflightServer = true
+	return r.run(ctx, r.lockLocalDB, r.Check, r.confirmReplace(r.serverSource()), r.dumpAndTransfer, r.Restore, r.Swap)
+}
+
+// serverSource names the server database in confirmReplace.
+func (r *Replicator) serverSource() string {
+	return fmt.Sprintf("database %s of %s", r.config.Server.DB.Database, r.config.Server.Host)
+}
+
+// confirmReplace returns the step asking the Prompter to confirm replacing
+// the local database with source, for ConfirmReplace.
+func (r *Replicator) confirmReplace(source string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if !r.ConfirmReplace {
+			return nil
+		}
+		localDB := r.config.LocalDB.Database
+		if r.targetName != "" {
+			localDB += " of " + r.targetName
+		}
+		what := "dropping its current content"
+		if r.config.Backup.Mode != "" {
+			what = "keeping its current content as a backup"
+		}
+		question := fmt.Sprintf("Replace local database %s with %s, %s?", localDB, source, what)
+		if !r.Prompter.Confirm(ctx, question) {
+			return fmt.Errorf("replacing local database %s wasn't confirmed", r.config.LocalDB.Database)
+		}
+		return nil
+	}
+}
+
+// dumpAndTransfer runs Dump and Transfer, unless resuming a failed run or
+// the cached dump is recent enough for ReuseDump.
+func (r *Replicator) dumpAndTransfer(ctx context.Context) error {
+	if resumed, err := r.resumeRun(ctx); resumed || err != nil {
+		return err
+	}
+	if reused, err := r.reuseCachedDump(ctx); reused || err != nil {
+		return err
+	}
+	if err := r.Dump(ctx); err != nil {
+		return err
+	}
+	return r.Transfer(ctx)
+}
+
+// RunTo dumps the server database to w, for external pipelines, and removes
+// the temporary artifacts.
+func (r *Replicator) RunTo(ctx context.Context, w io.Writer) error {
+	return r.run(ctx, func(ctx context.Context) error {
+		return r.DumpTo(ctx, w)
+	})
+}
+
+// RunFrom replicates the dump read from rd, produced by an external pipeline
+// instead of Dump and Transfer, and removes the temporary artifacts.
+func (r *Replicator) RunFrom(ctx context.Context, rd io.Reader) error {
+	return r.run(ctx, r.lockLocalDB, r.Check, r.confirmReplace("the dump read from the input"), func(ctx context.Context) error {
+		return r.Receive(ctx, rd)
+	}, r.Restore, r.Swap)
+}
+
+// RunFile replicates the existing local dump file name, produced by another
+// process, instead of Dump and Transfer. The file is left in place.
+func (r *Replicator) RunFile(ctx context.Context, name string) error {
+	return r.run(ctx, r.lockLocalDB, r.Check, r.confirmReplace("dump file "+name), func(ctx context.Context) error {
+		return r.UseFile(ctx, name)
+	}, r.Restore, r.Swap)
+}
+
+// RunArtifact dumps the server database into an artifact kept on the
+// server, for a later RunLatest.
+func (r *Replicator) RunArtifact(ctx context.Context) error {
+	return r.run(ctx, r.DumpArtifact)
+}
+
+// RunLatest replicates the latest artifact of the server database if it is
+// fresh enough, dumping the database otherwise.
+func (r *Replicator) RunLatest(ctx context.Context) error {
+	return r.run(ctx, r.lockLocalDB, r.Check, r.confirmReplace(r.serverSource()), r.PullLatest, r.Transfer, r.Restore, r.Swap)
+}
+
+// RunStore dumps the server database into an artifact uploaded to the
+// artifact store, for a later RunStored.
+func (r *Replicator) RunStore(ctx context.Context) error {
+	return r.run(ctx, r.StoreArtifact)
+}
+
+// RunStored replicates the latest artifact of the artifact store, without
+// reaching the server.
+func (r *Replicator) RunStored(ctx context.Context) error {
+	return r.run(ctx, r.lockLocalDB, r.Check, r.confirmReplace("the stored dump of "+r.serverSource()), r.FetchStored, r.Restore, r.Swap)
+}
+
+func (r *Replicator) run(ctx context.Context, steps ...func(ctx context.Context) error) (err error) {
+	started := time.Now()
+	r.manifest = r.newManifest(started)
+	r.timings = nil
+	r.result = RunResult{}
+	output := r.Output
+	r.Output = redactingWriter{w: output, r: r}
+	defer func() { r.Output = output }()
+	if r.Heartbeat > 0 {
+		defer r.startHeartbeat(ctx)()
+	}
+	defer func() {
+		err = r.redactError(err)
+		if r.resumable {
+			r.writeRunState(err)
+		}
+		r.writeManifest(ctx, err)
+		if cleanupErr := r.Cleanup(ctx); err == nil {
+			err = r.redactError(cleanupErr)
+		}
+		r.printTimings(time.Since(started))
+		r.appendHistory(started, err)
+		r.finishResult(started, err)
+		r.pushMetrics(ctx)
+		r.notify(ctx, started, err)
+	}()
+
+	for _, step := range steps {
+		if err := step(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Replicator) checkEngine() error {
+	if r.Engine != nil {
+		return nil
+	}
+	if _, err := engineFor(r.config.Server.DB.Engine); err != nil {
+		return err
+	}
+	return errors.New("no database engine")
+}
+
+// Check verifies the config, then the local database and its client tools,
+// and, for the runs dumping the server database, the server, its dump tool
+// and its database. It reports all the problems found at once, stopping
+// early only when the checks left can't run.
+func (r *Replicator) Check(ctx context.Context) error {
+	r.printStep("Checking config...")
+	var problems []string
+	add := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if err := r.checkEngine(); err != nil {
+		// The other checks depend on the engine.
+		return err
+	}
+	add(r.pipelineErr)
+	for _, name := range r.config.Notify {
+		_, err := notifierFor(name)
+		add(err)
+	}
+	problems = append(problems, r.validateConfig()...)
+	if _, ok := r.Engine.(disconnecter); r.ForceDisconnect && !ok {
+		add(errors.New("the database engine can't disconnect the sessions of the local database"))
+	}
+	add(r.checkSchemaOnly())
+	add(r.checkFormat())
+	localDB := r.config.LocalDB
+	if localDB.Engine != "" {
+		localEngine, err := engineFor(localDB.Engine)
+		if err == nil && localEngine != r.Engine {
+			err = fmt.Errorf("can't replicate a %s database into a %s one", r.config.Server.DB.Engine, localDB.Engine)
+		}
+		add(err)
+	}
+	if r.ReuseDump > 0 && r.config.CacheDir == "" {
+		r.config.CacheDir = defaultCacheDir
+	}
+
+	// The local database and its client tools can't be checked without the
+	// passwords or the target server.
+	if err := r.resolveSecrets(ctx); err != nil {
+		return preflightError(append(problems, err.Error()))
+	}
+	if err := r.connectTarget(ctx); err != nil {
+		return preflightError(append(problems, err.Error()))
+	}
+	// Before any check connecting to the local database, for its password
+	// to stay out of the commands.
+	if err := r.storeLocalPassword(ctx); err != nil {
+		return preflightError(append(problems, err.Error()))
+	}
+	// The checks below depend on the built-in client checkClientTools may
+	// fall back to.
+	add(r.checkClientTools(ctx))
+	add(r.checkDowngrade(ctx))
+	add(r.checkLimits(ctx))
+	add(r.checkVerify())
+	add(r.checkDeferIndexes())
+	if !r.plainDump() {
+		add(r.checkRestoreVersion(ctx))
+	}
+	// The databases whose options are missing aren't tried.
+	if len(validateDB("local_db", localDB)) == 0 {
+		if err := r.runScript(ctx, localDB.Database, r.Engine.PingScript()); err != nil {
+			problems = append(problems, fmt.Sprintf("local database %s can't be reached: %v", localDB.Database, err))
+		}
+	}
+	server := r.config.Server
+	if r.preflightServer && len(validateServer(server))+len(validateDB("server.db", server.DB)) == 0 {
+		problems = append(problems, r.checkServerAccess(ctx)...)
+	}
+	if len(problems) > 0 {
+		return preflightError(problems)
+	}
+	return nil
+}
+
+// Connect opens the SSH connection to the server, or finds its pod, Dump
+// connects on its own when needed.
+func (r *Replicator) Connect(ctx context.Context) error {
+	what := "SSH to " + r.config.Server.Host
+	if r.config.Server.Kubernetes != nil {
+		what = "Connect to pod " + r.config.Server.Host
+	}
+	r.printStep("%s", what)
+	return r.retry(ctx, what, func(attempt int) error {
+		return r.dial(ctx)
+	})
+}
+
+// CheckServer connects to the server and reads the version of the server
+// database, which fails if it can't be reached, for `rep init` to test the
+// config as it is written. In direct mode, only the connection is checked.
+// Cleanup must follow.
+func (r *Replicator) CheckServer(ctx context.Context) error {
+	if err := r.resolveSecrets(ctx); err != nil {
+		return err
+	}
+	if err := r.Connect(ctx); err != nil {
+		return err
+	}
+	reporter, ok := r.Engine.(versionReporter)
+	if !ok || r.config.Server.Mode == "direct" {
+		return nil
+	}
+	r.printStep("Check database %s in %s", r.config.Server.DB.Database, r.config.Server.Host)
+	if err := r.storeServerPassword(ctx); err != nil {
+		return err
+	}
+	var out string
+	err := r.withRemote(ctx, "Getting the server version", func() error {
+		var err error
+		out, err = r.Remote.Output(ctx, reporter.ServerVersionCommand(r.config.Server.DB))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.Output, "   Server %s\n", firstLine(out))
+	return nil
+}
+
+func (r *Replicator) dial(ctx context.Context) error {
+	dialCtx, cancel := withTimeout(ctx, r.config.Timeouts.Connect)
+	defer cancel()
+
+	r.connected = false
+	if err := r.Remote.Connect(dialCtx); err != nil {
+		return err
+	}
+	r.connected = true
+
+	return nil
+}
+
+// connectTarget opens the SSH connection to the target server, or checks
+// the Docker container is running, if any and not connected yet.
+func (r *Replicator) connectTarget(ctx context.Context) error {
+	if r.target == nil || r.targetConnected {
+		return nil
+	}
+
+	what := "SSH to " + r.targetName
+	if r.config.Target != nil {
+		r.printStep("SSH to target %s", r.targetName)
+	} else {
+		what = "Checking " + r.targetName
+		r.printStep("Check %s", r.targetName)
+	}
+	err := r.retry(ctx, what, func(attempt int) error {
+		dialCtx, cancel := withTimeout(ctx, r.config.Timeouts.Connect)
+		defer cancel()
+		return r.target.Connect(dialCtx)
+	})
+	if err != nil {
+		return err
+	}
+	r.targetConnected = true
+
+	return nil
+}
+
+// withRemote retries fn on transient failures, reconnecting first as the
+// previous connection may be the reason it failed.
+func (r *Replicator) withRemote(ctx context.Context, what string, fn func() error) error {
+	return r.retry(ctx, what, func(attempt int) error {
+		if attempt > 1 || !r.connected {
+			if err := r.dial(ctx); err != nil {
+				return err
+			}
+		}
+		if r.secretsResolved {
+			if err := r.refreshIAMToken(ctx); err != nil {
+				return err
+			}
+		}
+		return fn()
+	})
+}
+
+// Dump captures the settings of the server database and dumps it into a
+// temporary file on the server, in a directory private to the SSH user. In
+// direct mode, the dump is written locally instead.
+func (r *Replicator) Dump(ctx context.Context) error {
+	defer r.timePhase("dump")()
+	if err := r.checkEngine(); err != nil {
+		return err
+	}
+	if r.pipelineErr != nil {
+		return r.pipelineErr
+	}
+	if err := r.resolveSecrets(ctx); err != nil {
+		return err
+	}
+	server := r.config.Server
+	switch server.Mode {
+	case "", "remote", "direct":
+	default:
+		return fmt.Errorf("unknown server mode %q", server.Mode)
+	}
+	if !r.connected {
+		if err := r.Connect(ctx); err != nil {
+			return err
+		}
+	}
+	if err := r.storeServerPassword(ctx); err != nil {
+		return err
+	}
+	if err := r.runPreDump(ctx); err != nil {
+		return err
+	}
+	server = r.config.Server
+	if server.Mode == "direct" {
+		return r.dumpDirect(ctx)
+	}
+	r.captureServerVersion(ctx, r.Remote, server.DB)
+	if _, ok := r.Engine.(versionChecker); ok {
+		r.printStep("Check versions of the database and dump tool in %s", server.Host)
+		err := r.withRemote(ctx, "Checking versions", func() error {
+			return r.checkVersions(ctx, r.Remote, server.DB)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := r.Engine.(privilegeChecker); ok {
+		r.printStep("Check privileges of %s on database %s in %s", server.DB.Username, server.DB.Database, server.Host)
+		err := r.withRemote(ctx, "Checking privileges", func() error {
+			return r.checkPrivileges(ctx, r.Remote, server.DB)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := r.Engine.(sizeEngine); ok && !r.SkipSpaceCheck {
+		r.printStep("Check free space for database %s", server.DB.Database)
+		err := r.withRemote(ctx, "Checking free space", func() error {
+			return r.checkSpace(ctx, r.Remote, server.DB)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := r.Engine.(tableSizer); ok {
+		r.printStep("Estimate dump of database %s", server.DB.Database)
+		err := r.withRemote(ctx, "Estimating dump", func() error {
+			r.printEstimates(ctx, r.Remote, server.DB)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if r.config.Verify.enabled() {
+		r.printStep("Count rows of the tables of database %s", server.DB.Database)
+		err := r.withRemote(ctx, "Counting rows", func() error {
+			return r.captureSourceTables(ctx, r.Remote, server.DB)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := r.captureServerSettings(ctx); err != nil {
+		return err
+	}
+
+	runDir := fmt.Sprintf("%s/rep_%s_%s", r.remoteTempDir(), sanitizeName(server.User), r.runID)
+	r.printStep("Create private run directory %s in %s", runDir, server.Host)
+	err := r.withRemote(ctx, "Creating run directory", func() error {
+		return r.Remote.Run(ctx, buildRunDirCommand(runDir))
+	})
+	if err != nil {
+		return err
+	}
+	r.remoteRunDir = runDir
+	r.onRemoteCleanup("temp run directory "+runDir, func(ctx context.Context) error {
+		if r.keptForResume(runDir) {
+			return nil
+		}
+		r.printStep("Remove temp run directory %s in %s", runDir, server.Host)
+		return r.withRemote(ctx, "Removing temp run directory", func() error {
+			return r.Remote.Run(ctx, removeDirCommand(runDir, r.config.SecureDelete))
+		})
+	})
+
+	dumpFile := fmt.Sprintf("%s/%s_%s%s", runDir, server.DB.Database, r.runID, r.dumpExtension())
+	encodedFile := dumpFile + r.Pipeline.Extension()
+	dumpedFiles := []string{dumpFile}
+	if len(r.Pipeline) > 0 {
+		dumpedFiles = []string{encodedFile, dumpFile}
+	}
+	dumpDB := r.dumpDB(server.DB)
+	dumpCmd := r.Engine.DumpCommand(dumpDB, dumpFile)
+	logFile := fmt.Sprintf("%s/%s_%s.log", runDir, server.DB.Database, r.runID)
+	dumper, logged := r.Engine.(verboseDumper)
+	if logged {
+		dumpCmd = r.loggedDumpCommand(dumper, dumpDB, dumpFile, logFile)
+	}
+	r.recordCommand("server", dumpCmd, "")
+	r.printStep("Dumping database %s in %s", server.DB.Database, server.Host)
+	err = r.withRemote(ctx, "Dumping", func() error {
+		// A retry after a dropped connection must not redo a dump that
+		// already completed on the server, and maybe encoded already.
+		for _, file := range dumpedFiles {
+			exists, err := remoteFileExists(ctx, r.Remote, file)
+			if err != nil {
+				return err
+			}
+			if exists {
+				fmt.Fprintf(r.Output, "   %s already dumped\n", file)
+				return nil
+			}
+		}
+
+		dumpCtx, cancel := withTimeout(ctx, r.config.Timeouts.Dump)
+		defer cancel()
+		if logged {
+			return r.runLoggedDump(dumpCtx, dumpCmd, logFile)
+		}
+		return r.Remote.Run(dumpCtx, dumpCmd)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(r.Pipeline) > 0 {
+		encodeCmd := r.Pipeline.EncodeCommand(dumpFile, encodedFile)
+		r.recordCommand("server", encodeCmd, "")
+		r.printStep("Encoding %s with %s in %s", dumpFile, r.Pipeline, server.Host)
+		err = r.withRemote(ctx, "Encoding", func() error {
+			exists, err := remoteFileExists(ctx, r.Remote, encodedFile)
+			if err != nil || exists {
+				return err
+			}
+			dumpCtx, cancel := withTimeout(ctx, r.config.Timeouts.Dump)
+			defer cancel()
+			return r.Remote.Run(dumpCtx, encodeCmd)
+		})
+		if err != nil {
+			return err
+		}
+		if r.Pipeline.encrypts() {
+			r.printStep("Remove plain dump file %s in %s", dumpFile, server.Host)
+			err = r.withRemote(ctx, "Removing plain dump file", func() error {
+				return r.Remote.Run(ctx, removeFileCommand(dumpFile, r.config.SecureDelete))
+			})
+			if err != nil {
+				return err
+			}
+		}
+		dumpFile = encodedFile
+	}
+	r.remoteDumpFile = dumpFile
+
+	return nil
+}
+
+// captureServerSettings captures the settings of the server database, and
+// its roles for WithGlobals, for Restore.
+func (r *Replicator) captureServerSettings(ctx context.Context) error {
+	server := r.config.Server
+	if capturer, ok := r.Engine.(settingsCapturer); ok {
+		r.printStep("Capturing settings of database %s in %s", server.DB.Database, server.Host)
+		err := r.withRemote(ctx, "Capturing settings", func() error {
+			var err error
+			r.settings, err = capturer.CaptureSettings(ctx, r.Remote, server.DB)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.WithGlobals {
+		r.printStep("Capturing roles of %s", server.Host)
+		err := r.withRemote(ctx, "Capturing roles", func() error {
+			return r.captureGlobals(ctx, r.Remote, server.DB)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dumpDirect dumps the server database with the local client, through a
+// local port forwarded to the database over SSH. It needs neither the client
+// nor room for the dump on the server, but the dump fails if the SSH
+// connection drops.
+func (r *Replicator) dumpDirect(ctx context.Context) error {
+	server := r.config.Server
+	tunneledDB, err := r.forwardServerDB()
+	if err != nil {
+		return err
+	}
+
+	r.captureServerVersion(ctx, r.Local, tunneledDB)
+	if _, ok := r.Engine.(versionChecker); ok {
+		r.printStep("Check versions of the database in %s and the local dump tool", server.Host)
+		if err := r.checkVersions(ctx, r.Local, tunneledDB); err != nil {
+			return err
+		}
+	}
+	if _, ok := r.Engine.(privilegeChecker); ok {
+		r.printStep("Check privileges of %s on database %s in %s", server.DB.Username, server.DB.Database, server.Host)
+		if err := r.checkPrivileges(ctx, r.Local, tunneledDB); err != nil {
+			return err
+		}
+	}
+	if _, ok := r.Engine.(sizeEngine); ok && !r.SkipSpaceCheck {
+		r.printStep("Check free space for database %s", server.DB.Database)
+		if err := r.checkSpace(ctx, r.Local, tunneledDB); err != nil {
+			return err
+		}
+	}
+	if _, ok := r.Engine.(tableSizer); ok {
+		r.printStep("Estimate dump of database %s", server.DB.Database)
+		r.printEstimates(ctx, r.Local, tunneledDB)
+	}
+	if r.config.Verify.enabled() {
+		r.printStep("Count rows of the tables of database %s", server.DB.Database)
+		if err := r.captureSourceTables(ctx, r.Local, tunneledDB); err != nil {
+			return err
+		}
+	}
+	if capturer, ok := r.Engine.(settingsCapturer); ok {
+		r.printStep("Capturing settings of database %s in %s", server.DB.Database, server.Host)
+		r.settings, err = capturer.CaptureSettings(ctx, r.Local, tunneledDB)
+		if err != nil {
+			return err
+		}
+	}
+	if r.WithGlobals {
+		r.printStep("Capturing roles of %s", server.Host)
+		if err := r.captureGlobals(ctx, r.Local, tunneledDB); err != nil {
+			return err
+		}
+	}
+
+	dumpFile := r.localDumpPath()
+	r.onCleanup(func(ctx context.Context) error {
+		if r.keptForResume(dumpFile) {
+			return nil
+		}
+		r.printStep("Remove local temp dump file %s", dumpFile)
+		return r.Local.Run(ctx, fmt.Sprintf(
+			"%s && %s",
+			removeFileCommand(dumpFile+".partial", r.config.SecureDelete),
+			removeFileCommand(dumpFile, r.config.SecureDelete),
+		))
+	})
+
+	r.printStep("Dumping database %s in %s to %s", server.DB.Database, server.Host, dumpFile)
+	if _, err := os.Stat(dumpFile); err == nil {
+		fmt.Fprintf(r.Output, "   %s already dumped\n", dumpFile)
+	} else {
+		dumpCmd := r.Engine.DumpCommand(r.dumpDB(tunneledDB), dumpFile)
+		r.recordCommand("local", dumpCmd, "")
+		dumpCtx, cancel := withTimeout(ctx, r.config.Timeouts.Dump)
+		err := r.Local.Run(dumpCtx, dumpCmd)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	r.localDumpFile = dumpFile
+
+	return nil
+}
+
+// forwardServerDB forwards a local port to the server database through the
+// SSH connection until Cleanup, returning the database as reached through
+// it.
+func (r *Replicator) forwardServerDB() (DB, error) {
+	server := r.config.Server
+	addr := net.JoinHostPort(server.DB.Host, strconv.Itoa(server.DB.Port))
+	r.printStep("Forward a local port to %s through %s", addr, server.Host)
+	listener, err := r.Forwarder.Forward(addr)
+	if err != nil {
+		return DB{}, err
+	}
+	r.onCleanup(func(ctx context.Context) error {
+		r.printStep("Close the local port forwarded to %s", addr)
+		return listener.Close()
+	})
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return DB{}, err
+	}
+	tunneledDB := server.DB
+	tunneledDB.Host = host
+	// The client tools run locally.
+	tunneledDB.PgDumpPath = ""
+	tunneledDB.PsqlPath = r.config.LocalDB.PsqlPath
+	tunneledDB.PgRestorePath = r.config.LocalDB.PgRestorePath
+	if tunneledDB.Port, err = strconv.Atoi(port); err != nil {
+		return DB{}, err
+	}
+	return tunneledDB, nil
+}
+
+// remoteTempDir is the directory of the server the run directory is
+// created in.
+func (r *Replicator) remoteTempDir() string {
+	if r.config.Server.TempDir != "" {
+		return r.config.Server.TempDir
+	}
+	return "/tmp"
+}
+
+// localDumpPath returns where the dump is transferred, in the private run
+// directory of the target server if any.
+func (r *Replicator) localDumpPath() string {
+	dir := os.TempDir()
+	if r.targetDir != "" {
+		dir = r.targetDir
+	}
+	return filepath.Join(
+		dir,
+		fmt.Sprintf("rep_%s_%s_%s%s", r.user, r.config.Server.DB.Database, r.runID, r.dumpExtension()),
+	)
+}
+
+// buildRunDirCommand creates dir only accessible by the SSH user. A retry
+// accepts dir if it already exists as a directory owned by the user, which
+// rules out one created beforehand by someone else.
+func buildRunDirCommand(dir string) string {
+	return fmt.Sprintf(
+		"umask 077 && { mkdir -m 700 %s 2>/dev/null || { test -d %s && test ! -L %s && test -O %s; }; } && chmod 700 %s",
+		dir,
+		dir,
+		dir,
+		dir,
+		dir,
+	)
+}
+
+// removeFileCommand removes file, overwriting it first with shred when
+// secure. Overwriting only erases the data on filesystems that write in
+// place: copy-on-write and log-structured filesystems (btrfs, ZFS, APFS),
+// journaled data, snapshots and the wear leveling of SSDs can keep copies
+// of it. The file is still removed where shred isn't installed.
+func removeFileCommand(file string, secure bool) string {
+	if !secure {
+		return fmt.Sprintf("rm -f %s", file)
+	}
+	return fmt.Sprintf(
+		"{ ! command -v shred >/dev/null || test ! -f %s || shred -u %s; } && rm -f %s",
+		file,
+		file,
+		file,
+	)
+}
+
+// removeDirCommand removes dir, shredding its files first when secure, with
+// the limits of removeFileCommand.
+func removeDirCommand(dir string, secure bool) string {
+	if !secure {
+		return fmt.Sprintf("rm -rf %s", dir)
+	}
+	return fmt.Sprintf(
+		"{ ! command -v shred >/dev/null || test ! -d %s || find %s -type f -exec shred -u {} +; } && rm -rf %s",
+		dir,
+		dir,
+		dir,
+	)
+}
+
+// Transfer copies the dump file from the server to the local machine. It has
+// nothing to do in direct mode.
+func (r *Replicator) Transfer(ctx context.Context) error {
+	defer r.timePhase("transfer")()
+	if r.remoteDumpFile == "" && r.localDumpFile != "" {
+		// The direct mode dumped locally, there is no transfer to time.
+		r.recordTransfer(ctx, r.localDumpFile, 0)
+		return r.keepDump(ctx)
+	}
+	if r.remoteDumpFile == "" {
+		return errors.New("nothing to transfer, Dump must run first")
+	}
+
+	localDumpFile, verified, err := r.transferDump(ctx)
+	if err != nil {
+		return err
+	}
+	return r.useTransferred(ctx, localDumpFile, verified)
+}
+
+// useTransferred verifies the transferred dump against expectedSum, unless
+// already verified, and decodes it for Restore.
+func (r *Replicator) useTransferred(ctx context.Context, localDumpFile string, verified bool) error {
+	if r.expectedSum != "" && !verified {
+		r.printStep("Verify checksum of %s", localDumpFile)
+		sum, err := r.fileChecksum(ctx, localDumpFile)
+		if err != nil {
+			return err
+		}
+		if sum != r.expectedSum {
+			return fmt.Errorf("checksum of %s is %s, expected %s", localDumpFile, sum, r.expectedSum)
+		}
+	}
+
+	r.encrypted = r.Pipeline.encrypts()
+	if len(r.Pipeline) > 0 && !r.encrypted {
+		decodedFile := r.localDumpPath()
+		r.printStep("Decoding %s with %s", localDumpFile, r.Pipeline)
+		r.onCleanup(func(ctx context.Context) error {
+			if r.keptForResume(decodedFile) {
+				return nil
+			}
+			r.printStep("Remove local temp decoded file %s", decodedFile)
+			return r.Local.Run(ctx, removeFileCommand(decodedFile, r.config.SecureDelete))
+		})
+		if err := r.decodeFile(localDumpFile, decodedFile); err != nil {
+			return err
+		}
+		localDumpFile = decodedFile
+	}
+	r.localDumpFile = localDumpFile
+
+	return r.keepDump(ctx)
+}
+
+// transferDump copies the dump file, into the cache when there is one, and
+// returns the local file. A cached dump matching the SHA-256 of the dump
+// file is used instead, which is reported as already verified. The SHA-256
+// is also computed for a transfer split into chunks, for useTransferred to
+// check the joined parts.
+func (r *Replicator) transferDump(ctx context.Context) (string, bool, error) {
+	if r.config.CacheDir != "" || r.config.Server.TransferStreams > 1 {
+		sum, err := r.remoteChecksum(ctx)
+		if err != nil {
+			return "", false, err
+		}
+		r.expectedSum = sum
+	}
+	var localDumpFile string
+	if r.config.CacheDir != "" {
+		localDumpFile = r.cachePath()
+		if r.cachedDump(ctx, r.expectedSum) {
+			fmt.Fprintf(r.Output, "   Using cached dump file %s\n", localDumpFile)
+			return localDumpFile, true, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(localDumpFile), 0700); err != nil {
+			return "", false, err
+		}
+	}
+	if err := r.checkLocalSpace(ctx); err != nil {
+		return "", false, err
+	}
+
+	if r.target != nil {
+		if err := r.createTargetDir(ctx); err != nil {
+			return "", false, err
+		}
+		r.printStep("Copy dump file %s to %s through local", r.remoteDumpFile, r.targetName)
+	} else {
+		r.printStep("Copy dump file %s to local", r.remoteDumpFile)
+	}
+	transferredFile := r.localDumpPath() + r.Pipeline.Extension()
+	if localDumpFile == "" {
+		if err := r.checkFileFree(ctx, transferredFile); err != nil {
+			return "", false, err
+		}
+	} else {
+		// A partial file left by an earlier run may belong to another dump.
+		transferredFile = localDumpFile + ".partial"
+		if err := os.Remove(transferredFile); err != nil && !os.IsNotExist(err) {
+			return "", false, err
+		}
+		removeParts(transferredFile)
+	}
+	started := time.Now()
+	err := r.withRemote(ctx, "Copying dump file", func() error {
+		return r.transferFile(ctx, r.remoteDumpFile, transferredFile, r.config.Timeouts.Copy)
+	})
+	if err != nil {
+		return "", false, err
+	}
+	r.recordTransfer(ctx, transferredFile, time.Since(started))
+	if localDumpFile != "" {
+		return localDumpFile, false, r.cacheDump(transferredFile, r.expectedSum)
+	}
+
+	r.onCleanup(func(ctx context.Context) error {
+		if r.keptForResume(transferredFile) {
+			return nil
+		}
+		r.printStep("Remove local temp copied file %s", transferredFile)
+		return r.Local.Run(ctx, removeFileCommand(transferredFile, r.config.SecureDelete))
+	})
+	return transferredFile, false, nil
+}
+
+// DumpTo runs Dump and writes the dump to w instead of transferring it,
+// decoded by the pipeline. Unlike Transfer, the stream can't resume if it is
+// interrupted. Cleanup must follow.
+func (r *Replicator) DumpTo(ctx context.Context, w io.Writer) error {
+	if err := r.Dump(ctx); err != nil {
+		return err
+	}
+
+	if r.remoteDumpFile == "" {
+		// The direct mode dumped locally.
+		r.printStep("Write dump file %s to the output", r.localDumpFile)
+		file, err := os.Open(r.localDumpFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(countingWriter{w, &r.heartbeat}, file)
+		return err
+	}
+
+	r.printStep("Stream dump file %s to the output", r.remoteDumpFile)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.Transferrer.CopyFrom(ctx, r.remoteDumpFile, 0, pw))
+	}()
+	defer pr.Close()
+
+	reader, err := r.Pipeline.Decode(pr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(countingWriter{w, &r.heartbeat}, reader)
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Receive stores the dump read from rd where Transfer would have, so Restore
+// and Swap can follow without Dump and Transfer. The dump isn't decoded by
+// the pipeline.
+func (r *Replicator) Receive(ctx context.Context, rd io.Reader) error {
+	if r.target != nil {
+		if err := r.createTargetDir(ctx); err != nil {
+			return err
+		}
+	}
+
+	localDumpFile := r.localDumpPath()
+	r.printStep("Receive dump file %s from the input", localDumpFile)
+	r.onCleanup(func(ctx context.Context) error {
+		r.printStep("Remove temp received file %s", localDumpFile)
+		return r.Local.Run(ctx, removeFileCommand(localDumpFile, r.config.SecureDelete))
+	})
+
+	file, err := r.Receiver.Append(ctx, localDumpFile)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(countingWriter{file, &r.heartbeat}, rd)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	r.localDumpFile = localDumpFile
+
+	return nil
+}
+
+// UseFile makes Restore restore the local dump file name instead of the
+// transferred one, so Restore and Swap can follow without Dump and Transfer.
+// The file isn't decoded by the pipeline, nor removed by Cleanup.
+func (r *Replicator) UseFile(ctx context.Context, name string) error {
+	if r.target != nil {
+		return errors.New("a local dump file can't be restored on a target server or container")
+	}
+	file, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return permanent(err)
+	}
+	if !info.Mode().IsRegular() {
+		return permanent(fmt.Errorf("%s isn't a dump file", file))
+	}
+	r.printStep("Use dump file %s", file)
+	r.localDumpFile = file
+	return nil
+}
+
+// createTargetDir creates the private run directory receiving the dump on
+// the target server or in the Docker container.
+func (r *Replicator) createTargetDir(ctx context.Context) error {
+	if r.targetDir != "" {
+		return nil
+	}
+	if err := r.connectTarget(ctx); err != nil {
+		return err
+	}
+
+	owner := r.user
+	if r.config.Target != nil {
+		owner = r.config.Target.User
+	}
+	dir := fmt.Sprintf("/tmp/rep_%s_%s", sanitizeName(owner), r.runID)
+	r.printStep("Create private run directory %s in %s", dir, r.targetName)
+	if err := r.target.Run(ctx, buildRunDirCommand(dir)); err != nil {
+		return err
+	}
+	r.targetDir = dir
+	r.onCleanup(func(ctx context.Context) error {
+		if r.keptForResume(dir) {
+			return nil
+		}
+		r.printStep("Remove temp run directory %s in %s", dir, r.targetName)
+		return r.target.Run(ctx, removeDirCommand(dir, r.config.SecureDelete))
+	})
+
+	return nil
+}
+
+// decryptDump decodes the transferred dump, left encrypted by Transfer, next
+// to it, for Restore. The decrypted file is also removed by the cleanup in
+// case the run is interrupted.
+func (r *Replicator) decryptDump(ctx context.Context) (string, error) {
+	decryptedFile := r.localDumpPath()
+	r.printStep("Decrypting %s with %s", r.localDumpFile, r.Pipeline)
+	r.onCleanup(func(ctx context.Context) error {
+		r.printStep("Remove local temp decrypted file %s", decryptedFile)
+		return r.Local.Run(ctx, removeFileCommand(decryptedFile, r.config.SecureDelete))
+	})
+	if err := r.decodeFile(r.localDumpFile, decryptedFile); err != nil {
+		return "", err
+	}
+	r.localDumpFile = decryptedFile
+	return decryptedFile, nil
+}
+
+// decodeFile decodes the encoded file into decoded with the pipeline.
+func (r *Replicator) decodeFile(encoded, decoded string) error {
+	in, err := os.Open(encoded)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	reader, err := r.Pipeline.Decode(in)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(decoded, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	_, err = io.Copy(out, reader)
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("decoding %s: %v", encoded, err)
+	}
+
+	return nil
+}
+
+// Restore restores the transferred dump into a new local database, next to
+// the local database it will replace.
+func (r *Replicator) Restore(ctx context.Context) error {
+	defer r.timePhase("restore")()
+	if r.localDumpFile == "" {
+		return errors.New("nothing to restore, Transfer must run first")
+	}
+	if err := r.checkEngine(); err != nil {
+		return err
+	}
+	if err := r.resolveSecrets(ctx); err != nil {
+		return err
+	}
+	if err := r.connectTarget(ctx); err != nil {
+		return err
+	}
+	localDB := r.config.LocalDB
+
+	if err := r.applyGlobals(ctx, localDB.Database); err != nil {
+		return err
+	}
+
+	intermediateDB := r.tempDBName("tmp")
+	restoredDB := r.tempDBName("restored")
+	if err := r.checkNamesFree(ctx, intermediateDB, restoredDB); err != nil {
+		return err
+	}
+
+	r.printStep("Create local intermediate database %s", intermediateDB)
+	err := r.runScript(ctx, localDB.Database, r.Engine.CreateDatabaseScript(intermediateDB))
+	if err != nil {
+		return err
+	}
+	r.intermediateDB = intermediateDB
+	r.onCleanup(func(ctx context.Context) error {
+		r.printStep("Drop local intermediate database %s", intermediateDB)
+		return r.runScript(ctx, localDB.Database, r.Engine.DropDatabaseScript(intermediateDB))
+	})
+
+	createScript := r.Engine.CreateDatabaseScript(restoredDB)
+	if creator, ok := r.settings.(databaseCreator); ok {
+		createScript = creator.CreateDatabaseScript(restoredDB)
+	}
+	r.printStep("Create local restored database %s", restoredDB)
+	err = r.runScript(ctx, intermediateDB, createScript)
+	if err != nil {
+		return err
+	}
+	r.onCleanup(func(ctx context.Context) error {
+		r.printStep("Drop local restored database if exists %s", restoredDB)
+		return r.runScript(ctx, localDB.Database, r.Engine.DropDatabaseScript(restoredDB))
+	})
+
+	if err := r.createExtensions(ctx, restoredDB); err != nil {
+		return err
+	}
+
+	if r.encrypted {
+		// The plain dump is only kept for the restore.
+		encryptedFile := r.localDumpFile
+		decrypted, err := r.decryptDump(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			r.localDumpFile = encryptedFile
+			r.printStep("Remove local decrypted file %s", decrypted)
+			if err := r.Local.Run(ctx, removeFileCommand(decrypted, r.config.SecureDelete)); err != nil {
+				fmt.Fprintf(r.Output, "   Removing %s failed: %v\n", decrypted, err)
+			}
+		}()
+	}
+
+	restoreCtx, cancel := withTimeout(ctx, r.config.Timeouts.Restore)
+	started := time.Now()
+	previous := readStats()[r.statsID()].Restore
+	if r.Downgrade {
+		err = r.restoreDowngraded(restoreCtx, restoredDB)
+	} else if r.useDriver {
+		r.printStep("Restoring %s to databae %s", r.localDumpFile, restoredDB)
+		r.estimateStep(previous)
+		r.recordCommand(r.localWhere(), "(built-in client) "+r.localDumpFile, "")
+		err = r.Engine.(driverEngine).DriverRestore(restoreCtx, localDB, restoredDB, r.localDumpFile)
+	} else if r.plainFormat() {
+		r.estimateStep(previous)
+		err = r.restorePlain(restoreCtx, restoredDB)
+	} else if r.config.DeferIndexes {
+		r.estimateStep(previous)
+		err = r.restoreDeferred(restoreCtx, restoredDB)
+	} else {
+		r.printStep("Restoring %s to databae %s", r.localDumpFile, restoredDB)
+		r.estimateStep(previous)
+		restoreCmd := r.Engine.RestoreCommand(localDB, restoredDB, r.localDumpFile)
+		if limiter, ok := r.Engine.(restoreLimiter); ok && r.config.Limits.set() {
+			restoreCmd = r.limitCommand(limiter.LimitedRestoreCommand(localDB, restoredDB, r.localDumpFile, r.config.Limits))
+		}
+		r.recordCommand(r.localWhere(), restoreCmd, "")
+		err = r.Local.Run(restoreCtx, restoreCmd)
+	}
+	cancel()
+	if err != nil {
+		return err
+	}
+	restored := time.Since(started)
+	r.updateStats(func(stats *runStats) {
+		stats.Restore = restored
+	})
+	if err := r.verifyRestored(ctx, restoredDB); err != nil {
+		return err
+	}
+
+	if err := r.mapOwners(ctx, restoredDB); err != nil {
+		return err
+	}
+	if sql := r.settingsSQL(restoredDB); sql != "" {
+		r.printStep("Applying database settings to %s", restoredDB)
+		if err := r.runScript(ctx, restoredDB, sql); err != nil {
+			return err
+		}
+	}
+	if err := r.runPostRestore(ctx, restoredDB, false); err != nil {
+		return err
+	}
+	if err := r.refreshMatviews(ctx, restoredDB); err != nil {
+		return err
+	}
+	if err := r.analyze(ctx, restoredDB); err != nil {
+		return err
+	}
+	r.restoredDB = restoredDB
+
+	return nil
+}
+
+func (r *Replicator) settingsSQL(database string) string {
+	if r.settings == nil {
+		return ""
+	}
+	return r.settings.SQL(database)
+}
+
+// Swap replaces the local database with the restored one once it is
+// verified. The local database is moved aside by the same scripts, which
+// leave it in place if they fail, and only dropped afterwards, unless the
+// config keeps it as a backup.
+func (r *Replicator) Swap(ctx context.Context) error {
+	defer r.timePhase("swap")()
+	if r.restoredDB == "" {
+		return errors.New("nothing to swap, Restore must run first")
+	}
+	localDB := r.config.LocalDB
+
+	r.printStep("Verify local restored database %s", r.restoredDB)
+	if err := r.runScript(ctx, r.restoredDB, r.Engine.PingScript()); err != nil {
+		return err
+	}
+	r.printSchemaDiff(ctx, r.restoredDB)
+
+	previousDB, keep, err := r.previousLocalDB(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := r.disconnect(ctx, localDB.Database); err != nil {
+		return err
+	}
+	r.printStep("Replace local database %s with %s, moving it to %s", localDB.Database, r.restoredDB, previousDB)
+	for _, sql := range r.Engine.SwapScripts(r.restoredDB, localDB.Database, previousDB) {
+		if err := r.runScript(ctx, r.intermediateDB, sql); err != nil {
+			return fmt.Errorf("replacing local database %s failed, it was left as it was: %v", localDB.Database, err)
+		}
+	}
+	r.result.Replaced = true
+
+	if err := r.runPostRestore(ctx, localDB.Database, true); err != nil {
+		return fmt.Errorf("local database %s was replaced, but %v", localDB.Database, err)
+	}
+	if err := r.checkSwap(ctx, previousDB); err != nil {
+		return err
+	}
+
+	if keep {
+		r.result.PreviousDatabase = previousDB
+		fmt.Fprintf(r.Output, "   Previous local database kept as %s\n", previousDB)
+		return r.dropOldBackupDBs(ctx)
+	}
+	// Sessions follow the database it was renamed to.
+	if err := r.disconnect(ctx, previousDB); err != nil {
+		return err
+	}
+	r.printStep("Drop previous local database %s", previousDB)
+	return r.runScript(ctx, r.intermediateDB, r.Engine.DropDatabaseScript(previousDB))
+}
+
+// disconnect ends the sessions connected to the local database if
+// ForceDisconnect is set.
+func (r *Replicator) disconnect(ctx context.Context, database string) error {
+	if !r.ForceDisconnect {
+		return nil
+	}
+	engine, ok := r.Engine.(disconnecter)
+	if !ok {
+		return errors.New("the database engine can't disconnect the sessions of the local database")
+	}
+	r.printStep("Disconnect sessions of local database %s", database)
+	return r.runScript(ctx, r.intermediateDB, engine.DisconnectScript(database))
+}
+
+// Cleanup removes the temporary artifacts of the steps that ran, in reverse
+// order, and closes the connection to the server. It returns the first
+// error but keeps cleaning up after it. The server is connected to again for
+// its cleanups, whether the connection died or was never made, and those
+// left over when it can't be reached are reported. A done ctx, as when the
+// run was canceled, is replaced by one of cleanupTimeout.
+func (r *Replicator) Cleanup(ctx context.Context) error {
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+	}
+	reachable := true
+	for _, c := range r.cleanups {
+		if c.remote == "" {
+			continue
+		}
+		if err := r.dial(ctx); err != nil {
+			fmt.Fprintf(r.Output, "   Reconnecting to %s for the cleanup failed: %v\n", r.config.Server.Host, err)
+			reachable = false
+		}
+		break
+	}
+	if len(r.cleanups) > 0 && r.targetConnected {
+		if err := r.target.Connect(ctx); err != nil {
+			fmt.Fprintf(r.Output, "   Reconnecting to %s for the cleanup failed: %v\n", r.targetName, err)
+		}
+	}
+
+	var firstErr error
+	var leftOver []string
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		c := r.cleanups[i]
+		if c.remote != "" && !reachable {
+			leftOver = append(leftOver, c.remote)
+			continue
+		}
+		if err := c.fn(ctx); err != nil {
+			fmt.Fprintf(r.Output, "   %v\n", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	r.cleanups = nil
+	if len(leftOver) > 0 {
+		err := fmt.Errorf("%s couldn't be reached to remove %s", r.config.Server.Host, strings.Join(leftOver, ", "))
+		fmt.Fprintf(r.Output, "   %v\n", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if r.connected {
+		if !r.SharedRemote {
+			r.Remote.Close()
+		}
+		r.connected = false
+	}
+	if r.targetConnected {
+		r.target.Close()
+		r.targetConnected = false
+	}
+
+	return firstErr
+}
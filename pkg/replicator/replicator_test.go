@@ -0,0 +1,140 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRunOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		failRemote string
+		failLocal  string
+		// want are the commands expected in this order.
+		want []string
+		// never are the commands that must not run.
+		never []string
+	}{
+		{
+			name: "replicates",
+			want: []string{
+				"remote connect",
+				"pg_dump -h",
+				"copy ",
+				"pg_restore -h",
+				"RENAME TO dev",
+				"DROP DATABASE IF EXISTS old_dev_",
+				"local rm -f",
+				"remote rm -rf",
+			},
+		},
+		{
+			name:       "dump fails",
+			failRemote: "pg_dump -h",
+			want:       []string{"pg_dump -h", "remote rm -rf"},
+			never:      []string{"copy ", "CREATE DATABASE", "pg_restore -h", "RENAME TO dev"},
+		},
+		{
+			name:      "restore fails",
+			failLocal: "pg_restore -h",
+			want: []string{
+				"pg_restore -h",
+				"DROP DATABASE IF EXISTS restored_dev_",
+				"DROP DATABASE IF EXISTS tmp_dev_",
+				"local rm -f",
+				"remote rm -rf",
+			},
+			never: []string{"RENAME TO dev", "DROP DATABASE IF EXISTS old_dev_"},
+		},
+		{
+			name:      "swap fails",
+			failLocal: "RENAME TO dev",
+			want: []string{
+				"RENAME TO dev",
+				"DROP DATABASE IF EXISTS restored_dev_",
+				"local rm -f",
+				"remote rm -rf",
+			},
+			never: []string{"DROP DATABASE IF EXISTS old_dev_"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, log := newFakeReplicator(t, test.failRemote, test.failLocal)
+			err := r.Run(context.Background())
+			if failed := test.failRemote != "" || test.failLocal != ""; failed != (err != nil) {
+				t.Fatalf("Run returned %v, commands:\n%s", err, log)
+			}
+			at := 0
+			for _, want := range test.want {
+				i := log.index(want, at)
+				if i < 0 {
+					t.Fatalf("no %q after command %d, commands:\n%s", want, at, log)
+				}
+				at = i + 1
+			}
+			for _, never := range test.never {
+				if log.index(never, 0) >= 0 {
+					t.Errorf("%q ran, commands:\n%s", never, log)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanupRemote(t *testing.T) {
+	tests := []struct {
+		name       string
+		connectErr error
+		want       []string
+		never      []string
+		err        string
+	}{
+		{
+			name: "never connected",
+			want: []string{"remote connect", "local rm -f /tmp/local", "remote rm -rf /tmp/run"},
+		},
+		{
+			name:       "unreachable",
+			connectErr: errors.New("connection refused"),
+			want:       []string{"remote connect", "local rm -f /tmp/local"},
+			never:      []string{"remote rm -rf /tmp/run"},
+			err:        "server couldn't be reached to remove temp run directory /tmp/run",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, log := newFakeReplicator(t, "", "")
+			r.Remote.(*fakeExecutor).connectErr = test.connectErr
+			r.config.Retry.Attempts = 1
+			r.onRemoteCleanup("temp run directory /tmp/run", func(ctx context.Context) error {
+				return r.withRemote(ctx, "Removing temp run directory", func() error {
+					return r.Remote.Run(ctx, "rm -rf /tmp/run")
+				})
+			})
+			r.onCleanup(func(ctx context.Context) error {
+				return r.Local.Run(ctx, "rm -f /tmp/local")
+			})
+
+			err := r.Cleanup(context.Background())
+			if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("Cleanup = %v, want %q", err, test.err)
+			}
+			at := 0
+			for _, want := range test.want {
+				i := log.index(want, at)
+				if i < 0 {
+					t.Fatalf("no %q after command %d, commands:\n%s", want, at, log)
+				}
+				at = i + 1
+			}
+			for _, never := range test.never {
+				if log.index(never, 0) >= 0 {
+					t.Errorf("%q ran, commands:\n%s", never, log)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runState records where a failed Run stopped, for ResumeFailed to continue it
+// from the dump it kept instead of dumping again.
+type runState struct {
+	RunID    string    `json:"run_id"`
+	FailedAt time.Time `json:"failed_at"`
+	Error    string    `json:"error"`
+	// RemoteRunDir holds RemoteDumpFile on the server, when the run failed
+	// before the dump was transferred.
+	RemoteRunDir   string `json:"remote_run_dir,omitempty"`
+	RemoteDumpFile string `json:"remote_dump_file,omitempty"`
+	ExpectedSum    string `json:"expected_sum,omitempty"`
+	// LocalDumpFile is the transferred dump, in TargetDir with a target,
+	// when the run failed after the transfer. Temporary is set unless it is
+	// the cached dump, which the cleanup leaves in place.
+	LocalDumpFile string `json:"local_dump_file,omitempty"`
+	TargetDir     string `json:"target_dir,omitempty"`
+	Temporary     bool   `json:"temporary,omitempty"`
+	Encrypted     bool   `json:"encrypted,omitempty"`
+}
+
+// DefaultStateDir returns ~/.rep/state, or "" if the home directory is
+// unknown.
+func DefaultStateDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".rep", "state")
+}
+
+// statePath returns the state file of the replication of the server
+// database into the local database.
+func (r *Replicator) statePath() string {
+	name := fileName(r.statsID() + "_" + r.config.LocalDB.Database)
+	return filepath.Join(r.StateDir, name+".json")
+}
+
+// readRunState reads the state file, nil if there is none.
+func (r *Replicator) readRunState() (*runState, error) {
+	if r.StateDir == "" {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(r.statePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state runState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("reading state file %s: %v", r.statePath(), err)
+	}
+	return &state, nil
+}
+
+// writeRunState records the failure of the run in the state file when it
+// got a dump, which the cleanup then keeps. A failure to write it is
+// reported but doesn't fail the run.
+func (r *Replicator) writeRunState(runErr error) {
+	if runErr == nil || r.StateDir == "" {
+		return
+	}
+	state := runState{RunID: r.runID, FailedAt: time.Now(), Error: r.redact(runErr.Error())}
+	switch {
+	case r.localDumpFile != "":
+		state.LocalDumpFile = r.localDumpFile
+		state.TargetDir = r.targetDir
+		state.Temporary = r.localDumpFile != r.cachePath()
+		state.Encrypted = r.encrypted
+		state.ExpectedSum = r.expectedSum
+	case r.remoteDumpFile != "" && r.remoteRunDir != "":
+		state.RemoteRunDir = r.remoteRunDir
+		state.RemoteDumpFile = r.remoteDumpFile
+		state.ExpectedSum = r.expectedSum
+	default:
+		return
+	}
+
+	file := r.statePath()
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(r.StateDir, 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(file, append(raw, '\n'), 0600)
+	}
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Writing state file failed: %v\n", err)
+		return
+	}
+	r.resumeKept = map[string]bool{}
+	for _, kept := range []string{state.RemoteRunDir, state.LocalDumpFile, state.TargetDir} {
+		if kept != "" {
+			r.resumeKept[kept] = true
+		}
+	}
+	fmt.Fprintf(r.Output, "   State of the failed run written to %s, it can be resumed\n", file)
+}
+
+// keptForResume reports whether the cleanup keeps path for ResumeFailed,
+// the run having failed.
+func (r *Replicator) keptForResume(path string) bool {
+	if !r.resumeKept[path] {
+		return false
+	}
+	fmt.Fprintf(r.Output, "   Keeping %s to resume the run\n", path)
+	return true
+}
+
+// resumeRun continues the failed run of the state file for ResumeFailed, from its
+// dump on the server or its transferred dump, and reports whether it did.
+// Either way, the files kept by the failed run are then owned by this one,
+// its cleanup removing them.
+func (r *Replicator) resumeRun(ctx context.Context) (bool, error) {
+	state, err := r.readRunState()
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		if r.ResumeFailed {
+			fmt.Fprintf(r.Output, "   No failed run to resume, dumping\n")
+		}
+		return false, nil
+	}
+	if err := os.Remove(r.statePath()); err != nil {
+		return false, err
+	}
+	if err := r.adoptRunState(ctx, state); err != nil {
+		return false, err
+	}
+	if !r.ResumeFailed {
+		return false, nil
+	}
+
+	if err := r.resolveSecrets(ctx); err != nil {
+		return false, err
+	}
+	if state.LocalDumpFile != "" {
+		r.printStep("Resume run %s from dump file %s", state.RunID, state.LocalDumpFile)
+		if err := r.connectTarget(ctx); err != nil {
+			return false, err
+		}
+		exists, err := fileExists(ctx, r.Local, state.LocalDumpFile)
+		if err != nil || !exists {
+			fmt.Fprintf(r.Output, "   Dump file %s is gone, dumping\n", state.LocalDumpFile)
+			return false, err
+		}
+		// The settings can't be captured again without the tunnel of the
+		// direct mode, they are left out like with a reused dump.
+		if r.config.Server.Mode != "direct" {
+			if err := r.captureServerSettings(ctx); err != nil {
+				return false, err
+			}
+		}
+		r.targetDir = state.TargetDir
+		r.localDumpFile = state.LocalDumpFile
+		r.encrypted = state.Encrypted
+		r.expectedSum = state.ExpectedSum
+		return true, nil
+	}
+
+	r.printStep("Resume run %s from dump file %s in %s", state.RunID, state.RemoteDumpFile, r.config.Server.Host)
+	var exists bool
+	err = r.withRemote(ctx, "Checking dump file", func() error {
+		var err error
+		exists, err = fileExists(ctx, r.Remote, state.RemoteDumpFile)
+		return err
+	})
+	if err != nil || !exists {
+		fmt.Fprintf(r.Output, "   Dump file %s is gone, dumping\n", state.RemoteDumpFile)
+		return false, err
+	}
+	if err := r.captureServerSettings(ctx); err != nil {
+		return false, err
+	}
+	r.remoteRunDir = state.RemoteRunDir
+	r.remoteDumpFile = state.RemoteDumpFile
+	r.expectedSum = state.ExpectedSum
+	return true, r.Transfer(ctx)
+}
+
+// adoptRunState makes the cleanup remove the files kept by the failed run
+// of state, unless this run fails too and keeps them again.
+func (r *Replicator) adoptRunState(ctx context.Context, state *runState) error {
+	if dir := state.RemoteRunDir; dir != "" {
+		r.onRemoteCleanup("temp run directory "+dir, func(ctx context.Context) error {
+			if r.keptForResume(dir) {
+				return nil
+			}
+			r.printStep("Remove temp run directory %s of run %s in %s", dir, state.RunID, r.config.Server.Host)
+			return r.withRemote(ctx, "Removing temp run directory", func() error {
+				return r.Remote.Run(ctx, removeDirCommand(dir, r.config.SecureDelete))
+			})
+		})
+	}
+
+	file := state.LocalDumpFile
+	if state.TargetDir != "" {
+		// The dump file is in the directory.
+		file = state.TargetDir
+		if err := r.connectTarget(ctx); err != nil {
+			return err
+		}
+	} else if !state.Temporary {
+		file = ""
+	}
+	if file != "" {
+		r.onCleanup(func(ctx context.Context) error {
+			if r.keptForResume(file) {
+				return nil
+			}
+			r.printStep("Remove temp dump %s of run %s", file, state.RunID)
+			if file == state.TargetDir {
+				return r.Local.Run(ctx, removeDirCommand(file, r.config.SecureDelete))
+			}
+			return r.Local.Run(ctx, removeFileCommand(file, r.config.SecureDelete))
+		})
+	}
+
+	return nil
+}
+
+// fileExists reports whether file exists, run by executor.
+func fileExists(ctx context.Context, executor outputExecutor, file string) (bool, error) {
+	out, err := executor.Output(ctx, fmt.Sprintf("test -f %s && echo yes || true", file))
+	return strings.TrimSpace(out) == "yes", err
+}
@@ -0,0 +1,84 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultRetryAttempts       = 3
+	defaultRetryInitialBackoff = 2 * time.Second
+	defaultRetryMaxBackoff     = 30 * time.Second
+)
+
+// RetryPolicy controls how network-bound steps are retried on transient
+// failures. Attempts includes the first try, so 1 disables retrying.
+type RetryPolicy struct {
+	Attempts       int           `yaml:"attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts <= 0 {
+		p.Attempts = defaultRetryAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultRetryMaxBackoff
+	}
+	return p
+}
+
+// permanentError marks an error that retrying cannot fix, e.g. a command
+// that ran and failed rather than a dropped connection.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// retry calls fn until it succeeds, returns a permanent error, ctx is done
+// or the attempts of the retry policy are exhausted, doubling the wait in
+// between.
+func (r *Replicator) retry(ctx context.Context, what string, fn func(attempt int) error) error {
+	policy := r.config.Retry.withDefaults()
+	backoff := policy.InitialBackoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(attempt)
+		if err == nil {
+			return nil
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) || ctx.Err() != nil || attempt >= policy.Attempts {
+			return err
+		}
+
+		fmt.Fprintf(r.Output, "   %s failed (%v), retrying in %s (attempt %d/%d)\n", what, err, backoff, attempt+1, policy.Attempts)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// schemaDescriber is implemented by the engines able to describe the
+// schema of a database, for the schema diff.
+type schemaDescriber interface {
+	// SchemaCommand returns the local command printing the relations,
+	// columns and indexes of database as kind|name|definition lines.
+	SchemaCommand(dbConfig DB, database string) string
+}
+
+// schemaObject is a line of SchemaCommand, its definition aside.
+type schemaObject struct {
+	kind string
+	name string
+}
+
+// printSchemaDiff prints what the restored database adds, removes or
+// changes in the schema of the local database it replaces, so developers
+// see the migrations the refresh brings. A failure is only reported.
+func (r *Replicator) printSchemaDiff(ctx context.Context, restoredDB string) {
+	engine, ok := r.Engine.(schemaDescriber)
+	if !ok || !r.config.SchemaDiff {
+		return
+	}
+	localDB := r.config.LocalDB
+	if r.useDriver {
+		fmt.Fprintf(r.Output, "   The schema diff needs the local client tools\n")
+		return
+	}
+	r.printStep("Compare schema of local database %s with %s", localDB.Database, restoredDB)
+	old, err := r.describeSchema(ctx, engine, localDB.Database)
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Describing %s failed: %v\n", localDB.Database, err)
+		return
+	}
+	restored, err := r.describeSchema(ctx, engine, restoredDB)
+	if err != nil {
+		fmt.Fprintf(r.Output, "   Describing %s failed: %v\n", restoredDB, err)
+		return
+	}
+
+	type change struct {
+		name string
+		line string
+	}
+	var changes []change
+	for object, definition := range restored {
+		previous, ok := old[object]
+		switch {
+		case !ok:
+			changes = append(changes, change{object.name, fmt.Sprintf("+ %s %s %s", object.kind, object.name, definition)})
+		case previous != definition:
+			changes = append(changes, change{object.name, fmt.Sprintf("~ %s %s %s -> %s", object.kind, object.name, previous, definition)})
+		}
+	}
+	for object, definition := range old {
+		if _, ok := restored[object]; !ok {
+			changes = append(changes, change{object.name, fmt.Sprintf("- %s %s %s", object.kind, object.name, definition)})
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(r.Output, "   No schema change\n")
+		return
+	}
+	// Sorted by name, the changes of a table follow each other.
+	sort.Slice(changes, func(i, j int) bool { return changes[i].name < changes[j].name })
+	for _, change := range changes {
+		fmt.Fprintf(r.Output, "   %s\n", strings.TrimSpace(change.line))
+	}
+}
+
+func (r *Replicator) describeSchema(ctx context.Context, engine schemaDescriber, database string) (map[schemaObject]string, error) {
+	out, err := r.Local.Output(ctx, engine.SchemaCommand(r.config.LocalDB, database))
+	if err != nil {
+		return nil, err
+	}
+	schema := map[schemaObject]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.SplitN(line, "|", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		schema[schemaObject{kind: fields[0], name: fields[1]}] = fields[2]
+	}
+	return schema, nil
+}
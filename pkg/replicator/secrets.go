@@ -0,0 +1,148 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretBackend resolves references to secrets, such as the password of a
+// database kept in a vault.
+type SecretBackend interface {
+	Secret(ctx context.Context, ref string) (string, error)
+}
+
+var (
+	secretBackendsMu sync.Mutex
+	secretBackends   = map[string]SecretBackend{
+		"vault":    &vaultBackend{},
+		"aws-sm":   awsSecretBackend{service: "aws-sm"},
+		"ssm":      awsSecretBackend{service: "ssm"},
+		"keychain": keychainBackend{},
+	}
+)
+
+// RegisterSecretBackend makes backend available to the password_secret of
+// the config under name.
+func RegisterSecretBackend(name string, backend SecretBackend) {
+	secretBackendsMu.Lock()
+	defer secretBackendsMu.Unlock()
+	secretBackends[name] = backend
+}
+
+// execSecretBackend is a SecretBackend implemented by an exec plugin, called
+// with the secret method.
+type execSecretBackend struct {
+	path string
+}
+
+func (b execSecretBackend) Secret(ctx context.Context, ref string) (string, error) {
+	var secret string
+	err := callPlugin(ctx, b.path, "secret", map[string]string{"ref": ref}, &secret)
+	return secret, err
+}
+
+func secretBackendFor(name string) (SecretBackend, error) {
+	secretBackendsMu.Lock()
+	defer secretBackendsMu.Unlock()
+	if backend, ok := secretBackends[name]; ok {
+		return backend, nil
+	}
+	if path, ok := findPlugin("secret", name); ok {
+		return execSecretBackend{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown secret backend %q", name)
+}
+
+// resolveSecret returns the secret referenced by backend:reference.
+func resolveSecret(ctx context.Context, secret string) (string, error) {
+	i := strings.Index(secret, ":")
+	if i <= 0 {
+		return "", fmt.Errorf("invalid secret %q, expected backend:reference", secret)
+	}
+	backend, err := secretBackendFor(secret[:i])
+	if err != nil {
+		return "", err
+	}
+	value, err := backend.Secret(ctx, secret[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("resolving secret %s: %v", secret, err)
+	}
+	return value, nil
+}
+
+// resolveSecrets replaces the passwords and private keys of the config with
+// the ones of Secrets, once, and the IAM token once it expires.
+func (r *Replicator) resolveSecrets(ctx context.Context) error {
+	if r.secretsResolved {
+		return r.refreshIAMToken(ctx)
+	}
+	for _, db := range []*DB{&r.config.Server.DB, &r.config.LocalDB} {
+		password, err := r.Secrets.Password(ctx, *db)
+		if err != nil {
+			return permanent(err)
+		}
+		db.Password = password
+	}
+	if err := r.refreshIAMToken(ctx); err != nil {
+		return err
+	}
+
+	key, err := r.Secrets.PrivateKey(ctx, r.config.Server)
+	if err != nil {
+		return permanent(err)
+	}
+	r.config.Server.PrivateKey = key
+	switch executor := r.Remote.(type) {
+	case *SSHExecutor:
+		executor.config.PrivateKey = key
+	case *dockerRemote:
+		executor.config.PrivateKey = key
+	}
+	if r.config.Target != nil {
+		key, err := r.Secrets.PrivateKey(ctx, *r.config.Target)
+		if err != nil {
+			return permanent(err)
+		}
+		r.config.Target.PrivateKey = key
+		if executor, ok := r.target.(*SSHExecutor); ok {
+			executor.config.PrivateKey = key
+		}
+	}
+
+	r.secretsResolved = true
+	return nil
+}
+
+// iamTokenLifetime is how long an IAM token is used, short of the 15 minutes
+// of the RDS ones, the connections of a run going on long after it starts.
+const iamTokenLifetime = 10 * time.Minute
+
+// refreshIAMToken generates the IAM token of the server database, again
+// when the one in use is about to expire, writing it to a new password file
+// if the previous one was. It is called before the server database is
+// connected to.
+func (r *Replicator) refreshIAMToken(ctx context.Context) error {
+	db := &r.config.Server.DB
+	if db.IAMAuth == "" || !r.iamTokenAt.IsZero() && time.Since(r.iamTokenAt) < iamTokenLifetime {
+		return nil
+	}
+	token, err := iamToken(ctx, *db)
+	if err != nil {
+		return permanent(err)
+	}
+	stored := db.PasswordFile != ""
+	if !r.iamTokenAt.IsZero() {
+		fmt.Fprintf(r.Output, "   Generated a new %s IAM token for database %s\n", db.IAMAuth, db.Database)
+	}
+	db.Password = token
+	r.iamTokenAt = time.Now()
+	if !stored {
+		return nil
+	}
+	// The previous file is removed by Cleanup.
+	db.PasswordFile = ""
+	return r.storeServerPassword(ctx)
+}
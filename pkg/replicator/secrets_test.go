@@ -0,0 +1,70 @@
+package replicator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshIAMToken(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake aws CLI is a shell script")
+	}
+	r, log := newFakeReplicator(t, "", "")
+	bin := filepath.Join(os.Getenv("TMPDIR"), "bin")
+	if err := os.Mkdir(bin, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// The fake aws CLI numbers the tokens it generates.
+	script := "#!/bin/sh\nn=$(cat \"$0.count\" 2>/dev/null || echo 0)\nn=$((n+1))\necho $n > \"$0.count\"\necho token-$n\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "aws"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+
+	outputs := map[string]string{"mktemp": "/tmp/rep_pass_x"}
+	for key, out := range postgresOutputs {
+		outputs[key] = out
+	}
+	r.Remote.(*fakeExecutor).outputs = outputs
+	db := &r.config.Server.DB
+	db.IAMAuth = "aws"
+
+	ctx := context.Background()
+	if err := r.resolveSecrets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.storeServerPassword(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if db.Password != "token-1" || db.PasswordFile == "" {
+		t.Fatalf("password %q in file %q, want token-1 in a file", db.Password, db.PasswordFile)
+	}
+
+	// A fresh token is kept.
+	if err := r.withRemote(ctx, "Testing", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if db.Password != "token-1" {
+		t.Errorf("password %q, want token-1 kept", db.Password)
+	}
+
+	// An expiring one is replaced, and written to a new file.
+	r.iamTokenAt = time.Now().Add(-iamTokenLifetime)
+	if err := r.withRemote(ctx, "Testing", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if db.Password != "token-2" || db.PasswordFile == "" {
+		t.Errorf("password %q in file %q, want token-2 in a file", db.Password, db.PasswordFile)
+	}
+	if n := strings.Count(log.String(), "remote append"); n != 2 {
+		t.Errorf("the password file was written %d times, want 2:\n%s", n, log)
+	}
+}
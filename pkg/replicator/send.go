@@ -0,0 +1,98 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Teammate is the machine of a teammate, reached over SSH, where Send runs
+// rep restore with their own config.
+type Teammate struct {
+	Server `yaml:",inline"`
+	// Config is the config file of rep on the machine of the teammate,
+	// config.yml by default.
+	Config string `yaml:"config"`
+	// Rep is the rep command on the machine of the teammate, rep by default.
+	Rep string `yaml:"rep"`
+}
+
+// Send pushes the dump last pulled into CacheDir to the machine of the
+// teammate named to, where rep restores it into their local database, so
+// the server isn't dumped again. SSH authenticates the relay and encrypts
+// the dump.
+func (r *Replicator) Send(ctx context.Context, to string, forceDisconnect bool) error {
+	teammate, ok := r.config.Teammates[to]
+	if !ok {
+		return fmt.Errorf("unknown teammate %q", to)
+	}
+	if r.pipelineErr != nil {
+		return r.pipelineErr
+	}
+	if r.config.CacheDir == "" {
+		return errors.New("nothing to send, the pulled dump is only kept with a cache_dir")
+	}
+	file := r.cachePath()
+	sum, err := ioutil.ReadFile(file + ".sha256")
+	if err != nil {
+		return fmt.Errorf("nothing to send, no dump cached in %s: %v", r.config.CacheDir, err)
+	}
+	if !r.cachedDump(ctx, strings.TrimSpace(string(sum))) {
+		return fmt.Errorf("cached dump file %s is corrupted, pull it again", file)
+	}
+
+	teammate.PrivateKey, err = r.Secrets.PrivateKey(ctx, teammate.Server)
+	if err != nil {
+		return err
+	}
+	remote := NewSSHExecutor(teammate.Server)
+	r.printStep("SSH to teammate %s at %s", to, teammate.Host)
+	err = r.retry(ctx, "SSH to "+teammate.Host, func(attempt int) error {
+		dialCtx, cancel := withTimeout(ctx, r.config.Timeouts.Connect)
+		defer cancel()
+		return remote.Connect(dialCtx)
+	})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	dump, err := r.Pipeline.Decode(in)
+	if err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("%s restore --stdin -f %s", teammate.rep(), shellQuote(teammate.config()))
+	if forceDisconnect {
+		cmd += " --force-disconnect"
+	}
+	r.printStep("Send dump file %s to %s, restored by %s", file, to, cmd)
+	err = remote.Pipe(ctx, cmd, io.TeeReader(dump, countingWriter{ioutil.Discard, &r.heartbeat}), r.Output)
+	if closeErr := dump.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (t Teammate) config() string {
+	if t.Config == "" {
+		return "config.yml"
+	}
+	return t.Config
+}
+
+func (t Teammate) rep() string {
+	if t.Rep == "" {
+		return "rep"
+	}
+	return t.Rep
+}
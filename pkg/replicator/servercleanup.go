@@ -0,0 +1,61 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultServerCleanupTTL is how old the temp files of rep on the server
+// must be for the cleanup cron job to remove them, by default.
+const DefaultServerCleanupTTL = 24 * time.Hour
+
+// serverCleanupMarker ends the crontab line of the cleanup job, to replace it
+// when installed again.
+const serverCleanupMarker = "# rep server cleanup"
+
+// ServerCleanupCronLine returns the crontab line removing, every hour, the
+// temp run directories and files of rep in dir of the server user, /tmp if
+// empty, that are older than ttl, as a backstop for the runs that crashed
+// before their cleanup.
+func ServerCleanupCronLine(dir string, ttl time.Duration) string {
+	minutes := int(ttl / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	find := "/tmp"
+	if dir != "" {
+		find = shellQuote(dir)
+	}
+	return fmt.Sprintf(
+		`0 * * * * find %s -maxdepth 1 -name 'rep_*' -user "$(id -un)" -mmin +%d -exec rm -rf {} + %s`,
+		find,
+		minutes,
+		serverCleanupMarker,
+	)
+}
+
+// InstallServerCleanup installs the job of ServerCleanupCronLine in the
+// crontab of the server user, replacing a previous one.
+func (r *Replicator) InstallServerCleanup(ctx context.Context, ttl time.Duration) error {
+	if err := r.resolveSecrets(ctx); err != nil {
+		return err
+	}
+	if !r.connected {
+		if err := r.Connect(ctx); err != nil {
+			return err
+		}
+	}
+	if !r.SharedRemote {
+		defer r.Remote.Close()
+	}
+
+	r.printStep("Install the cleanup cron job in %s", r.config.Server.Host)
+	return r.withRemote(ctx, "Installing cleanup cron job", func() error {
+		return r.Remote.Run(ctx, fmt.Sprintf(
+			"{ crontab -l 2>/dev/null | grep -vF %s; echo %s; } | crontab -",
+			shellQuote(serverCleanupMarker),
+			shellQuote(ServerCleanupCronLine(r.config.Server.TempDir, ttl)),
+		))
+	})
+}
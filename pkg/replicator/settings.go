@@ -0,0 +1,230 @@
+package replicator
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// dbSetting is one entry of pg_db_role_setting for the source database.
+// Role is empty for database-wide settings (ALTER DATABASE ... SET).
+type dbSetting struct {
+	Role  string
+	Name  string
+	Value string
+}
+
+// dbSettings holds the database-level state that pg_dump of a single
+// database does not include.
+type dbSettings struct {
+	Comment  string
+	Settings []dbSetting
+	// Encoding, Collate and CType are the options the database was created
+	// with and Owner its owner, empty if unknown.
+	Encoding string
+	Collate  string
+	CType    string
+	Owner    string
+}
+
+// listQuoteSettings are the variables whose values are lists that must be
+// emitted as separate literals, like pg_dumpall does for GUC_LIST_QUOTE.
+var listQuoteSettings = map[string]bool{
+	"search_path":               true,
+	"temp_tablespaces":          true,
+	"local_preload_libraries":   true,
+	"session_preload_libraries": true,
+	"shared_preload_libraries":  true,
+	"unix_socket_directories":   true,
+}
+
+const dbSettingsQuery = "SELECT 'c', encode(convert_to(coalesce(shobj_description(d.oid, 'pg_database'), ''), 'UTF8'), 'hex'), '' " +
+	"FROM pg_database d WHERE d.datname = current_database() " +
+	"UNION ALL " +
+	"SELECT 'e', encode(convert_to(pg_encoding_to_char(d.encoding), 'UTF8'), 'hex'), encode(convert_to(pg_get_userbyid(d.datdba), 'UTF8'), 'hex') " +
+	"FROM pg_database d WHERE d.datname = current_database() " +
+	"UNION ALL " +
+	"SELECT 'l', encode(convert_to(d.datcollate, 'UTF8'), 'hex'), encode(convert_to(d.datctype, 'UTF8'), 'hex') " +
+	"FROM pg_database d WHERE d.datname = current_database() " +
+	"UNION ALL " +
+	"SELECT 's', encode(convert_to(coalesce(r.rolname, ''), 'UTF8'), 'hex'), encode(convert_to(c.cfg, 'UTF8'), 'hex') " +
+	"FROM pg_db_role_setting s " +
+	"JOIN pg_database d ON d.oid = s.setdatabase " +
+	"LEFT JOIN pg_roles r ON r.oid = s.setrole " +
+	"CROSS JOIN LATERAL unnest(s.setconfig) AS c(cfg) " +
+	"WHERE d.datname = current_database()"
+
+func captureDBSettings(ctx context.Context, exec outputExecutor, dbConfig DB) (*dbSettings, error) {
+	cmd := fmt.Sprintf(
+		"%s -At -F ' ' -c \"%s\"",
+		buildPSQLCommand(dbConfig, dbConfig.Database),
+		dbSettingsQuery,
+	)
+	output, err := exec.Output(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDBSettings(output)
+}
+
+func parseDBSettings(output string) (*dbSettings, error) {
+	settings := &dbSettings{}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, " ")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected database settings row: %q", line)
+		}
+
+		values := make([]string, 2)
+		for i, field := range fields[1:] {
+			raw, err := hex.DecodeString(field)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected database settings row: %q", line)
+			}
+			values[i] = string(raw)
+		}
+
+		switch fields[0] {
+		case "c":
+			settings.Comment = values[0]
+		case "e":
+			settings.Encoding = values[0]
+			settings.Owner = values[1]
+		case "l":
+			settings.Collate = values[0]
+			settings.CType = values[1]
+		case "s":
+			name, value := splitSetting(values[1])
+			settings.Settings = append(settings.Settings, dbSetting{
+				Role:  values[0],
+				Name:  name,
+				Value: value,
+			})
+		}
+	}
+
+	return settings, nil
+}
+
+func splitSetting(cfg string) (string, string) {
+	i := strings.Index(cfg, "=")
+	if i < 0 {
+		return cfg, ""
+	}
+	return cfg[:i], cfg[i+1:]
+}
+
+// splitGUCList splits a list-valued setting such as search_path into its
+// elements, removing the double quotes around quoted identifiers.
+func splitGUCList(value string) []string {
+	var items []string
+	var item strings.Builder
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' && quoted && i+1 < len(value) && value[i+1] == '"':
+			item.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			items = append(items, strings.TrimSpace(item.String()))
+			item.Reset()
+		case (c == ' ' || c == '\t') && !quoted && item.Len() == 0:
+		default:
+			item.WriteByte(c)
+		}
+	}
+	items = append(items, strings.TrimSpace(item.String()))
+
+	return items
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func settingValueSQL(setting dbSetting) string {
+	if !listQuoteSettings[strings.ToLower(setting.Name)] {
+		return quoteLiteral(setting.Value)
+	}
+
+	var values []string
+	for _, item := range splitGUCList(setting.Value) {
+		values = append(values, quoteLiteral(item))
+	}
+	return strings.Join(values, ", ")
+}
+
+// CreateDatabaseScript creates database with the encoding and locale of the
+// source database, from template0 whose encoding can be changed.
+func (settings *dbSettings) CreateDatabaseScript(database string) string {
+	if settings.Encoding == "" {
+		return postgresEngine{}.CreateDatabaseScript(database)
+	}
+	return fmt.Sprintf(
+		"CREATE DATABASE %s TEMPLATE template0 ENCODING %s LC_COLLATE %s LC_CTYPE %s",
+		database,
+		quoteLiteral(settings.Encoding),
+		quoteLiteral(settings.Collate),
+		quoteLiteral(settings.CType),
+	)
+}
+
+// SQL returns the statements that apply the captured settings to database.
+// Role specific settings and the owner are only applied when the role exists
+// locally, since the restore runs with --no-owner.
+func (settings *dbSettings) SQL(database string) string {
+	var sql strings.Builder
+	if settings.Owner != "" {
+		stmt := fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", quoteIdent(database), quoteIdent(settings.Owner))
+		fmt.Fprintf(
+			&sql,
+			"DO $rep$BEGIN IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = %s) THEN EXECUTE %s; END IF; END$rep$;\n",
+			quoteLiteral(settings.Owner),
+			quoteLiteral(stmt),
+		)
+	}
+	for _, setting := range settings.Settings {
+		if setting.Role == "" {
+			fmt.Fprintf(
+				&sql,
+				"ALTER DATABASE %s SET %s TO %s;\n",
+				quoteIdent(database),
+				quoteIdent(setting.Name),
+				settingValueSQL(setting),
+			)
+			continue
+		}
+
+		stmt := fmt.Sprintf(
+			"ALTER ROLE %s IN DATABASE %s SET %s TO %s",
+			quoteIdent(setting.Role),
+			quoteIdent(database),
+			quoteIdent(setting.Name),
+			settingValueSQL(setting),
+		)
+		fmt.Fprintf(
+			&sql,
+			"DO $rep$BEGIN IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = %s) THEN EXECUTE %s; END IF; END$rep$;\n",
+			quoteLiteral(setting.Role),
+			quoteLiteral(stmt),
+		)
+	}
+
+	if settings.Comment != "" {
+		fmt.Fprintf(&sql, "COMMENT ON DATABASE %s IS %s;\n", quoteIdent(database), quoteLiteral(settings.Comment))
+	}
+
+	return sql.String()
+}
@@ -0,0 +1,159 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sizeEngine is implemented by the engines able to report the size of a
+// database and where the local server keeps its data, for checkSpace and
+// checkLocalSpace.
+type sizeEngine interface {
+	// DatabaseSizeCommand returns the command printing the size of the
+	// database of db in bytes.
+	DatabaseSizeCommand(db DB) string
+	// DataDirectoryCommand returns the command printing the data directory
+	// of the server of db.
+	DataDirectoryCommand(db DB) string
+}
+
+// spaceCheck is a directory, where exec runs, requiring free space.
+type spaceCheck struct {
+	exec   outputExecutor
+	where  string
+	dir    string
+	needed int64
+	what   string
+}
+
+// checkSpace estimates the size of the dump from the size of the server
+// database, read with exec, and fails before the dump if the temp directory
+// of the server lacks the space, rather than the dump failing midway. The
+// dump being compressed, the estimate errs on the safe side. In direct mode,
+// the dump is written locally, so the local space is checked instead.
+func (r *Replicator) checkSpace(ctx context.Context, exec outputExecutor, db DB) error {
+	engine := r.Engine.(sizeEngine)
+	out, err := exec.Output(ctx, engine.DatabaseSizeCommand(db))
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected size of database %s %q", db.Database, strings.TrimSpace(out))
+	}
+	fmt.Fprintf(r.Output, "   Database %s is %s\n", db.Database, FormatSize(size))
+	r.databaseSize = size
+
+	if r.config.Server.Mode == "direct" {
+		return r.checkLocalSpace(ctx)
+	}
+	// The dump is encoded next to itself.
+	return r.checkFreeSpace(ctx, spaceCheck{r.Remote, r.config.Server.Host, r.remoteTempDir(), r.dumpCopies() * size, "the dump"})
+}
+
+// checkLocalSpace fails if the local directory receiving the dump or the
+// data volume of the local server lacks the space for the database measured
+// by checkSpace.
+func (r *Replicator) checkLocalSpace(ctx context.Context) error {
+	engine, ok := r.Engine.(sizeEngine)
+	if !ok || r.SkipSpaceCheck || r.databaseSize == 0 {
+		return nil
+	}
+	localDir := filepath.Dir(r.localDumpPath())
+	switch {
+	case r.target != nil:
+		localDir = "/tmp"
+	case r.config.CacheDir != "":
+		localDir = filepath.Dir(r.cachePath())
+	}
+	// The transferred dump is decoded next to itself, and joined from the
+	// parts of its chunks.
+	copies := r.dumpCopies()
+	if r.config.Server.TransferStreams > 1 {
+		copies++
+	}
+	err := r.checkFreeSpace(ctx, spaceCheck{r.Local, r.localWhere(), localDir, copies * r.databaseSize, "the dump"})
+	if err != nil {
+		return err
+	}
+
+	out, err := r.Local.Output(ctx, engine.DataDirectoryCommand(r.config.LocalDB))
+	if err != nil || strings.TrimSpace(out) == "" {
+		fmt.Fprintf(r.Output, "   The data directory of the local server can't be read, skipping its check\n")
+		return nil
+	}
+	return r.checkFreeSpace(ctx, spaceCheck{r.Local, r.localWhere(), strings.TrimSpace(out), r.databaseSize, "the restored database"})
+}
+
+// dumpCopies returns how many copies of the dump sit side by side at most,
+// two when the pipeline encodes it.
+func (r *Replicator) dumpCopies() int64 {
+	if len(r.Pipeline) > 0 {
+		return 2
+	}
+	return 1
+}
+
+// checkFreeSpace fails if the directory of check has less free space than
+// needed. Free space that can't be read is only reported.
+func (r *Replicator) checkFreeSpace(ctx context.Context, check spaceCheck) error {
+	out, err := check.exec.Output(ctx, fmt.Sprintf("df -Pk %s | tail -n 1", check.dir))
+	fields := strings.Fields(out)
+	if err != nil || len(fields) < 4 {
+		fmt.Fprintf(r.Output, "   The free space of %s on %s can't be read, skipping its check\n", check.dir, check.where)
+		return nil
+	}
+	free, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		fmt.Fprintf(r.Output, "   The free space of %s on %s can't be read, skipping its check\n", check.dir, check.where)
+		return nil
+	}
+	free *= 1024
+	if free < check.needed {
+		return permanent(fmt.Errorf(
+			"%s may need up to %s in %s on %s, which has %s free: free up space, or skip this check with --skip-space-check",
+			check.what,
+			FormatSize(check.needed),
+			check.dir,
+			check.where,
+			FormatSize(free),
+		))
+	}
+	fmt.Fprintf(r.Output, "   %s free in %s on %s\n", FormatSize(free), check.dir, check.where)
+	return nil
+}
+
+// FormatSize returns n bytes in a human readable unit.
+func FormatSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+// ParseSize parses a size such as 500K, 10M or 1G, in the units of
+// FormatSize, or a number of bytes.
+func ParseSize(s string) (int64, error) {
+	units := map[string]int64{"": 1, "B": 1, "K": 1 << 10, "KB": 1 << 10, "M": 1 << 20, "MB": 1 << 20, "G": 1 << 30, "GB": 1 << 30}
+	size := strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(size, func(c rune) bool { return (c < '0' || c > '9') && c != '.' })
+	if i < 0 {
+		i = len(size)
+	}
+	unit, ok := units[strings.TrimSpace(size[i:])]
+	n, err := strconv.ParseFloat(size[:i], 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500K, 10M or 1G", s)
+	}
+	return int64(n * float64(unit)), nil
+}
@@ -0,0 +1,65 @@
+package replicator
+
+import "testing"
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{10 << 20, "10.0 MB"},
+		{3 << 30, "3.0 GB"},
+		{2 << 40, "2.0 TB"},
+		{2048 << 40, "2048.0 TB"},
+	}
+	for _, test := range tests {
+		if got := FormatSize(test.n); got != test.want {
+			t.Errorf("FormatSize(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512B", 512},
+		{"500K", 500 << 10},
+		{"500kb", 500 << 10},
+		{"10M", 10 << 20},
+		{" 10 MB ", 10 << 20},
+		{"1G", 1 << 30},
+		{"1.5g", 3 << 29},
+	}
+	for _, test := range tests {
+		got, err := ParseSize(test.s)
+		if err != nil || got != test.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", test.s, got, err, test.want)
+		}
+	}
+	for _, s := range []string{"", "M", "-1M", "10T", "10 MiB", "1.2.3K", "ten"} {
+		if got, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+// The sizes FormatSize rounds to a tenth parse back within that tenth.
+func TestParseFormatSize(t *testing.T) {
+	for _, n := range []int64{1, 1000, 1 << 20, 123456789} {
+		got, err := ParseSize(FormatSize(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := got - n; diff*20 > n || -diff*20 > n {
+			t.Errorf("ParseSize(FormatSize(%d)) = %d", n, got)
+		}
+	}
+}
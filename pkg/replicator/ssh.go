@@ -0,0 +1,466 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Dial connects to the server, errors that a new attempt cannot fix such as
+// an unreadable key or a rejected authentication are permanent.
+func Dial(ctx context.Context, config Server) (*ssh.Client, error) {
+	key := []byte(config.PrivateKey)
+	if len(key) == 0 {
+		var err error
+		if key, err = ioutil.ReadFile(config.PrivateKeyFile); err != nil {
+			return nil, permanent(err)
+		}
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	id := hostID(config)
+	previous, known := readHosts()[id]
+	current := hostRecord{Auth: "publickey", Key: ssh.FingerprintSHA256(signer.PublicKey())}
+	sshClientConfig := &ssh.ClientConfig{
+		User: config.User,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			current.HostKey = hostKeyFingerprint(key)
+			if known && previous.HostKey != "" && current.HostKey != previous.HostKey {
+				return errors.New("host key changed")
+			}
+			return nil
+		}),
+	}
+
+	address := net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+	dialer := net.Dialer{}
+	if config.DSCP != "" {
+		dscp, err := parseDSCP(config.DSCP)
+		if err != nil {
+			return nil, permanent(err)
+		}
+		dialer.Control = dscpControl(dscp)
+	}
+	var conn net.Conn
+	if config.Proxy != "" {
+		// The IP of the server isn't known through the proxy.
+		proxy, err := parseProxy(config.Proxy)
+		if err != nil {
+			return nil, permanent(err)
+		}
+		if conn, err = dialProxy(ctx, dialer, proxy, address); err != nil {
+			return nil, err
+		}
+		current.IP = previous.IP
+	} else {
+		if conn, err = dialer.DialContext(ctx, "tcp", address); err != nil {
+			if known {
+				err = withDiagnosis(err, previous.diagnoseDial(ctx, config))
+			}
+			return nil, err
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			current.IP = addr.IP.String()
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, sshClientConfig)
+	if err != nil {
+		conn.Close()
+		if known && previous.HostKey != "" && current.HostKey != previous.HostKey {
+			return nil, permanent(fmt.Errorf(
+				"the host key of %s changed from %s to %s since the last successful connection on %s, "+
+					"remove %s from %s if the server was reinstalled",
+				address,
+				previous.HostKey,
+				current.HostKey,
+				previous.connected(),
+				id,
+				hostsFile(),
+			))
+		}
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			if known {
+				err = withDiagnosis(err, previous.diagnoseAuth(current, config))
+			}
+			return nil, permanent(err)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	current.Connected = time.Now()
+	rememberHost(id, current)
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// remoteCmdError marks the failures of a command that ran on the server as
+// permanent, while a broken session or connection may be retried.
+func remoteCmdError(err error) error {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return permanent(err)
+	}
+	return err
+}
+
+// runSession runs cmd in session and gives up as soon as ctx is done, so a
+// hung remote command or a dead connection doesn't block forever.
+func runSession(ctx context.Context, session *ssh.Session, cmd string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(cmd)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return ctx.Err()
+	}
+}
+
+// SSHExecutor is the RemoteExecutor and FileTransferrer of a server reached
+// over SSH.
+type SSHExecutor struct {
+	config Server
+	client *ssh.Client
+}
+
+func NewSSHExecutor(config Server) *SSHExecutor {
+	return &SSHExecutor{config: config}
+}
+
+// ShareRemote makes r run its server commands over the connection of other,
+// if they replicate from the same server, and reports whether it does. The
+// caller closes the Remote of other once all of them ran.
+func (r *Replicator) ShareRemote(other *Replicator) bool {
+	a, b := r.config.Server, other.config.Server
+	if a.Host != b.Host || a.Port != b.Port || a.User != b.User || a.PrivateKeyFile != b.PrivateKeyFile ||
+		a.PrivateKeySecret != b.PrivateKeySecret || a.DockerContainer != b.DockerContainer {
+		return false
+	}
+	if (a.Kubernetes == nil) != (b.Kubernetes == nil) || a.Kubernetes != nil && *a.Kubernetes != *b.Kubernetes {
+		return false
+	}
+	r.Remote = other.Remote
+	r.Transferrer = other.Transferrer
+	r.Forwarder = other.Forwarder
+	r.SharedRemote = true
+	other.SharedRemote = true
+	return true
+}
+
+const (
+	// aliveTimeout is how long a connection has to answer a keepalive to be
+	// reused.
+	aliveTimeout = 5 * time.Second
+	// defaultKeepaliveInterval is how often a keepalive is sent over a
+	// connection, unless Server.KeepaliveInterval is set, and keepaliveMissed
+	// how many in a row may go unanswered before it is considered lost.
+	defaultKeepaliveInterval = 30 * time.Second
+	keepaliveMissed          = 3
+)
+
+// Connect reuses the connection if it still answers a keepalive, so
+// Replicators sharing the executor share the connection.
+func (e *SSHExecutor) Connect(ctx context.Context) error {
+	if e.alive() {
+		return nil
+	}
+	e.Close()
+
+	client, err := Dial(ctx, e.config)
+	if err != nil {
+		return err
+	}
+	e.client = client
+	interval := e.config.KeepaliveInterval
+	if interval <= 0 {
+		interval = defaultKeepaliveInterval
+	}
+	go keepalive(client, interval)
+
+	return nil
+}
+
+func (e *SSHExecutor) Close() error {
+	if e.client == nil {
+		return nil
+	}
+
+	err := e.client.Close()
+	e.client = nil
+	return err
+}
+
+func (e *SSHExecutor) alive() bool {
+	return e.client != nil && answersKeepalive(e.client, aliveTimeout)
+}
+
+// answersKeepalive sends a keepalive over client and reports whether it is
+// answered within timeout. A server refusing the request still answers.
+func answersKeepalive(client *ssh.Client, timeout time.Duration) bool {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
+
+// keepalive sends a keepalive over client every interval until it is
+// closed, so an idle connection, such as the one of a long dump, isn't
+// dropped by a firewall. A connection missing keepaliveMissed of them in a
+// row is closed, so the commands and transfers running over it fail, and
+// are retried over a new one, rather than hang.
+func keepalive(client *ssh.Client, interval time.Duration) {
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		if answersKeepalive(client, interval) {
+			missed = 0
+			continue
+		}
+		if missed++; missed >= keepaliveMissed {
+			client.Close()
+			return
+		}
+	}
+}
+
+func (e *SSHExecutor) newSession() (*ssh.Session, error) {
+	if e.client == nil {
+		return nil, errors.New("not connected to " + e.config.Host)
+	}
+	return e.client.NewSession()
+}
+
+func (e *SSHExecutor) Run(ctx context.Context, cmd string) error {
+	_, err := e.Output(ctx, cmd)
+	return err
+}
+
+func (e *SSHExecutor) Output(ctx context.Context, cmd string) (string, error) {
+	session, err := e.newSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := runSession(ctx, session, cmd); err != nil {
+		return "", remoteCmdError(withStderr(err, stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// Pipe runs cmd with in as its stdin, writing its stdout and stderr to out.
+func (e *SSHExecutor) Pipe(ctx context.Context, cmd string, in io.Reader, out io.Writer) error {
+	session, err := e.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = in
+	session.Stdout = out
+	session.Stderr = out
+	return remoteCmdError(runSession(ctx, session, cmd))
+}
+
+func (e *SSHExecutor) Size(ctx context.Context, remote string) (int64, error) {
+	out, err := e.Output(ctx, fmt.Sprintf("wc -c < %s", remote))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+func (e *SSHExecutor) CopyFrom(ctx context.Context, remote string, offset int64, w io.Writer) error {
+	return e.streamFrom(ctx, fmt.Sprintf("tail -c +%d %s", offset+1, remote), w)
+}
+
+func (e *SSHExecutor) CopyRange(ctx context.Context, remote string, offset, length int64, w io.Writer) error {
+	return e.streamFrom(ctx, fmt.Sprintf("tail -c +%d %s | head -c %d", offset+1, remote, length), w)
+}
+
+// streamFrom runs cmd, writing its stdout to w.
+func (e *SSHExecutor) streamFrom(ctx context.Context, cmd string, w io.Writer) error {
+	session, err := e.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if _, err := io.Copy(w, stdout); err != nil {
+			done <- err
+			return
+		}
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return remoteCmdError(err)
+	case <-ctx.Done():
+		session.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (e *SSHExecutor) ReceivedSize(ctx context.Context, name string) (int64, error) {
+	out, err := e.Output(ctx, fmt.Sprintf("if test -f %s; then wc -c < %s; else echo 0; fi", name, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+func (e *SSHExecutor) Append(ctx context.Context, name string) (io.WriteCloser, error) {
+	return e.streamTo(fmt.Sprintf("umask 077 && cat >> %s", name))
+}
+
+// streamTo starts cmd, the returned writer writing to its stdin.
+func (e *SSHExecutor) streamTo(cmd string) (io.WriteCloser, error) {
+	session, err := e.newSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &sessionWriter{WriteCloser: stdin, session: session, stderr: &stderr}, nil
+}
+
+// sessionWriter writes to the stdin of a remote command, closing it waits for
+// the command to complete.
+type sessionWriter struct {
+	io.WriteCloser
+	session *ssh.Session
+	stderr  *bytes.Buffer
+}
+
+func (w *sessionWriter) Close() error {
+	defer w.session.Close()
+	w.WriteCloser.Close()
+	if err := w.session.Wait(); err != nil {
+		return remoteCmdError(withStderr(err, w.stderr.String()))
+	}
+	return nil
+}
+
+// Forward captures the current connection: a reconnection doesn't affect
+// the listeners already open.
+func (e *SSHExecutor) Forward(addr string) (net.Listener, error) {
+	if e.client == nil {
+		return nil, errors.New("not connected to " + e.config.Host)
+	}
+	client := e.client
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go forwardConn(conn, client, addr)
+		}
+	}()
+
+	return listener, nil
+}
+
+// forwardConn copies between conn and addr until either side closes.
+func forwardConn(conn net.Conn, client *ssh.Client, addr string) {
+	defer conn.Close()
+	remote, err := client.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func remoteFileExists(ctx context.Context, remote RemoteExecutor, fileName string) (bool, error) {
+	out, err := remote.Output(ctx, fmt.Sprintf("test -f %s && echo yes || true", fileName))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == "yes", nil
+}
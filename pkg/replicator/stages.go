@@ -0,0 +1,135 @@
+package replicator
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// gzipStage compresses with gzip on the server and decompresses in process.
+type gzipStage struct {
+	level int
+}
+
+func newGzipStage(options map[string]string) (Stage, error) {
+	stage := &gzipStage{level: 6}
+	if level, ok := options["level"]; ok {
+		var err error
+		if stage.level, err = strconv.Atoi(level); err != nil || stage.level < 1 || stage.level > 9 {
+			return nil, fmt.Errorf("invalid level %q, expected 1 to 9", level)
+		}
+	}
+	return stage, nil
+}
+
+func (s *gzipStage) Name() string      { return "gzip" }
+func (s *gzipStage) Extension() string { return ".gz" }
+
+func (s *gzipStage) EncodeCommand() string {
+	return fmt.Sprintf("gzip -c -%d", s.level)
+}
+
+func (s *gzipStage) Decode(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdStage compresses with zstd, which must be installed on the server and
+// locally.
+type zstdStage struct {
+	level int
+}
+
+func newZstdStage(options map[string]string) (Stage, error) {
+	stage := &zstdStage{level: 3}
+	if level, ok := options["level"]; ok {
+		var err error
+		if stage.level, err = strconv.Atoi(level); err != nil || stage.level < 1 || stage.level > 19 {
+			return nil, fmt.Errorf("invalid level %q, expected 1 to 19", level)
+		}
+	}
+	return stage, nil
+}
+
+func (s *zstdStage) Name() string      { return "zstd" }
+func (s *zstdStage) Extension() string { return ".zst" }
+
+func (s *zstdStage) EncodeCommand() string {
+	return fmt.Sprintf("zstd -q -c -T0 -%d", s.level)
+}
+
+func (s *zstdStage) Decode(r io.Reader) (io.ReadCloser, error) {
+	return newCommandReader("zstd -q -d -c", r)
+}
+
+// ageStage encrypts the dump on the server for recipient, a public key, and
+// decrypts it locally with the identity file holding the private key. age
+// must be installed on the server and locally.
+type ageStage struct {
+	recipient string
+	identity  string
+}
+
+func newAgeStage(options map[string]string) (Stage, error) {
+	stage := &ageStage{recipient: options["recipient"], identity: options["identity"]}
+	if stage.recipient == "" || stage.identity == "" {
+		return nil, errors.New("the recipient and identity options are required")
+	}
+	return stage, nil
+}
+
+func (s *ageStage) Name() string      { return "age" }
+func (s *ageStage) Extension() string { return ".age" }
+func (s *ageStage) Encrypts() bool    { return true }
+
+func (s *ageStage) EncodeCommand() string {
+	return fmt.Sprintf("age -r %s", shellQuote(s.recipient))
+}
+
+func (s *ageStage) Decode(r io.Reader) (io.ReadCloser, error) {
+	return newCommandReader(fmt.Sprintf("age -d -i %s", shellQuote(s.identity)), r)
+}
+
+// gpgStage encrypts the dump on the server for recipient, a key of the
+// keyring of the server user, and decrypts it locally with the secret key of
+// the local keyring, or of homedir. The passphrase of the key is asked by
+// the gpg agent, unless it is read from passphrase_file. gpg must be
+// installed on the server and locally.
+type gpgStage struct {
+	recipient      string
+	homedir        string
+	passphraseFile string
+}
+
+func newGPGStage(options map[string]string) (Stage, error) {
+	stage := &gpgStage{
+		recipient:      options["recipient"],
+		homedir:        options["homedir"],
+		passphraseFile: options["passphrase_file"],
+	}
+	if stage.recipient == "" {
+		return nil, errors.New("the recipient option is required")
+	}
+	return stage, nil
+}
+
+func (s *gpgStage) Name() string      { return "gpg" }
+func (s *gpgStage) Extension() string { return ".gpg" }
+func (s *gpgStage) Encrypts() bool    { return true }
+
+func (s *gpgStage) EncodeCommand() string {
+	// The public key is only imported on the server, so it isn't trusted.
+	return fmt.Sprintf("gpg --batch --quiet --trust-model always --encrypt --recipient %s", shellQuote(s.recipient))
+}
+
+func (s *gpgStage) Decode(r io.Reader) (io.ReadCloser, error) {
+	cmd := "gpg --quiet --decrypt"
+	if s.homedir != "" {
+		cmd += " --homedir " + shellQuote(s.homedir)
+	}
+	if s.passphraseFile != "" {
+		cmd += " --batch --pinentry-mode loopback --passphrase-file " + shellQuote(s.passphraseFile)
+	}
+	return newCommandReader(cmd, r)
+}
@@ -0,0 +1,123 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tableCopier is implemented by the engines able to copy the rows of single
+// tables, for RunTables.
+type tableCopier interface {
+	// CopyTableCommand returns the command writing the rows of table of
+	// the database of dbConfig to fileName.
+	CopyTableCommand(dbConfig DB, table, fileName string) string
+	// LoadTablesScript returns the script replacing the rows of the tables
+	// of the database it runs on with those of files, in one transaction.
+	LoadTablesScript(tables, files []string) string
+}
+
+// RunTables replaces the rows of the tables of the local database with
+// those of the server database, leaving the rest of the local database as
+// it is, when only a few tables need refreshing. The rows are copied
+// through a port forwarded over SSH to local files, then loaded in one
+// transaction, the tables referred to by the others first.
+func (r *Replicator) RunTables(ctx context.Context, tables []string) error {
+	return r.run(ctx, r.lockLocalDB, r.Check, r.checkTables(tables), r.confirmTables(tables), r.syncTables(tables))
+}
+
+func (r *Replicator) checkTables(tables []string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if len(tables) == 0 {
+			return errors.New("no tables to copy")
+		}
+		if _, ok := r.Engine.(tableCopier); !ok {
+			return errors.New("the database engine can't copy single tables")
+		}
+		switch {
+		case r.useDriver:
+			return errors.New("copying single tables needs the local client tools")
+		case r.target != nil:
+			return errors.New("copying single tables needs the local database on this machine")
+		case r.config.Server.Kubernetes != nil || r.config.Server.DockerContainer != "":
+			return errors.New("single tables are copied through SSH, which kubernetes and the docker_container of the server don't use")
+		}
+		return nil
+	}
+}
+
+// confirmTables returns the step asking the Prompter to confirm replacing
+// the rows of the tables, for ConfirmReplace.
+func (r *Replicator) confirmTables(tables []string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if !r.ConfirmReplace {
+			return nil
+		}
+		question := fmt.Sprintf("Replace the rows of %s of local database %s with those of %s?", strings.Join(tables, ", "), r.config.LocalDB.Database, r.serverSource())
+		if !r.Prompter.Confirm(ctx, question) {
+			return fmt.Errorf("replacing the tables of local database %s wasn't confirmed", r.config.LocalDB.Database)
+		}
+		return nil
+	}
+}
+
+func (r *Replicator) syncTables(tables []string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		engine := r.Engine.(tableCopier)
+		server := r.config.Server
+		localDB := r.config.LocalDB
+
+		if !r.connected {
+			if err := r.Connect(ctx); err != nil {
+				return err
+			}
+		}
+		tunneledDB, err := r.forwardServerDB()
+		if err != nil {
+			return err
+		}
+		tunneledDB.PasswordFile = ""
+		if err := r.storePassword(ctx, r.Local, r.Receiver, &tunneledDB, "local"); err != nil {
+			return err
+		}
+
+		dir, err := ioutil.TempDir("", "rep_tables_")
+		if err != nil {
+			return err
+		}
+		r.onCleanup(func(ctx context.Context) error {
+			r.printStep("Remove local temp directory %s", dir)
+			return os.RemoveAll(dir)
+		})
+
+		var files []string
+		for i, table := range tables {
+			file := filepath.Join(dir, fmt.Sprintf("%d.copy", i))
+			r.printStep("Copy table %s of database %s in %s to %s", table, server.DB.Database, server.Host, file)
+			copyCmd := engine.CopyTableCommand(tunneledDB, table, file)
+			r.recordCommand("local", copyCmd, "")
+			copyCtx, cancel := withTimeout(ctx, r.config.Timeouts.Copy)
+			err := r.Local.Run(copyCtx, copyCmd)
+			cancel()
+			if err != nil {
+				return err
+			}
+			if info, err := os.Stat(file); err == nil {
+				fmt.Fprintf(r.Output, "   %s copied\n", FormatSize(info.Size()))
+			}
+			files = append(files, file)
+		}
+
+		r.printStep("Replace the rows of %s of local database %s", strings.Join(tables, ", "), localDB.Database)
+		restoreCtx, cancel := withTimeout(ctx, r.config.Timeouts.Restore)
+		defer cancel()
+		if err := r.runScript(restoreCtx, localDB.Database, engine.LoadTablesScript(tables, files)); err != nil {
+			return fmt.Errorf("replacing the tables of local database %s failed, they were left as they were: %v", localDB.Database, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,228 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// pauser lets another goroutine pause and resume the transfer.
+type pauser struct {
+	mu      sync.Mutex
+	paused  bool
+	changed chan struct{}
+}
+
+func (p *pauser) set(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused == paused {
+		return
+	}
+	p.paused = paused
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+// state returns whether the transfer is paused and a channel closed on the
+// next change.
+func (p *pauser) state() (bool, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return p.paused, p.changed
+}
+
+// Pause stops the running transfer at the current byte, it continues from
+// there on Resume. It is safe to call from another goroutine.
+func (r *Replicator) Pause() {
+	r.pauser.set(true)
+}
+
+// Resume continues a paused transfer.
+func (r *Replicator) Resume() {
+	r.pauser.set(false)
+}
+
+// LocalFiles is the FileReceiver storing files on the local machine.
+type LocalFiles struct{}
+
+func (LocalFiles) ReceivedSize(ctx context.Context, name string) (int64, error) {
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, permanent(err)
+	}
+	return info.Size(), nil
+}
+
+func (LocalFiles) Append(ctx context.Context, name string) (io.WriteCloser, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	return file, nil
+}
+
+// transferFile downloads remote to local with the Transferrer and stores it
+// with the Receiver, split into chunks copied at once if transferChunks
+// does. It resumes from the size of local, or of the parts of the chunks,
+// so it continues where a failed or paused transfer stopped. The timeout
+// only counts the time spent transferring.
+func (r *Replicator) transferFile(ctx context.Context, remote, local string, timeout time.Duration) error {
+	size, err := r.Transferrer.Size(ctx, remote)
+	if err != nil {
+		return err
+	}
+
+	if r.BandwidthLimit > 0 {
+		fmt.Fprintf(r.Output, "   Transfer limited to %s/s\n", FormatSize(r.BandwidthLimit))
+	}
+	chunks := r.transferChunks(local, size)
+	if chunks != nil {
+		fmt.Fprintf(r.Output, "   Transfer split into %d chunks copied at once\n", len(chunks))
+	}
+
+	var active time.Duration
+	for {
+		offset, err := r.receivedSize(ctx, local, chunks)
+		if err != nil {
+			return err
+		}
+		if offset >= size {
+			if chunks != nil {
+				return joinChunks(local, chunks)
+			}
+			return nil
+		}
+
+		paused, changed := r.pauser.state()
+		if paused {
+			fmt.Fprintf(r.Output, "   Transfer paused at %d/%d bytes\n", offset, size)
+			select {
+			case <-changed:
+				fmt.Fprintf(r.Output, "   Transfer resumed at %d/%d bytes\n", offset, size)
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var remaining time.Duration
+		if timeout > 0 {
+			if active >= timeout {
+				return permanent(context.DeadlineExceeded)
+			}
+			remaining = timeout - active
+		}
+
+		copyCtx, cancel := withTimeout(ctx, remaining)
+		go func() {
+			// Pausing stops the copy, it continues from the new offset.
+			select {
+			case <-changed:
+				cancel()
+			case <-copyCtx.Done():
+			}
+		}()
+		started := time.Now()
+		r.heartbeat.setBytes(offset, size)
+		if chunks != nil {
+			err = r.copyChunks(copyCtx, remote, chunks)
+		} else {
+			err = r.copyStream(copyCtx, remote, local, offset)
+		}
+		active += time.Since(started)
+		cancel()
+
+		paused, _ = r.pauser.state()
+		if paused && errors.Is(err, context.Canceled) && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			return remoteCmdError(err)
+		}
+		received, err := r.receivedSize(ctx, local, chunks)
+		if err == nil && received < size && !paused {
+			return fmt.Errorf("transfer of %s stopped at %d/%d bytes", remote, received, size)
+		}
+	}
+}
+
+// receivedSize returns how many bytes of the dump were received, in local or
+// in the parts of the chunks.
+func (r *Replicator) receivedSize(ctx context.Context, local string, chunks []chunk) (int64, error) {
+	if chunks != nil {
+		return receivedChunks(chunks), nil
+	}
+	return r.Receiver.ReceivedSize(ctx, local)
+}
+
+// copyStream appends remote from offset to local over a single stream.
+func (r *Replicator) copyStream(ctx context.Context, remote, local string, offset int64) error {
+	file, err := r.Receiver.Append(ctx, local)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = countingWriter{file, &r.heartbeat}
+	if r.BandwidthLimit > 0 {
+		w = &throttledWriter{ctx: ctx, w: w, rate: r.BandwidthLimit, started: time.Now()}
+	}
+	err = r.Transferrer.CopyFrom(ctx, remote, offset, w)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// throttledWriter writes at most rate bytes per second to w, the transfer
+// slowing down as the writes wait. The bytes are written in chunks of a
+// tenth of a second so the rate stays even.
+type throttledWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	rate    int64
+	started time.Time
+	written int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if max := t.rate/10 + 1; int64(len(chunk)) > max {
+			chunk = chunk[:max]
+		}
+		n, err := t.w.Write(chunk)
+		total += n
+		t.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+
+		due := time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second))
+		if wait := due - time.Since(t.started); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return total, t.ctx.Err()
+			}
+		}
+	}
+	return total, nil
+}
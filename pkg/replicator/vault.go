@@ -0,0 +1,132 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// vaultBackend is the vault SecretBackend, reading the field of a secret of
+// HashiCorp Vault referenced as <path>#<field>, such as
+// secret/data/rep#password. It is configured like the vault CLI: the
+// address from VAULT_ADDR, the token from VAULT_TOKEN or ~/.vault-token, or
+// an AppRole login with VAULT_ROLE_ID and VAULT_SECRET_ID, and the namespace
+// from VAULT_NAMESPACE.
+type vaultBackend struct {
+	mu    sync.Mutex
+	token string
+}
+
+func (b *vaultBackend) Secret(ctx context.Context, ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i <= 0 || i == len(ref)-1 {
+		return "", fmt.Errorf("invalid vault reference %q, expected <path>#<field>", ref)
+	}
+	path, field := strings.Trim(ref[:i], "/"), ref[i+1:]
+
+	token, err := b.login(ctx)
+	if err != nil {
+		return "", err
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := vaultRequest(ctx, http.MethodGet, path, token, nil, &secret); err != nil {
+		return "", err
+	}
+	data := secret.Data
+	// A KV version 2 secret nests its fields in data.
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
+
+// login returns the token of the vault requests, logging in with AppRole
+// once if there is no token.
+func (b *vaultBackend) login(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token != "" {
+		return b.token, nil
+	}
+
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		b.token = token
+		return token, nil
+	}
+	roleID, secretID := os.Getenv("VAULT_ROLE_ID"), os.Getenv("VAULT_SECRET_ID")
+	if roleID != "" {
+		var login struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		body := map[string]string{"role_id": roleID, "secret_id": secretID}
+		if err := vaultRequest(ctx, http.MethodPost, "auth/approle/login", "", body, &login); err != nil {
+			return "", fmt.Errorf("vault AppRole login failed: %v", err)
+		}
+		b.token = login.Auth.ClientToken
+		return b.token, nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if token, err := ioutil.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+			b.token = strings.TrimSpace(string(token))
+			return b.token, nil
+		}
+	}
+	return "", errors.New("no vault token, set VAULT_TOKEN or VAULT_ROLE_ID and VAULT_SECRET_ID")
+}
+
+// vaultRequest calls the vault API at path and decodes its JSON response
+// into out.
+func vaultRequest(ctx context.Context, method, path, token string, in, out interface{}) error {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return errors.New("VAULT_ADDR isn't set")
+	}
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(addr, "/")+"/v1/"+path, &body)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		if len(failure.Errors) == 0 {
+			return fmt.Errorf("vault answered %s for %s", resp.Status, path)
+		}
+		return fmt.Errorf("vault answered %s for %s: %s", resp.Status, path, strings.Join(failure.Errors, ", "))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,236 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Verify compares the tables of the restored database with those of the
+// server database, to catch a partial restore before the swap.
+type Verify struct {
+	// RowCounts compares the number of rows of each table.
+	RowCounts bool `yaml:"row_counts"`
+	// ChecksumRows also compares a checksum of the first rows of each table
+	// with a primary key, as many as this.
+	ChecksumRows int `yaml:"checksum_rows"`
+	// Ignore lists the tables not compared, such as those written to while
+	// the dump runs, as schema.table.
+	Ignore []string `yaml:"ignore"`
+}
+
+func (v Verify) enabled() bool {
+	return v.RowCounts || v.ChecksumRows > 0
+}
+
+// tableVerifier is implemented by the engines able to count the rows of the
+// tables and checksum them.
+type tableVerifier interface {
+	// TableChecksumsCommand returns the command printing the tables of
+	// database as table|rows|checksum lines, the checksum covering the
+	// first checksumRows rows by primary key, empty for none.
+	TableChecksumsCommand(dbConfig DB, database string, checksumRows int) string
+}
+
+// tableDataExcluder is implemented by the engines able to dump tables
+// without their rows, for tables.schema_only.
+type tableDataExcluder interface {
+	// ExcludeTableDataOptions returns the options of the dump tool leaving
+	// out the rows of the tables matching patterns.
+	ExcludeTableDataOptions(patterns []string) []string
+}
+
+func (r *Replicator) checkSchemaOnly() error {
+	if _, ok := r.Engine.(tableDataExcluder); len(r.config.Tables.SchemaOnly) > 0 && !ok {
+		return errors.New("the database engine can't leave out the rows of the tables of tables.schema_only")
+	}
+	return nil
+}
+
+// schemaOnly reports whether table, as schema.table, matches a pattern of
+// tables.schema_only, its rows not being compared. A pattern without a
+// schema matches the table in any schema.
+func (r *Replicator) schemaOnly(table string) bool {
+	for _, pattern := range r.config.Tables.SchemaOnly {
+		if !strings.Contains(pattern, ".") {
+			pattern = "*." + pattern
+		}
+		if matched, _ := path.Match(pattern, table); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// tableSummary is the row count and checksum of a table.
+type tableSummary struct {
+	rows     string
+	checksum string
+}
+
+func (r *Replicator) checkVerify() error {
+	if !r.config.Verify.enabled() {
+		return nil
+	}
+	if _, ok := r.Engine.(tableVerifier); !ok {
+		return errors.New("the database engine can't verify the restored database")
+	}
+	if r.useDriver {
+		return errors.New("verifying the restored database needs the local client tools")
+	}
+	return nil
+}
+
+// summarizeTables runs the command of TableChecksumsCommand with exec.
+func (r *Replicator) summarizeTables(ctx context.Context, exec outputExecutor, db DB, database string) (map[string]tableSummary, error) {
+	cmd := r.Engine.(tableVerifier).TableChecksumsCommand(db, database, r.config.Verify.ChecksumRows)
+	out, err := exec.Output(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	tables := map[string]tableSummary{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		// The name of the table may hold a |, the count and checksum can't.
+		n := len(fields)
+		tables[strings.Join(fields[:n-2], "|")] = tableSummary{rows: fields[n-2], checksum: fields[n-1]}
+	}
+	return tables, nil
+}
+
+// captureSourceTables summarizes the tables of the server database, read
+// with exec, when the dump starts, for verifyRestored.
+func (r *Replicator) captureSourceTables(ctx context.Context, exec outputExecutor, db DB) error {
+	tables, err := r.summarizeTables(ctx, exec, db, db.Database)
+	if err != nil {
+		return err
+	}
+	r.sourceTables = tables
+	return nil
+}
+
+// verifyRestored compares the tables of the restored database with those
+// of the server database, reporting those that differ.
+func (r *Replicator) verifyRestored(ctx context.Context, database string) error {
+	if !r.config.Verify.enabled() {
+		return nil
+	}
+	if r.sourceTables == nil {
+		fmt.Fprintf(r.Output, "   The rows of the server database weren't counted for this dump, not verifying it\n")
+		return nil
+	}
+	r.printStep("Verify tables of local restored database %s", database)
+	restored, err := r.summarizeTables(ctx, r.Local, r.config.LocalDB, database)
+	if err != nil {
+		return err
+	}
+
+	differences, matching := r.compareTables(restored)
+	if len(differences) > 0 {
+		for _, difference := range differences {
+			fmt.Fprintf(r.Output, "   %s\n", difference)
+		}
+		return fmt.Errorf("%d tables of %s differ from the server, the local database was left as it was", len(differences), database)
+	}
+	fmt.Fprintf(r.Output, "   %d tables match the server\n", matching)
+	return nil
+}
+
+// compareTables compares tables with the tables of the server database,
+// returning how they differ and how many match.
+func (r *Replicator) compareTables(tables map[string]tableSummary) ([]string, int) {
+	ignored := map[string]bool{}
+	for _, table := range r.config.Verify.Ignore {
+		ignored[table] = true
+	}
+	var names []string
+	for name := range r.sourceTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var differences []string
+	matching := 0
+	for _, name := range names {
+		if ignored[name] || r.schemaOnly(name) {
+			continue
+		}
+		source := r.sourceTables[name]
+		local, ok := tables[name]
+		switch {
+		case !ok:
+			differences = append(differences, fmt.Sprintf("%s is missing", name))
+		case local.rows != source.rows:
+			differences = append(differences, fmt.Sprintf("%s has %s rows, %s on the server", name, local.rows, source.rows))
+		case local.checksum != source.checksum:
+			differences = append(differences, fmt.Sprintf("%s has different rows than on the server", name))
+		default:
+			matching++
+		}
+	}
+	return differences, matching
+}
+
+// RunVerify compares the tables of the local database with those of the
+// server database, as Verify does for the restored database before the
+// swap, to check later on that a replicated database still matches the
+// server. The rows are counted if Verify isn't configured.
+func (r *Replicator) RunVerify(ctx context.Context) error {
+	if err := r.checkEngine(); err != nil {
+		return err
+	}
+	if _, ok := r.Engine.(tableVerifier); !ok {
+		return errors.New("the database engine can't verify the local database")
+	}
+	if r.config.Server.Mode == "direct" {
+		return errors.New("the tables of the server database are counted through SSH, which the direct mode doesn't use")
+	}
+	if !r.config.Verify.enabled() {
+		r.config.Verify.RowCounts = true
+	}
+	if err := r.resolveSecrets(ctx); err != nil {
+		return err
+	}
+	defer r.Cleanup(ctx)
+	if err := r.connectTarget(ctx); err != nil {
+		return err
+	}
+	if err := r.Connect(ctx); err != nil {
+		return err
+	}
+	if err := r.storeServerPassword(ctx); err != nil {
+		return err
+	}
+	server := r.config.Server
+	r.printStep("Count rows of the tables of database %s in %s", server.DB.Database, server.Host)
+	err := r.withRemote(ctx, "Counting rows", func() error {
+		return r.captureSourceTables(ctx, r.Remote, server.DB)
+	})
+	if err != nil {
+		return err
+	}
+
+	localDB := r.config.LocalDB
+	if err := r.storeLocalPassword(ctx); err != nil {
+		return err
+	}
+	r.printStep("Count rows of the tables of local database %s", localDB.Database)
+	tables, err := r.summarizeTables(ctx, r.Local, localDB, localDB.Database)
+	if err != nil {
+		return err
+	}
+	differences, matching := r.compareTables(tables)
+	if len(differences) > 0 {
+		for _, difference := range differences {
+			fmt.Fprintf(r.Output, "   %s\n", difference)
+		}
+		return fmt.Errorf("%d tables of %s differ from the server", len(differences), localDB.Database)
+	}
+	fmt.Fprintf(r.Output, "   %d tables match the server\n", matching)
+	return nil
+}
@@ -0,0 +1,39 @@
+package replicator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareTables(t *testing.T) {
+	r, _ := newFakeReplicator(t, "", "")
+	r.config.Verify.Ignore = []string{"public.sessions"}
+	r.config.Tables.SchemaOnly = []string{"audit_log", "logs.*"}
+	r.sourceTables = map[string]tableSummary{
+		"public.users":     {rows: "10", checksum: "a"},
+		"public.orders":    {rows: "5", checksum: "b"},
+		"public.items":     {rows: "7", checksum: "c"},
+		"public.accounts":  {rows: "3", checksum: "d"},
+		"public.sessions":  {rows: "100", checksum: "e"},
+		"public.audit_log": {rows: "50", checksum: "f"},
+		"logs.requests":    {rows: "900", checksum: "g"},
+	}
+
+	differences, matching := r.compareTables(map[string]tableSummary{
+		"public.users":  {rows: "10", checksum: "a"},
+		"public.orders": {rows: "4", checksum: "b"},
+		"public.items":  {rows: "7", checksum: "x"},
+		"public.extra":  {rows: "1", checksum: "y"},
+	})
+	want := []string{
+		"public.accounts is missing",
+		"public.items has different rows than on the server",
+		"public.orders has 4 rows, 5 on the server",
+	}
+	if !reflect.DeepEqual(differences, want) {
+		t.Errorf("compareTables = %q, want %q", differences, want)
+	}
+	if matching != 1 {
+		t.Errorf("compareTables matched %d tables, want 1", matching)
+	}
+}
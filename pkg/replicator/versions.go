@@ -0,0 +1,90 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// versionChecker is implemented by the engines whose dump tool must be at
+// least as recent as the database server, and whose restore tool must be at
+// least as recent as the dump tool to read its format.
+type versionChecker interface {
+	versionReporter
+	// DumpVersionCommand returns the command printing the version of the
+	// dump tool.
+	DumpVersionCommand(db DB) string
+	// RestoreVersionCommand returns the command printing the version of the
+	// restore tool.
+	RestoreVersionCommand(db DB) string
+	// MajorVersion returns the major version in the output of the version
+	// commands, comparable between them.
+	MajorVersion(version string) (int, bool)
+}
+
+// checkRestoreVersion reads the version of the local restore tool, for
+// checkVersions to compare to the dump tool once connected to the server.
+func (r *Replicator) checkRestoreVersion(ctx context.Context) error {
+	checker, ok := r.Engine.(versionChecker)
+	if !ok {
+		return nil
+	}
+	out, err := r.Local.Output(ctx, checker.RestoreVersionCommand(r.config.LocalDB))
+	if err != nil {
+		return fmt.Errorf("getting the version of the local restore tool failed: %v", err)
+	}
+	r.restoreVersion = firstLine(out)
+	return nil
+}
+
+// checkVersions fails, before the dump starts, if the dump tool run with exec
+// is older than the database server or newer than the local restore tool,
+// rather than the dump or the restore failing midway. Versions that can't be
+// compared are only reported.
+func (r *Replicator) checkVersions(ctx context.Context, exec outputExecutor, db DB) error {
+	checker, ok := r.Engine.(versionChecker)
+	if !ok {
+		return nil
+	}
+	out, err := exec.Output(ctx, checker.ServerVersionCommand(db))
+	if err != nil {
+		return err
+	}
+	serverVersion := firstLine(out)
+	out, err = exec.Output(ctx, checker.DumpVersionCommand(db))
+	if err != nil {
+		return err
+	}
+	dumpVersion := firstLine(out)
+	fmt.Fprintf(r.Output, "   Server %s, dump tool %s\n", serverVersion, dumpVersion)
+	if r.restoreVersion != "" {
+		fmt.Fprintf(r.Output, "   Local restore tool %s\n", r.restoreVersion)
+	}
+
+	server, serverOK := checker.MajorVersion(serverVersion)
+	dump, dumpOK := checker.MajorVersion(dumpVersion)
+	restore, restoreOK := checker.MajorVersion(r.restoreVersion)
+	if !serverOK || !dumpOK || (r.restoreVersion != "" && !restoreOK) {
+		fmt.Fprintf(r.Output, "   Versions can't be compared, continuing\n")
+		return nil
+	}
+	if dump < server {
+		return permanent(fmt.Errorf(
+			"dump tool %s is older than the database server %s, install a version at least as recent",
+			dumpVersion,
+			serverVersion,
+		))
+	}
+	if r.restoreVersion != "" && restore < dump {
+		return permanent(fmt.Errorf(
+			"local restore tool %s is older than dump tool %s and can't read its dumps, install a version at least as recent",
+			r.restoreVersion,
+			dumpVersion,
+		))
+	}
+	return nil
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(strings.TrimSpace(s), "\n", 2)[0])
+}
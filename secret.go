@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+// secretCommand handles `rep secret set <env> <field>`, storing a secret
+// read from stdin in the keychain of the OS.
+func secretCommand(args []string) {
+	if len(args) != 3 || args[0] != "set" {
+		fmt.Fprintln(os.Stderr, "usage: rep secret set <env> <field>")
+		os.Exit(2)
+	}
+	env, field := args[1], args[2]
+
+	secret, err := readSecret(fmt.Sprintf("%s %s: ", env, field))
+	if err != nil {
+		panic(err)
+	}
+	if err := replicator.SetKeychainSecret(context.Background(), env, field, secret); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Stored, refer to it in the config with:\n  password_secret: %s\n", replicator.KeychainSecret(env, field))
+}
+
+// readSecret reads a line from stdin, without echoing it on a terminal.
+func readSecret(prompt string) (string, error) {
+	if isTerminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, prompt)
+		if stty("-echo") == nil {
+			defer func() {
+				stty("echo")
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phuocph/rep/pkg/replicator"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	selftestImage  = "postgres:16"
+	selftestServer = "rep-selftest-server"
+	selftestRows   = 10000
+)
+
+// selftestDockerfile adds sshd to the Postgres image, for the container
+// playing the server.
+const selftestDockerfile = `FROM ` + selftestImage + `
+RUN apt-get update && apt-get install -y --no-install-recommends openssh-server && rm -rf /var/lib/apt/lists/* && mkdir -p /run/sshd
+`
+
+// selftestServerStart authorizes the key of the test for the postgres user
+// and starts sshd along with Postgres.
+const selftestServerStart = `mkdir -p /var/lib/postgresql/.ssh && echo "$AUTHORIZED_KEY" > /var/lib/postgresql/.ssh/authorized_keys && chown -R postgres /var/lib/postgresql/.ssh && chmod 700 /var/lib/postgresql/.ssh && chmod 600 /var/lib/postgresql/.ssh/authorized_keys && /usr/sbin/sshd && exec docker-entrypoint.sh postgres`
+
+// selftestData is the sample data of the server database.
+var selftestData = fmt.Sprintf(`CREATE TABLE customers (id serial PRIMARY KEY, name text NOT NULL, created_at timestamptz DEFAULT now());
+CREATE TABLE orders (id bigserial PRIMARY KEY, customer_id int REFERENCES customers, total numeric(10, 2), note text);
+INSERT INTO customers (name) SELECT 'customer ' || i FROM generate_series(1, %d) i;
+INSERT INTO orders (customer_id, total, note) SELECT 1 + i %% %d, i / 100.0, md5(i::text) FROM generate_series(1, %d) i;
+CREATE INDEX orders_customer_id ON orders (customer_id);
+CREATE VIEW big_orders AS SELECT * FROM orders WHERE total > 50;
+`, selftestRows, selftestRows, selftestRows)
+
+// selftestCommand handles `rep selftest`, replicating a sample database
+// between throwaway Docker containers through the same code as a real pull:
+// one plays the server, with sshd and Postgres, the other the local
+// database, restored with the local client tools.
+func selftestCommand(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	keep := flags.Bool("keep", false, "keep the containers for inspection")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: rep selftest [--keep]")
+		os.Exit(2)
+	}
+
+	if err := runSelftest(context.Background(), *keep); err != nil {
+		fmt.Printf("\nSelftest FAILED: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("\nSelftest PASSED")
+}
+
+func runSelftest(ctx context.Context, keep bool) error {
+	if _, err := dockerOutput("version", "--format", "{{.Server.Version}}"); err != nil {
+		return fmt.Errorf("docker is needed: %v", err)
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	prefix := "rep-selftest-" + hex.EncodeToString(id)
+	password := prefix
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Println("-> Generate SSH key")
+	keyFile := filepath.Join(dir, "id_rsa")
+	authorizedKey, err := selftestKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("-> Build image %s\n", selftestServer)
+	build := exec.Command("docker", "build", "-q", "-t", selftestServer, "-")
+	build.Stdin = strings.NewReader(selftestDockerfile)
+	if out, err := build.CombinedOutput(); err != nil {
+		return fmt.Errorf("building %s: %v: %s", selftestServer, err, strings.TrimSpace(string(out)))
+	}
+
+	server, local := prefix+"-server", prefix+"-local"
+	if !keep {
+		defer func() {
+			fmt.Printf("-> Remove containers %s and %s\n", server, local)
+			dockerOutput("rm", "-f", server, local)
+		}()
+	}
+	fmt.Printf("-> Start server container %s\n", server)
+	_, err = dockerOutput(
+		"run", "-d", "--name", server,
+		"-e", "POSTGRES_PASSWORD="+password,
+		"-e", "AUTHORIZED_KEY="+authorizedKey,
+		"-p", "127.0.0.1::22",
+		"--entrypoint", "bash",
+		selftestServer, "-c", selftestServerStart,
+	)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("-> Start local database container %s\n", local)
+	_, err = dockerOutput(
+		"run", "-d", "--name", local,
+		"-e", "POSTGRES_PASSWORD="+password,
+		"-p", "127.0.0.1::5432",
+		selftestImage,
+	)
+	if err != nil {
+		return err
+	}
+
+	sshHost, sshPort, err := dockerPort(server, "22")
+	if err != nil {
+		return err
+	}
+	localHost, localPort, err := dockerPort(local, "5432")
+	if err != nil {
+		return err
+	}
+	for _, container := range []string{server, local} {
+		if err := waitPostgres(ctx, container, password); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("-> Generate sample data")
+	if _, err := dockerOutput("exec", server, "createdb", "-U", "postgres", "selftest"); err != nil {
+		return err
+	}
+	load := exec.Command("docker", "exec", "-i", server, "psql", "-U", "postgres", "-d", "selftest", "-v", "ON_ERROR_STOP=1", "-q")
+	load.Stdin = strings.NewReader(selftestData)
+	if out, err := load.CombinedOutput(); err != nil {
+		return fmt.Errorf("loading the sample data: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if _, err := dockerOutput("exec", local, "createdb", "-U", "postgres", "selftest"); err != nil {
+		return err
+	}
+
+	config := &replicator.Config{
+		Server: replicator.Server{
+			Host:           sshHost,
+			Port:           replicator.SSHPort(sshPort),
+			User:           "postgres",
+			PrivateKeyFile: keyFile,
+			DB: replicator.DB{
+				Host:     "localhost",
+				Port:     5432,
+				Database: "selftest",
+				Username: "postgres",
+				Password: password,
+			},
+		},
+		LocalDB: replicator.DB{
+			Host:     localHost,
+			Port:     localPort,
+			Database: "selftest",
+			Username: "postgres",
+			Password: password,
+		},
+		Timeouts: replicator.Timeouts{Connect: time.Minute},
+	}
+	rep := replicator.New(config)
+	rep.Output = os.Stdout
+	rep.ManifestDir = ""
+	if err := rep.Run(ctx); err != nil {
+		return err
+	}
+
+	fmt.Println("-> Verify local database")
+	for _, table := range []string{"customers", "orders"} {
+		out, err := dockerOutput("exec", local, "psql", "-U", "postgres", "-d", "selftest", "-At", "-c", "SELECT count(*) FROM "+table)
+		if err != nil {
+			return err
+		}
+		if count := strings.TrimSpace(out); count != fmt.Sprint(selftestRows) {
+			return fmt.Errorf("%s has %s rows locally, %d on the server", table, count, selftestRows)
+		}
+		fmt.Printf("   %s: %d rows\n", table, selftestRows)
+	}
+	if keep {
+		fmt.Printf("   Containers %s and %s kept, remove them with docker rm -f\n", server, local)
+	}
+	return nil
+}
+
+// selftestKey writes a new private key to file and returns its public key
+// as a line of authorized_keys.
+func selftestKey(file string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(file, pemKey, 0600); err != nil {
+		return "", err
+	}
+	public, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(public))), nil
+}
+
+func dockerOutput(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// dockerPort returns the local address published for port of container.
+func dockerPort(container, port string) (string, int, error) {
+	out, err := dockerOutput("port", container, port)
+	if err != nil {
+		return "", 0, err
+	}
+	// One line per address, such as 127.0.0.1:49153.
+	host, hostPort, err := net.SplitHostPort(strings.TrimSpace(strings.Split(out, "\n")[0]))
+	if err != nil {
+		return "", 0, err
+	}
+	published, err := strconv.Atoi(hostPort)
+	return host, published, err
+}
+
+// waitPostgres waits for Postgres to accept connections in container, its
+// first start initializing the data directory.
+func waitPostgres(ctx context.Context, container, password string) error {
+	fmt.Printf("-> Wait for Postgres in %s\n", container)
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		// The entrypoint restarts Postgres once initialized, so the check
+		// is on a real query over TCP.
+		_, err := dockerOutput("exec", "-e", "PGPASSWORD="+password, container, "psql", "-h", "127.0.0.1", "-U", "postgres", "-Atc", "SELECT 1")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("Postgres didn't start in " + container)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// sendCommand handles `rep send --to <teammate>`, pushing the dump last
+// pulled into the cache_dir to a teammate over SSH, where their rep restores
+// it.
+func sendCommand(args []string) {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	to := flags.String("to", "", "teammate of the config to send the dump to")
+	forceDisconnect := flags.Bool("force-disconnect", false, forceDisconnectUsage)
+	flags.Parse(args)
+	if *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: rep send --to <teammate> [-f config.yml] [--force-disconnect]")
+		os.Exit(2)
+	}
+
+	rep, mon := newReplicator(*configFile, os.Stdout, &outputOptions{})
+	defer mon.close()
+	if err := rep.Send(context.Background(), *to, *forceDisconnect); err != nil {
+		panic(err)
+	}
+}
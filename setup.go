@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+// setupRemoteCommand handles `rep setup-remote`, creating a role with only
+// the privileges the dump needs, as a database admin, and switching the
+// config to it so the routine pulls don't run as the application user.
+func setupRemoteCommand(args []string) {
+	flags := flag.NewFlagSet("setup-remote", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	admin := flags.String("admin-user", "postgres", "database user creating the role, once")
+	role := flags.String("role", replicator.DefaultReaderRole, "role to create or update")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: rep setup-remote [-f config.yml] [--admin-user postgres] [--role rep_reader]")
+		os.Exit(2)
+	}
+
+	adminPassword, err := readSecret(fmt.Sprintf("Password of %s: ", *admin))
+	if err != nil {
+		panic(err)
+	}
+
+	rep, mon := newReplicator(*configFile, os.Stdout, &outputOptions{})
+	defer mon.close()
+	password, err := rep.SetupRemote(context.Background(), *role, *admin, adminPassword)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := replicator.SetServerCredentials(*configFile, *role, password); err != nil {
+		fmt.Fprintf(os.Stderr, "Updating %s failed: %v\n", *configFile, err)
+		fmt.Printf("Set the credentials of server.db by hand:\n  username: %s\n  password: %s\n", *role, password)
+		os.Exit(1)
+	}
+	fmt.Printf("%s now dumps as %s\n", *configFile, *role)
+}
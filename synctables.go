@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// syncTablesCommand handles `rep sync-tables users,orders`, replacing the
+// rows of these tables of the local database with those of the server
+// database, the rest of the local database being left as it is.
+func syncTablesCommand(args []string) {
+	flags := flag.NewFlagSet("sync-tables", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	output := addOutputFlags(flags)
+	yes := flags.Bool("yes", false, "replace the rows of the tables without asking, for scripts")
+	flags.BoolVar(yes, "y", false, "replace the rows of the tables without asking, for scripts")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: rep sync-tables [-f config.yml] [--screen-reader|--tui] [--verbose|--quiet] [--log-format json] [--yes] table[,table]...")
+		os.Exit(2)
+	}
+	var tables []string
+	for _, table := range strings.Split(flags.Arg(0), ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			tables = append(tables, table)
+		}
+	}
+	checkConfirmable(*yes)
+
+	rep, mon := newReplicator(*configFile, os.Stdout, output)
+	defer mon.close()
+	rep.ConfirmReplace = !*yes
+	if err := rep.RunTables(context.Background(), tables); err != nil {
+		output.fail(os.Stdout, err)
+	}
+}
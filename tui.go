@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/phuocph/rep/pkg/replicator"
+)
+
+const (
+	// tuiSteps and tuiTail are how many of the last steps and of the last
+	// other lines of the output the TUI shows.
+	tuiSteps = 12
+	tuiTail  = 6
+	tuiWidth = 80
+	tuiBar   = 30
+	tuiDraw  = 200 * time.Millisecond
+)
+
+// tuiStep is a step of the run shown by the TUI.
+type tuiStep struct {
+	title   string
+	started time.Time
+	took    time.Duration
+}
+
+// tuiDisplay is the --tui output of a run on a terminal: the steps, with a
+// progress bar for the running one, the last lines of the rest of the
+// output, such as the log of the dump with --show-remote-logs, and the
+// elapsed time, redrawn in place.
+type tuiDisplay struct {
+	mu      sync.Mutex
+	w       io.Writer
+	width   int
+	started time.Time
+	header  []string
+	steps   []tuiStep
+	tail    []string
+	partial []byte
+	// copied and total are the bytes copied by the running step, and
+	// estimate how long it took in the previous run.
+	copied   int64
+	total    int64
+	estimate time.Duration
+	// drawn is the number of lines drawn last, erased by the next draw.
+	drawn  int
+	paused bool
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newTUIDisplay(w io.Writer) *tuiDisplay {
+	t := &tuiDisplay{
+		w:       w,
+		width:   tuiWidth,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 20 {
+		t.width = columns
+	}
+	go t.tick()
+	return t
+}
+
+// tick redraws the display for the elapsed time and the progress bar until
+// close.
+func (t *tuiDisplay) tick() {
+	defer close(t.done)
+	ticker := time.NewTicker(tuiDraw)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			t.draw()
+			t.mu.Unlock()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// close stops the redraws, leaving the last one on the terminal. The last
+// step isn't marked done, the run may have failed in it.
+func (t *tuiDisplay) close() {
+	close(t.stop)
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endStep()
+	t.closed = true
+	t.draw()
+	t.paused = true
+}
+
+func (t *tuiDisplay) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		raw := string(t.partial[:i])
+		t.partial = t.partial[i+1:]
+		line := strings.TrimSpace(raw)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "-> "):
+			t.header = append(t.header, strings.Join(strings.Fields(line[3:]), " "))
+		default:
+			t.tail = append(t.tail, line)
+			if len(t.tail) > tuiTail {
+				t.tail = t.tail[len(t.tail)-tuiTail:]
+			}
+		}
+	}
+	t.draw()
+	return len(p), nil
+}
+
+// step starts step n, the last one ending.
+func (t *tuiDisplay) step(n int, title string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endStep()
+	t.steps = append(t.steps, tuiStep{title: fmt.Sprintf("%d. %s", n, title), started: time.Now()})
+	t.copied, t.total, t.estimate = 0, 0, 0
+	t.draw()
+}
+
+func (t *tuiDisplay) endStep() {
+	if len(t.steps) > 0 && t.steps[len(t.steps)-1].took == 0 {
+		last := &t.steps[len(t.steps)-1]
+		last.took = time.Since(last.started)
+	}
+}
+
+func (t *tuiDisplay) setBytes(copied, total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.copied, t.total = copied, total
+}
+
+func (t *tuiDisplay) setEstimate(took time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.estimate = took
+}
+
+// pause stops the redraws, for a question to be asked below the display,
+// until resume draws it again under the answer.
+func (t *tuiDisplay) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = true
+}
+
+func (t *tuiDisplay) resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = false
+	t.drawn = 0
+	t.draw()
+}
+
+// draw erases the last drawing and draws the display again. The lines are
+// cut to the width of the terminal so none wraps, which would leave part of
+// it on the screen.
+func (t *tuiDisplay) draw() {
+	if t.paused {
+		return
+	}
+	var lines []string
+	lines = append(lines, fmt.Sprintf("rep  %s  elapsed %s", strings.Join(t.header, "  "), time.Since(t.started).Round(time.Second)))
+	steps := t.steps
+	if len(steps) > tuiSteps {
+		lines = append(lines, fmt.Sprintf("     ... %d earlier steps", len(steps)-tuiSteps))
+		steps = steps[len(steps)-tuiSteps:]
+	}
+	for i, step := range steps {
+		if t.closed && i == len(steps)-1 {
+			lines = append(lines, fmt.Sprintf("    %s  %s", step.title, step.took.Round(time.Second)))
+			continue
+		}
+		if step.took == 0 {
+			lines = append(lines, fmt.Sprintf(" >  %s  %s", step.title, time.Since(step.started).Round(time.Second)))
+			if bar := t.progressBar(step); bar != "" {
+				lines = append(lines, "    "+bar)
+			}
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(" ok %s  %s", step.title, step.took.Round(time.Second)))
+	}
+	if len(t.tail) > 0 {
+		lines = append(lines, "")
+		for _, line := range t.tail {
+			lines = append(lines, "   "+line)
+		}
+	}
+
+	var out bytes.Buffer
+	if t.drawn > 0 {
+		// Back to the start of the last drawing, erasing it.
+		fmt.Fprintf(&out, "\x1b[%dF\x1b[J", t.drawn)
+	}
+	for _, line := range lines {
+		out.WriteString(cutLine(line, t.width-1) + "\n")
+	}
+	t.drawn = len(lines)
+	t.w.Write(out.Bytes())
+}
+
+// progressBar returns the bar of the bytes copied by the running step, or
+// of its time against the previous run, empty if neither is known.
+func (t *tuiDisplay) progressBar(step tuiStep) string {
+	switch {
+	case t.total > 0:
+		return bar(float64(t.copied)/float64(t.total)) + fmt.Sprintf(" %s / %s", replicator.FormatSize(t.copied), replicator.FormatSize(t.total))
+	case t.copied > 0:
+		return fmt.Sprintf("%s copied", replicator.FormatSize(t.copied))
+	case t.estimate > 0:
+		return bar(float64(time.Since(step.started))/float64(t.estimate)) + fmt.Sprintf(" of the %s of the previous run", t.estimate.Round(time.Second))
+	}
+	return ""
+}
+
+func bar(done float64) string {
+	if done > 1 {
+		done = 1
+	}
+	filled := int(done * tuiBar)
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat(".", tuiBar-filled), int(done*100))
+}
+
+func cutLine(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:width-3]) + "..."
+}
+
+// tuiProgress gives the TUI the steps, the copied bytes and the estimates,
+// and writes the steps and the commands as lines to the monitor.
+type tuiProgress struct {
+	replicator.ProgressWriter
+	tui *tuiDisplay
+}
+
+func (p tuiProgress) Step(n int, title string) {
+	p.ProgressWriter.Step(n, title)
+	p.tui.step(n, title)
+}
+
+// Command shows the commands of --verbose below the steps.
+func (p tuiProgress) Command(cmd, script string) {
+	p.ProgressWriter.Command(cmd, script)
+	replicator.ProgressWriter{W: p.tui}.Command(cmd, script)
+}
+
+func (p tuiProgress) Bytes(copied, total int64) {
+	p.tui.setBytes(copied, total)
+}
+
+func (p tuiProgress) Estimate(took time.Duration) {
+	p.tui.setEstimate(took)
+}
+
+// tuiPrompter asks on the terminal below the TUI, stopping its redraws
+// meanwhile.
+type tuiPrompter struct {
+	replicator.TerminalPrompter
+	tui *tuiDisplay
+}
+
+func (p tuiPrompter) Confirm(ctx context.Context, question string) bool {
+	p.tui.pause()
+	defer p.tui.resume()
+	return p.TerminalPrompter.Confirm(ctx, question)
+}
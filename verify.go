@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// verifyCommand handles `rep verify`, comparing the tables of the local
+// database with those of the server database, as verify does before the
+// swap, without replicating it.
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	configFile := flags.String("f", "config.yml", "config file")
+	output := addOutputFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: rep verify [-f config.yml] [--screen-reader|--tui] [--verbose|--quiet] [--log-format json]")
+		os.Exit(2)
+	}
+
+	rep, mon := newReplicator(*configFile, os.Stdout, output)
+	defer mon.close()
+	if err := rep.RunVerify(context.Background()); err != nil {
+		output.fail(os.Stdout, err)
+	}
+}